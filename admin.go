@@ -0,0 +1,437 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI 在Caddy管理接口上提供运维操作，
+// 与Caddy自带的管理接口一样受admin监听地址和origin检查的保护
+type AdminAPI struct{}
+
+// CaddyModule 返回Caddy模块的信息
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.auth_modifier",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes 实现caddy.AdminRouter接口
+func (api *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/auth_modifier/index", Handler: caddy.AdminHandlerFunc(api.handleIndex)},
+		{Pattern: "/auth_modifier/indexes", Handler: caddy.AdminHandlerFunc(api.handleReplaceIndexes)},
+		{Pattern: "/auth_modifier/flush", Handler: caddy.AdminHandlerFunc(api.handleFlush)},
+		{Pattern: "/auth_modifier/drain", Handler: caddy.AdminHandlerFunc(api.handleDrain)},
+		{Pattern: "/auth_modifier/selftest", Handler: caddy.AdminHandlerFunc(api.handleSelfTest)},
+		{Pattern: "/auth_modifier/saver", Handler: caddy.AdminHandlerFunc(api.handleSaver)},
+		{Pattern: "/auth_modifier/decisions", Handler: caddy.AdminHandlerFunc(api.handleDecisions)},
+	}
+}
+
+// setIndexRequest 是设置索引接口的请求体。只加载了一个索引文件时可以省略index_file
+type setIndexRequest struct {
+	IndexFile string `json:"index_file,omitempty"`
+	Path      string `json:"path"`
+	Index     *int   `json:"index"`
+}
+
+// handleIndex 按请求方法分发索引接口：GET分页列出索引，POST设置索引，DELETE删除索引键；
+// PUT整体替换索引，与POST /auth_modifier/indexes相同
+func (api *AdminAPI) handleIndex(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return api.handleListIndexes(w, r)
+	case http.MethodPost:
+		return api.handleSetIndex(w, r)
+	case http.MethodPut:
+		return api.handleReplaceIndexes(w, r)
+	case http.MethodDelete:
+		return api.handleDeleteIndex(w, r)
+	}
+	return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+}
+
+// 列出索引接口的默认和最大每页数量
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// trackedIndex 是列出索引接口中的一个索引键
+type trackedIndex struct {
+	Path  string `json:"path"`
+	Index int    `json:"index"`
+}
+
+// listIndexesResponse 是列出索引接口的响应，total为索引键的总数
+type listIndexesResponse struct {
+	IndexFile string         `json:"index_file"`
+	Total     int            `json:"total"`
+	Offset    int            `json:"offset"`
+	Limit     int            `json:"limit"`
+	Indexes   []trackedIndex `json:"indexes"`
+}
+
+// handleListIndexes 按索引键排序后分页返回当前的索引。参数通过查询串传递：
+// ?offset=...&limit=...&index_file=...，limit默认100，最大1000
+func (api *AdminAPI) handleListIndexes(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("offset: %v", err)}
+	}
+	limit, err := queryInt(query.Get("limit"), defaultListLimit)
+	if err != nil || limit == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("limit must be a positive integer")}
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	f, err := lookupIndexFile(query.Get("index_file"))
+	if err != nil {
+		return err
+	}
+
+	f.Mutex.RLock()
+	paths := make([]string, 0, len(f.Indexes))
+	for path := range f.Indexes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	resp := listIndexesResponse{IndexFile: f.path, Total: len(paths), Offset: offset, Limit: limit, Indexes: []trackedIndex{}}
+	for i := offset; i < len(paths) && i < offset+limit; i++ {
+		resp.Indexes = append(resp.Indexes, trackedIndex{Path: paths[i], Index: f.Indexes[paths[i]]})
+	}
+	f.Mutex.RUnlock()
+	return writeJSON(w, resp)
+}
+
+// queryInt 解析非负整数的查询参数，为空时返回def
+func queryInt(value string, def int) (int, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a non-negative integer", value)
+	}
+	return n, nil
+}
+
+// handleSetIndex 将某个索引键的索引设置为指定值，使对应的密钥成为下一个被选中的密钥
+func (api *AdminAPI) handleSetIndex(w http.ResponseWriter, r *http.Request) error {
+	var req setIndexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+	}
+	if len(req.Path) == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("path is required")}
+	}
+	if req.Index == nil || *req.Index < 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("index must be a non-negative integer")}
+	}
+	f, err := lookupIndexFile(req.IndexFile)
+	if err != nil {
+		return err
+	}
+
+	f.Mutex.Lock()
+	f.Indexes[req.Path] = *req.Index
+	f.touchLocked(req.Path, time.Now(), true)
+	f.dirty[req.Path] = struct{}{}
+	f.Changed = true
+	f.Mutex.Unlock()
+	f.logger.Info("Index set via admin API", zap.String("path", req.Path), zap.Int("index", *req.Index))
+
+	req.IndexFile = f.path
+	return writeJSON(w, req)
+}
+
+// replaceIndexesRequest 是整体替换索引接口的请求体
+type replaceIndexesRequest struct {
+	IndexFile string         `json:"index_file,omitempty"`
+	Indexes   map[string]int `json:"indexes"`
+}
+
+// replaceIndexesResponse 是整体替换索引接口的响应
+type replaceIndexesResponse struct {
+	IndexFile string `json:"index_file"`
+	Replaced  int    `json:"replaced"` // 替换后的索引键数量
+	Previous  int    `json:"previous"` // 替换前的索引键数量
+	Bytes     int    `json:"bytes"`    // 保存写入的字节数，ignore_persisted时为0
+}
+
+// handleReplaceIndexes 用请求体中的索引整体替换内存中的索引并立即保存，用于从备份恢复。
+// 请求体整体校验通过后才会替换，校验失败时不修改任何状态
+func (api *AdminAPI) handleReplaceIndexes(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var req replaceIndexesRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+	}
+	if req.Indexes == nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("indexes is required")}
+	}
+	for path, index := range req.Indexes {
+		if len(path) == 0 {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("indexes contains an empty path")}
+		}
+		if index < 0 {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("index for %s must be a non-negative integer", path)}
+		}
+	}
+	f, err := lookupIndexFile(req.IndexFile)
+	if err != nil {
+		return err
+	}
+
+	previous := f.replace(req.Indexes)
+	f.logger.Info("Indexes replaced via admin API", zap.Int("replaced", len(req.Indexes)), zap.Int("previous", previous))
+	resp := replaceIndexesResponse{IndexFile: f.path, Replaced: len(req.Indexes), Previous: previous}
+	if !f.memoryOnly {
+		if resp.Bytes, err = f.persistIndexes(true); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: fmt.Errorf("indexes replaced but saving failed: %v", err)}
+		}
+	}
+	return writeJSON(w, resp)
+}
+
+// deleteIndexResponse 是删除索引键接口的响应
+type deleteIndexResponse struct {
+	IndexFile string `json:"index_file"`
+	Path      string `json:"path"`
+	Index     int    `json:"index"` // 删除前的索引
+}
+
+// handleDeleteIndex 删除某个索引键及其权重和使用时间，而不只是把索引归零，
+// 该索引键下次出现时按初始状态开始轮换。参数通过查询串传递：?path=...&index_file=...
+func (api *AdminAPI) handleDeleteIndex(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	path := query.Get("path")
+	if len(path) == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("path is required")}
+	}
+	f, err := lookupIndexFile(query.Get("index_file"))
+	if err != nil {
+		return err
+	}
+
+	f.Mutex.Lock()
+	index, ok := f.Indexes[path]
+	if ok {
+		f.removeLocked(path)
+	}
+	f.Mutex.Unlock()
+	if !ok {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("path not tracked: %s", path)}
+	}
+	f.logger.Info("Index deleted via admin API", zap.String("path", path), zap.Int("index", index))
+	return writeJSON(w, deleteIndexResponse{IndexFile: f.path, Path: path, Index: index})
+}
+
+// flushRequest 是立即保存接口的请求体，请求体可以为空
+type flushRequest struct {
+	IndexFile string `json:"index_file,omitempty"`
+}
+
+// flushResponse 是立即保存接口的响应
+type flushResponse struct {
+	IndexFile string    `json:"index_file"`
+	Bytes     int       `json:"bytes"`
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+// handleFlush 立即同步保存当前索引，用于计划重启前确保索引文件是最新的。只保存，不修改索引
+func (api *AdminAPI) handleFlush(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var req flushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+	}
+	f, err := lookupIndexFile(req.IndexFile)
+	if err != nil {
+		return err
+	}
+	if f.memoryOnly {
+		return caddy.APIError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("index file %s is memory only (ignore_persisted)", f.path)}
+	}
+	n, err := f.flush()
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: fmt.Errorf("saving indexes: %v", err)}
+	}
+	f.logger.Info("Indexes flushed via admin API", zap.Int("bytes", n))
+	return writeJSON(w, flushResponse{IndexFile: f.path, Bytes: n, SavedAt: time.Now()})
+}
+
+// selfTestResponse 是存储自检接口的响应
+type selfTestResponse struct {
+	IndexFile string        `json:"index_file"`
+	OK        bool          `json:"ok"`
+	Bytes     int           `json:"bytes"`
+	Duration  time.Duration `json:"duration_ns"`
+}
+
+// handleSelfTest 把当前索引写入临时位置再读回比较，确认存储、权限和编解码正常，不影响正在使用的索引。
+// 自检失败时返回500和失败的原因
+func (api *AdminAPI) handleSelfTest(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var req flushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+	}
+	f, err := lookupIndexFile(req.IndexFile)
+	if err != nil {
+		return err
+	}
+	if f.memoryOnly {
+		return caddy.APIError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("index file %s is memory only (ignore_persisted)", f.path)}
+	}
+	start := time.Now()
+	n, err := f.selfTest()
+	if err != nil {
+		f.logger.Error("Index persistence self-test failed", zap.Error(err))
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: fmt.Errorf("self-test failed: %v", err)}
+	}
+	return writeJSON(w, selfTestResponse{IndexFile: f.path, OK: true, Bytes: n, Duration: time.Since(start)})
+}
+
+// saverResponse 是保存协程状态接口的响应
+type saverResponse struct {
+	IndexFile string `json:"index_file"`
+	saverStatus
+}
+
+// handleSaver 返回后台保存协程是否在运行、保存和跳过的次数以及最近一次定时器触发的时间，用于排查索引没有落盘的问题
+func (api *AdminAPI) handleSaver(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	f, err := lookupIndexFile(r.URL.Query().Get("index_file"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, saverResponse{IndexFile: f.path, saverStatus: f.status()})
+}
+
+// drainRequest 是排空接口的请求体，fingerprint为密钥SHA-256的前32个十六进制字符
+type drainRequest struct {
+	IndexFile   string `json:"index_file,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Draining    *bool  `json:"draining"`
+}
+
+// drainResponse 是排空接口的响应
+type drainResponse struct {
+	IndexFile string       `json:"index_file"`
+	Draining  []drainedKey `json:"draining"`
+}
+
+// handleDrain 标记或取消标记排空中的密钥。排空中的密钥不再被选中，但不会被隔离，
+// 已在处理中的请求照常完成；GET返回所有排空中的密钥及其处理中的请求数，drained为true时可以安全移除
+func (api *AdminAPI) handleDrain(w http.ResponseWriter, r *http.Request) error {
+	var req drainRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.IndexFile = r.URL.Query().Get("index_file")
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+		}
+		req.Fingerprint = strings.ToLower(req.Fingerprint)
+		if len(req.Fingerprint) != 32 || strings.Trim(req.Fingerprint, "0123456789abcdef") != "" {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("fingerprint must be 32 hex characters")}
+		}
+		if req.Draining == nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("draining is required")}
+		}
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	f, err := lookupIndexFile(req.IndexFile)
+	if err != nil {
+		return err
+	}
+	if r.Method == http.MethodPost {
+		f.setDraining(req.Fingerprint, *req.Draining)
+		f.logger.Info("Key drain state set via admin API",
+			zap.String("fingerprint", req.Fingerprint), zap.Bool("draining", *req.Draining))
+	}
+	return writeJSON(w, drainResponse{IndexFile: f.path, Draining: f.drainStatus()})
+}
+
+// decisionsResponse 是查询轮换决定接口的响应
+type decisionsResponse struct {
+	IndexFile string     `json:"index_file"`
+	Decisions []decision `json:"decisions"`
+}
+
+// handleDecisions 返回共享索引上配置了decision_buffer的处理器最近的轮换决定，从新到旧排列。
+// 参数通过查询串传递：?limit=...&index_file=...，limit默认100，最大1000
+func (api *AdminAPI) handleDecisions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultListLimit)
+	if err != nil || limit == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("limit must be a positive integer")}
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	f, err := lookupIndexFile(query.Get("index_file"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, decisionsResponse{IndexFile: f.path, Decisions: f.recentDecisions(limit)})
+}
+
+// lookupIndexFile 按配置的索引文件路径查找正在使用的共享索引，
+// name为空且只有一个索引文件时返回该文件
+func lookupIndexFile(name string) (*indexFile, error) {
+	var found []*indexFile
+	indexFiles.Range(func(_, value interface{}) bool {
+		f := value.(*indexFile)
+		if len(name) == 0 || f.path == name {
+			found = append(found, f)
+		}
+		return true
+	})
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(found) == 0:
+		return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("index file not found: %s", name)}
+	default:
+		return nil, caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("multiple index files loaded, index_file is required")}
+	}
+}
+
+// writeJSON 以JSON格式写出响应
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
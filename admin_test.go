@@ -0,0 +1,315 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminRequest 调用管理接口的处理函数，返回响应和APIError中的状态码（没有错误时为响应的状态码）
+func adminRequest(t *testing.T, handler caddy.AdminHandlerFunc, method, target, body string) (*httptest.ResponseRecorder, int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	err := handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if err == nil {
+		return w, w.Code
+	}
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("错误 %v 不是caddy.APIError", err)
+	}
+	return w, apiErr.HTTPStatus
+}
+
+// snapshotIndexes 复制当前的索引
+func snapshotIndexes(f *indexFile) map[string]int {
+	f.Mutex.RLock()
+	defer f.Mutex.RUnlock()
+	indexes := make(map[string]int, len(f.Indexes))
+	for key, index := range f.Indexes {
+		indexes[key] = index
+	}
+	return indexes
+}
+
+func TestAdminReplaceIndexesMethod(t *testing.T) {
+	api := new(AdminAPI)
+	for _, method := range []string{http.MethodGet, http.MethodDelete, http.MethodPatch} {
+		if _, status := adminRequest(t, api.handleReplaceIndexes, method, "/auth_modifier/indexes", ""); status != http.StatusMethodNotAllowed {
+			t.Errorf("%s: 状态码 = %d, 期望 405", method, status)
+		}
+	}
+}
+
+func TestAdminReplaceIndexes(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	rotatedSequence(t, a, "/old", "k1,k2", 1)
+	api := new(AdminAPI)
+
+	for _, tt := range []struct {
+		method, target string
+		handler        caddy.AdminHandlerFunc
+	}{
+		{http.MethodPost, "/auth_modifier/indexes", api.handleReplaceIndexes},
+		{http.MethodPut, "/auth_modifier/index", api.handleIndex},
+	} {
+		body := `{"index_file": "` + a.IndexPath + `", "indexes": {"/v1/chat": 3, "/v1/models": 0}}`
+		w, status := adminRequest(t, tt.handler, tt.method, tt.target, body)
+		if status != http.StatusOK {
+			t.Fatalf("%s %s: 状态码 = %d", tt.method, tt.target, status)
+		}
+		var resp replaceIndexesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Replaced != 2 || resp.Bytes == 0 {
+			t.Errorf("%s %s: 响应 = %+v", tt.method, tt.target, resp)
+		}
+		want := map[string]int{"/v1/chat": 3, "/v1/models": 0}
+		if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s %s: 索引 = %v, 期望 %v", tt.method, tt.target, got, want)
+		}
+	}
+
+	// 替换后立即保存，文件中只有新的索引
+	data, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved indexSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.Indexes["/old"]; ok || saved.Indexes["/v1/chat"] != 3 {
+		t.Errorf("保存的索引 = %v", saved.Indexes)
+	}
+	// 替换后的索引立即用于选择
+	seen, _ := serveTest(t, a, authRequest("/v1/chat", "k0,k1,k2,k3"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "k3" {
+		t.Errorf("Authorization = %q, 期望 k3", got)
+	}
+}
+
+func TestAdminReplaceIndexesInvalid(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	rotatedSequence(t, a, "/v1", "k1,k2,k3", 2)
+	if _, err := a.indexFile.flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotIndexes(a.indexFile)
+	saved, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := new(AdminAPI)
+	file := `"index_file": "` + a.IndexPath + `", `
+
+	for name, body := range map[string]string{
+		"malformed":     `{` + file + `"indexes": {"/v1": 1`,
+		"missing":       `{` + file[:len(file)-2] + `}`,
+		"negative":      `{` + file + `"indexes": {"/v1": 1, "/v2": -1}}`,
+		"empty path":    `{` + file + `"indexes": {"": 1}}`,
+		"not a number":  `{` + file + `"indexes": {"/v1": "1"}}`,
+		"unknown field": `{` + file + `"indexes": {"/v1": 1}, "weights": {}}`,
+	} {
+		if _, status := adminRequest(t, api.handleReplaceIndexes, http.MethodPost, "/auth_modifier/indexes", body); status != http.StatusBadRequest {
+			t.Errorf("%s: 状态码 = %d, 期望 400", name, status)
+		}
+		if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, before) {
+			t.Fatalf("%s: 不合法的请求修改了索引: %v, 之前 %v", name, got, before)
+		}
+	}
+	a.indexFile.Mutex.RLock()
+	changed := a.indexFile.Changed
+	a.indexFile.Mutex.RUnlock()
+	if changed {
+		t.Error("不合法的请求不应标记索引有变化")
+	}
+	if data, err := os.ReadFile(a.IndexPath); err != nil || string(data) != string(saved) {
+		t.Errorf("不合法的请求修改了索引文件: %v", err)
+	}
+	if _, status := adminRequest(t, api.handleReplaceIndexes, http.MethodPost, "/auth_modifier/indexes", `{"index_file": "missing.json", "indexes": {}}`); status != http.StatusNotFound {
+		t.Errorf("未知的index_file: 状态码 = %d, 期望 404", status)
+	}
+}
+
+func TestAdminFlush(t *testing.T) {
+	a := newTestHandler(t, "", "journal\nsave_interval 1h")
+	rotatedSequence(t, a, "/v1", pool(3), 2)
+	rotatedSequence(t, a, "/v2", pool(3), 1)
+	api := new(AdminAPI)
+
+	w, status := adminRequest(t, api.handleFlush, http.MethodPost, "/auth_modifier/flush", `{"index_file": "`+a.IndexPath+`"}`)
+	if status != http.StatusOK {
+		t.Fatalf("状态码 = %d", status)
+	}
+	var resp flushResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Bytes != len(data) || resp.IndexFile != a.IndexPath || resp.SavedAt.IsZero() {
+		t.Errorf("响应 = %+v, 文件 %d 字节", resp, len(data))
+	}
+	var saved indexSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"/v1": 2, "/v2": 1}
+	if !reflect.DeepEqual(saved.Indexes, want) {
+		t.Errorf("保存的索引 = %v, 期望 %v", saved.Indexes, want)
+	}
+	// 增量日志已合并进完整索引文件
+	if _, err := os.Stat(a.IndexPath + ".journal"); !os.IsNotExist(err) {
+		t.Errorf("flush后增量日志仍存在: %v", err)
+	}
+	// 只保存，不修改索引
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("索引 = %v, 期望 %v", got, want)
+	}
+
+	// 没有请求体时使用唯一加载的索引文件
+	if _, status := adminRequest(t, api.handleFlush, http.MethodPost, "/auth_modifier/flush", ""); status != http.StatusOK {
+		t.Errorf("空请求体: 状态码 = %d", status)
+	}
+	if _, status := adminRequest(t, api.handleFlush, http.MethodGet, "/auth_modifier/flush", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET: 状态码 = %d, 期望 405", status)
+	}
+}
+
+func TestAdminFlushMemoryOnly(t *testing.T) {
+	a := newTestHandler(t, "", "ignore_persisted")
+	api := new(AdminAPI)
+	if _, status := adminRequest(t, api.handleFlush, http.MethodPost, "/auth_modifier/flush", `{"index_file": "`+a.IndexPath+`"}`); status != http.StatusConflict {
+		t.Errorf("状态码 = %d, 期望 409", status)
+	}
+	if _, err := os.Stat(a.IndexPath); !os.IsNotExist(err) {
+		t.Errorf("ignore_persisted 下不应写入索引文件: %v", err)
+	}
+}
+
+func TestAdminDeleteIndex(t *testing.T) {
+	a := newTestHandler(t, "", "journal\nstrategy round_robin_global_seeded\nseed 1")
+	rotatedSequence(t, a, "/v1", pool(4), 2)
+	rotatedSequence(t, a, "/v2", pool(4), 1)
+	if _, err := a.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	api := new(AdminAPI)
+
+	w, status := adminRequest(t, api.handleIndex, http.MethodDelete, "/auth_modifier/index?path=/v1&index_file="+a.IndexPath, "")
+	if status != http.StatusOK {
+		t.Fatalf("状态码 = %d", status)
+	}
+	var resp deleteIndexResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Path != "/v1" || resp.Index != 3 {
+		t.Errorf("响应 = %+v, 期望删除前的索引 3", resp)
+	}
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, map[string]int{"/v2": 2}) {
+		t.Errorf("索引 = %v", got)
+	}
+	// 增量日志无法表达删除，下次保存重写完整索引文件
+	if _, err := a.persistIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := savedIndexes(t, a.IndexPath); !reflect.DeepEqual(saved, map[string]int{"/v2": 2}) {
+		t.Errorf("保存的索引 = %v", saved)
+	}
+	// 被删除的索引键重新从seed开始
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(4), 1), []string{"k1"})
+
+	if _, status := adminRequest(t, api.handleIndex, http.MethodDelete, "/auth_modifier/index?path=/missing", ""); status != http.StatusNotFound {
+		t.Errorf("不存在的索引键: 状态码 = %d, 期望 404", status)
+	}
+	if _, status := adminRequest(t, api.handleIndex, http.MethodDelete, "/auth_modifier/index", ""); status != http.StatusBadRequest {
+		t.Errorf("缺少path: 状态码 = %d, 期望 400", status)
+	}
+}
+
+// listIndexes 调用列出索引接口并解码响应
+func listIndexes(t *testing.T, api *AdminAPI, query string) (listIndexesResponse, int) {
+	t.Helper()
+	w, status := adminRequest(t, api.handleIndex, http.MethodGet, "/auth_modifier/index"+query, "")
+	var resp listIndexesResponse
+	if status == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, status
+}
+
+func TestAdminListIndexesEmpty(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	api := new(AdminAPI)
+	resp, status := listIndexes(t, api, "")
+	if status != http.StatusOK {
+		t.Fatalf("状态码 = %d", status)
+	}
+	// 没有索引时返回空数组而不是null
+	if resp.IndexFile != a.IndexPath || resp.Total != 0 || resp.Indexes == nil || len(resp.Indexes) != 0 || resp.Limit != defaultListLimit {
+		t.Errorf("响应 = %+v", resp)
+	}
+}
+
+func TestAdminListIndexesPagination(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	for path, index := range map[string]int{"/c": 4, "/a": 1, "/e": 0, "/b": 7, "/d": 2} {
+		setIndex(a, path, index)
+	}
+	api := new(AdminAPI)
+	paths := func(resp listIndexesResponse) []string {
+		var got []string
+		for _, entry := range resp.Indexes {
+			got = append(got, entry.Path)
+		}
+		return got
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"/a", "/b", "/c", "/d", "/e"}},
+		{"?limit=2", []string{"/a", "/b"}},
+		{"?offset=2&limit=2", []string{"/c", "/d"}},
+		{"?offset=4&limit=2", []string{"/e"}},
+		{"?offset=5", nil},
+		{"?offset=100", nil},
+		{"?limit=100000", []string{"/a", "/b", "/c", "/d", "/e"}},
+	} {
+		resp, status := listIndexes(t, api, c.query)
+		if status != http.StatusOK {
+			t.Errorf("%q: 状态码 = %d", c.query, status)
+			continue
+		}
+		if got := paths(resp); !reflect.DeepEqual(got, c.want) || resp.Total != 5 {
+			t.Errorf("%q: 索引键 = %v, total = %d, 期望 %v, 5", c.query, got, resp.Total, c.want)
+		}
+	}
+	resp, _ := listIndexes(t, api, "?limit=100000")
+	if resp.Limit != maxListLimit {
+		t.Errorf("limit = %d, 期望被限制为 %d", resp.Limit, maxListLimit)
+	}
+	if resp.Indexes[2] != (trackedIndex{Path: "/c", Index: 4}) {
+		t.Errorf("第3项 = %+v", resp.Indexes[2])
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=-1", "?offset=-1", "?offset=x"} {
+		if _, status := listIndexes(t, api, query); status != http.StatusBadRequest {
+			t.Errorf("%q: 状态码 = %d, 期望 400", query, status)
+		}
+	}
+}
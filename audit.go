@@ -0,0 +1,213 @@
+package auth_modifier
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// 审计日志的默认参数
+const (
+	defaultAuditMaxSize = 100               // 单个审计日志文件的默认大小上限（MB）
+	auditBuffer         = 4096              // 等待写入的审计记录上限，写满时丢弃新记录，不阻塞请求
+	auditFlushInterval  = time.Second       // 缓冲区刷新到文件的间隔
+	auditTimeFormat     = "20060102T150405" // 轮转后文件名中的时间后缀
+)
+
+// auditLogs 按文件路径共享审计日志，多个处理器写同一个文件时只打开一个文件句柄
+var auditLogs = caddy.NewUsagePool()
+
+// auditEntry 是审计日志中的一行，不包含密钥本身，只记录其指纹
+type auditEntry struct {
+	Time     time.Time         `json:"ts"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	IndexKey string            `json:"index_key"`
+	Keys     map[string]string `json:"keys"` // 轮换请求头到所选密钥指纹的映射
+	Status   int               `json:"status"`
+	Outcome  string            `json:"outcome"` // ok、key_failed或error
+}
+
+// auditLog 异步写入JSON Lines格式的审计日志，超过大小上限时轮转
+type auditLog struct {
+	path    string
+	maxSize int64
+	logger  *zap.Logger
+	entries chan auditEntry
+	done    chan struct{}
+
+	mu     sync.RWMutex // 保护closed，避免关闭后仍向entries发送
+	closed bool
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// auditKey 返回用于在auditLogs中查找共享审计日志的键
+func (a *AuthModifier) auditKey() (string, error) {
+	return filepath.Abs(a.AuditLog)
+}
+
+// openAuditLog 获取audit_log对应的共享审计日志，首次使用时打开文件并启动写入协程
+func (a *AuthModifier) openAuditLog() error {
+	key, err := a.auditKey()
+	if err != nil {
+		return err
+	}
+	val, _, err := auditLogs.LoadOrNew(key, func() (caddy.Destructor, error) {
+		l := &auditLog{
+			path:    a.AuditLog,
+			maxSize: int64(a.AuditMaxSize) << 20,
+			logger:  a.logger,
+			entries: make(chan auditEntry, auditBuffer),
+			done:    make(chan struct{}),
+		}
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+		go l.run()
+		return l, nil
+	})
+	if err != nil {
+		return err
+	}
+	a.audit = val.(*auditLog)
+	a.auditLogKey = key
+	return nil
+}
+
+// open 以追加方式打开审计日志文件
+func (l *auditLog) open() error {
+	if err := ensureDir(l.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.w, l.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// run 是写入协程，定期刷新缓冲区，entries关闭后写完剩余记录并关闭文件
+func (l *auditLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-l.entries:
+			if !ok {
+				l.flush()
+				l.file.Close()
+				return
+			}
+			l.write(e)
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
+
+// write 写入一条记录，写入后会超过大小上限时先轮转文件
+func (l *auditLog) write(e auditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		l.logger.Error("Error encoding audit entry", zap.Error(err))
+		return
+	}
+	line = append(line, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.logger.Error("Error rotating audit log", zap.String("path", l.path), zap.Error(err))
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		auditDroppedTotal.Inc()
+		l.logger.Error("Error writing audit log", zap.String("path", l.path), zap.Error(err))
+	}
+}
+
+func (l *auditLog) flush() {
+	if err := l.w.Flush(); err != nil {
+		l.logger.Error("Error flushing audit log", zap.String("path", l.path), zap.Error(err))
+	}
+}
+
+// rotate 将当前文件重命名为带时间后缀的文件，并重新打开一个空文件
+func (l *auditLog) rotate() error {
+	l.flush()
+	l.file.Close()
+	if err := os.Rename(l.path, l.path+"."+time.Now().UTC().Format(auditTimeFormat)); err != nil {
+		l.logger.Error("Error renaming audit log", zap.String("path", l.path), zap.Error(err))
+	}
+	return l.open()
+}
+
+// enqueue 把记录交给写入协程，缓冲已满或已关闭时丢弃并计数，不阻塞请求
+func (l *auditLog) enqueue(e auditEntry) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		auditDroppedTotal.Inc()
+	}
+}
+
+// Destruct 实现caddy.Destructor接口，写完剩余记录后关闭文件
+func (l *auditLog) Destruct() error {
+	l.mu.Lock()
+	l.closed = true
+	close(l.entries)
+	l.mu.Unlock()
+	<-l.done
+	return nil
+}
+
+// auditOutcome 将下游结果归类为ok、key_failed或error
+func auditOutcome(status int, err error) string {
+	switch {
+	case keyFailed(status):
+		return "key_failed"
+	case err != nil || status >= 500:
+		return "error"
+	}
+	return "ok"
+}
+
+// recordAudit 为本次尝试写一行审计记录
+func (a *AuthModifier) recordAudit(r *http.Request, key string, rotations []rotation, rec *statusRecorder, err error) {
+	status := outcomeStatus(rec, err)
+	keys := make(map[string]string, len(rotations))
+	for _, rot := range rotations {
+		keys[rot.header] = a.keyID(rot.token)
+	}
+	a.audit.enqueue(auditEntry{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		IndexKey: key,
+		Keys:     keys,
+		Status:   status,
+		Outcome:  auditOutcome(status, err),
+	})
+}
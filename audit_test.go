@@ -0,0 +1,86 @@
+package auth_modifier
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAuditLogWriteAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	a := parseTest(t, `auth_modifier auth/index.json {
+		circuit_breaker {
+			error_percent 50
+		}
+		audit_log `+path+` 1
+	}`)
+	if a.AuditLog != path || a.AuditMaxSize != 1 {
+		t.Fatalf("audit_log = %q %d, 期望 %q 1", a.AuditLog, a.AuditMaxSize, path)
+	}
+	a.logger = zap.NewNop()
+	if err := a.openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	l := a.audit
+	entry := auditEntry{
+		Time:     time.Now(),
+		Method:   "GET",
+		Path:     "/v1/chat",
+		IndexKey: "/v1/chat",
+		Keys:     map[string]string{"Authorization": "abcd"},
+		Status:   200,
+		Outcome:  "ok",
+	}
+	line, _ := json.Marshal(entry)
+	lines := int(l.maxSize)/(len(line)+1) + 10
+	for i := 0; i < lines; i++ {
+		// 等待写入协程消费，避免写满缓冲后丢弃记录
+		for len(l.entries) >= auditBuffer-1 {
+			time.Sleep(time.Millisecond)
+		}
+		l.enqueue(entry)
+	}
+	// 释放共享日志，Destruct会写完剩余记录并关闭文件
+	if _, err := auditLogs.Delete(a.auditLogKey); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("轮转后的文件 = %v, %v，期望1个", rotated, err)
+	}
+	info, err := os.Stat(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > l.maxSize {
+		t.Errorf("轮转文件大小 %d 超过上限 %d", info.Size(), l.maxSize)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("轮转后的新文件为空")
+	}
+	var got auditEntry
+	if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != entry.Path || got.Keys["Authorization"] != "abcd" || got.Outcome != "ok" {
+		t.Errorf("审计记录 = %+v", got)
+	}
+	if strings.Contains(scanner.Text(), "Bearer") {
+		t.Error("审计记录中不应包含密钥")
+	}
+}
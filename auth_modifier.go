@@ -2,39 +2,281 @@ package auth_modifier
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"fmt"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
 	"go.uber.org/zap"
 )
 
 func init() {
-	caddy.RegisterModule(AuthModifier{})
+	caddy.RegisterModule(new(AuthModifier))
 	httpcaddyfile.RegisterHandlerDirective("auth_modifier", parseCaddyfile)
 }
 
+// 支持的轮换策略
+const (
+	StrategyRoundRobin = "round_robin" // 按路径索引依次轮换（默认）
+	StrategyRandom     = "random"      // 每次请求随机选择
+	// 平滑加权轮询，密钥可写成"密钥:权重"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	// 按权重随机选择，长期比例与权重一致但不形成固定序列，也不需要持久化状态
+	StrategyWeightedRandom = "weighted_random"
+	// 始终使用第一个可用密钥，失败后才切换到下一个
+	StrategyFailover = "failover"
+	// 与round_robin相同，但所有索引从seed开始，配合ignore_persisted得到完全确定的序列，用于压测复现
+	StrategyRoundRobinSeeded = "round_robin_global_seeded"
+	// 按各密钥上游延迟的指数加权移动平均动态加权，偏向更快的密钥
+	StrategyAdaptiveLatency = "adaptive_latency"
+	// 按请求体前缀的哈希选择，相同的请求总是落到同一个密钥上
+	StrategyBodyHash = "body_hash"
+	// 按索引键做加权一致性哈希，同一租户总是落到同一个密钥上，权重高的密钥承载更多租户
+	StrategyWeightedHash = "weighted_hash"
+	// 随机挑选两个密钥，使用处理中请求数较少的一个，并发下比轮询更均衡
+	StrategyP2C = "p2c"
+	// 按索引键的jump consistent hash选择，同一索引键总是落到同一个密钥上，密钥池变化时移动的索引键最少
+	StrategyJumpHash = "jump_hash"
+)
+
+// validStrategies 列出所有合法的策略名称，用于配置校验和错误提示
+var validStrategies = []string{StrategyRoundRobin, StrategyRandom, StrategyWeightedRoundRobin, StrategyFailover, StrategyRoundRobinSeeded, StrategyWeightedRandom, StrategyAdaptiveLatency, StrategyBodyHash, StrategyWeightedHash, StrategyP2C, StrategyJumpHash}
+
+// 索引推进的时机
+const (
+	AdvanceAlways    = "always"     // 请求转发前推进（默认）
+	AdvanceSuccess   = "success"    // 仅在下游请求成功后推进
+	AdvanceFailure   = "failure"    // 仅在下游请求失败后推进
+	AdvanceCacheMiss = "cache_miss" // 仅在下游缓存未命中时推进，命中缓存的请求不消耗密钥配额
+	AdvanceStatus    = "status"     // 按advance_on_status和no_advance_on_status匹配下游状态码决定是否推进
+)
+
+var validAdvanceOn = []string{AdvanceAlways, AdvanceSuccess, AdvanceFailure, AdvanceCacheMiss, AdvanceStatus}
+
+// 判断缓存是否命中的默认响应头和未命中值
+const (
+	defaultCacheHeader    = "X-Cache"
+	defaultCacheMissValue = "MISS"
+)
+
+// 索引键的计算方式
+const (
+	KeyByPath       = "path"        // 按请求路径（默认）
+	KeyByPoolHash   = "pool_hash"   // 按密钥池内容的哈希，同一组密钥无论从哪个路径进来都共享轮换进度
+	KeyByPathMethod = "path_method" // 按请求方法和路径，同一路径的GET和POST分别轮换
+	KeyByGlobal     = "global"      // 所有请求共享一个单调递增的计数器
+)
+
+var validKeyBy = []string{KeyByPath, KeyByPoolHash, KeyByPathMethod, KeyByGlobal}
+
+// KeyByHeadersPrefix 是按多个请求头组合索引键的key_by前缀，如 headers:X-Tenant,X-Region
+const KeyByHeadersPrefix = "headers:"
+
+// defaultSaveInterval 是默认的定时保存间隔
+const defaultSaveInterval = 30 * time.Second
+
+// defaultIndexCap 是1到16的最小公倍数，保证常见大小的密钥池在计数器回绕时也不会打乱顺序
+const defaultIndexCap = 720720
+
 type AuthModifier struct {
-	Indexes    map[string]int `json:"indexes"`
-	Mutex      sync.RWMutex
-	SaveTicker *time.Ticker
-	Changed    bool // 追踪索引数据是否有变化
+	*indexFile `json:"-"` // 共享的索引状态，提供Indexes、Mutex和Changed
+
 	ctx        context.Context
 	cancel     context.CancelFunc
 	logger     *zap.Logger
 	IndexPath  string // 存储索引文件的路径
+
+	SaveInterval caddy.Duration `json:"save_interval,omitempty"` // 定时保存索引的间隔，默认30秒
+	Strict       bool           `json:"strict,omitempty"`        // 启动时检查索引文件是否可写，不可写时拒绝启动
+	InstanceID   string         `json:"instance_id,omitempty"`   // 实例标识，设置后索引文件名加上该后缀，如indexes-<id>.json，避免不相关的处理器意外共享索引
+
+	Strategy  string   `json:"strategy,omitempty"`   // 轮换策略，默认round_robin
+	AdvanceOn string   `json:"advance_on,omitempty"` // 索引推进时机，默认always
+	IndexCap  int      `json:"index_cap,omitempty"`  // 索引计数器的回绕上限，默认720720
+	KeyBy     string   `json:"key_by,omitempty"`     // 索引键的计算方式，默认path
+	Headers   []string `json:"headers,omitempty"`    // 需要轮换的请求头，默认Authorization、X-Goog-Api-Key和x-api-key
+	Keys      []string `json:"keys,omitempty"`       // 服务端配置的密钥池，配置后写入第一个轮换请求头，忽略客户端传入的值
+
+	CollapseDuplicates bool `json:"collapse_duplicates,omitempty"` // 去掉密钥池中重复的密钥；默认保留，重复的密钥相当于更高的权重
+
+	KeyTemplate string `json:"key_template,omitempty"` // 用占位符自定义索引键，如{http.request.uri}，配置后优先于key_by
+	StripQuery  bool   `json:"strip_query,omitempty"`  // 展开key_template后去掉查询串和片段
+
+	CacheHeader    string `json:"cache_header,omitempty"`     // advance_on为cache_miss时读取的响应头，默认X-Cache
+	CacheMissValue string `json:"cache_miss_value,omitempty"` // 该响应头以此开头（不区分大小写）时视为未命中，默认MISS
+
+	AdvanceOnStatus   []string `json:"advance_on_status,omitempty"`    // 推进索引的下游状态码，如2xx、429、500-503，配置后advance_on默认为status
+	NoAdvanceOnStatus []string `json:"no_advance_on_status,omitempty"` // 不推进索引的下游状态码，优先于advance_on_status
+
+	AuditLog     string `json:"audit_log,omitempty"`         // JSON Lines格式的审计日志路径，每个请求一行，只记录密钥指纹
+	AuditMaxSize int    `json:"audit_max_size_mb,omitempty"` // 审计日志文件超过该大小（MB）时轮转，默认100
+
+	KeyAliases     map[string]string `json:"key_aliases,omitempty"`      // 密钥指纹到别名的映射，日志、占位符和指标中用别名代替末尾4个字符
+	MaxTrackedKeys int               `json:"max_tracked_keys,omitempty"` // 拥有独立指标标签和延迟统计的密钥数量上限，超出的密钥在指标中记为other，默认不限制
+
+	FingerprintMode   string `json:"fingerprint_mode,omitempty"`   // 日志、指标和占位符中标识密钥的方式：last4（默认）、sha256或hmac
+	FingerprintSecret string `json:"fingerprint_secret,omitempty"` // hmac模式的密钥，支持{env.*}等全局占位符
+
+	CanaryKey     string  `json:"canary_key,omitempty"`     // 灰度密钥，按canary_percent的比例直接写入第一个轮换请求头
+	CanaryPercent float64 `json:"canary_percent,omitempty"` // 使用灰度密钥的请求百分比，取值0到100
+
+	Seed            int  `json:"seed,omitempty"`             // round_robin_global_seeded下所有索引的初始值
+	IgnorePersisted bool `json:"ignore_persisted,omitempty"` // 不加载也不保存索引文件，每次启动都从初始状态开始
+	FreezeIndex     bool `json:"freeze_index,omitempty"`     // 只按当前索引选择密钥、照常改写请求头，但从不推进索引，用于回放生产流量的影子部署
+
+	ReplicaOffset       int  `json:"replica_offset,omitempty"`        // 选择时加在索引上的偏移，使不共享状态的各副本从不同的密钥开始
+	ReplicaFromHostname bool `json:"replica_from_hostname,omitempty"` // 从主机名末尾的序号（如StatefulSet的pod-2）推导replica_offset
+
+	ShuffleSeed         int64 `json:"shuffle_seed,omitempty"`          // 非0时按该种子固定打乱密钥池的顺序后再选择，使各副本按不同顺序尝试密钥
+	ShuffleFromHostname bool  `json:"shuffle_from_hostname,omitempty"` // 用主机名的哈希作为shuffle_seed
+
+	ResetEvery caddy.Duration `json:"reset_every,omitempty"` // 定期清空索引的周期，按墙上时间对齐，0表示不重置
+	ResetSkew  caddy.Duration `json:"reset_skew,omitempty"`  // 重置时容忍的各副本时钟偏差，默认2s
+
+	RequestWeightHeader string `json:"request_weight_header,omitempty"` // weighted_round_robin下读取客户端声明的请求代价的请求头
+
+	MaxInFlight     int `json:"max_in_flight,omitempty"`    // 每个密钥同时处理中的请求上限，0表示不限制
+	SaturatedStatus int `json:"saturated_status,omitempty"` // 所有密钥并发都已满时返回的状态码，默认503
+
+	Drain         []string `json:"drain,omitempty"`           // 排空中的密钥指纹，不再被选中，但不计为失败，处理中的请求照常完成
+	TrackInFlight bool     `json:"track_in_flight,omitempty"` // 未配置max_in_flight时也统计每个密钥处理中的请求数，用于观察管理接口排空的进度
+
+	MinPoolSize   int    `json:"min_pool_size,omitempty"`   // 请求的密钥池至少应有的密钥数量，0表示不检查
+	MinPoolMode   string `json:"min_pool_mode,omitempty"`   // 密钥池过小时的处理方式，warn（默认）或reject
+	MinPoolStatus int    `json:"min_pool_status,omitempty"` // reject时返回的状态码，默认400
+
+	PoolWarnInterval caddy.Duration `json:"pool_warn_interval,omitempty"` // 同一个有问题的密钥池在该时长内只警告一次，默认5m
+
+	AllDeadResponse *DeadResponse `json:"all_dead_response,omitempty"` // 所有密钥都被隔离或吊销时直接返回的响应，不再转发
+
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"` // 整个密钥池失败率过高时熔断
+
+	BearerJWT bool `json:"bearer_jwt,omitempty"` // 没有认证方案前缀但形如JWT的密钥写回时补上前缀（如Bearer）
+	GRPCWeb   bool `json:"grpc_web,omitempty"`   // 同时轮换gRPC-Web的Grpc-Metadata-Authorization请求头
+
+	CookieName string `json:"cookie_name,omitempty"` // 需要轮换的Cookie名称，其值中的多个密钥以逗号分隔
+	Denylist   string `json:"denylist,omitempty"`    // 吊销密钥列表文件，每行一个，修改后自动重新加载，列表中的密钥不会被选中
+
+	SourceURL     string         `json:"source_url,omitempty"`     // 定期从该地址拉取密钥池，拉取成功后替换keys
+	SourceRefresh caddy.Duration `json:"source_refresh,omitempty"` // 拉取密钥池的间隔，默认1m
+	SecretsDir    string         `json:"secrets_dir,omitempty"`    // 从该目录加载密钥池，每个文件一个密钥，目录变化时自动重新加载
+
+	Schemes []string `json:"schemes,omitempty"` // 在所有轮换请求头中识别并保留的认证方案，默认Bearer和Basic
+
+	BasicInvalid       string `json:"basic_invalid,omitempty"`        // Basic凭据无法解码时的处理方式：rotate（默认）、pass或reject
+	BasicInvalidStatus int    `json:"basic_invalid_status,omitempty"` // reject时返回的状态码，默认400
+
+	// SelectorRaw 是自定义选择策略模块，配置后代替strategy选择密钥，索引仍按strategy推进
+	SelectorRaw json.RawMessage `json:"selector,omitempty" caddy:"namespace=http.handlers.auth_modifier.selectors inline_key=selector"`
+
+	HeaderFormats map[string]HeaderConfig `json:"header_formats,omitempty"` // 按请求头配置认证方案前缀和分隔符
+
+	DelimiterHeader string `json:"delimiter_header,omitempty"` // 客户端通过该请求头指定本次请求的密钥分隔符，只接受部分单个字符，否则使用header_format
+
+	ZipHeaders [][]string `json:"zip_headers,omitempty"` // 每组请求头使用相同的下标，第一个请求头按策略选择，如密钥和对应的密钥对
+
+	PreferHeader string `json:"prefer_header,omitempty"` // 请求带有该请求头时删除其余的轮换请求头，只保留并轮换它
+
+	MultiValueMode string `json:"multi_value_mode,omitempty"` // 同一轮换请求头出现多次时的处理方式：first（默认）、combine或all
+
+	SetHeaders map[string]string `json:"set_headers,omitempty"` // 轮换或注入灰度密钥时一并设置的固定请求头，如OpenAI-Organization
+
+	RequireHeader      string `json:"require_header,omitempty"`       // 只轮换携带该请求头的请求
+	RequireHeaderValue string `json:"require_header_value,omitempty"` // 非空时请求头的值还必须与之相等
+
+	Cooldown        caddy.Duration `json:"cooldown,omitempty"`          // 密钥失败后被隔离的时长，默认5分钟
+	RecoveryRamp    caddy.Duration `json:"recovery_ramp,omitempty"`     // 隔离结束后逐步恢复流量的时长，期间被选中的概率从5%线性增长到100%
+	HonorRetryAfter bool           `json:"honor_retry_after,omitempty"` // 下游返回429并带有Retry-After时按其给出的时长隔离
+	ValidateOnStart bool           `json:"validate_on_start,omitempty"` // 启动时校验密钥池中的每个密钥
+	HealthCheckURL  string         `json:"health_check_url,omitempty"`  // 校验密钥时请求的地址
+	ProbeTimeout    caddy.Duration `json:"probe_timeout,omitempty"`     // 单次校验的超时时间，默认5秒
+	ProbeWorkers    int            `json:"probe_workers,omitempty"`     // 并发校验的数量，默认4
+
+	PersistQuarantine bool           `json:"persist_quarantine,omitempty"` // 把隔离记录保存在索引文件旁，重启后继续隔离
+	QuarantineMaxAge  caddy.Duration `json:"quarantine_max_age,omitempty"` // 加载时丢弃开始时间早于该时长的隔离记录，0表示不限制
+
+	DailyQuota    int            `json:"daily_quota,omitempty"`    // 每个密钥每天最多使用的次数，用完后跳过该密钥直到重置，0表示不限制
+	DailyQuotas   map[string]int `json:"daily_quotas,omitempty"`   // 按密钥指纹单独配置的每日配额，优先于daily_quota
+	QuotaReset    string         `json:"quota_reset,omitempty"`    // 每日配额的重置时间，HH:MM，默认00:00
+	QuotaTimezone string         `json:"quota_timezone,omitempty"` // quota_reset所在的时区，默认UTC
+
+	Format       string `json:"format,omitempty"`        // 完整索引文件的编码格式，json（默认）或binary
+	Pretty       bool   `json:"pretty,omitempty"`        // json格式下写入带缩进和末尾换行的索引文件，便于比较备份
+	Journal      bool   `json:"journal,omitempty"`       // 是否以增量日志方式保存索引
+	CompactAfter int    `json:"compact_after,omitempty"` // 增量日志累计多少条记录后压缩为完整索引文件
+
+	PruneAfter caddy.Duration `json:"prune_after,omitempty"` // 超过该时长未使用的路径会在保存时从索引中清理
+
+	MaxFileBytes int `json:"max_file_bytes,omitempty"` // 完整索引文件的大小上限（字节），超过时在保存前丢弃最久未使用的索引键
+
+	Migrate bool `json:"migrate,omitempty"` // key_by变化后加载索引文件时转换或丢弃旧的索引键
+
+	UseStorage bool `json:"use_storage,omitempty"` // 使用Caddy配置的存储模块保存索引，而不是直接读写文件
+
+	MaxRetries         int            `json:"max_retries,omitempty"`          // 密钥失败（401/403/429）后换下一个密钥重试的次数，默认不重试
+	RetryBackoff       caddy.Duration `json:"retry_backoff,omitempty"`        // 两次重试之间的等待时间
+	RetryBackoffFactor float64        `json:"retry_backoff_factor,omitempty"` // 每次重试后等待时间乘以该系数，大于1时为指数退避
+	MaxRetryTime       caddy.Duration `json:"max_retry_time,omitempty"`       // 重试的总时长上限，默认30秒
+
+	SummaryInterval caddy.Duration `json:"summary_interval,omitempty"` // 定期输出各密钥被选中次数的间隔，默认不输出
+	LogSample       int            `json:"log_sample,omitempty"`       // 调试级别的轮换日志每N次只输出一次，0或1表示每次都输出
+	VarsPrefix      string         `json:"vars_prefix,omitempty"`      // 写入请求变量和占位符时使用的名称前缀，默认auth_modifier
+	DecisionBuffer  int            `json:"decision_buffer,omitempty"`  // 在内存中保留最近N次轮换决定，可通过管理接口查询，默认不保留
+
+	ClientCerts []ClientCert `json:"client_certs,omitempty"` // 与请求头同步轮换的客户端证书
+
+	certs        []tls.Certificate
+	formats      map[string]HeaderConfig // 每个轮换请求头最终使用的格式
+	keyHeaders   []string                // key_by为headers:时参与组合索引键的请求头
+	zipFollowers map[string][]string     // zip_headers每组的主请求头到跟随请求头的映射
+	zipped       map[string]bool         // 所有zip_headers跟随请求头
+	latency      *latencyTracker         // adaptive_latency下各密钥的延迟统计，与共享索引一同保存
+	denied       *denylist
+	selector     Selector
+	custom       bool // 是否使用自定义选择模块，LoadModule加载后会清空SelectorRaw，不能再据此判断
+	source       *keySource
+	secrets      *secretsDir
+	tracked      *trackedKeys // max_tracked_keys下已拥有独立指标标签的密钥
+	poolWarnings *warnCache   // 有问题的密钥池上次输出警告的时间
+	decisions    *decisionRing
+	loggerOnce   sync.Once    // 未经Provision直接使用时只补一次空日志器
+	breaker      *breaker
+	drain        map[string]struct{} // drain配置的密钥指纹
+	rnd          *rand.Rand          // SimulateSelection使用的随机源，为nil时使用全局随机源
+	perms        sync.Map            // shuffle_seed下按密钥池长度缓存的排列，int -> []int
+	audit        *auditLog
+	auditLogKey  string            // 审计日志在auditLogs中的键
+	counters     *rotationCounters // 开启summary_interval时统计轮换分布
+	logCount     uint32            // log_sample的计数器，原子操作
+	indexFileKey string            // 共享索引在indexFiles中的键
+
+	fingerprintKey  []byte        // 展开占位符后的fingerprint_secret
+	advanceStatus   []statusRange // 解析后的advance_on_status
+	noAdvanceStatus []statusRange // 解析后的no_advance_on_status
+
+	healthMu sync.Mutex
+	inFlight map[string]int // 每个密钥正在处理中的请求数
+
+	quotaOffset time.Duration  // 解析后的quota_reset
+	quotaLoc    *time.Location // 解析后的quota_timezone
 }
 
-func (AuthModifier) CaddyModule() caddy.ModuleInfo {
+// CaddyModule 使用指针接收者，AuthModifier包含sync.Once等锁，不能按值复制
+func (*AuthModifier) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.handlers.auth_modifier",
 		New: func() caddy.Module { return new(AuthModifier) },
@@ -60,141 +302,1058 @@ func (a *AuthModifier) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
             return d.ArgErr()
         }
 		fmt.Println("get params IndexPath:", a.IndexPath)
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "instance_id":
+				if !d.Args(&a.InstanceID) {
+					return d.ArgErr()
+				}
+			case "strategy":
+				if !d.Args(&a.Strategy) {
+					return d.ArgErr()
+				}
+			case "headers":
+				a.Headers = d.RemainingArgs()
+				if len(a.Headers) == 0 {
+					return d.ArgErr()
+				}
+			case "canary_key":
+				if !d.Args(&a.CanaryKey) {
+					return d.ArgErr()
+				}
+			case "canary_percent":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				percent, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return wrapErr(d, ErrInvalidOption, "canary_percent '%s': %v", d.Val(), err)
+				}
+				a.CanaryPercent = percent
+			case "seed":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				seed, err := strconv.Atoi(d.Val())
+				if err != nil || seed < 0 {
+					return wrapErr(d, ErrInvalidOption, "seed '%s'", d.Val())
+				}
+				a.Seed = seed
+			case "replica_offset":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if d.Val() == "hostname" {
+					a.ReplicaFromHostname = true
+					break
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil || n < 0 {
+					return wrapErr(d, ErrInvalidOption, "replica_offset '%s'", d.Val())
+				}
+				a.ReplicaOffset = n
+			case "shuffle_seed":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if d.Val() == "hostname" {
+					a.ShuffleFromHostname = true
+					break
+				}
+				seed, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil || seed == 0 {
+					return wrapErr(d, ErrInvalidOption, "shuffle_seed '%s' must be a non-zero integer or hostname", d.Val())
+				}
+				a.ShuffleSeed = seed
+			case "ignore_persisted":
+				a.IgnorePersisted = true
+			case "freeze_index":
+				a.FreezeIndex = true
+			case "reset_every":
+				if err := parseDuration(d, &a.ResetEvery); err != nil {
+					return err
+				}
+			case "reset_skew":
+				if err := parseDuration(d, &a.ResetSkew); err != nil {
+					return err
+				}
+			case "request_weight_header":
+				a.RequestWeightHeader = "X-Request-Weight"
+				if d.NextArg() {
+					a.RequestWeightHeader = d.Val()
+				}
+			case "max_in_flight":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.MaxInFlight = n
+			case "saturated_status":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.SaturatedStatus = n
+			case "min_pool_size":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.MinPoolSize = n
+				if d.NextArg() {
+					a.MinPoolMode = d.Val()
+				}
+			case "min_pool_status":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.MinPoolStatus = n
+			case "pool_warn_interval":
+				if err := parseDuration(d, &a.PoolWarnInterval); err != nil {
+					return err
+				}
+			case "all_dead_response":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				status, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return wrapErr(d, ErrInvalidOption, "all_dead_response status '%s'", d.Val())
+				}
+				a.AllDeadResponse = &DeadResponse{StatusCode: status}
+				if d.NextArg() {
+					a.AllDeadResponse.Body = d.Val()
+				}
+			case "audit_log":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuditLog = d.Val()
+				if d.NextArg() {
+					n, err := strconv.Atoi(d.Val())
+					if err != nil || n <= 0 {
+						return wrapErr(d, ErrInvalidOption, "audit_log max size '%s'", d.Val())
+					}
+					a.AuditMaxSize = n
+				}
+			case "drain":
+				fingerprints := d.RemainingArgs()
+				if len(fingerprints) == 0 {
+					return d.ArgErr()
+				}
+				a.Drain = append(a.Drain, fingerprints...)
+			case "track_in_flight":
+				a.TrackInFlight = true
+			case "circuit_breaker":
+				cb := &CircuitBreaker{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "error_percent":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						percent, err := strconv.ParseFloat(d.Val(), 64)
+						if err != nil {
+							return wrapErr(d, ErrInvalidOption, "circuit_breaker error_percent '%s'", d.Val())
+						}
+						cb.ErrorPercent = percent
+					case "window":
+						if err := parseDuration(d, &cb.Window); err != nil {
+							return err
+						}
+					case "min_requests":
+						n, err := parsePositiveInt(d)
+						if err != nil {
+							return err
+						}
+						cb.MinRequests = n
+					case "cooldown":
+						if err := parseDuration(d, &cb.Cooldown); err != nil {
+							return err
+						}
+					case "passthrough":
+						cb.Passthrough = true
+					case "status_code":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						status, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return wrapErr(d, ErrInvalidOption, "circuit_breaker status_code '%s'", d.Val())
+						}
+						cb.StatusCode = status
+					default:
+						return wrapErr(d, ErrUnknownDirective, "circuit_breaker option '%s'", d.Val())
+					}
+				}
+				a.CircuitBreaker = cb
+			case "bearer_jwt":
+				a.BearerJWT = true
+			case "grpc_web":
+				a.GRPCWeb = true
+			case "cookie_name":
+				if !d.Args(&a.CookieName) {
+					return d.ArgErr()
+				}
+			case "denylist":
+				if !d.Args(&a.Denylist) {
+					return d.ArgErr()
+				}
+			case "source_url":
+				if !d.Args(&a.SourceURL) {
+					return d.ArgErr()
+				}
+			case "secrets_dir":
+				if !d.Args(&a.SecretsDir) {
+					return d.ArgErr()
+				}
+			case "source_refresh":
+				if err := parseDuration(d, &a.SourceRefresh); err != nil {
+					return err
+				}
+			case "basic_invalid":
+				if !d.Args(&a.BasicInvalid) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return wrapErr(d, ErrInvalidOption, "basic_invalid status '%s'", d.Val())
+					}
+					a.BasicInvalidStatus = n
+				}
+			case "schemes":
+				schemes := d.RemainingArgs()
+				if len(schemes) == 0 {
+					return d.ArgErr()
+				}
+				a.Schemes = append(a.Schemes, schemes...)
+			case "selector":
+				var name string
+				if !d.Args(&name) {
+					return d.ArgErr()
+				}
+				unm, err := caddyfile.UnmarshalModule(d, "http.handlers.auth_modifier.selectors."+name)
+				if err != nil {
+					return err
+				}
+				a.SelectorRaw = caddyconfig.JSONModuleObject(unm, "selector", name, nil)
+			case "delimiter_header":
+				if !d.Args(&a.DelimiterHeader) {
+					return d.ArgErr()
+				}
+			case "header_format":
+				var name string
+				if !d.Args(&name) {
+					return d.ArgErr()
+				}
+				var hc HeaderConfig
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "scheme":
+						if !d.Args(&hc.Scheme) {
+							return d.ArgErr()
+						}
+					case "delimiter":
+						if !d.Args(&hc.Delimiter) {
+							return d.ArgErr()
+						}
+					default:
+						return wrapErr(d, ErrUnknownDirective, "header_format option '%s'", d.Val())
+					}
+				}
+				if a.HeaderFormats == nil {
+					a.HeaderFormats = make(map[string]HeaderConfig)
+				}
+				a.HeaderFormats[name] = hc
+			case "multi_value_mode":
+				if !d.Args(&a.MultiValueMode) {
+					return d.ArgErr()
+				}
+			case "prefer_header":
+				if !d.Args(&a.PreferHeader) {
+					return d.ArgErr()
+				}
+			case "zip_headers":
+				group := d.RemainingArgs()
+				if len(group) < 2 {
+					return d.ArgErr()
+				}
+				a.ZipHeaders = append(a.ZipHeaders, group)
+			case "keys":
+				keys := d.RemainingArgs()
+				if len(keys) == 0 {
+					return d.ArgErr()
+				}
+				a.Keys = append(a.Keys, keys...)
+			case "set_headers":
+				var name, value string
+				if !d.Args(&name, &value) {
+					return d.ArgErr()
+				}
+				if a.SetHeaders == nil {
+					a.SetHeaders = make(map[string]string)
+				}
+				a.SetHeaders[name] = value
+			case "collapse_duplicates":
+				a.CollapseDuplicates = true
+			case "key_alias":
+				var fingerprint, alias string
+				if !d.Args(&fingerprint, &alias) {
+					return d.ArgErr()
+				}
+				if a.KeyAliases == nil {
+					a.KeyAliases = make(map[string]string)
+				}
+				a.KeyAliases[strings.ToLower(fingerprint)] = alias
+			case "max_tracked_keys":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil || n < 0 {
+					return wrapErr(d, ErrInvalidOption, "max_tracked_keys '%s'", d.Val())
+				}
+				a.MaxTrackedKeys = n
+			case "fingerprint_mode":
+				if !d.Args(&a.FingerprintMode) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					a.FingerprintSecret = d.Val()
+				}
+			case "cooldown":
+				if err := parseDuration(d, &a.Cooldown); err != nil {
+					return err
+				}
+			case "recovery_ramp":
+				if err := parseDuration(d, &a.RecoveryRamp); err != nil {
+					return err
+				}
+			case "persist_quarantine":
+				a.PersistQuarantine = true
+			case "daily_quota":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(args[len(args)-1])
+				if err != nil || n < 0 {
+					return wrapErr(d, ErrInvalidOption, "daily_quota '%s'", args[len(args)-1])
+				}
+				if len(args) == 1 {
+					a.DailyQuota = n
+					break
+				}
+				if a.DailyQuotas == nil {
+					a.DailyQuotas = make(map[string]int)
+				}
+				a.DailyQuotas[strings.ToLower(args[0])] = n
+			case "quota_reset":
+				if !d.Args(&a.QuotaReset) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					a.QuotaTimezone = d.Val()
+				}
+			case "quarantine_max_age":
+				if err := parseDuration(d, &a.QuarantineMaxAge); err != nil {
+					return err
+				}
+			case "honor_retry_after":
+				a.HonorRetryAfter = true
+			case "validate_on_start":
+				a.ValidateOnStart = true
+			case "health_check_url":
+				if !d.Args(&a.HealthCheckURL) {
+					return d.ArgErr()
+				}
+			case "probe_timeout":
+				if err := parseDuration(d, &a.ProbeTimeout); err != nil {
+					return err
+				}
+			case "probe_workers":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.ProbeWorkers = n
+			case "require_header":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				a.RequireHeader = args[0]
+				if len(args) == 2 {
+					a.RequireHeaderValue = args[1]
+				}
+			case "key_template":
+				if !d.Args(&a.KeyTemplate) {
+					return d.ArgErr()
+				}
+			case "strip_query":
+				a.StripQuery = true
+			case "key_by":
+				if !d.Args(&a.KeyBy) {
+					return d.ArgErr()
+				}
+			case "index_cap":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.IndexCap = n
+			case "advance_on":
+				if !d.Args(&a.AdvanceOn) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					a.CacheHeader = d.Val()
+					if d.NextArg() {
+						a.CacheMissValue = d.Val()
+					}
+				}
+			case "advance_on_status":
+				codes := d.RemainingArgs()
+				if len(codes) == 0 {
+					return d.ArgErr()
+				}
+				a.AdvanceOnStatus = append(a.AdvanceOnStatus, codes...)
+			case "no_advance_on_status":
+				codes := d.RemainingArgs()
+				if len(codes) == 0 {
+					return d.ArgErr()
+				}
+				a.NoAdvanceOnStatus = append(a.NoAdvanceOnStatus, codes...)
+			case "format":
+				if !d.Args(&a.Format) {
+					return d.ArgErr()
+				}
+			case "pretty":
+				a.Pretty = true
+			case "migrate":
+				a.Migrate = true
+			case "journal":
+				a.Journal = true
+				if d.NextArg() {
+					n, err := strconv.Atoi(d.Val())
+					if err != nil || n <= 0 {
+						return wrapErr(d, ErrInvalidOption, "journal compaction threshold '%s'", d.Val())
+					}
+					a.CompactAfter = n
+				}
+			case "save_interval":
+				if err := parseDuration(d, &a.SaveInterval); err != nil {
+					return err
+				}
+			case "strict":
+				a.Strict = true
+			case "prune_after":
+				if err := parseDuration(d, &a.PruneAfter); err != nil {
+					return err
+				}
+			case "max_file_bytes":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.MaxFileBytes = n
+			case "use_storage":
+				a.UseStorage = true
+			case "max_retries":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.MaxRetries = n
+			case "retry_backoff":
+				if err := parseDuration(d, &a.RetryBackoff); err != nil {
+					return err
+				}
+				if d.NextArg() {
+					if d.Val() != "exponential" {
+						return wrapErr(d, ErrInvalidOption, "retry_backoff mode '%s'", d.Val())
+					}
+					a.RetryBackoffFactor = 2
+				}
+			case "max_retry_time":
+				if err := parseDuration(d, &a.MaxRetryTime); err != nil {
+					return err
+				}
+			case "log_sample":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.LogSample = n
+			case "decision_buffer":
+				n, err := parsePositiveInt(d)
+				if err != nil {
+					return err
+				}
+				a.DecisionBuffer = n
+			case "vars_prefix":
+				if !d.Args(&a.VarsPrefix) {
+					return d.ArgErr()
+				}
+				if err := validateVarsPrefix(a.VarsPrefix); err != nil {
+					return wrapErr(d, ErrInvalidOption, "%v", err)
+				}
+			case "summary_interval":
+				if err := parseDuration(d, &a.SummaryInterval); err != nil {
+					return err
+				}
+			case "client_cert":
+				var cc ClientCert
+				if !d.Args(&cc.Certificate, &cc.Key) {
+					return d.ArgErr()
+				}
+				a.ClientCerts = append(a.ClientCerts, cc)
+			default:
+				return wrapErr(d, ErrUnknownDirective, "subdirective '%s'", d.Val())
+			}
+		}
     }
     return nil
 }
 
+// parseDuration 读取下一个参数并解析为时长
+func parseDuration(d *caddyfile.Dispenser, target *caddy.Duration) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return wrapErr(d, ErrInvalidOption, "duration '%s': %v", d.Val(), err)
+	}
+	*target = caddy.Duration(dur)
+	return nil
+}
+
+// parsePositiveInt 读取下一个参数并解析为正整数
+func parsePositiveInt(d *caddyfile.Dispenser) (int, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	n, err := strconv.Atoi(d.Val())
+	if err != nil || n <= 0 {
+		return 0, wrapErr(d, ErrInvalidOption, "positive integer '%s'", d.Val())
+	}
+	return n, nil
+}
+
+// ensureLogger 在logger为nil时使用不输出任何内容的日志器，
+// 避免未经完整Provision流程构造的处理器（如单元测试中）在记录日志时panic
+func (a *AuthModifier) ensureLogger() {
+	a.loggerOnce.Do(func() {
+		if a.logger == nil {
+			a.logger = zap.NewNop()
+		}
+	})
+}
+
 func (a *AuthModifier) Provision(ctx caddy.Context) error {
 	a.ctx, a.cancel = context.WithCancel(ctx.Context)
 	a.logger = ctx.Logger(a)
+	a.ensureLogger()
 	// 检查IndexPath是否已设置，如果没有设置，则使用默认路径
     if len(a.IndexPath) == 0 {
         a.IndexPath = "indexes.json" // 默认文件路径
     }
-	// 确保文件路径中的目录存在
-    if err := ensureDir(a.IndexPath); err != nil {
-		a.logger.Error("Error mkdir", zap.Error(err))
-    }
-	a.loadIndexes()
-	// 设置定时任务，每30秒保存一次索引到文件
-	a.SaveTicker = time.NewTicker(30 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-a.SaveTicker.C:
-				a.saveIndexes()
-			case <-a.ctx.Done():
-				return
+	// 索引文件在Provision中就会打开，非法的instance_id不能等到Validate再拒绝
+	if len(a.InstanceID) > 0 {
+		if !isInstanceID(a.InstanceID) {
+			return fmt.Errorf("%w: instance_id '%s' may only contain letters, digits, '-', '_' and '.'", ErrInvalidOption, a.InstanceID)
+		}
+		a.IndexPath = instancePath(a.IndexPath, a.InstanceID)
+	}
+	// 这里只填充默认值，配置是否合法由Validate统一检查
+	if len(a.Strategy) == 0 {
+		a.Strategy = StrategyRoundRobin
+	}
+	if len(a.Headers) == 0 {
+		a.Headers = defaultHeaders
+	}
+	// 追加到末尾而不是开头，keys仍然填充原来的第一个请求头；已配置时由canonicalHeaders去重
+	if a.GRPCWeb {
+		a.Headers = append(append([]string(nil), a.Headers...), grpcWebHeader)
+	}
+	a.Headers = canonicalHeaders(a.Headers)
+	if len(a.PreferHeader) > 0 {
+		a.PreferHeader = http.CanonicalHeaderKey(a.PreferHeader)
+	}
+	if len(a.Schemes) == 0 {
+		a.Schemes = defaultSchemes
+	}
+	a.buildHeaderFormats()
+	if a.CollapseDuplicates {
+		keys, _ := collapseDuplicates(a.Keys, nil)
+		if len(keys) < len(a.Keys) {
+			a.logger.Info("Collapsed duplicate keys", zap.Int("configured", len(a.Keys)), zap.Int("unique", len(keys)))
+		}
+		a.Keys = keys
+	}
+	if err := a.buildZipHeaders(); err != nil {
+		return err
+	}
+	a.selector = a.builtinSelector()
+	if a.SelectorRaw != nil {
+		mod, err := ctx.LoadModule(a, "SelectorRaw")
+		if err != nil {
+			return fmt.Errorf("%w: loading selector module: %v", ErrInvalidStrategy, err)
+		}
+		a.selector = mod.(Selector)
+		a.custom = true
+	}
+	if a.tracksQuota() {
+		if len(a.QuotaReset) == 0 {
+			a.QuotaReset = "00:00"
+		}
+		offset, err := parseQuotaReset(a.QuotaReset)
+		if err != nil {
+			return err
+		}
+		a.quotaOffset = offset
+		a.quotaLoc = time.UTC
+		if len(a.QuotaTimezone) > 0 {
+			if a.quotaLoc, err = time.LoadLocation(a.QuotaTimezone); err != nil {
+				return fmt.Errorf("%w: quota_timezone '%s': %v", ErrInvalidOption, a.QuotaTimezone, err)
 			}
 		}
-	}()
+	}
+	if len(a.AdvanceOnStatus) > 0 || len(a.NoAdvanceOnStatus) > 0 {
+		var err error
+		if a.advanceStatus, err = parseStatusRanges(a.AdvanceOnStatus); err != nil {
+			return err
+		}
+		if a.noAdvanceStatus, err = parseStatusRanges(a.NoAdvanceOnStatus); err != nil {
+			return err
+		}
+		if len(a.AdvanceOn) == 0 {
+			a.AdvanceOn = AdvanceStatus
+		}
+	}
+	if len(a.AdvanceOn) == 0 {
+		a.AdvanceOn = AdvanceAlways
+	}
+	if a.AdvanceOn == AdvanceCacheMiss {
+		if len(a.CacheHeader) == 0 {
+			a.CacheHeader = defaultCacheHeader
+		}
+		if len(a.CacheMissValue) == 0 {
+			a.CacheMissValue = defaultCacheMissValue
+		}
+	}
+	if len(a.KeyBy) == 0 {
+		a.KeyBy = KeyByPath
+	}
+	if strings.HasPrefix(a.KeyBy, KeyByHeadersPrefix) {
+		for _, name := range strings.Split(strings.TrimPrefix(a.KeyBy, KeyByHeadersPrefix), ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				a.keyHeaders = append(a.keyHeaders, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	if a.SaveInterval == 0 {
+		a.SaveInterval = caddy.Duration(defaultSaveInterval)
+	}
+	// Validate在Provision之后才执行，负数的间隔必须在创建定时器之前拒绝，否则time.NewTicker会panic
+	if a.SaveInterval < 0 {
+		return fmt.Errorf("%w: save_interval must be positive, got %s", ErrInvalidOption, time.Duration(a.SaveInterval))
+	}
+	if len(a.Format) == 0 {
+		a.Format = FormatJSON
+	}
+	if a.IndexCap <= 0 {
+		a.IndexCap = defaultIndexCap
+	}
+	if a.ReplicaFromHostname {
+		offset, err := hostnameOrdinal()
+		if err != nil {
+			return fmt.Errorf("%w: replica_offset hostname: %v", ErrInvalidOption, err)
+		}
+		a.ReplicaOffset = offset
+		a.logger.Info("Replica offset derived from hostname", zap.Int("replica_offset", offset))
+	}
+	if a.ShuffleFromHostname {
+		seed, err := hostnameSeed()
+		if err != nil {
+			return fmt.Errorf("%w: shuffle_seed hostname: %v", ErrInvalidOption, err)
+		}
+		a.ShuffleSeed = seed
+	}
+	if a.CompactAfter <= 0 {
+		a.CompactAfter = 1000
+	}
+	if err := a.loadClientCerts(); err != nil {
+		return err
+	}
+	if a.Cooldown <= 0 {
+		a.Cooldown = caddy.Duration(5 * time.Minute)
+	}
+	a.inFlight = make(map[string]int)
+	if len(a.FingerprintMode) == 0 {
+		a.FingerprintMode = FingerprintLast4
+	}
+	a.fingerprintKey = []byte(caddy.NewReplacer().ReplaceAll(a.FingerprintSecret, ""))
+	if a.MaxTrackedKeys > 0 {
+		a.tracked = &trackedKeys{max: int32(a.MaxTrackedKeys)}
+	}
+	a.buildDrain()
+	if a.SaturatedStatus == 0 {
+		a.SaturatedStatus = http.StatusServiceUnavailable
+	}
+	if len(a.VarsPrefix) == 0 {
+		a.VarsPrefix = defaultVarsPrefix
+	}
+	if a.DecisionBuffer > 0 {
+		a.decisions = newDecisionRing(a.DecisionBuffer)
+	}
+	if len(a.MultiValueMode) == 0 {
+		a.MultiValueMode = MultiValueFirst
+	}
+	if len(a.MinPoolMode) == 0 {
+		a.MinPoolMode = MinPoolWarn
+	}
+	if len(a.BasicInvalid) == 0 {
+		a.BasicInvalid = BasicInvalidRotate
+	}
+	if a.BasicInvalidStatus == 0 {
+		a.BasicInvalidStatus = http.StatusBadRequest
+	}
+	if a.PoolWarnInterval <= 0 {
+		a.PoolWarnInterval = caddy.Duration(defaultPoolWarnInterval)
+	}
+	a.poolWarnings = newWarnCache(time.Duration(a.PoolWarnInterval))
+	if a.MinPoolStatus == 0 {
+		a.MinPoolStatus = http.StatusBadRequest
+	}
+	if a.CircuitBreaker != nil {
+		a.CircuitBreaker.provision()
+		a.breaker = newBreaker(a.CircuitBreaker, a.logger)
+	}
+	if len(a.Denylist) > 0 {
+		denied, err := newDenylist(a.ctx, a.Denylist, a.logger)
+		if err != nil {
+			return fmt.Errorf("%w %s: %v", ErrDenylist, a.Denylist, err)
+		}
+		a.denied = denied
+	}
+	if a.MaxRetries > 0 && a.MaxRetryTime <= 0 {
+		a.MaxRetryTime = caddy.Duration(30 * time.Second)
+	}
+	if len(a.SourceURL) > 0 {
+		if a.SourceRefresh <= 0 {
+			a.SourceRefresh = caddy.Duration(defaultSourceRefresh)
+		}
+		if err := a.provisionSource(); err != nil {
+			return err
+		}
+	}
+	if len(a.SecretsDir) > 0 {
+		secrets, err := newSecretsDir(a.ctx, a.SecretsDir, a.CollapseDuplicates, a.logger)
+		if err != nil {
+			return fmt.Errorf("%w: secrets_dir %s: %v", ErrKeySource, a.SecretsDir, err)
+		}
+		a.secrets = secrets
+	}
+	if len(a.AuditLog) > 0 {
+		if a.AuditMaxSize <= 0 {
+			a.AuditMaxSize = defaultAuditMaxSize
+		}
+		if err := a.openAuditLog(); err != nil {
+			return fmt.Errorf("%w: opening audit log %s: %v", ErrPathNotWritable, a.AuditLog, err)
+		}
+	}
+	if a.SummaryInterval > 0 {
+		a.counters = new(rotationCounters)
+		a.startSummary()
+	}
+	var storage certmagic.Storage
+	if a.UseStorage {
+		storage = ctx.Storage()
+	} else {
+		// 确保文件路径中的目录存在
+		// strict模式下目录无法创建时直接报错，否则只记录日志，保存时会继续重试
+		if err := ensureDir(a.IndexPath); err != nil {
+			if a.Strict {
+				return fmt.Errorf("%w: %s: %v", ErrPathNotWritable, filepath.Dir(a.IndexPath), err)
+			}
+			a.logger.Error("Error mkdir", zap.Error(err))
+		}
+	}
+	if err := a.openIndexFile(storage); err != nil {
+		return err
+	}
+	a.indexFile.register(a)
+	if a.Strategy == StrategyAdaptiveLatency {
+		a.latency = a.indexFile.latency
+	}
+	if a.PersistQuarantine && !a.IgnorePersisted {
+		a.loadQuarantine()
+		a.startQuarantineSaves()
+	}
+	// 隔离记录在共享索引上，启动校验放在打开共享索引并恢复隔离记录之后。
+	// 缺少health_check_url时由Validate报错，这里不发起校验
+	if a.ValidateOnStart && len(a.HealthCheckURL) > 0 {
+		if a.ProbeTimeout <= 0 {
+			a.ProbeTimeout = caddy.Duration(5 * time.Second)
+		}
+		if a.ProbeWorkers <= 0 {
+			a.ProbeWorkers = 4
+		}
+		a.probeKeys()
+	}
+	if a.tracksQuota() && !a.IgnorePersisted {
+		a.loadQuota()
+		a.startQuotaSaves()
+	}
+	if a.ResetEvery > 0 {
+		if a.ResetSkew <= 0 {
+			a.ResetSkew = caddy.Duration(defaultResetSkew)
+		}
+		a.startResets()
+	}
 	return nil
 }
 
 func (a *AuthModifier) Cleanup() error {
-	a.cancel()        // 通知goroutine退出
-	a.SaveTicker.Stop() // 停止定时器
-	a.saveIndexes()     // 确保在清理时保存一次
-	return nil
+	a.cancel() // 取消仍在进行的启动校验
+	// Provision在打开共享索引之前失败时Caddy同样会调用Cleanup，此时没有可保存的隔离记录和计数
+	if a.PersistQuarantine && !a.IgnorePersisted && a.indexFile != nil {
+		a.saveQuarantine()
+	}
+	if a.tracksQuota() && !a.IgnorePersisted && a.indexFile != nil {
+		a.saveQuota()
+	}
+	if a.indexFile != nil {
+		a.indexFile.unregister(a)
+	}
+	if a.audit != nil {
+		auditLogs.Delete(a.auditLogKey)
+	}
+	// 释放共享索引，最后一个使用者释放时会停止保存协程并保存一次完整索引
+	_, err := indexFiles.Delete(a.indexFileKey)
+	return err
 }
 
 func (a *AuthModifier) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	a.ensureLogger()
+	// 不满足require_header条件的请求原样放行
+	if !a.requirementMet(r) {
+		return next.ServeHTTP(w, r)
+	}
+	if len(a.PreferHeader) > 0 {
+		a.dropNonPreferred(r)
+	}
+	// 只有单个密钥的请求会走下面的快速路径，需要在此之前检查密钥池大小
+	if a.MinPoolSize > 0 && !a.checkPoolSize(w, r) {
+		return nil
+	}
+	if a.BasicInvalid != BasicInvalidRotate {
+		if name, ok := a.malformedBasic(r); ok {
+			return a.respondMalformedBasic(w, r, next, name)
+		}
+	}
+	// 快速路径：只有单个密钥时无需轮换，跳过加锁和索引更新
+	if len(a.certs) == 0 && len(a.keys()) == 0 && len(a.CanaryKey) == 0 && !a.hasMultipleTokens(r) {
+		return next.ServeHTTP(w, r)
+	}
+	// 密钥池熔断期间不再轮换
+	if a.breaker != nil && !a.breaker.allow(time.Now()) {
+		return a.respondOpen(w, r, next)
+	}
+
+	// 协议升级（如WebSocket）的连接建立后不能再更换凭据，只选择一次且不重试
+	if a.MaxRetries > 0 && !isUpgrade(r) {
+		return a.serveWithRetries(w, r, next)
+	}
+
+	r, key, rotations := a.rotate(r)
+	if a.saturated(rotations) {
+		return a.respondSaturated(w, key, rotations)
+	}
+	defer a.release(rotations)
+	if a.AllDeadResponse != nil && a.allDead(rotations) {
+		return a.respondAllDead(w, key)
+	}
+	// 需要根据下游结果推进索引或隔离失败的密钥时才包装ResponseWriter
+	if !a.observesOutcome() || len(rotations) == 0 {
+		return next.ServeHTTP(w, r)
+	}
+	rec := newStatusRecorder(w, nil)
+	err := next.ServeHTTP(rec, r)
+	a.finish(r, key, rotations, rec, err)
+	return err
+}
+
+// rotate 轮换请求中的凭据，返回可能带有新上下文的请求、索引键和各请求头的轮换结果
+func (a *AuthModifier) rotate(r *http.Request) (*http.Request, string, []rotation) {
+	key := a.indexKey(r)
 	a.Mutex.RLock()
-	index := a.Indexes[r.URL.Path]
+	index := a.positionLocked(key)
 	a.Mutex.RUnlock()
 
-	authHeader := r.Header.Get("Authorization")
-	googleApiKeyHeader := r.Header.Get("X-Goog-Api-Key")
-	claudeApiKeyHeader := r.Header.Get("x-api-key")
-	prefix := "bearer "
-
-	if len(authHeader) >= 7 && strings.HasPrefix(strings.ToLower(authHeader[:7]), prefix) {
-		token := strings.TrimSpace(authHeader[7:])
-		tokens := strings.Split(token, ",")
-		if len(tokens) > 0 {
-			selectedToken := tokens[index%len(tokens)]
-			r.Header.Set("Authorization", "Bearer "+selectedToken)
+	// 灰度请求不参与主密钥池的轮换，也不推进索引
+	if a.useCanary() {
+		a.applyCanary(r, key)
+		a.setStaticHeaders(r)
+		return a.withClientCert(r, index, nil), key, nil
+	}
 
-			a.logger.Debug("Set Authorization", zap.String("Auth-Key", "Bearer "+selectedToken))
-			a.updateIndex(r.URL.Path, len(tokens))
+	var rotations []rotation // 本次请求被轮换的头部，用于推进索引
+	headers := a.Headers
+	if len(a.keys()) > 0 {
+		rotations = append(rotations, a.rotatePool(r, key, index))
+		headers = headers[1:]
+	}
+	for _, name := range headers {
+		// zip_headers的跟随请求头随主请求头一起改写
+		if a.zipped[name] {
+			continue
+		}
+		if rot, ok := a.rotateHeader(r, name, key, index); ok {
+			rotations = append(rotations, rot)
+			rotations = append(rotations, a.rotateZipped(r, rot)...)
+			rotations = append(rotations, a.rotateOtherValues(r, name, key, index)...)
 		}
-	} else if len(authHeader) > 0 {
-		tokens := strings.Split(authHeader, ",")
-		if len(tokens) > 0 {
-			selectedToken := tokens[index%len(tokens)]
-			r.Header.Set("Authorization", selectedToken)
+	}
+	if rot, ok := a.rotateCookie(r, key, index); ok {
+		rotations = append(rotations, rot)
+	}
+	r = a.withClientCert(r, index, rotations)
 
-			a.logger.Debug("Set Authorization", zap.String("Auth-Key", selectedToken))
-			a.updateIndex(r.URL.Path, len(tokens))
+	if len(rotations) > 0 {
+		a.setStaticHeaders(r)
+		a.exposeRotation(r, key, rotations[0])
+		if a.counters != nil {
+			a.counters.record(key, rotations[0].pos)
 		}
 	}
+	// 默认在转发前推进索引，使并发请求立即使用下一个密钥
+	if a.AdvanceOn == AdvanceAlways {
+		a.advance(key, rotations)
+	}
+	return r, key, rotations
+}
 
-	if len(googleApiKeyHeader) > 0 {
-		apiKeys := strings.Split(googleApiKeyHeader, ",")
-		if len(apiKeys) > 0 {
-			selectedApiKey := apiKeys[index%len(apiKeys)]
-			r.Header.Set("X-Goog-Api-Key", selectedApiKey)
+// useCanary 按canary_percent随机决定本次请求是否使用灰度密钥
+func (a *AuthModifier) useCanary() bool {
+	return len(a.CanaryKey) > 0 && rand.Float64()*100 < a.CanaryPercent
+}
 
-			a.logger.Debug("Set X-Goog-Api-Key", zap.String("Auth-Key", selectedApiKey))
-			a.updateIndex(r.URL.Path, len(apiKeys))
-		}
-	} else if len(claudeApiKeyHeader) > 0 {
-		apiKeys := strings.Split(claudeApiKeyHeader, ",")
-		if len(apiKeys) > 0 {
-			selectedApiKey := apiKeys[index%len(apiKeys)]
-			r.Header.Set("x-api-key", selectedApiKey)
+// applyCanary 将灰度密钥写入第一个轮换请求头
+func (a *AuthModifier) applyCanary(r *http.Request, key string) {
+	name := a.Headers[0]
+	r.Header.Set(name, a.CanaryKey)
+	a.exposeRotation(r, key, rotation{header: name, token: a.CanaryKey, pos: -1, length: 1, canary: true, pool: "canary"})
+	if a.sampled() {
+		a.logger.Debug("Set "+name+" to canary key", zap.String("Auth-Key", a.keyLabel(a.CanaryKey)))
+	}
+}
 
-			a.logger.Debug("Set x-api-key", zap.String("Auth-Key", selectedApiKey))
-			a.updateIndex(r.URL.Path, len(apiKeys))
+// observesOutcome 判断是否需要知道下游的处理结果
+func (a *AuthModifier) observesOutcome() bool {
+	return a.AdvanceOn != AdvanceAlways || a.Strategy == StrategyFailover || a.MaxRetries > 0 || a.breaker != nil || a.latency != nil || a.audit != nil
+}
+
+// finish 根据下游结果隔离失败的密钥，并按advance_on推进索引
+func (a *AuthModifier) finish(r *http.Request, key string, rotations []rotation, rec *statusRecorder, err error) {
+	if a.audit != nil {
+		a.recordAudit(r, key, rotations, rec, err)
+	}
+	if a.breaker != nil {
+		a.breaker.record(requestFailed(outcomeStatus(rec, err)), time.Now())
+	}
+	a.observeLatency(rotations, rec, err)
+	if (a.Strategy == StrategyFailover || a.MaxRetries > 0) && keyFailed(outcomeStatus(rec, err)) {
+		cooldown := a.cooldownFor(rec, err)
+		for _, rot := range rotations {
+			if rot.follower {
+				continue
+			}
+			a.quarantine(rot.token, cooldown)
+			a.logger.Warn("Key failed, quarantined",
+				zap.String("header", rot.header), zap.String("Auth-Key", a.keyLabel(rot.token)),
+				zap.Duration("cooldown", cooldown))
+		}
+	}
+	if a.AdvanceOn == AdvanceCacheMiss {
+		if a.cacheMiss(rec) {
+			a.advance(key, rotations)
+		}
+		return
+	}
+	if a.AdvanceOn == AdvanceStatus {
+		if a.statusAdvances(outcomeStatus(rec, err)) {
+			a.advance(key, rotations)
+		}
+		return
+	}
+	if a.AdvanceOn != AdvanceAlways {
+		success := err == nil && rec.Status() < 400
+		if success == (a.AdvanceOn == AdvanceSuccess) {
+			a.advance(key, rotations)
 		}
 	}
-
-	return next.ServeHTTP(w, r)
 }
 
-func (a *AuthModifier) updateIndex(url string, length int) {
-	a.Mutex.Lock()
-	a.Indexes[url] = (a.Indexes[url] + 1) % length
-	a.Changed = true
-	a.Mutex.Unlock()
+// cacheMiss 判断下游响应是否未命中缓存。没有缓存响应头时请求一定到达了上游，同样视为未命中
+func (a *AuthModifier) cacheMiss(rec *statusRecorder) bool {
+	value := strings.TrimSpace(rec.Header().Get(a.CacheHeader))
+	if len(value) == 0 {
+		return true
+	}
+	n := len(a.CacheMissValue)
+	return len(value) >= n && strings.EqualFold(value[:n], a.CacheMissValue)
 }
 
-func (a *AuthModifier) loadIndexes() {
-	data, err := os.ReadFile(a.IndexPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			a.logger.Error("Error reading indexes file", zap.Error(err))
+// requirementMet 判断请求是否满足require_header条件，未配置时总是满足
+func (a *AuthModifier) requirementMet(r *http.Request) bool {
+	if len(a.RequireHeader) == 0 {
+		return true
+	}
+	values, ok := r.Header[http.CanonicalHeaderKey(a.RequireHeader)]
+	if !ok {
+		return false
+	}
+	if len(a.RequireHeaderValue) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == a.RequireHeaderValue {
+			return true
 		}
-		a.Indexes = make(map[string]int)
-		return
 	}
-	if err := json.Unmarshal(data, &a.Indexes); err != nil {
-		a.logger.Error("Error parsing indexes file", zap.Error(err))
-		a.Indexes = make(map[string]int)
+	return false
+}
+
+// advance 在本次请求发生过轮换时推进一次索引
+func (a *AuthModifier) advance(url string, rotations []rotation) {
+	if len(rotations) > 0 {
+		a.updateIndex(url)
 	}
 }
 
-func (a *AuthModifier) saveIndexes() {
-	a.Mutex.Lock()
-	if !a.Changed {
-		a.Mutex.Unlock()
+// updateIndex 将索引加一。索引是与密钥数量无关的计数器，选择时才对密钥数量取模，
+// 并在IndexCap处回绕，这样同一路径交替出现不同大小的密钥池时各自仍能均匀轮换。
+func (a *AuthModifier) updateIndex(url string) {
+	// 随机和加权策略不依赖索引，无需记录；freeze_index下索引保持不变
+	if !a.usesIndex() || a.FreezeIndex {
 		return
 	}
-	data, err := json.Marshal(a.Indexes)
-	if err != nil {
-		a.logger.Error("Error marshalling indexes", zap.Error(err))
-		a.Mutex.Unlock()
+	// 全局计数器只需一次原子加法，不加锁也不记录索引键
+	if a.KeyBy == KeyByGlobal {
+		atomic.AddUint64(&a.global, 1)
 		return
 	}
-	a.Changed = false
+	a.Mutex.Lock()
+	a.Indexes[url] = (a.indexLocked(url) + 1) % a.IndexCap
+	a.touchLocked(url, time.Now(), true)
+	a.dirty[url] = struct{}{}
+	a.Changed = true
 	a.Mutex.Unlock()
-
-	if err := os.WriteFile(a.IndexPath, data, 0644); err != nil {
-		a.logger.Error("Error writing indexes to file", zap.Error(err))
-		a.Mutex.Lock()
-		a.Changed = true
-		a.Mutex.Unlock()
-	}
 }
 
 // parseCaddyfile 用于解析Caddyfile并返回中间件处理器
@@ -211,3 +1370,12 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 func main() {
 	// 留空，因为Caddy通过插件机制调用此模块
 }
+
+// 接口守卫
+var (
+	_ caddy.Provisioner           = (*AuthModifier)(nil)
+	_ caddy.Validator             = (*AuthModifier)(nil)
+	_ caddy.CleanerUpper          = (*AuthModifier)(nil)
+	_ caddyhttp.MiddlewareHandler = (*AuthModifier)(nil)
+	_ caddyfile.Unmarshaler       = (*AuthModifier)(nil)
+)
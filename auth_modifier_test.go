@@ -0,0 +1,306 @@
+package auth_modifier
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+)
+
+// provisionTest 依次执行Provision和Validate，IndexPath为空时使用临时目录，测试结束时执行Cleanup。
+// 与Caddy的LoadModule一样，Provision失败时立即执行Cleanup
+func provisionTest(t testing.TB, a *AuthModifier) error {
+	t.Helper()
+	if len(a.IndexPath) == 0 {
+		a.IndexPath = filepath.Join(t.TempDir(), "index.json")
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := a.Provision(ctx); err != nil {
+		if cerr := a.Cleanup(); cerr != nil {
+			t.Errorf("Provision失败后Cleanup: %v", cerr)
+		}
+		return err
+	}
+	t.Cleanup(func() { a.Cleanup() })
+	return a.Validate()
+}
+
+// newTestHandler 解析auth_modifier块的内容，使用path作为索引文件（为空时使用临时文件）并完成Provision
+func newTestHandler(t testing.TB, path, block string) *AuthModifier {
+	t.Helper()
+	if len(path) == 0 {
+		path = filepath.Join(t.TempDir(), "index.json")
+	}
+	a := new(AuthModifier)
+	if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser("auth_modifier " + path + " {\n" + block + "\n}")); err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if err := provisionTest(t, a); err != nil {
+		t.Fatalf("Provision失败: %v", err)
+	}
+	return a
+}
+
+// serveTest 让请求经过处理器，下游返回status，返回下游看到的请求头和响应
+func serveTest(t testing.TB, a *AuthModifier, r *http.Request, status int) (http.Header, *httptest.ResponseRecorder) {
+	t.Helper()
+	var seen http.Header
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		seen = r.Header.Clone()
+		w.WriteHeader(status)
+		return nil
+	})
+	w := httptest.NewRecorder()
+	if err := a.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	return seen, w
+}
+
+// authRequest 构造携带Authorization的请求
+func authRequest(path, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Authorization", value)
+	return r
+}
+
+// rotatedSequence 连续发送n个相同的请求，返回下游每次看到的Authorization
+func rotatedSequence(t *testing.T, a *AuthModifier, path, value string, n int) []string {
+	t.Helper()
+	got := make([]string, n)
+	for i := range got {
+		seen, _ := serveTest(t, a, authRequest(path, value), http.StatusOK)
+		got[i] = seen.Get("Authorization")
+	}
+	return got
+}
+
+func assertSequence(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, 期望 %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("第%d个请求: got %v, 期望 %v", i+1, got, want)
+		}
+	}
+}
+
+func TestServeHTTPRoundRobin(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	got := rotatedSequence(t, a, "/v1/chat", "Bearer k1,k2,k3", 7)
+	assertSequence(t, got, []string{"Bearer k1", "Bearer k2", "Bearer k3", "Bearer k1", "Bearer k2", "Bearer k3", "Bearer k1"})
+}
+
+func TestServeHTTPIndexPerPath(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	for i, want := range []string{"k1", "k2"} {
+		seen, _ := serveTest(t, a, authRequest("/a", "k1,k2,k3"), http.StatusOK)
+		if got := seen.Get("Authorization"); got != want {
+			t.Fatalf("/a 第%d个请求 = %q, 期望 %q", i+1, got, want)
+		}
+	}
+	// 其他路径有独立的索引，从第一个密钥开始
+	seen, _ := serveTest(t, a, authRequest("/b", "k1,k2,k3"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "k1" {
+		t.Fatalf("/b = %q, 期望 k1", got)
+	}
+	seen, _ = serveTest(t, a, authRequest("/a", "k1,k2,k3"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "k3" {
+		t.Fatalf("/a 第3个请求 = %q, 期望 k3", got)
+	}
+	a.Mutex.RLock()
+	defer a.Mutex.RUnlock()
+	if a.Indexes["/a"] != 3 || a.Indexes["/b"] != 1 {
+		t.Errorf("Indexes = %v", a.Indexes)
+	}
+}
+
+func TestServeHTTPSingleKeyUnchanged(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	for i := 0; i < 3; i++ {
+		seen, _ := serveTest(t, a, authRequest("/v1/chat", "Bearer only"), http.StatusOK)
+		if got := seen.Get("Authorization"); got != "Bearer only" {
+			t.Fatalf("Authorization = %q, 期望原样转发", got)
+		}
+	}
+	if len(a.Indexes) != 0 {
+		t.Errorf("单个密钥不应推进索引: %v", a.Indexes)
+	}
+}
+
+func TestServeHTTPMultipleHeaders(t *testing.T) {
+	a := newTestHandler(t, "", "headers Authorization X-Api-Key")
+	for i, want := range [][2]string{{"a1", "b1"}, {"a2", "b2"}, {"a1", "b1"}} {
+		r := authRequest("/v1", "a1,a2")
+		r.Header.Set("X-Api-Key", "b1,b2")
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		if seen.Get("Authorization") != want[0] || seen.Get("X-Api-Key") != want[1] {
+			t.Fatalf("第%d个请求 = %q %q, 期望 %v", i+1, seen.Get("Authorization"), seen.Get("X-Api-Key"), want)
+		}
+	}
+}
+
+func TestServeHTTPIndexPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	t.Run("first", func(t *testing.T) {
+		a := newTestHandler(t, path, "")
+		rotatedSequence(t, a, "/v1", "k1,k2,k3", 2)
+	})
+	// 上一个处理器在子测试结束时Cleanup并保存索引，新的处理器从保存的位置继续
+	a := newTestHandler(t, path, "")
+	assertSequence(t, rotatedSequence(t, a, "/v1", "k1,k2,k3", 2), []string{"k3", "k1"})
+}
+
+// BenchmarkSingleToken 比较只有一个密钥时的快速路径与完整的轮换流程
+func BenchmarkSingleToken(b *testing.B) {
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	b.Run("fast_path", func(b *testing.B) {
+		a := newTestHandler(b, "", "")
+		r := authRequest("/v1/chat", "Bearer only")
+		w := httptest.NewRecorder()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.ServeHTTP(w, r, next)
+		}
+	})
+	b.Run("rotate", func(b *testing.B) {
+		a := newTestHandler(b, "", "")
+		r := authRequest("/v1/chat", "Bearer only")
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.rotate(r)
+		}
+	})
+	b.Run("multiple_tokens", func(b *testing.B) {
+		a := newTestHandler(b, "", "")
+		w := httptest.NewRecorder()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.ServeHTTP(w, authRequest("/v1/chat", "Bearer k1,k2,k3"), next)
+		}
+	})
+}
+
+func TestRequireHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		block  string
+		header map[string]string
+		want   string
+	}{
+		{"present", "require_header X-Rotate", map[string]string{"X-Rotate": ""}, "k1"},
+		{"absent", "require_header X-Rotate", nil, "k1,k2"},
+		{"value match", "require_header X-Rotate yes", map[string]string{"X-Rotate": "yes"}, "k1"},
+		{"value mismatch", "require_header X-Rotate yes", map[string]string{"X-Rotate": "no"}, "k1,k2"},
+		{"lowercase name", "require_header x-rotate", map[string]string{"X-Rotate": "1"}, "k1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestHandler(t, "", tt.block)
+			r := authRequest("/v1", "k1,k2")
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			seen, _ := serveTest(t, a, r, http.StatusOK)
+			if got := seen.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %q, 期望 %q", got, tt.want)
+			}
+			if tt.want == "k1,k2" && len(a.Indexes) != 0 {
+				t.Errorf("未轮换的请求不应推进索引: %v", a.Indexes)
+			}
+		})
+	}
+}
+
+// cacheNext 返回按顺序在响应头name中返回values的下游处理器，并记录每次看到的Authorization
+func cacheNext(name string, values ...string) (caddyhttp.Handler, *[]string) {
+	var seen []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if value := values[len(seen)]; len(value) > 0 {
+			w.Header().Set(name, value)
+		}
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	return next, &seen
+}
+
+func TestAdvanceOnCacheMiss(t *testing.T) {
+	for _, c := range []struct {
+		block  string
+		header string
+		values []string
+		want   []string
+	}{
+		{"advance_on cache_miss", "X-Cache", []string{"HIT", "MISS", "HIT", "miss from upstream", "", "HIT"},
+			[]string{"k0", "k0", "k1", "k1", "k2", "k0"}},
+		{"advance_on cache_miss CF-Cache-Status EXPIRED", "CF-Cache-Status", []string{"HIT", "EXPIRED", "MISS", "HIT"},
+			[]string{"k0", "k0", "k1", "k1"}},
+	} {
+		a := newTestHandler(t, "", c.block)
+		next, seen := cacheNext(c.header, c.values...)
+		for range c.values {
+			if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", pool(3)), next); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertSequence(t, *seen, c.want)
+	}
+}
+
+func TestSaveIntervalZeroOrNegative(t *testing.T) {
+	// 零值使用默认间隔，不会让time.NewTicker panic
+	a := &AuthModifier{SaveInterval: 0}
+	if err := provisionTest(t, a); err != nil {
+		t.Fatalf("save_interval 0: %v", err)
+	}
+	if got := time.Duration(a.SaveInterval); got != defaultSaveInterval {
+		t.Errorf("SaveInterval = %s, 期望默认的 %s", got, defaultSaveInterval)
+	}
+
+	a = &AuthModifier{SaveInterval: caddy.Duration(-time.Second)}
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("save_interval -1s: 错误 = %v, 期望 ErrInvalidOption", err)
+	}
+	if got := (persistOptions{interval: -time.Second}).saveInterval(); got != defaultSaveInterval {
+		t.Errorf("非法间隔的定时器间隔 = %s, 期望 %s", got, defaultSaveInterval)
+	}
+}
+
+func TestServeHTTPWithoutLogger(t *testing.T) {
+	// 在完整的Provision流程之外构造、没有设置日志器的处理器
+	a := storageReplica(t, &certmagic.FileStorage{Path: t.TempDir()})
+	a.logger = nil
+	a.Headers = []string{"Authorization"}
+	a.Strategy, a.KeyBy, a.IndexCap = StrategyRoundRobin, KeyByPath, defaultIndexCap
+	a.AdvanceOn = AdvanceAlways
+	a.buildHeaderFormats()
+	a.selector = a.builtinSelector()
+	a.poolWarnings = newWarnCache(defaultPoolWarnInterval)
+
+	seen, _ := serveTest(t, a, authRequest("/v1", "Bearer only"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "Bearer only" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if a.logger == nil {
+		t.Fatal("ServeHTTP没有补上空日志器")
+	}
+	assertSequence(t, rotatedSequence(t, a, "/v1", "Bearer k0,k1", 2), []string{"Bearer k0", "Bearer k1"})
+	// 记录警告的路径同样不会panic
+	serveTest(t, a, authRequest("/v2", "Bearer k1,,k2"), http.StatusOK)
+}
@@ -0,0 +1,55 @@
+package auth_modifier
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Basic凭据无法解码时的处理方式
+const (
+	BasicInvalidRotate = "rotate" // 不检查，与其他密钥一样轮换（默认）
+	BasicInvalidPass   = "pass"   // 不轮换，原样转发请求
+	BasicInvalidReject = "reject" // 直接返回basic_invalid_status，不再转发
+)
+
+var validBasicInvalidModes = []string{BasicInvalidRotate, BasicInvalidPass, BasicInvalidReject}
+
+// validBasic 判断Basic凭据是否是标准base64编码的"用户名:密码"
+func validBasic(credential string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(credential)
+	return err == nil && strings.IndexByte(string(decoded), ':') >= 0
+}
+
+// malformedBasic 返回第一个携带了无法解码的Basic凭据的轮换请求头，列表中的每个Basic元素都会检查
+func (a *AuthModifier) malformedBasic(r *http.Request) (string, bool) {
+	for _, name := range a.Headers {
+		value := r.Header.Get(name)
+		if len(value) == 0 {
+			continue
+		}
+		scheme, pool := a.splitCredential(r, name, value)
+		schemes, bare := a.trimElementSchemes(name, scheme, pool)
+		for i, token := range bare {
+			if strings.EqualFold(strings.TrimSpace(schemes[i]), "Basic") && !validBasic(token) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// respondMalformedBasic 按basic_invalid处理请求头name中携带了无法解码的Basic凭据的请求：
+// reject时直接返回basic_invalid_status，pass时不轮换、原样转发。日志中只记录密钥池的指纹
+func (a *AuthModifier) respondMalformedBasic(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, name string) error {
+	malformedBasicTotal.Inc()
+	a.warnPool("Malformed Basic credential", name, r.Header.Get(name), zap.String("basic_invalid", a.BasicInvalid))
+	if a.BasicInvalid == BasicInvalidReject {
+		w.WriteHeader(a.BasicInvalidStatus)
+		return nil
+	}
+	return next.ServeHTTP(w, r)
+}
@@ -0,0 +1,101 @@
+package auth_modifier
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func basicToken(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+func TestValidBasic(t *testing.T) {
+	for token, want := range map[string]bool{
+		basicToken("u1", "p1"):                               true,
+		basicToken("u1", ""):                                 true,
+		base64.StdEncoding.EncodeToString([]byte("nocolon")): false,
+		"%%%not-base64":                                      false,
+		"dTE6cDE":                                            false, // 缺少填充
+		"":                                                   false,
+	} {
+		if got := validBasic(token); got != want {
+			t.Errorf("validBasic(%q) = %v, 期望 %v", token, got, want)
+		}
+	}
+}
+
+func TestBasicInvalidModes(t *testing.T) {
+	good := "Basic " + basicToken("u1", "p1") + ",Basic " + basicToken("u2", "p2")
+	bad := "Basic " + basicToken("u1", "p1") + ",Basic %%%garbage"
+	for _, c := range []struct {
+		block    string
+		value    string
+		status   int
+		want     string // 下游看到的Authorization，为空表示没有转发
+		advanced bool
+	}{
+		// 合法的凭据在各模式下都照常轮换
+		{"basic_invalid pass", good, http.StatusOK, "Basic " + basicToken("u1", "p1"), true},
+		{"basic_invalid reject", good, http.StatusOK, "Basic " + basicToken("u1", "p1"), true},
+		// 默认不检查，与其他密钥一样轮换
+		{"", bad, http.StatusOK, "Basic " + basicToken("u1", "p1"), true},
+		{"basic_invalid pass", bad, http.StatusOK, bad, false},
+		{"basic_invalid reject", bad, http.StatusBadRequest, "", false},
+		{"basic_invalid reject 401", bad, http.StatusUnauthorized, "", false},
+	} {
+		a := newTestHandler(t, "", c.block)
+		core, logs := observer.New(zap.WarnLevel)
+		a.logger = zap.New(core)
+		before := testutil.ToFloat64(malformedBasicTotal)
+
+		forwarded := ""
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			forwarded = r.Header.Get("Authorization")
+			return nil
+		})
+		w := httptest.NewRecorder()
+		if err := a.ServeHTTP(w, authRequest("/v1", c.value), next); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != c.status || forwarded != c.want {
+			t.Errorf("%q %q: 状态码 = %d, 转发 %q, 期望 %d, %q", c.block, c.value, w.Code, forwarded, c.status, c.want)
+		}
+		if advanced := snapshotIndexes(a.indexFile)["/v1"] == 1; advanced != c.advanced {
+			t.Errorf("%q %q: 推进了索引 = %v, 期望 %v", c.block, c.value, advanced, c.advanced)
+		}
+
+		// 检查无法解码的凭据时计数并记录不含密钥原文的警告
+		checked := len(c.block) > 0 && c.value == bad
+		if got := testutil.ToFloat64(malformedBasicTotal) - before; (got == 1) != checked {
+			t.Errorf("%q %q: malformed 计数增加了 %v", c.block, c.value, got)
+		}
+		entries := logs.FilterMessage("Malformed Basic credential").All()
+		if (len(entries) == 1) != checked {
+			t.Errorf("%q %q: 输出了 %d 条警告", c.block, c.value, len(entries))
+		}
+		for _, entry := range entries {
+			for _, v := range entry.ContextMap() {
+				if s, ok := v.(string); ok && strings.Contains(s, "garbage") {
+					t.Errorf("警告中包含凭据原文: %v", entry.ContextMap())
+				}
+			}
+		}
+	}
+}
+
+func TestBasicInvalidModeInvalid(t *testing.T) {
+	a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\nbasic_invalid drop\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidOption", err)
+	}
+}
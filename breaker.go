@@ -0,0 +1,210 @@
+package auth_modifier
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// 熔断器的默认参数
+const (
+	defaultBreakerPercent     = 50
+	defaultBreakerWindow      = time.Minute
+	defaultBreakerMinRequests = 20
+	defaultBreakerCooldown    = 30 * time.Second
+	breakerBuckets            = 10 // 滚动窗口划分的桶数
+)
+
+// CircuitBreaker 是整个密钥池的熔断配置：窗口内的失败率超过阈值时熔断，
+// 熔断期间不再轮换密钥，直接返回错误或原样放行，避免在上游故障时放大请求量
+type CircuitBreaker struct {
+	ErrorPercent float64        `json:"error_percent,omitempty"` // 触发熔断的失败率百分比，默认50
+	Window       caddy.Duration `json:"window,omitempty"`        // 统计失败率的滚动窗口，默认1m
+	MinRequests  int            `json:"min_requests,omitempty"`  // 窗口内请求数达到该值才会判断是否熔断，默认20
+	Cooldown     caddy.Duration `json:"cooldown,omitempty"`      // 熔断持续的时长，之后放行一个探测请求，默认30s
+	Passthrough  bool           `json:"passthrough,omitempty"`   // 熔断期间不轮换、原样放行请求，而不是直接失败
+	StatusCode   int            `json:"status_code,omitempty"`   // 熔断期间直接返回的状态码，默认503
+}
+
+// provision 填充未配置的默认值
+func (c *CircuitBreaker) provision() {
+	if c.ErrorPercent <= 0 {
+		c.ErrorPercent = defaultBreakerPercent
+	}
+	if c.Window <= 0 {
+		c.Window = caddy.Duration(defaultBreakerWindow)
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultBreakerMinRequests
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = caddy.Duration(defaultBreakerCooldown)
+	}
+	if c.StatusCode == 0 {
+		c.StatusCode = http.StatusServiceUnavailable
+	}
+}
+
+// breakerState 是熔断器的状态
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // 正常轮换并统计失败率
+	breakerOpen                         // 熔断中，请求被直接拒绝或放行
+	breakerHalfOpen                     // 冷却结束，放行一个探测请求决定是否恢复
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// breakerBucket 是滚动窗口中的一个桶
+type breakerBucket struct {
+	slot     int64 // 桶对应的时间片编号
+	total    int
+	failures int
+}
+
+// breaker 实现熔断器的状态机
+type breaker struct {
+	config *CircuitBreaker
+	logger *zap.Logger
+
+	mu         sync.Mutex
+	state      breakerState
+	buckets    [breakerBuckets]breakerBucket
+	openedAt   time.Time
+	probing    bool      // 半开状态下是否已有探测请求
+	probeStart time.Time // 探测请求开始的时间，探测请求没有结果时超过冷却时长后允许新的探测
+}
+
+func newBreaker(config *CircuitBreaker, logger *zap.Logger) *breaker {
+	return &breaker{config: config, logger: logger}
+}
+
+// slotWidth 返回每个桶覆盖的时长
+func (b *breaker) slotWidth() time.Duration {
+	width := time.Duration(b.config.Window) / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return width
+}
+
+// allow 判断当前请求是否可以正常轮换
+func (b *breaker) allow(now time.Time) bool {
+	cooldown := time.Duration(b.config.Cooldown)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		if b.probing && now.Sub(b.probeStart) < cooldown {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	b.probeStart = now
+	return true
+}
+
+// record 记录一次请求的结果并推进状态机
+func (b *breaker) record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.trip(now)
+			return
+		}
+		b.buckets = [breakerBuckets]breakerBucket{}
+		b.setState(breakerClosed)
+	case breakerOpen:
+		// 熔断前已经放行的请求，结果不再计入
+	default:
+		slot := now.UnixNano() / int64(b.slotWidth())
+		bucket := &b.buckets[slot%breakerBuckets]
+		if bucket.slot != slot {
+			*bucket = breakerBucket{slot: slot}
+		}
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+		total, failures := b.countLocked(slot)
+		if total >= b.config.MinRequests && float64(failures)*100 >= b.config.ErrorPercent*float64(total) {
+			b.trip(now)
+		}
+	}
+}
+
+// countLocked 汇总滚动窗口内的请求数和失败数，调用方需持有mu
+func (b *breaker) countLocked(slot int64) (int, int) {
+	total, failures := 0, 0
+	for _, bucket := range b.buckets {
+		if slot-bucket.slot < breakerBuckets {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+	return total, failures
+}
+
+// trip 进入熔断状态，调用方需持有mu
+func (b *breaker) trip(now time.Time) {
+	b.openedAt = now
+	b.setState(breakerOpen)
+}
+
+// setState 切换状态并记录日志，调用方需持有mu
+func (b *breaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	b.logger.Warn("Circuit breaker state changed",
+		zap.Stringer("from", b.state), zap.Stringer("to", state))
+	b.state = state
+}
+
+// retryAfter 返回熔断还将持续的秒数，至少为1
+func (b *breaker) retryAfter(now time.Time) int {
+	b.mu.Lock()
+	remaining := time.Duration(b.config.Cooldown) - now.Sub(b.openedAt)
+	b.mu.Unlock()
+	return int(math.Max(1, math.Ceil(remaining.Seconds())))
+}
+
+// requestFailed 判断下游结果是否计为熔断器的一次失败：密钥失败或上游5xx
+func requestFailed(status int) bool {
+	return keyFailed(status) || status >= 500
+}
+
+// respondOpen 处理熔断期间的请求：passthrough时原样放行，否则直接返回并带上Retry-After
+func (a *AuthModifier) respondOpen(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if a.CircuitBreaker.Passthrough {
+		return next.ServeHTTP(w, r)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(a.breaker.retryAfter(time.Now())))
+	w.WriteHeader(a.CircuitBreaker.StatusCode)
+	return nil
+}
@@ -0,0 +1,142 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// testBreaker 返回窗口10s、至少4个请求、失败率50%时熔断并冷却30s的熔断器
+func testBreaker() *breaker {
+	config := &CircuitBreaker{ErrorPercent: 50, Window: caddy.Duration(10 * time.Second), MinRequests: 4, Cooldown: caddy.Duration(30 * time.Second)}
+	config.provision()
+	return newBreaker(config, zap.NewNop())
+}
+
+// stateOf 在锁内读取熔断器的状态
+func stateOf(b *breaker) breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := testBreaker()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 请求数未达到min_requests时不熔断
+	for i := 0; i < 3; i++ {
+		b.record(true, now)
+	}
+	if stateOf(b) != breakerClosed {
+		t.Fatalf("请求数不足时状态 = %v", stateOf(b))
+	}
+	b.record(true, now)
+	if stateOf(b) != breakerOpen {
+		t.Fatalf("失败率超过阈值后状态 = %v, 期望 open", stateOf(b))
+	}
+	if b.allow(now.Add(29 * time.Second)) {
+		t.Fatal("冷却期内应拒绝请求")
+	}
+	if got := b.retryAfter(now.Add(29*time.Second + time.Millisecond)); got != 1 {
+		t.Errorf("retryAfter = %d, 期望 1", got)
+	}
+
+	// 冷却结束后只放行一个探测请求
+	probe := now.Add(30 * time.Second)
+	if !b.allow(probe) || stateOf(b) != breakerHalfOpen {
+		t.Fatalf("冷却结束后应放行探测请求, 状态 = %v", stateOf(b))
+	}
+	if b.allow(probe.Add(time.Second)) {
+		t.Fatal("探测请求未结束时应拒绝其他请求")
+	}
+	b.record(true, probe.Add(time.Second))
+	if stateOf(b) != breakerOpen {
+		t.Fatalf("探测失败后状态 = %v, 期望 open", stateOf(b))
+	}
+
+	probe = probe.Add(31 * time.Second)
+	if !b.allow(probe) {
+		t.Fatal("再次冷却结束后应放行探测请求")
+	}
+	b.record(false, probe)
+	if stateOf(b) != breakerClosed {
+		t.Fatalf("探测成功后状态 = %v, 期望 closed", stateOf(b))
+	}
+	// 恢复后重新统计，之前的失败不再计入
+	b.record(true, probe)
+	if stateOf(b) != breakerClosed || !b.allow(probe) {
+		t.Errorf("恢复后状态 = %v", stateOf(b))
+	}
+}
+
+func TestBreakerStuckProbe(t *testing.T) {
+	b := testBreaker()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		b.record(true, now)
+	}
+	probe := now.Add(30 * time.Second)
+	if !b.allow(probe) {
+		t.Fatal("冷却结束后应放行探测请求")
+	}
+	// 探测请求一直没有结果时，超过冷却时长后允许新的探测
+	if !b.allow(probe.Add(30 * time.Second)) {
+		t.Error("探测请求超时后应允许新的探测")
+	}
+}
+
+func TestBreakerRollingWindow(t *testing.T) {
+	b := testBreaker()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.record(true, now)
+	b.record(true, now)
+	// 窗口之外的失败不再计入
+	later := now.Add(11 * time.Second)
+	b.record(false, later)
+	b.record(true, later)
+	b.record(false, later)
+	if stateOf(b) != breakerClosed {
+		t.Fatalf("过期的失败仍被计入, 状态 = %v", stateOf(b))
+	}
+	b.record(true, later)
+	if stateOf(b) != breakerOpen {
+		t.Errorf("窗口内失败率50%%时状态 = %v, 期望 open", stateOf(b))
+	}
+}
+
+func TestBreakerRespondOpen(t *testing.T) {
+	for _, c := range []struct {
+		block  string
+		status int
+		header string
+	}{
+		{"status_code 502", http.StatusBadGateway, "k1,k2"},
+		{"passthrough", http.StatusOK, "k1,k2"},
+	} {
+		a := newTestHandler(t, "", "circuit_breaker {\nmin_requests 2\ncooldown 1m\n"+c.block+"\n}")
+		for i := 0; i < 2; i++ {
+			serveTest(t, a, authRequest("/v1", "k1,k2"), http.StatusInternalServerError)
+		}
+		next, seen := countingNext(http.StatusOK)
+		w := httptest.NewRecorder()
+		if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2"), next); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != c.status {
+			t.Errorf("%q: 状态码 = %d, 期望 %d", c.block, w.Code, c.status)
+		}
+		if c.status == http.StatusOK {
+			// 熔断期间原样放行，不轮换密钥
+			if len(*seen) != 1 || (*seen)[0] != c.header {
+				t.Errorf("%q: 下游看到 %v", c.block, *seen)
+			}
+		} else if len(*seen) != 0 || w.Header().Get("Retry-After") != "60" {
+			t.Errorf("%q: 转发了 %v, Retry-After = %q", c.block, *seen, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package auth_modifier
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// parseTest 解析一段Caddyfile指令并返回解析出的处理器
+func parseTest(t *testing.T, input string) *AuthModifier {
+	t.Helper()
+	a := new(AuthModifier)
+	if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	return a
+}
+
+func TestUnmarshalDrainTrackInFlight(t *testing.T) {
+	a := parseTest(t, `auth_modifier auth/index.json {
+		circuit_breaker {
+			error_percent 50
+			cooldown 10s
+		}
+		drain ab12 cd34
+		drain ef56
+		track_in_flight
+	}`)
+	if want := []string{"ab12", "cd34", "ef56"}; len(a.Drain) != len(want) || a.Drain[0] != want[0] || a.Drain[2] != want[2] {
+		t.Errorf("Drain = %v, 期望 %v", a.Drain, want)
+	}
+	if !a.TrackInFlight {
+		t.Error("TrackInFlight 未设置")
+	}
+	if a.CircuitBreaker == nil || a.CircuitBreaker.Cooldown == 0 {
+		t.Errorf("circuit_breaker cooldown 丢失: %+v", a.CircuitBreaker)
+	}
+}
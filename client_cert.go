@@ -0,0 +1,53 @@
+package auth_modifier
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ClientCertCtxKey 是请求上下文中存放本次选中客户端证书的键，
+// 值的类型为 *tls.Certificate，供自定义的 reverse_proxy transport 读取。
+const ClientCertCtxKey caddy.CtxKey = "auth_modifier_client_cert"
+
+// ClientCert 描述一对用于双向TLS的证书和私钥文件
+type ClientCert struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// loadClientCerts 在Provision阶段加载所有配置的客户端证书
+func (a *AuthModifier) loadClientCerts() error {
+	a.certs = make([]tls.Certificate, 0, len(a.ClientCerts))
+	for _, cc := range a.ClientCerts {
+		cert, err := tls.LoadX509KeyPair(cc.Certificate, cc.Key)
+		if err != nil {
+			return fmt.Errorf("%w %s: %v", ErrClientCert, cc.Certificate, err)
+		}
+		a.certs = append(a.certs, cert)
+	}
+	return nil
+}
+
+// withClientCert 选出与本次所选密钥下标相同的客户端证书并放入请求上下文，
+// 使证书在任何策略下都与密钥成对。没有轮换任何密钥（如灰度请求或只配置了证书）时按索引选择
+func (a *AuthModifier) withClientCert(r *http.Request, index uint64, rotations []rotation) *http.Request {
+	if len(a.certs) == 0 {
+		return r
+	}
+	pos := a.selectIndex(index, len(a.certs))
+	if len(rotations) > 0 && rotations[0].pos >= 0 {
+		pos = rotations[0].pos % len(a.certs)
+	}
+	cert := &a.certs[pos]
+	return r.WithContext(context.WithValue(r.Context(), ClientCertCtxKey, cert))
+}
+
+// ClientCertificate 返回auth_modifier为该请求选中的客户端证书
+func ClientCertificate(r *http.Request) (*tls.Certificate, bool) {
+	cert, ok := r.Context().Value(ClientCertCtxKey).(*tls.Certificate)
+	return cert, ok
+}
@@ -0,0 +1,89 @@
+package auth_modifier
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// writeTestCert 在dir中生成一张自签名证书，返回client_cert指令的参数和证书的DER
+func writeTestCert(t *testing.T, dir, name string) (string, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath + " " + keyPath, der
+}
+
+func TestClientCertFollowsSelectedKey(t *testing.T) {
+	for _, strategy := range []string{StrategyRoundRobin, StrategyRandom, StrategyP2C} {
+		t.Run(strategy, func(t *testing.T) {
+			dir := t.TempDir()
+			var block strings.Builder
+			fmt.Fprintf(&block, "strategy %s\n", strategy)
+			ders := make([][]byte, 3)
+			for i := range ders {
+				var args string
+				args, ders[i] = writeTestCert(t, dir, fmt.Sprintf("c%d", i))
+				fmt.Fprintf(&block, "client_cert %s\n", args)
+			}
+			a := newTestHandler(t, "", block.String())
+
+			for i := 0; i < 30; i++ {
+				var token string
+				var cert []byte
+				next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					token = r.Header.Get("Authorization")
+					if c, ok := ClientCertificate(r); ok {
+						cert = c.Certificate[0]
+					}
+					return nil
+				})
+				if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k0,k1,k2"), next); err != nil {
+					t.Fatal(err)
+				}
+				want := ders[token[len(token)-1]-'0']
+				if !bytes.Equal(cert, want) {
+					t.Fatalf("第%d个请求使用密钥 %s 但证书不匹配", i+1, token)
+				}
+			}
+		})
+	}
+}
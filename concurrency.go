@@ -0,0 +1,81 @@
+package auth_modifier
+
+import (
+	"context"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// p2cSelector 实现power of two choices：随机挑选两个不同的密钥，使用处理中请求数较少的一个，
+// 相同时取第一个。只需读取两个计数，开销与random相当，负载却接近最优
+type p2cSelector struct {
+	a *AuthModifier
+}
+
+func (s p2cSelector) Select(ctx context.Context, key string, pool []string) int {
+	if len(pool) < 2 {
+		return 0
+	}
+	i := randIntn(s.a.rnd, len(pool))
+	j := randIntn(s.a.rnd, len(pool)-1)
+	if j >= i {
+		j++
+	}
+	s.a.healthMu.Lock()
+	defer s.a.healthMu.Unlock()
+	if s.a.inFlight[pool[j]] < s.a.inFlight[pool[i]] {
+		return j
+	}
+	return i
+}
+
+// acquireLocked 尝试占用token的一个并发名额，未配置max_in_flight时总是成功，调用方需持有healthMu
+func (a *AuthModifier) acquireLocked(token string) bool {
+	if !a.tracksInFlight() {
+		return true
+	}
+	if a.MaxInFlight > 0 && a.inFlight[token] >= a.MaxInFlight {
+		return false
+	}
+	a.inFlight[token]++
+	return true
+}
+
+// release 归还本次请求占用的并发名额
+func (a *AuthModifier) release(rotations []rotation) {
+	if !a.tracksInFlight() {
+		return
+	}
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+	for _, rot := range rotations {
+		if !rot.acquired {
+			continue
+		}
+		if a.inFlight[rot.token]--; a.inFlight[rot.token] <= 0 {
+			delete(a.inFlight, rot.token)
+		}
+	}
+}
+
+// saturated 判断是否有某个请求头的所有密钥并发都已满
+func (a *AuthModifier) saturated(rotations []rotation) bool {
+	if a.MaxInFlight <= 0 {
+		return false
+	}
+	for _, rot := range rotations {
+		if !rot.acquired && !rot.follower {
+			return true
+		}
+	}
+	return false
+}
+
+// respondSaturated 归还已占用的名额并返回saturated_status，不再转发请求
+func (a *AuthModifier) respondSaturated(w http.ResponseWriter, key string, rotations []rotation) error {
+	a.release(rotations)
+	a.logger.Warn("All keys reached max_in_flight", zap.String("index_key", key))
+	w.WriteHeader(a.SaturatedStatus)
+	return nil
+}
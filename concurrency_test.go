@@ -0,0 +1,155 @@
+package auth_modifier
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// simulateLoad 模拟并发负载：每个时刻到达arrivals个请求，10%的请求占用密钥50个时刻，其余占用1个时刻。
+// pick返回请求使用的下标，返回各时刻负载最重的密钥的处理中请求数的平均值
+func simulateLoad(a *AuthModifier, pool []string, arrivals, steps int, pick func(step int) int) float64 {
+	durations := rand.New(rand.NewSource(7))
+	finish := make(map[int][]string) // 时刻 -> 在该时刻结束的请求所用的密钥
+	total := 0
+	for step := 0; step < steps; step++ {
+		a.healthMu.Lock()
+		for _, token := range finish[step] {
+			a.inFlight[token]--
+		}
+		a.healthMu.Unlock()
+		delete(finish, step)
+		for i := 0; i < arrivals; i++ {
+			token := pool[pick(step*arrivals+i)]
+			d := 1
+			if durations.Intn(10) == 0 {
+				d = 50
+			}
+			a.healthMu.Lock()
+			a.inFlight[token]++
+			a.healthMu.Unlock()
+			finish[step+d] = append(finish[step+d], token)
+		}
+		peak := 0
+		a.healthMu.Lock()
+		for _, token := range pool {
+			if a.inFlight[token] > peak {
+				peak = a.inFlight[token]
+			}
+		}
+		a.healthMu.Unlock()
+		total += peak
+	}
+	return float64(total) / float64(steps)
+}
+
+func TestP2CBalancesConcurrentLoad(t *testing.T) {
+	pool := strings.Split(pool(8), ",")
+	a := newTestHandler(t, "", "strategy p2c")
+	a.rnd = rand.New(rand.NewSource(1))
+	p2c := simulateLoad(a, pool, 4, 2000, func(int) int {
+		return a.selector.Select(context.Background(), "/v1", pool)
+	})
+
+	b := newTestHandler(t, "", "track_in_flight")
+	rr := simulateLoad(b, pool, 4, 2000, func(n int) int { return n % len(pool) })
+	// 平均每个密钥约有3个处理中的请求，p2c应使最重的密钥更接近平均值
+	if p2c >= rr {
+		t.Errorf("p2c 最重密钥的平均负载 %.2f 不低于轮询的 %.2f", p2c, rr)
+	}
+	t.Logf("最重密钥的平均处理中请求数: p2c %.2f, round_robin %.2f", p2c, rr)
+}
+
+func TestP2CAvoidsBusyKey(t *testing.T) {
+	a := newTestHandler(t, "", "strategy p2c")
+	release := make(chan struct{})
+	started := make(chan string)
+	slow := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		started <- r.Header.Get("Authorization")
+		<-release
+		return nil
+	})
+	done := make(chan error)
+	go func() { done <- a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k0,k1"), slow) }()
+	busy := <-started
+
+	// 只有两个密钥时两个都会被挑中，总是使用空闲的一个
+	for i := 0; i < 5; i++ {
+		seen, _ := serveTest(t, a, authRequest("/v1", "k0,k1"), http.StatusOK)
+		if got := seen.Get("Authorization"); got == busy {
+			t.Errorf("第%d次请求选中了处理中的 %s", i, busy)
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	a.healthMu.Lock()
+	inFlight := a.inFlight[busy]
+	a.healthMu.Unlock()
+	if inFlight != 0 {
+		t.Errorf("请求结束后 %s 处理中的请求数 = %d", busy, inFlight)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	for _, c := range []struct {
+		block  string
+		status int
+	}{
+		{"", http.StatusServiceUnavailable},
+		{"\nsaturated_status 429", http.StatusTooManyRequests},
+	} {
+		a := newTestHandler(t, "", "strategy failover\nmax_in_flight 1"+c.block)
+		release := make(chan struct{})
+		started := make(chan string)
+		slow := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			started <- r.Header.Get("Authorization")
+			<-release
+			return nil
+		})
+		done := make(chan error)
+		for i := 0; i < 2; i++ {
+			go func() { done <- a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k0,k1"), slow) }()
+		}
+		// 第一个密钥的名额已满时顺延到下一个密钥
+		if first, second := <-started, <-started; first == second {
+			t.Errorf("两个处理中的请求都使用了 %s", first)
+		}
+
+		// 所有密钥都已满时直接返回saturated_status，不再转发
+		forwarded := false
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			forwarded = true
+			return nil
+		})
+		w := httptest.NewRecorder()
+		if err := a.ServeHTTP(w, authRequest("/v1", "k0,k1"), next); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != c.status || forwarded {
+			t.Errorf("%q: 状态码 = %d, 转发 = %v, 期望 %d", c.block, w.Code, forwarded, c.status)
+		}
+
+		close(release)
+		for i := 0; i < 2; i++ {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 名额归还后恢复使用第一个密钥
+		if seen, _ := serveTest(t, a, authRequest("/v1", "k0,k1"), http.StatusOK); seen.Get("Authorization") != "k0" {
+			t.Errorf("名额归还后 Authorization = %q, 期望 k0", seen.Get("Authorization"))
+		}
+		a.healthMu.Lock()
+		if len(a.inFlight) != 0 {
+			t.Errorf("请求结束后仍有处理中的请求: %v", a.inFlight)
+		}
+		a.healthMu.Unlock()
+	}
+}
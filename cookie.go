@@ -0,0 +1,70 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cookieDelimiter 是同一个Cookie值中多个密钥之间的分隔符
+const cookieDelimiter = ","
+
+// findCookie 在Cookie请求头中查找名为cookie_name的Cookie，
+// 返回其所在的请求头行、该行按分号拆开的各段、所在段的下标和去掉引号的值
+func (a *AuthModifier) findCookie(r *http.Request) (line int, parts []string, part int, value string, ok bool) {
+	// HTTP/2下Cookie可能被拆成多个请求头行
+	for i, l := range r.Header["Cookie"] {
+		segments := strings.Split(l, ";")
+		for j, segment := range segments {
+			s := strings.TrimSpace(segment)
+			eq := strings.IndexByte(s, '=')
+			if eq < 0 || s[:eq] != a.CookieName {
+				continue
+			}
+			v := s[eq+1:]
+			if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+				v = v[1 : len(v)-1]
+			}
+			return i, segments, j, v, true
+		}
+	}
+	return 0, nil, 0, "", false
+}
+
+// hasMultipleCookieTokens 判断配置的Cookie是否携带了多个密钥
+func (a *AuthModifier) hasMultipleCookieTokens(r *http.Request) bool {
+	if len(a.CookieName) == 0 {
+		return false
+	}
+	_, _, _, value, ok := a.findCookie(r)
+	return ok && strings.Contains(value, cookieDelimiter)
+}
+
+// rotateCookie 按索引从配置的Cookie携带的多个密钥中选出一个写回，
+// 其余Cookie保持原样，请求未携带该Cookie或其中只有一个密钥时返回false
+func (a *AuthModifier) rotateCookie(r *http.Request, key string, index uint64) (rotation, bool) {
+	if len(a.CookieName) == 0 {
+		return rotation{}, false
+	}
+	line, parts, part, value, ok := a.findCookie(r)
+	if !ok || !strings.Contains(value, cookieDelimiter) {
+		return rotation{}, false
+	}
+	pool := strings.Split(value, cookieDelimiter)
+	if a.CollapseDuplicates {
+		pool, _ = collapseDuplicates(pool, nil)
+	}
+	perm := a.shufflePerm(len(pool))
+	if perm != nil {
+		pool = permute(pool, perm)
+	}
+	tokens := a.stripWeights(pool)
+	pos, acquired := a.pickLive(r, tokens, a.choose(r, key, index, pool))
+	token := tokens[pos]
+	// 保留原有的前导空格，只替换这一个Cookie的值
+	segment := parts[part]
+	lead := segment[:len(segment)-len(strings.TrimLeft(segment, " "))]
+	parts[part] = lead + a.CookieName + "=" + token
+	r.Header["Cookie"][line] = strings.Join(parts, ";")
+	a.logRotation("Cookie "+a.CookieName, token)
+	return rotation{header: "Cookie", token: token, pos: originalPos(perm, pos), length: len(tokens), tokens: tokens, acquired: acquired, pool: "cookie"}, true
+}
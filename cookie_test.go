@@ -0,0 +1,59 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func cookieRequest(lines ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/cookie", nil)
+	for _, l := range lines {
+		r.Header.Add("Cookie", l)
+	}
+	return r
+}
+
+func TestRotateCookieAmongOtherCookies(t *testing.T) {
+	a := newTestHandler(t, "", "cookie_name session")
+	want := []string{
+		"a=1; session=t1; b=2",
+		"a=1; session=t2; b=2",
+		"a=1; session=t3; b=2",
+		"a=1; session=t1; b=2",
+	}
+	for i, w := range want {
+		seen, _ := serveTest(t, a, cookieRequest("a=1; session=t1,t2,t3; b=2"), http.StatusOK)
+		if got := seen.Get("Cookie"); got != w {
+			t.Errorf("第%d次请求 Cookie = %q, 期望 %q", i, got, w)
+		}
+	}
+}
+
+func TestRotateCookieOnSecondHeaderLine(t *testing.T) {
+	a := newTestHandler(t, "", "cookie_name session")
+	seen, _ := serveTest(t, a, cookieRequest("a=1", "b=2;session=t1,t2"), http.StatusOK)
+	got := seen.Values("Cookie")
+	if len(got) != 2 || got[0] != "a=1" || got[1] != "b=2;session=t1" {
+		t.Errorf("Cookie = %q", got)
+	}
+}
+
+func TestRotateCookieQuotedValue(t *testing.T) {
+	a := newTestHandler(t, "", "cookie_name session")
+	serveTest(t, a, cookieRequest(`session="t1,t2"`), http.StatusOK)
+	seen, _ := serveTest(t, a, cookieRequest(`session="t1,t2"`), http.StatusOK)
+	if got := seen.Get("Cookie"); got != "session=t2" {
+		t.Errorf("Cookie = %q, 期望 session=t2", got)
+	}
+}
+
+func TestRotateCookieLeavesSingleToken(t *testing.T) {
+	a := newTestHandler(t, "", "cookie_name session")
+	for _, c := range []string{"a=1; session=t1; b=2", "a=1,2; b=2", "sessionx=t1,t2"} {
+		seen, _ := serveTest(t, a, cookieRequest(c), http.StatusOK)
+		if got := seen.Get("Cookie"); got != c {
+			t.Errorf("Cookie = %q, 期望保持 %q", got, c)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package auth_modifier
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// decision 是一次轮换决定，Key只记录keyLabel
+type decision struct {
+	Seq      uint64    `json:"-"` // 写入顺序，用于识别被覆盖的槽位
+	Time     time.Time `json:"ts"`
+	Strategy string    `json:"strategy"`
+	IndexKey string    `json:"index_key"`
+	Header   string    `json:"header"`
+	Key      string    `json:"key"`
+	Index    int       `json:"index"`
+	Canary   bool      `json:"canary,omitempty"`
+}
+
+// decisionRing 是固定大小的环形缓冲区，保存最近的轮换决定。
+// 写入只需一次原子加法领取槽位和一次原子存储，不加锁，满了以后覆盖最旧的记录
+type decisionRing struct {
+	next  uint64         // 下一条记录的序号，原子操作
+	slots []atomic.Value // *decision
+}
+
+func newDecisionRing(size int) *decisionRing {
+	return &decisionRing{slots: make([]atomic.Value, size)}
+}
+
+// record 写入一条记录
+func (d *decisionRing) record(entry decision) {
+	seq := atomic.AddUint64(&d.next, 1) - 1
+	entry.Seq = seq
+	d.slots[seq%uint64(len(d.slots))].Store(&entry)
+}
+
+// snapshot 返回缓冲区中的记录，从旧到新排列。读取期间被新记录覆盖的槽位会被跳过
+func (d *decisionRing) snapshot() []decision {
+	end := atomic.LoadUint64(&d.next)
+	start := uint64(0)
+	if size := uint64(len(d.slots)); end > size {
+		start = end - size
+	}
+	entries := make([]decision, 0, end-start)
+	for seq := start; seq < end; seq++ {
+		entry, _ := d.slots[seq%uint64(len(d.slots))].Load().(*decision)
+		if entry != nil && entry.Seq == seq {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// recordDecision 在配置了decision_buffer时记录本次轮换决定
+func (a *AuthModifier) recordDecision(key, label string, rot rotation) {
+	if a.decisions == nil {
+		return
+	}
+	a.decisions.record(decision{
+		Time:     time.Now(),
+		Strategy: a.strategyLabel(),
+		IndexKey: key,
+		Header:   rot.header,
+		Key:      label,
+		Index:    rot.pos,
+		Canary:   rot.canary,
+	})
+}
+
+// recentDecisions 汇总共享索引上所有处理器最近的轮换决定，按时间从新到旧排列，最多limit条
+func (f *indexFile) recentDecisions(limit int) []decision {
+	f.drainMu.Lock()
+	var entries []decision
+	for a := range f.handlers {
+		if a.decisions != nil {
+			entries = append(entries, a.decisions.snapshot()...)
+		}
+	}
+	f.drainMu.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []decision{}
+	}
+	return entries
+}
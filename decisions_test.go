@@ -0,0 +1,113 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDecisionRingOverwritesOldest(t *testing.T) {
+	ring := newDecisionRing(3)
+	if got := ring.snapshot(); len(got) != 0 {
+		t.Fatalf("空缓冲区 = %v", got)
+	}
+	ring.record(decision{Index: 0})
+	ring.record(decision{Index: 1})
+	if got := ring.snapshot(); len(got) != 2 || got[0].Index != 0 || got[1].Index != 1 {
+		t.Errorf("未满时 = %+v", got)
+	}
+	for i := 2; i < 5; i++ {
+		ring.record(decision{Index: i})
+	}
+	// 只保留最近的3条，从旧到新排列
+	got := ring.snapshot()
+	if len(got) != 3 {
+		t.Fatalf("缓冲区中有 %d 条记录, 期望 3", len(got))
+	}
+	for i, entry := range got {
+		if entry.Index != i+2 || entry.Seq != uint64(i+2) {
+			t.Errorf("第%d条 = %+v, 期望第 %d 次的决定", i, entry, i+2)
+		}
+	}
+}
+
+func TestDecisionRingConcurrent(t *testing.T) {
+	ring := newDecisionRing(16)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ring.record(decision{Index: i})
+			}
+		}()
+	}
+	wg.Wait()
+	got := ring.snapshot()
+	if len(got) != 16 {
+		t.Fatalf("缓冲区中有 %d 条记录, 期望 16", len(got))
+	}
+	for i, entry := range got {
+		if entry.Seq != uint64(800-16+i) {
+			t.Errorf("第%d条的序号 = %d, 期望 %d", i, entry.Seq, 800-16+i)
+		}
+	}
+}
+
+func TestAdminDecisions(t *testing.T) {
+	a := newTestHandler(t, "", "decision_buffer 3")
+	keys := "sk-test-0000,sk-test-1111,sk-test-2222,sk-test-3333,sk-test-4444"
+	rotatedSequence(t, a, "/v1", keys, 5)
+	api := new(AdminAPI)
+
+	decisions := func(query string) []decision {
+		t.Helper()
+		w, status := adminRequest(t, api.handleDecisions, http.MethodGet, "/auth_modifier/decisions"+query, "")
+		if status != http.StatusOK {
+			t.Fatalf("状态码 = %d", status)
+		}
+		var resp decisionsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Decisions
+	}
+	// 从新到旧排列，最旧的两次决定已被覆盖，日志中的密钥只记录标签
+	got := decisions("")
+	if len(got) != 3 {
+		t.Fatalf("决定 = %+v, 期望 3 条", got)
+	}
+	for i, entry := range got {
+		want := 4 - i
+		if entry.Index != want || entry.Key != "****"+strings.Repeat(strconv.Itoa(want), 4) ||
+			entry.IndexKey != "/v1" || entry.Header != "Authorization" || entry.Strategy != StrategyRoundRobin || entry.Time.IsZero() {
+			t.Errorf("第%d条 = %+v", i, entry)
+		}
+	}
+	if got := decisions("?limit=1"); len(got) != 1 || got[0].Index != 4 {
+		t.Errorf("limit=1 = %+v", got)
+	}
+	if _, status := adminRequest(t, api.handleDecisions, http.MethodPost, "/auth_modifier/decisions", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST: 状态码 = %d, 期望 405", status)
+	}
+}
+
+func TestAdminDecisionsDisabled(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	rotatedSequence(t, a, "/v1", pool(3), 2)
+	if a.decisions != nil {
+		t.Fatal("未配置decision_buffer时不应分配缓冲区")
+	}
+	w, _ := adminRequest(t, new(AdminAPI).handleDecisions, http.MethodGet, "/auth_modifier/decisions", "")
+	var resp decisionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Decisions == nil || len(resp.Decisions) != 0 {
+		t.Errorf("决定 = %v, 期望空数组", resp.Decisions)
+	}
+}
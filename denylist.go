@@ -0,0 +1,134 @@
+package auth_modifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// denylist 是从文件加载的吊销密钥集合，文件变化时自动重新加载
+type denylist struct {
+	path         string
+	keys         atomic.Value // map[string]struct{}
+	fingerprints int32        // 列表中fp:条目的数量，原子操作，为0时不计算指纹
+	logger       *zap.Logger
+}
+
+// fingerprintPrefix 是吊销列表中按指纹而不是密钥原文吊销的条目前缀，指纹见keyID
+const fingerprintPrefix = "fp:"
+
+// newDenylist 加载吊销列表文件，并在ctx结束前持续监视其变化。
+// 首次加载失败直接返回错误，之后的加载失败只记录日志并保留上一次的列表。
+func newDenylist(ctx context.Context, path string, logger *zap.Logger) (*denylist, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &denylist{path: abs, logger: logger}
+	keys, err := readDenylist(abs)
+	if err != nil {
+		return nil, err
+	}
+	d.store(keys)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// 监视所在目录而不是文件本身，编辑器和配置管理工具通常以重命名的方式替换文件
+	if err := watcher.Add(filepath.Dir(abs)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go d.watch(ctx, watcher)
+	return d, nil
+}
+
+// watch 在文件被写入、创建或替换时重新加载
+func (d *denylist) watch(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) == d.path && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				d.reload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			d.logger.Warn("Error watching denylist", zap.String("path", d.path), zap.Error(err))
+		}
+	}
+}
+
+// reload 重新读取文件，成功后整体替换内存中的集合
+func (d *denylist) reload() {
+	keys, err := readDenylist(d.path)
+	if err != nil {
+		d.logger.Error("Error reloading denylist, keeping the previous list", zap.String("path", d.path), zap.Error(err))
+		return
+	}
+	d.store(keys)
+	d.logger.Info("Denylist reloaded", zap.String("path", d.path), zap.Int("keys", len(keys)))
+}
+
+// store 整体替换内存中的集合，并统计其中fp:条目的数量
+func (d *denylist) store(keys map[string]struct{}) {
+	n := int32(0)
+	for key := range keys {
+		if strings.HasPrefix(key, fingerprintPrefix) {
+			n++
+		}
+	}
+	d.keys.Store(keys)
+	atomic.StoreInt32(&d.fingerprints, n)
+}
+
+// contains 判断token（或fp:加指纹）是否已被吊销
+func (d *denylist) contains(token string) bool {
+	_, ok := d.keys.Load().(map[string]struct{})[token]
+	return ok
+}
+
+// hasFingerprints 判断列表中是否有按指纹吊销的条目
+func (d *denylist) hasFingerprints() bool {
+	return atomic.LoadInt32(&d.fingerprints) > 0
+}
+
+// readDenylist 读取每行一个密钥（或fp:加指纹）的文件，忽略空行和#开头的注释行
+func readDenylist(path string) (map[string]struct{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		key := strings.TrimSpace(scanner.Text())
+		if len(key) == 0 || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: key must not contain whitespace", path, line)
+		}
+		keys[key] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,61 @@
+package auth_modifier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor 轮询cond直到返回true，超时则测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDenylistReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "denylist.txt")
+	if err := os.WriteFile(path, []byte("# 已吊销\nk2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestHandler(t, "", "denylist "+path)
+	for _, token := range rotatedSequence(t, a, "/v1", "k1,k2,k3", 6) {
+		if token == "k2" {
+			t.Fatal("不应选中已吊销的 k2")
+		}
+	}
+
+	// 以重命名的方式替换文件，与配置管理工具的做法相同
+	tmp := filepath.Join(dir, "denylist.tmp")
+	if err := os.WriteFile(tmp, []byte("k1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "吊销列表重新加载", func() bool { return a.denied.contains("k1") })
+	if a.denied.contains("k2") {
+		t.Error("重新加载后 k2 应已恢复")
+	}
+	for _, token := range rotatedSequence(t, a, "/v1", "k1,k2,k3", 6) {
+		if token == "k1" {
+			t.Fatal("重新加载后不应选中 k1")
+		}
+	}
+
+	// 解析失败时保留上一次成功加载的列表
+	if err := os.WriteFile(path, []byte("bad key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.denied.reload()
+	if !a.denied.contains("k1") {
+		t.Error("解析失败后应保留之前的列表")
+	}
+}
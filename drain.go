@@ -0,0 +1,119 @@
+package auth_modifier
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// buildDrain 整理drain配置的密钥指纹
+func (a *AuthModifier) buildDrain() {
+	if len(a.Drain) == 0 {
+		return
+	}
+	a.drain = make(map[string]struct{}, len(a.Drain))
+	for _, fingerprint := range a.Drain {
+		a.drain[strings.ToLower(fingerprint)] = struct{}{}
+	}
+}
+
+// tracksInFlight 判断是否统计每个密钥处理中的请求数。
+// 配置了max_in_flight、track_in_flight、drain或使用p2c策略时统计，排空的进度和p2c的选择依赖这一统计
+func (a *AuthModifier) tracksInFlight() bool {
+	return a.MaxInFlight > 0 || a.TrackInFlight || len(a.drain) > 0 || a.Strategy == StrategyP2C
+}
+
+// hasDraining 判断当前是否有排空中的密钥，不加锁，用于跳过快速路径
+func (a *AuthModifier) hasDraining() bool {
+	return len(a.drain) > 0 || (a.indexFile != nil && atomic.LoadInt32(&a.indexFile.drainingCount) > 0)
+}
+
+// isDraining 判断token是否正在排空：由drain配置，或通过管理接口标记在共享索引上
+func (a *AuthModifier) isDraining(token string) bool {
+	if !a.hasDraining() {
+		return false
+	}
+	h := a.keyID(token)
+	if _, ok := a.drain[h]; ok {
+		return true
+	}
+	return a.indexFile.isDraining(h)
+}
+
+// setDraining 通过管理接口标记或取消标记某个密钥指纹的排空状态
+func (f *indexFile) setDraining(fingerprint string, draining bool) {
+	f.drainMu.Lock()
+	defer f.drainMu.Unlock()
+	if draining {
+		f.draining[fingerprint] = struct{}{}
+	} else {
+		delete(f.draining, fingerprint)
+	}
+	atomic.StoreInt32(&f.drainingCount, int32(len(f.draining)))
+}
+
+func (f *indexFile) isDraining(fingerprint string) bool {
+	f.drainMu.Lock()
+	defer f.drainMu.Unlock()
+	_, ok := f.draining[fingerprint]
+	return ok
+}
+
+// register 记录使用该共享索引的处理器，管理接口据此汇总各密钥处理中的请求数
+func (f *indexFile) register(a *AuthModifier) {
+	f.drainMu.Lock()
+	f.handlers[a] = struct{}{}
+	f.drainMu.Unlock()
+}
+
+func (f *indexFile) unregister(a *AuthModifier) {
+	f.drainMu.Lock()
+	delete(f.handlers, a)
+	f.drainMu.Unlock()
+}
+
+// drainedKey 是排空中的一个密钥的状态
+type drainedKey struct {
+	Fingerprint string `json:"fingerprint"`
+	InFlight    int    `json:"in_flight"` // 各处理器中仍在处理的请求数之和
+	Tracked     bool   `json:"tracked"`   // 是否有处理器统计了处理中的请求数，为false时in_flight没有意义
+	Drained     bool   `json:"drained"`   // 已统计且没有处理中的请求，可以安全移除
+}
+
+// drainStatus 汇总共享索引上所有排空中的密钥（包括各处理器drain配置的密钥）及其处理中的请求数
+func (f *indexFile) drainStatus() []drainedKey {
+	f.drainMu.Lock()
+	fingerprints := make(map[string]struct{}, len(f.draining))
+	for fingerprint := range f.draining {
+		fingerprints[fingerprint] = struct{}{}
+	}
+	handlers := make([]*AuthModifier, 0, len(f.handlers))
+	for a := range f.handlers {
+		handlers = append(handlers, a)
+		for fingerprint := range a.drain {
+			fingerprints[fingerprint] = struct{}{}
+		}
+	}
+	f.drainMu.Unlock()
+
+	inFlight := make(map[string]int)
+	tracked := false
+	for _, a := range handlers {
+		if !a.tracksInFlight() {
+			continue
+		}
+		tracked = true
+		a.healthMu.Lock()
+		for token, n := range a.inFlight {
+			inFlight[a.keyID(token)] += n
+		}
+		a.healthMu.Unlock()
+	}
+	keys := make([]drainedKey, 0, len(fingerprints))
+	for fingerprint := range fingerprints {
+		n := inFlight[fingerprint]
+		keys = append(keys, drainedKey{Fingerprint: fingerprint, InFlight: n, Tracked: tracked, Drained: tracked && n == 0})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Fingerprint < keys[j].Fingerprint })
+	return keys
+}
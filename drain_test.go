@@ -0,0 +1,117 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestDrainConfiguredKeySkipped(t *testing.T) {
+	a := newTestHandler(t, "", "drain "+tokenHash("k2"))
+	got := rotatedSequence(t, a, "/v1", "k1,k2,k3", 6)
+	for _, token := range got {
+		if token == "k2" {
+			t.Fatalf("排空中的密钥被选中: %v", got)
+		}
+	}
+	// 排空不是失败，不会隔离密钥
+	a.indexFile.quarantine.mu.Lock()
+	_, quarantined := a.indexFile.quarantine.entries["k2"]
+	a.indexFile.quarantine.mu.Unlock()
+	if quarantined {
+		t.Error("排空中的密钥不应被隔离")
+	}
+}
+
+// drainStatusOf 通过管理接口查询排空状态
+func drainStatusOf(t *testing.T, api *AdminAPI, path string) []drainedKey {
+	t.Helper()
+	w, status := adminRequest(t, api.handleDrain, http.MethodGet, "/auth_modifier/drain?index_file="+path, "")
+	if status != http.StatusOK {
+		t.Fatalf("GET drain: 状态码 = %d", status)
+	}
+	var resp drainResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Draining
+}
+
+func TestDrainViaAdminWaitsForInFlight(t *testing.T) {
+	a := newTestHandler(t, "", "track_in_flight")
+	api := new(AdminAPI)
+	started, release := make(chan struct{}), make(chan struct{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("Authorization") == "k2" {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k1,k2,k3"), next) }()
+	<-started
+
+	fingerprint := tokenHash("k2")
+	body := `{"index_file": "` + a.IndexPath + `", "fingerprint": "` + fingerprint + `", "draining": true}`
+	if _, status := adminRequest(t, api.handleDrain, http.MethodPost, "/auth_modifier/drain", body); status != http.StatusOK {
+		t.Fatalf("POST drain: 状态码 = %d", status)
+	}
+	want := drainedKey{Fingerprint: fingerprint, InFlight: 1, Tracked: true}
+	if got := drainStatusOf(t, api, a.IndexPath); len(got) != 1 || got[0] != want {
+		t.Errorf("排空状态 = %+v, 期望 %+v", got, want)
+	}
+	// 已在处理中的请求照常完成，新的请求不再选中该密钥
+	for _, token := range rotatedSequence(t, a, "/v1", "k1,k2,k3", 4) {
+		if token == "k2" {
+			t.Fatal("排空中的密钥被选中")
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	want.InFlight, want.Drained = 0, true
+	if got := drainStatusOf(t, api, a.IndexPath); len(got) != 1 || got[0] != want {
+		t.Errorf("排空状态 = %+v, 期望 %+v", got, want)
+	}
+
+	// 取消排空后重新参与选择
+	body = `{"index_file": "` + a.IndexPath + `", "fingerprint": "` + fingerprint + `", "draining": false}`
+	if _, status := adminRequest(t, api.handleDrain, http.MethodPost, "/auth_modifier/drain", body); status != http.StatusOK {
+		t.Fatalf("POST drain: 状态码 = %d", status)
+	}
+	if got := drainStatusOf(t, api, a.IndexPath); len(got) != 0 {
+		t.Errorf("取消后排空状态 = %+v", got)
+	}
+	selected := false
+	for _, token := range rotatedSequence(t, a, "/v1", "k1,k2,k3", 3) {
+		selected = selected || token == "k2"
+	}
+	if !selected {
+		t.Error("取消排空后密钥应重新被选中")
+	}
+}
+
+func TestDrainAdminInvalid(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	api := new(AdminAPI)
+	for name, body := range map[string]string{
+		"short fingerprint": `{"index_file": "` + a.IndexPath + `", "fingerprint": "abc", "draining": true}`,
+		"missing draining":  `{"index_file": "` + a.IndexPath + `", "fingerprint": "` + tokenHash("k1") + `"}`,
+		"malformed":         `{"fingerprint": `,
+	} {
+		if _, status := adminRequest(t, api.handleDrain, http.MethodPost, "/auth_modifier/drain", body); status != http.StatusBadRequest {
+			t.Errorf("%s: 状态码 = %d, 期望 400", name, status)
+		}
+	}
+	if _, status := adminRequest(t, api.handleDrain, http.MethodDelete, "/auth_modifier/drain", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: 状态码 = %d, 期望 405", status)
+	}
+}
@@ -0,0 +1,27 @@
+package auth_modifier
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// 配置解析、Provision和Validate返回的错误都包装了以下错误之一，可用errors.Is判断类别
+var (
+	ErrInvalidStrategy  = errors.New("invalid strategy")
+	ErrInvalidOption    = errors.New("invalid option")
+	ErrInvalidHeader    = errors.New("invalid header")
+	ErrMissingOption    = errors.New("missing required option")
+	ErrPathNotWritable  = errors.New("path not writable")
+	ErrClientCert       = errors.New("invalid client certificate")
+	ErrDenylist         = errors.New("invalid denylist")
+	ErrKeySource        = errors.New("key source unavailable")
+	ErrUnknownDirective = errors.New("unrecognized subdirective")
+)
+
+// wrapErr 返回带Caddyfile文件名和行号的解析错误并包装sentinel，
+// Dispenser.Errf使用errors.New，不支持%w
+func wrapErr(d *caddyfile.Dispenser, sentinel error, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %w", d.Err(fmt.Sprintf(format, args...)), sentinel)
+}
@@ -0,0 +1,65 @@
+package auth_modifier
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestErrorSentinels(t *testing.T) {
+	tests := []struct {
+		name     string
+		block    string // auth_modifier块中的内容，{dir}替换为临时目录
+		index    string // 相对{dir}的索引文件路径，默认index.json
+		sentinel error
+		parse    bool // 是否在解析Caddyfile时就返回错误
+	}{
+		{name: "strategy", block: "strategy bogus", sentinel: ErrInvalidStrategy},
+		{name: "canary_percent", block: "canary_percent abc", sentinel: ErrInvalidOption, parse: true},
+		{name: "duration", block: "save_interval soon", sentinel: ErrInvalidOption, parse: true},
+		{name: "positive int", block: "max_retries -1", sentinel: ErrInvalidOption, parse: true},
+		{name: "circuit_breaker status_code", block: "circuit_breaker {\nstatus_code abc\n}", sentinel: ErrInvalidOption, parse: true},
+		{name: "prefer_header", block: "headers Authorization\nprefer_header X-Api-Key", sentinel: ErrInvalidHeader},
+		{name: "canary_key", block: "canary_percent 10", sentinel: ErrMissingOption},
+		{name: "strict", block: "strict", index: "blocker/index.json", sentinel: ErrPathNotWritable},
+		{name: "audit_log", block: "audit_log {dir}/blocker/audit.log", sentinel: ErrPathNotWritable},
+		{name: "client_cert", block: "client_cert {dir}/missing.pem {dir}/missing.key", sentinel: ErrClientCert},
+		{name: "denylist", block: "denylist {dir}/missing.txt", sentinel: ErrDenylist},
+		{name: "secrets_dir", block: "secrets_dir {dir}/missing", sentinel: ErrKeySource},
+		{name: "directive", block: "bogus_option", sentinel: ErrUnknownDirective, parse: true},
+		{name: "circuit_breaker option", block: "circuit_breaker {\nbogus\n}", sentinel: ErrUnknownDirective, parse: true},
+		{name: "header_format option", block: "header_format Authorization {\nbogus\n}", sentinel: ErrUnknownDirective, parse: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// 用普通文件占住目录名，使strict模式下无法创建索引文件所在目录
+			if err := os.WriteFile(filepath.Join(dir, "blocker"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			index := tt.index
+			if len(index) == 0 {
+				index = "index.json"
+			}
+			input := "auth_modifier " + filepath.Join(dir, index) + " {\n" + strings.ReplaceAll(tt.block, "{dir}", dir) + "\n}"
+
+			a := new(AuthModifier)
+			err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input))
+			if tt.parse != (err != nil) {
+				t.Fatalf("解析错误 = %v, 期望解析阶段出错: %v", err, tt.parse)
+			}
+			if err == nil {
+				err = provisionTest(t, a)
+			} else if !strings.Contains(err.Error(), "Testfile:") {
+				t.Errorf("解析错误 %q 缺少文件名和行号", err)
+			}
+			if !errors.Is(err, tt.sentinel) {
+				t.Errorf("错误 = %v, 期望包装 %v", err, tt.sentinel)
+			}
+		})
+	}
+}
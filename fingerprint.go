@@ -0,0 +1,45 @@
+package auth_modifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// 日志、指标和占位符中标识密钥的方式
+const (
+	FingerprintLast4  = "last4"  // ****加密钥末尾4个字符（默认），可读但可能重复
+	FingerprintSHA256 = "sha256" // 密钥SHA-256的前32个十六进制字符
+	FingerprintHMAC   = "hmac"   // 以fingerprint_secret为密钥的HMAC-SHA256的前32个十六进制字符，无法离线反推
+)
+
+var validFingerprintModes = []string{FingerprintLast4, FingerprintSHA256, FingerprintHMAC}
+
+// keyID 返回匹配密钥用的指纹，用于key_aliases、drain、denylist的fp:条目、管理接口和审计日志：
+// hmac模式下为HMAC-SHA256，其余模式为tokenHash。持久化的隔离记录和延迟统计始终使用tokenHash，切换模式不会丢失
+func (a *AuthModifier) keyID(token string) string {
+	if a.FingerprintMode != FingerprintHMAC {
+		return tokenHash(token)
+	}
+	mac := hmac.New(sha256.New, a.fingerprintKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// fingerprint 返回日志、指标和占位符中代表密钥的指纹：last4模式下为maskToken的结果，其余模式为keyID
+func (a *AuthModifier) fingerprint(token string) string {
+	if len(a.FingerprintMode) == 0 || a.FingerprintMode == FingerprintLast4 {
+		return maskToken(token)
+	}
+	return a.keyID(token)
+}
+
+// keyLabel 返回日志和指标中代表密钥的标签：配置了key_aliases时使用别名，否则使用fingerprint的结果
+func (a *AuthModifier) keyLabel(token string) string {
+	if len(a.KeyAliases) > 0 {
+		if alias, ok := a.KeyAliases[a.keyID(token)]; ok {
+			return alias
+		}
+	}
+	return a.fingerprint(token)
+}
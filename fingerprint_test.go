@@ -0,0 +1,112 @@
+package auth_modifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKeyAliases(t *testing.T) {
+	// 指纹不区分大小写
+	a := newTestHandler(t, "", "key_alias "+strings.ToUpper(tokenHash("sk-prod-1111"))+" prod-primary")
+	counter := selectionsTotal.WithLabelValues(a.strategyLabel(), "prod-primary")
+	before := testutil.ToFloat64(counter)
+	var labels []interface{}
+	for i := 0; i < 2; i++ {
+		r, repl, _ := withVars(authRequest("/v1", "sk-prod-1111,sk-backup-2222"))
+		serveTest(t, a, r, http.StatusOK)
+		label, _ := repl.Get("http.auth_modifier.selected_key")
+		labels = append(labels, label)
+	}
+	// 没有别名的密钥退回到末尾4个字符
+	if labels[0] != "prod-primary" || labels[1] != "****2222" {
+		t.Errorf("selected_key = %v, 期望 [prod-primary ****2222]", labels)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("别名标签的 selections_total 增加了 %v, 期望 1", got)
+	}
+}
+
+// hmacHex 计算以secret为密钥的HMAC-SHA256的前32个十六进制字符
+func hmacHex(secret, token string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func TestFingerprintModes(t *testing.T) {
+	os.Setenv("AUTH_MODIFIER_TEST_FP_SECRET", "s3cret")
+	defer os.Unsetenv("AUTH_MODIFIER_TEST_FP_SECRET")
+	for _, c := range []struct {
+		block string
+		want  string
+	}{
+		{"", "****1111"},
+		{"fingerprint_mode last4", "****1111"},
+		{"fingerprint_mode sha256", tokenHash("sk-prod-1111")},
+		{"fingerprint_mode hmac s3cret", hmacHex("s3cret", "sk-prod-1111")},
+		{"fingerprint_mode hmac {env.AUTH_MODIFIER_TEST_FP_SECRET}", hmacHex("s3cret", "sk-prod-1111")},
+	} {
+		a := newTestHandler(t, "", c.block)
+		r, repl, _ := withVars(authRequest("/v1", "sk-prod-1111,sk-backup-2222"))
+		serveTest(t, a, r, http.StatusOK)
+		if label, _ := repl.Get("http.auth_modifier.selected_key"); label != c.want {
+			t.Errorf("%q: selected_key = %v, 期望 %s", c.block, label, c.want)
+		}
+	}
+	if hmacHex("s3cret", "sk-prod-1111") == tokenHash("sk-prod-1111") || hmacHex("other", "sk-prod-1111") == hmacHex("s3cret", "sk-prod-1111") {
+		t.Error("HMAC指纹应随密钥变化且不同于SHA-256")
+	}
+}
+
+func TestFingerprintHMACMatching(t *testing.T) {
+	// hmac模式下别名和吊销列表的fp:条目都按HMAC匹配
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	if err := os.WriteFile(path, []byte("fp:"+hmacHex("s3cret", "sk-revoked-3333")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestHandler(t, "", "fingerprint_mode hmac s3cret\nkey_alias "+hmacHex("s3cret", "sk-prod-1111")+" prod\ndenylist "+path)
+	var labels []interface{}
+	for i := 0; i < 4; i++ {
+		r, repl, _ := withVars(authRequest("/v1", "sk-prod-1111,sk-revoked-3333,sk-backup-2222"))
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		if seen.Get("Authorization") == "sk-revoked-3333" {
+			t.Fatal("选中了已吊销的密钥")
+		}
+		label, _ := repl.Get("http.auth_modifier.selected_key")
+		labels = append(labels, label)
+	}
+	if labels[0] != "prod" || labels[1] != hmacHex("s3cret", "sk-backup-2222") {
+		t.Errorf("selected_key = %v", labels)
+	}
+
+	// 按SHA-256写的别名在hmac模式下不再匹配
+	a = newTestHandler(t, "", "fingerprint_mode hmac s3cret\nkey_alias "+tokenHash("sk-prod-1111")+" prod")
+	if got := a.keyLabel("sk-prod-1111"); got != hmacHex("s3cret", "sk-prod-1111") {
+		t.Errorf("keyLabel = %q", got)
+	}
+}
+
+func TestFingerprintModeInvalid(t *testing.T) {
+	for _, c := range []struct {
+		block string
+		err   error
+	}{
+		{"fingerprint_mode md5", ErrInvalidOption},
+		{"fingerprint_mode hmac", ErrMissingOption},
+		{"fingerprint_mode hmac {env.AUTH_MODIFIER_TEST_UNSET}", ErrMissingOption},
+	} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\n"+c.block+"\n}")
+		if err := provisionTest(t, a); !errors.Is(err, c.err) {
+			t.Errorf("%q: 错误 = %v, 期望 %v", c.block, err, c.err)
+		}
+	}
+}
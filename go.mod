@@ -4,5 +4,10 @@ go 1.14
 
 require (
 	github.com/caddyserver/caddy/v2 v2.4.1
+	github.com/caddyserver/certmagic v0.14.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/prometheus/client_golang v1.10.0
+	go.opentelemetry.io/otel v0.20.0
+	go.opentelemetry.io/otel/trace v0.20.0
 	go.uber.org/zap v1.16.0
 )
\ No newline at end of file
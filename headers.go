@@ -0,0 +1,468 @@
+package auth_modifier
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// defaultHeaders 是未配置headers时默认轮换的请求头
+var defaultHeaders = []string{"Authorization", "X-Goog-Api-Key", "x-api-key"}
+
+// grpcWebHeader 是gRPC-Web客户端携带认证信息的请求头，对应gRPC的authorization元数据
+const grpcWebHeader = "Grpc-Metadata-Authorization"
+
+// forbiddenHeaders 由HTTP协议栈或反向代理自行管理，改写后会破坏请求
+var forbiddenHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Expect":            true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// 同一请求头出现多次时的处理方式
+const (
+	MultiValueFirst   = "first"   // 只轮换第一个值，其余的值原样保留（默认）
+	MultiValueCombine = "combine" // 把所有值合并为一个密钥池，轮换后只写回选中的一个值
+	MultiValueAll     = "all"     // 每个值分别按同一索引轮换
+)
+
+var validMultiValueModes = []string{MultiValueFirst, MultiValueCombine, MultiValueAll}
+
+// forbiddenHeaderPrefixes 是禁止轮换的请求头前缀
+var forbiddenHeaderPrefixes = []string{"Sec-", "Proxy-"}
+
+// validateHeaders 检查配置的请求头能否被安全改写
+func (a *AuthModifier) validateHeaders() error {
+	for name := range a.HeaderFormats {
+		if !containsHeader(a.Headers, name) {
+			return fmt.Errorf("%w: header_format for '%s' does not match any rotated header", ErrInvalidHeader, name)
+		}
+	}
+	for _, name := range a.Headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if forbiddenHeaders[canonical] {
+			return fmt.Errorf("%w: '%s' cannot be rotated, it is managed by the HTTP stack", ErrInvalidHeader, name)
+		}
+		for _, prefix := range forbiddenHeaderPrefixes {
+			if strings.HasPrefix(canonical, prefix) {
+				return fmt.Errorf("%w: '%s' cannot be rotated, %s* headers are managed by the HTTP stack", ErrInvalidHeader, name, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalHeaders 返回规范化后的请求头名称，去掉规范化后重复的名称。
+// 之后所有查找都使用规范名称，x-goog-api-key与X-Goog-Api-Key等价，即使直接读取r.Header[name]也一致
+func canonicalHeaders(names []string) []string {
+	canonical := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if !seen[name] {
+			seen[name] = true
+			canonical = append(canonical, name)
+		}
+	}
+	return canonical
+}
+
+// HeaderConfig 描述一个请求头中多个密钥的书写格式
+type HeaderConfig struct {
+	// Scheme 是密钥前的认证方案，如Bearer，匹配时不区分大小写，写回时保留该前缀
+	Scheme string `json:"scheme,omitempty"`
+	// Delimiter 是多个密钥之间的分隔符，默认为逗号
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+// defaultSchemes 是未配置schemes时在所有请求头中识别的认证方案
+var defaultSchemes = []string{"Bearer", "Basic"}
+
+// defaultHeaderFormats 是内置请求头的默认格式，其余请求头默认无前缀、以逗号分隔
+var defaultHeaderFormats = map[string]HeaderConfig{
+	"Authorization": {Scheme: "Bearer", Delimiter: ","},
+}
+
+// buildHeaderFormats 为每个轮换请求头确定格式，未配置的请求头使用默认格式
+func (a *AuthModifier) buildHeaderFormats() {
+	configured := make(map[string]HeaderConfig, len(a.HeaderFormats))
+	for name, hc := range a.HeaderFormats {
+		configured[http.CanonicalHeaderKey(name)] = hc
+	}
+	a.formats = make(map[string]HeaderConfig, len(a.Headers))
+	for _, name := range a.Headers {
+		canonical := http.CanonicalHeaderKey(name)
+		hc, ok := configured[canonical]
+		if !ok {
+			hc = defaultHeaderFormats[canonical]
+		}
+		if len(hc.Delimiter) == 0 {
+			hc.Delimiter = ","
+		}
+		a.formats[name] = hc
+	}
+}
+
+// signaledDelimiters 是客户端可以通过delimiter_header指定的分隔符，只允许单个字符，
+// 且不能出现在常见的密钥（base64、JWT）、权重后缀或认证参数中
+const signaledDelimiters = ",;|!#$%&*^~"
+
+// delimiter 返回本次请求中请求头name的密钥分隔符：配置了delimiter_header且请求携带了允许的分隔符时使用该分隔符，
+// 否则使用该请求头的格式
+func (a *AuthModifier) delimiter(r *http.Request, name string) string {
+	if len(a.DelimiterHeader) > 0 {
+		if d := r.Header.Get(a.DelimiterHeader); len(d) == 1 && strings.Contains(signaledDelimiters, d) {
+			return d
+		}
+	}
+	return a.formats[name].Delimiter
+}
+
+// containsHeader 按规范化名称判断name是否在headers中
+func containsHeader(headers []string, name string) bool {
+	canonical := http.CanonicalHeaderKey(name)
+	for _, h := range headers {
+		if http.CanonicalHeaderKey(h) == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMultipleTokens 判断请求中是否有携带多个密钥、需要轮换的请求头
+func (a *AuthModifier) hasMultipleTokens(r *http.Request) bool {
+	for _, name := range a.Headers {
+		if strings.Contains(r.Header.Get(name), a.delimiter(r, name)) {
+			return true
+		}
+	}
+	return a.hasMultipleCookieTokens(r)
+}
+
+// dropNonPreferred 请求中带有prefer_header时删除其余的轮换请求头，只轮换并转发首选的请求头，
+// 例如Google的接口同时收到Authorization和X-Goog-Api-Key时可能冲突
+func (a *AuthModifier) dropNonPreferred(r *http.Request) {
+	if len(r.Header.Get(a.PreferHeader)) == 0 {
+		return
+	}
+	for _, name := range a.Headers {
+		if name != a.PreferHeader && len(r.Header.Get(name)) > 0 {
+			r.Header.Del(name)
+			a.logger.Debug("Removed non-preferred header", zap.String("header", name), zap.String("prefer_header", a.PreferHeader))
+		}
+	}
+}
+
+// splitCredential 按请求头name的格式拆出认证方案前缀（含空格）和密钥列表
+func (a *AuthModifier) splitCredential(r *http.Request, name, value string) (string, []string) {
+	scheme, value := a.trimScheme(name, value)
+	delimiter := a.delimiter(r, name)
+	value, _ = splitAuthParams(scheme, value, delimiter)
+	return scheme, strings.Split(value, delimiter)
+}
+
+// trimScheme 按请求头name的格式去掉认证方案前缀，返回前缀（含空格）和剩余的密钥串。
+// 先匹配该请求头配置的前缀，再匹配schemes中的前缀，后者写回时保留请求中的原始写法；
+// 开启bearer_jwt时，没有前缀但看起来是JWT的密钥串按带前缀处理，写回时补上前缀
+func (a *AuthModifier) trimScheme(name, value string) (string, string) {
+	hc := a.formats[name]
+	if n := len(hc.Scheme); n > 0 && len(value) > n && strings.EqualFold(value[:n], hc.Scheme) && value[n] == ' ' {
+		return hc.Scheme + " ", strings.TrimSpace(value[n+1:])
+	}
+	if i := strings.IndexByte(value, ' '); i > 0 {
+		for _, scheme := range a.Schemes {
+			if strings.EqualFold(value[:i], scheme) {
+				return value[:i+1], strings.TrimSpace(value[i+1:])
+			}
+		}
+	}
+	if len(hc.Scheme) > 0 && a.BearerJWT && looksLikeJWT(strings.TrimSpace(nthToken(value, hc.Delimiter, 0))) {
+		return hc.Scheme + " ", value
+	}
+	return "", value
+}
+
+// setStaticHeaders 写入set_headers配置的固定请求头，只在本次请求确实轮换或注入了密钥时调用，
+// 使伴随的请求头与凭据保持一致
+func (a *AuthModifier) setStaticHeaders(r *http.Request) {
+	for name, value := range a.SetHeaders {
+		r.Header.Set(name, value)
+	}
+}
+
+// trimElementScheme 去掉列表元素自带的认证方案前缀，如 "Bearer a, Bearer b" 中的第二个元素。
+// 元素的前缀是已知方案时返回该前缀（含空格）和裸密钥，写回时使用元素自己的前缀；
+// 否则返回整个列表的前缀scheme和原元素
+func (a *AuthModifier) trimElementScheme(name, scheme, element string) (string, string) {
+	trimmed := strings.TrimSpace(element)
+	i := strings.IndexByte(trimmed, ' ')
+	if i <= 0 {
+		return scheme, element
+	}
+	word := trimmed[:i]
+	known := strings.EqualFold(word, strings.TrimSpace(scheme)) || strings.EqualFold(word, a.formats[name].Scheme)
+	for _, s := range a.Schemes {
+		known = known || strings.EqualFold(word, s)
+	}
+	if !known {
+		return scheme, element
+	}
+	return word + " ", strings.TrimSpace(trimmed[i+1:])
+}
+
+// trimElementSchemes 对pool中的每个元素调用trimElementScheme，返回各元素写回时的前缀和裸元素
+func (a *AuthModifier) trimElementSchemes(name, scheme string, pool []string) ([]string, []string) {
+	schemes := make([]string, len(pool))
+	bare := make([]string, len(pool))
+	for i, element := range pool {
+		schemes[i], bare[i] = a.trimElementScheme(name, scheme, element)
+	}
+	return schemes, bare
+}
+
+// looksLikeJWT 判断token是否形如JWT：三段非空的base64url，且头部以{"开头
+func looksLikeJWT(token string) bool {
+	if !strings.HasPrefix(token, "eyJ") {
+		return false
+	}
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return false
+	}
+	for _, segment := range segments {
+		if len(segment) == 0 {
+			return false
+		}
+		for _, c := range segment {
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nthToken 返回value按sep分隔后的第n个元素，逐段查找而不生成完整的切片
+func nthToken(value, sep string, n int) string {
+	for ; n > 0; n-- {
+		i := strings.Index(value, sep)
+		if i < 0 {
+			return ""
+		}
+		value = value[i+len(sep):]
+	}
+	if i := strings.Index(value, sep); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
+
+// rotation 记录一次请求头轮换的结果
+type rotation struct {
+	header   string
+	token    string   // 选中的密钥，不含scheme
+	pos      int      // 选中密钥在密钥列表中的下标
+	length   int      // 可供选择的密钥数量
+	canary   bool     // 是否为灰度密钥
+	tokens   []string // 可供选择的密钥列表，快速路径下为nil
+	acquired bool     // 是否占用了该密钥的一个并发名额
+	pool     string   // 密钥池的名称，为空时即请求头名称
+	follower bool     // 是否为zip_headers中跟随主请求头下标的请求头，不参与并发限制和隔离
+}
+
+// poolName 返回本次使用的密钥池名称：keys、source、canary、cookie或客户端携带密钥的请求头名称
+func (rot rotation) poolName() string {
+	if len(rot.pool) > 0 {
+		return rot.pool
+	}
+	return rot.header
+}
+
+// rotateHeader 按索引从请求头name携带的多个密钥中选出一个写回。
+// 请求未携带该头部或只携带了一个密钥时不做修改并返回false，与Bearer前缀的有无无关，
+// 这样单个密钥的请求头不会计入轮换，也不会推进索引
+func (a *AuthModifier) rotateHeader(r *http.Request, name, key string, index uint64) (rotation, bool) {
+	values := r.Header[name]
+	if len(values) == 0 {
+		return rotation{}, false
+	}
+	if len(values) > 1 && a.MultiValueMode == MultiValueCombine {
+		values = []string{strings.Join(values, a.delimiter(r, name))}
+	}
+	value, rot, ok := a.rotateValue(r, name, values[0], key, index)
+	if !ok {
+		return rotation{}, false
+	}
+	values[0] = value
+	r.Header[name] = values
+	return rot, true
+}
+
+// rotateOtherValues 在multi_value_mode为all时按同一索引轮换请求头name的第二个及之后的值
+func (a *AuthModifier) rotateOtherValues(r *http.Request, name, key string, index uint64) []rotation {
+	if a.MultiValueMode != MultiValueAll {
+		return nil
+	}
+	var rotations []rotation
+	values := r.Header[name]
+	for i := 1; i < len(values); i++ {
+		if value, rot, ok := a.rotateValue(r, name, values[i], key, index); ok {
+			values[i] = value
+			rotations = append(rotations, rot)
+		}
+	}
+	return rotations
+}
+
+// rotateValue 从请求头name的一个值携带的多个密钥中选出一个，返回应写回的值
+func (a *AuthModifier) rotateValue(r *http.Request, name, value, key string, index uint64) (string, rotation, bool) {
+	if len(value) == 0 {
+		return "", rotation{}, false
+	}
+	scheme, rest := a.trimScheme(name, value)
+	delimiter := a.delimiter(r, name)
+	rest, params := splitAuthParams(scheme, rest, delimiter)
+	if len(rest) == 0 || strings.HasPrefix(rest, delimiter) || strings.HasSuffix(rest, delimiter) || strings.Contains(rest, delimiter+delimiter) {
+		a.warnPool("Key pool contains an empty key", name, value)
+	}
+	if !strings.Contains(rest, delimiter) {
+		return "", rotation{}, false
+	}
+	// 轮询和随机策略在没有隔离或吊销的密钥时只需要选中的那一个，直接定位以免请求头很长时拷贝整个列表
+	if (a.usesIndex() || a.Strategy == StrategyRandom) && !a.custom && a.denied == nil && !a.tracksInFlight() && !a.hasDraining() && !a.CollapseDuplicates && a.ShuffleSeed == 0 && !a.tracksQuota() && triedFrom(r) == nil && !a.hasQuarantined() {
+		length := strings.Count(rest, delimiter) + 1
+		pos := a.selectIndex(index, length)
+		prefix, token := a.trimElementScheme(name, scheme, nthToken(rest, delimiter, pos))
+		a.logRotation(name, token)
+		return prefix + token + params, rotation{header: name, token: token, pos: pos, length: length}, true
+	}
+	schemes, pool := a.trimElementSchemes(name, scheme, strings.Split(rest, delimiter))
+	if a.CollapseDuplicates {
+		pool, schemes = collapseDuplicates(pool, schemes)
+	}
+	perm := a.shufflePerm(len(pool))
+	if perm != nil {
+		pool, schemes = permute(pool, perm), permute(schemes, perm)
+	}
+	tokens := a.stripWeights(pool)
+	pos, acquired := a.pickLive(r, tokens, a.choose(r, key, index, pool))
+	token := tokens[pos]
+	a.logRotation(name, token)
+	return schemes[pos] + token + params, rotation{header: name, token: token, pos: originalPos(perm, pos), length: len(tokens), tokens: tokens, acquired: acquired}, true
+}
+
+// rotatePool 从配置的密钥池中选出一个写入第一个轮换请求头
+func (a *AuthModifier) rotatePool(r *http.Request, key string, index uint64) rotation {
+	name := a.Headers[0]
+	pool := a.keys()
+	perm := a.shufflePerm(len(pool))
+	if perm != nil {
+		pool = permute(pool, perm)
+	}
+	tokens := a.stripWeights(pool)
+	pos, acquired := a.pickLive(r, tokens, a.choose(r, key, index, pool))
+	token := tokens[pos]
+	r.Header.Set(name, token)
+	a.logRotation(name, token)
+	rot := rotation{header: name, token: token, pos: originalPos(perm, pos), length: len(tokens), tokens: tokens, acquired: acquired, pool: "keys"}
+	if a.source != nil && a.source.load() != nil {
+		rot.pool = "source"
+	}
+	return rot
+}
+
+// defaultVarsPrefix 是请求变量和占位符名称的默认前缀
+const defaultVarsPrefix = "auth_modifier"
+
+// reservedVarsPrefixes 是Caddy自身使用的http.*占位符命名空间，vars_prefix的第一段不能与之相同，
+// 否则{http.request.*}等占位符会被覆盖
+var reservedVarsPrefixes = map[string]bool{
+	"request":       true,
+	"response":      true,
+	"vars":          true,
+	"error":         true,
+	"regexp":        true,
+	"matchers":      true,
+	"reverse_proxy": true,
+	"auth":          true,
+	"handlers":      true,
+}
+
+// validateVarsPrefix 检查vars_prefix能否安全地拼接成占位符和请求变量的名称，
+// 返回的错误不包装ErrInvalidOption，由调用方加上位置信息后包装
+func validateVarsPrefix(prefix string) error {
+	if len(prefix) == 0 || strings.ContainsAny(prefix, " \t{}") || strings.HasPrefix(prefix, ".") || strings.HasSuffix(prefix, ".") {
+		return fmt.Errorf("vars_prefix '%s'", prefix)
+	}
+	first := strings.ToLower(strings.SplitN(prefix, ".", 2)[0])
+	if reservedVarsPrefixes[first] || strings.HasPrefix(first, "http") {
+		return fmt.Errorf("vars_prefix '%s' collides with Caddy's http.%s placeholders", prefix, first)
+	}
+	return nil
+}
+
+// exposeRotation 将本次的轮换结果写入请求变量和占位符，
+// 可在日志或其他处理器中通过 {http.auth_modifier.selected_index} 等引用，前缀可由vars_prefix修改
+func (a *AuthModifier) exposeRotation(r *http.Request, key string, rot rotation) {
+	label := a.keyLabel(rot.token)
+	a.recordDecision(key, label, rot)
+	strategy := a.strategyLabel()
+	strategyRequestsTotal.WithLabelValues(strategy).Inc()
+	selectionsTotal.WithLabelValues(strategy, a.metricLabel(rot.token)).Inc()
+	values := map[string]interface{}{
+		"strategy":       a.Strategy,
+		"index_key":      key,
+		"selected_index": rot.pos,
+		"selected_key":   label,
+		"canary":         rot.canary,
+		"pool":           rot.poolName(),
+	}
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for name, value := range values {
+		caddyhttp.SetVar(r.Context(), a.VarsPrefix+"."+name, value)
+		if repl != nil {
+			repl.Set("http."+a.VarsPrefix+"."+name, value)
+		}
+	}
+
+	// 请求处于链路追踪中时给当前span加上轮换结果，未启用追踪时是空操作
+	if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("auth_modifier.strategy", a.Strategy),
+			attribute.Int("auth_modifier.selected_index", rot.pos),
+			attribute.String("auth_modifier.selected_key", label),
+			attribute.Bool("auth_modifier.canary", rot.canary),
+			attribute.String("auth_modifier.pool", rot.poolName()),
+		)
+	}
+}
+
+// logRotation 记录请求头被改写为哪个密钥，只记录keyLabel而不是密钥原文，配置了log_sample时每log_sample次只记录一次
+func (a *AuthModifier) logRotation(name, token string) {
+	if !a.sampled() {
+		return
+	}
+	a.logger.Debug("Set "+name, zap.String("Auth-Key", a.keyLabel(token)))
+}
+
+// sampled 判断本次轮换日志是否需要输出。调试级别未开启时直接跳过，不计数
+func (a *AuthModifier) sampled() bool {
+	if ce := a.logger.Check(zap.DebugLevel, ""); ce == nil {
+		return false
+	}
+	return a.LogSample <= 1 || atomic.AddUint32(&a.logCount, 1)%uint32(a.LogSample) == 1
+}
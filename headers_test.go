@@ -0,0 +1,560 @@
+package auth_modifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestVarsPrefixReserved(t *testing.T) {
+	for _, prefix := range []string{"request", "response", "vars", "error", "regexp", "matchers", "Request.x", "vars.auth", "http", "https", "http.request", "httpx"} {
+		a := new(AuthModifier)
+		err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser("auth_modifier index.json {\nvars_prefix " + prefix + "\n}"))
+		if !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("vars_prefix %s: 错误 = %v, 期望被拒绝", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"auth_modifier", "upstream_a", "requester", "team.vars"} {
+		if err := validateVarsPrefix(prefix); err != nil {
+			t.Errorf("vars_prefix %s: %v", prefix, err)
+		}
+	}
+	// 通过JSON配置时由Validate拒绝
+	a := &AuthModifier{Headers: []string{"Authorization"}, VarsPrefix: "http.vars"}
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Validate: 错误 = %v, 期望被拒绝", err)
+	}
+}
+
+func TestVarsPrefixPlaceholders(t *testing.T) {
+	a := newTestHandler(t, "", "vars_prefix upstream_a")
+	r := authRequest("/v1", "k1,k2")
+	repl := caddy.NewReplacer()
+	vars := make(map[string]interface{})
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, vars)
+	r = r.WithContext(ctx)
+	repl.Set("http.request.uri", "/v1")
+
+	serveTest(t, a, r, http.StatusOK)
+	if got, _ := repl.Get("http.upstream_a.selected_index"); got != 0 {
+		t.Errorf("{http.upstream_a.selected_index} = %v, 期望 0", got)
+	}
+	if got, _ := repl.Get("http.upstream_a.strategy"); got != StrategyRoundRobin {
+		t.Errorf("{http.upstream_a.strategy} = %v", got)
+	}
+	if got := vars["upstream_a.pool"]; got != "Authorization" {
+		t.Errorf("vars upstream_a.pool = %v", got)
+	}
+	if _, ok := repl.Get("http.auth_modifier.selected_index"); ok {
+		t.Error("配置vars_prefix后不应再写入默认前缀")
+	}
+	if got, _ := repl.Get("http.request.uri"); got != "/v1" {
+		t.Errorf("{http.request.uri} = %v", got)
+	}
+}
+
+func TestNthToken(t *testing.T) {
+	value := "k0,k1,,k3"
+	for n, want := range strings.Split(value, ",") {
+		if got := nthToken(value, ",", n); got != want {
+			t.Errorf("nthToken(%q, %d) = %q, 期望 %q", value, n, got, want)
+		}
+	}
+	if got := nthToken(value, ",", 4); got != "" {
+		t.Errorf("越界时应返回空串, got %q", got)
+	}
+	if got := nthToken("a||b||c", "||", 2); got != "c" {
+		t.Errorf("多字节分隔符: got %q", got)
+	}
+	if got := nthToken("only", ",", 0); got != "only" {
+		t.Errorf("没有分隔符: got %q", got)
+	}
+}
+
+// longHeader 返回由n个40字节密钥组成、逗号分隔的请求头值
+func longHeader(n int) string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("sk-%037d", i)
+	}
+	return strings.Join(keys, ",")
+}
+
+func BenchmarkNthToken(b *testing.B) {
+	value := longHeader(200)
+	b.Run("nthToken", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			nthToken(value, ",", i%200)
+		}
+	})
+	b.Run("strings.Split", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = strings.Split(value, ",")[i%200]
+		}
+	})
+}
+
+// withVars 给请求加上Caddy为每个请求准备的占位符替换器和请求变量
+func withVars(r *http.Request) (*http.Request, *caddy.Replacer, map[string]interface{}) {
+	repl := caddy.NewReplacer()
+	vars := make(map[string]interface{})
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, vars)
+	return r.WithContext(ctx), repl, vars
+}
+
+func TestPoolVar(t *testing.T) {
+	for _, c := range []struct {
+		block  string
+		header string
+		value  string
+		want   string
+	}{
+		{"", "Authorization", "k1,k2", "Authorization"},
+		{"headers X-Api-Key", "X-Api-Key", "k1,k2", "X-Api-Key"},
+		{"keys s1 s2", "Authorization", "", "keys"},
+		{"cookie_name session", "Cookie", "session=c1,c2", "cookie"},
+		{"canary_key c0\ncanary_percent 100", "Authorization", "k1,k2", "canary"},
+	} {
+		a := newTestHandler(t, "", c.block)
+		r := httptest.NewRequest(http.MethodGet, "/v1", nil)
+		if len(c.value) > 0 {
+			r.Header.Set(c.header, c.value)
+		}
+		r, repl, vars := withVars(r)
+		serveTest(t, a, r, http.StatusOK)
+		if got := vars["auth_modifier.pool"]; got != c.want {
+			t.Errorf("%q: vars auth_modifier.pool = %v, 期望 %s", c.block, got, c.want)
+		}
+		if got, _ := repl.Get("http.auth_modifier.pool"); got != c.want {
+			t.Errorf("%q: {http.auth_modifier.pool} = %v, 期望 %s", c.block, got, c.want)
+		}
+	}
+}
+
+func TestPoolVarUnsetWithoutRotation(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	r, repl, vars := withVars(authRequest("/v1", "k1"))
+	serveTest(t, a, r, http.StatusOK)
+	if _, ok := vars["auth_modifier.pool"]; ok {
+		t.Error("只有一个密钥时不应写入pool")
+	}
+	if _, ok := repl.Get("http.auth_modifier.pool"); ok {
+		t.Error("只有一个密钥时不应设置 {http.auth_modifier.pool}")
+	}
+}
+
+func TestPerElementSchemes(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  []string
+	}{
+		{"Bearer a, Bearer b,c", []string{"Bearer a", "Bearer b", "Bearer c"}},
+		{"Bearer a, Basic b", []string{"Bearer a", "Basic b", "Bearer a"}},
+		{"bearer a,BEARER b", []string{"Bearer a", "BEARER b"}},
+		{"a, Bearer b", []string{"a", "Bearer b"}},
+		{"Bearer a,Foo b", []string{"Bearer a", "Bearer Foo b"}},
+	} {
+		a := newTestHandler(t, "", "")
+		assertSequence(t, rotatedSequence(t, a, "/v1", c.value, len(c.want)), c.want)
+	}
+}
+
+func TestPerElementSchemeQuarantinesBareKey(t *testing.T) {
+	a := newTestHandler(t, "", "strategy failover")
+	serveTest(t, a, authRequest("/v1", "Bearer k1, Bearer k2"), http.StatusUnauthorized)
+	a.indexFile.quarantine.mu.Lock()
+	_, bare := a.indexFile.quarantine.entries["k1"]
+	a.indexFile.quarantine.mu.Unlock()
+	if !bare {
+		t.Fatal("应按去掉前缀后的密钥隔离")
+	}
+	// 同一个密钥以列表前缀的写法出现时同样被跳过
+	seen, _ := serveTest(t, a, authRequest("/v1", "Bearer k1,k2"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "Bearer k2" {
+		t.Errorf("Authorization = %q, 期望 Bearer k2", got)
+	}
+}
+
+func TestLowercaseHeaderNames(t *testing.T) {
+	a := newTestHandler(t, "", "headers x-goog-api-key authorization X-GOOG-API-KEY\nheader_format x-goog-api-key {\ndelimiter ;\n}")
+	if want := []string{"X-Goog-Api-Key", "Authorization"}; !reflect.DeepEqual(a.Headers, want) {
+		t.Fatalf("Headers = %v, 期望 %v", a.Headers, want)
+	}
+	for i, want := range []string{"g1", "g2"} {
+		r := authRequest("/v1", "Bearer k1,k2")
+		r.Header.Set("X-Goog-Api-Key", "g1;g2")
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		if got := seen.Get("X-Goog-Api-Key"); got != want {
+			t.Errorf("第%d次请求 X-Goog-Api-Key = %q, 期望 %q", i, got, want)
+		}
+		if got := seen.Get("Authorization"); got != "Bearer k"+strconv.Itoa(i+1) {
+			t.Errorf("第%d次请求 Authorization = %q", i, got)
+		}
+	}
+}
+
+func TestPreferHeaderDropsOthers(t *testing.T) {
+	a := newTestHandler(t, "", "headers Authorization X-Goog-Api-Key\nprefer_header x-goog-api-key")
+	r := authRequest("/v1", "Bearer a1,a2")
+	r.Header.Set("X-Goog-Api-Key", "g1,g2")
+	r.Header.Set("X-Other", "kept")
+	seen, _ := serveTest(t, a, r, http.StatusOK)
+	if _, ok := seen["Authorization"]; ok {
+		t.Errorf("非首选的请求头没有被删除: %q", seen.Get("Authorization"))
+	}
+	if got := seen.Get("X-Goog-Api-Key"); got != "g1" {
+		t.Errorf("X-Goog-Api-Key = %q, 期望轮换后的 g1", got)
+	}
+	if got := seen.Get("X-Other"); got != "kept" {
+		t.Errorf("其他请求头 = %q", got)
+	}
+
+	// 没有首选请求头时照常轮换其余请求头
+	seen, _ = serveTest(t, a, authRequest("/v2", "Bearer a1,a2"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "Bearer a1" {
+		t.Errorf("Authorization = %q, 期望 Bearer a1", got)
+	}
+}
+
+func TestPreferHeaderNotRotated(t *testing.T) {
+	a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\nprefer_header X-Custom-Key\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidHeader", err)
+	}
+}
+
+func TestSetHeadersOnlyWhenRotated(t *testing.T) {
+	a := newTestHandler(t, "", "set_headers OpenAI-Organization org-1\nset_headers X-Tenant t1")
+	seen, _ := serveTest(t, a, authRequest("/v1", "Bearer a1,a2"), http.StatusOK)
+	if got := seen.Get("OpenAI-Organization"); got != "org-1" {
+		t.Errorf("轮换时 OpenAI-Organization = %q, 期望 org-1", got)
+	}
+	if got := seen.Get("X-Tenant"); got != "t1" {
+		t.Errorf("轮换时 X-Tenant = %q, 期望 t1", got)
+	}
+
+	// 没有携带密钥的请求原样放行，不设置固定请求头
+	seen, _ = serveTest(t, a, httptest.NewRequest(http.MethodGet, "/v1", nil), http.StatusOK)
+	if _, ok := seen["Openai-Organization"]; ok {
+		t.Errorf("未轮换的请求被设置了 OpenAI-Organization = %q", seen.Get("OpenAI-Organization"))
+	}
+	// 客户端自带的同名请求头在轮换时被覆盖
+	r := authRequest("/v1", "Bearer a1,a2")
+	r.Header.Set("OpenAI-Organization", "client-org")
+	seen, _ = serveTest(t, a, r, http.StatusOK)
+	if got := seen.Values("OpenAI-Organization"); !reflect.DeepEqual(got, []string{"org-1"}) {
+		t.Errorf("OpenAI-Organization = %q, 期望被覆盖为 org-1", got)
+	}
+}
+
+func TestSetHeadersRotatedHeaderConflict(t *testing.T) {
+	a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\nset_headers authorization fixed\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidHeader", err)
+	}
+}
+
+// multiValueSequence 连续发送n个携带多个Authorization的请求，返回下游每次看到的全部值
+func multiValueSequence(t *testing.T, a *AuthModifier, n int, values ...string) [][]string {
+	t.Helper()
+	got := make([][]string, n)
+	for i := range got {
+		r := httptest.NewRequest(http.MethodGet, "/v1", nil)
+		r.Header["Authorization"] = append([]string(nil), values...)
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		got[i] = seen.Values("Authorization")
+	}
+	return got
+}
+
+func TestMultiValueModes(t *testing.T) {
+	tests := []struct {
+		mode   string
+		values []string
+		want   [][]string
+	}{
+		// 默认只轮换第一个值，其余原样保留
+		{"", []string{"Bearer a1,a2", "Bearer x1,x2"}, [][]string{
+			{"Bearer a1", "Bearer x1,x2"}, {"Bearer a2", "Bearer x1,x2"}, {"Bearer a1", "Bearer x1,x2"},
+		}},
+		{"first", []string{"Bearer a1,a2", "Bearer other"}, [][]string{
+			{"Bearer a1", "Bearer other"}, {"Bearer a2", "Bearer other"},
+		}},
+		// 合并为一个密钥池，只写回选中的一个值
+		{"combine", []string{"Bearer a1,a2", "Bearer a3"}, [][]string{
+			{"Bearer a1"}, {"Bearer a2"}, {"Bearer a3"}, {"Bearer a1"},
+		}},
+		// 每个值按同一索引分别轮换
+		{"all", []string{"Bearer a1,a2", "Bearer b1,b2"}, [][]string{
+			{"Bearer a1", "Bearer b1"}, {"Bearer a2", "Bearer b2"}, {"Bearer a1", "Bearer b1"},
+		}},
+	}
+	for _, tt := range tests {
+		block := ""
+		if len(tt.mode) > 0 {
+			block = "multi_value_mode " + tt.mode
+		}
+		a := newTestHandler(t, "", block)
+		if got := multiValueSequence(t, a, len(tt.want), tt.values...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("multi_value_mode %q: 序列 = %q, 期望 %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestMultiValueModeInvalid(t *testing.T) {
+	a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\nmulti_value_mode last\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidOption", err)
+	}
+}
+
+func TestGRPCWebHeader(t *testing.T) {
+	grpcRequest := func(value string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+		r.Header.Set("grpc-metadata-authorization", value)
+		r.Header.Set("Content-Type", "application/grpc-web+proto")
+		return r
+	}
+	a := newTestHandler(t, "", "grpc_web")
+	var got []string
+	for i := 0; i < 3; i++ {
+		seen, _ := serveTest(t, a, grpcRequest("Bearer g1,g2"), http.StatusOK)
+		got = append(got, seen.Get("Grpc-Metadata-Authorization"))
+	}
+	assertSequence(t, got, []string{"Bearer g1", "Bearer g2", "Bearer g1"})
+
+	// 与Authorization共用同一个索引
+	r := grpcRequest("Bearer g1,g2")
+	r.Header.Set("Authorization", "Bearer a1,a2")
+	seen, _ := serveTest(t, a, r, http.StatusOK)
+	if seen.Get("Authorization") != "Bearer a2" || seen.Get("Grpc-Metadata-Authorization") != "Bearer g2" {
+		t.Errorf("Authorization = %q, Grpc-Metadata-Authorization = %q, 期望都使用第二个密钥",
+			seen.Get("Authorization"), seen.Get("Grpc-Metadata-Authorization"))
+	}
+
+	// 未开启grpc_web时原样放行
+	a = newTestHandler(t, "", "")
+	seen, _ = serveTest(t, a, grpcRequest("Bearer g1,g2"), http.StatusOK)
+	if got := seen.Get("Grpc-Metadata-Authorization"); got != "Bearer g1,g2" {
+		t.Errorf("未开启grpc_web时 Grpc-Metadata-Authorization = %q", got)
+	}
+}
+
+func TestGRPCWebHeaderNotDuplicated(t *testing.T) {
+	a := newTestHandler(t, "", "headers Authorization grpc-metadata-authorization\ngrpc_web")
+	if !reflect.DeepEqual(a.Headers, []string{"Authorization", grpcWebHeader}) {
+		t.Errorf("Headers = %q", a.Headers)
+	}
+}
+
+func TestDelimiterHeader(t *testing.T) {
+	a := newTestHandler(t, "", "delimiter_header X-Auth-Delimiter")
+	sequence := func(path, value, delimiter string, n int) []string {
+		got := make([]string, n)
+		for i := range got {
+			r := authRequest(path, value)
+			if len(delimiter) > 0 {
+				r.Header.Set("X-Auth-Delimiter", delimiter)
+			}
+			seen, _ := serveTest(t, a, r, http.StatusOK)
+			got[i] = seen.Get("Authorization")
+		}
+		return got
+	}
+	assertSequence(t, sequence("/v1", "Bearer a1|a2|a3", "|", 3), []string{"Bearer a1", "Bearer a2", "Bearer a3"})
+	// 按指定的分隔符拆分后，逗号是密钥的一部分
+	assertSequence(t, sequence("/v2", "Bearer a,1;a,2", ";", 2), []string{"Bearer a,1", "Bearer a,2"})
+	// 未携带时使用配置的分隔符
+	assertSequence(t, sequence("/v3", "Bearer a1,a2", "", 2), []string{"Bearer a1", "Bearer a2"})
+	// 多个字符、字母数字或不在允许列表中的分隔符被忽略
+	for i, delimiter := range []string{"||", "a", " ", "=", ":"} {
+		if got := sequence("/v4/"+strconv.Itoa(i), "Bearer a1,a2", delimiter, 1); got[0] != "Bearer a1" {
+			t.Errorf("分隔符 %q: Authorization = %q, 期望按逗号拆分", delimiter, got[0])
+		}
+	}
+	if got := sequence("/v5", "Bearer a1:a2", ":", 1); got[0] != "Bearer a1:a2" {
+		t.Errorf("不允许的分隔符 ':' 被使用: %q", got[0])
+	}
+}
+
+func TestDelimiterHeaderRotatedConflict(t *testing.T) {
+	a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\ndelimiter_header authorization\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidHeader", err)
+	}
+}
+
+func TestForbiddenHeaders(t *testing.T) {
+	for _, name := range []string{"Host", "content-length", "Transfer-Encoding", "connection", "Sec-WebSocket-Key", "proxy-authorization"} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\nheaders Authorization "+name+"\n}")
+		if err := provisionTest(t, a); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%s: 错误 = %v, 期望 ErrInvalidHeader", name, err)
+		}
+	}
+	// 名称中只是含有这些前缀的普通请求头不受影响
+	newTestHandler(t, "", "headers Authorization X-Sec-Key X-Proxy-Key")
+}
+
+func TestBearerJWT(t *testing.T) {
+	j1 := "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2lnMQ"
+	j2 := "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIyIn0.c2lnMg"
+	// 默认时没有前缀的JWT列表按普通密钥列表轮换，原样写回
+	a := newTestHandler(t, "", "")
+	assertSequence(t, rotatedSequence(t, a, "/v1", j1+","+j2, 2), []string{j1, j2})
+
+	b := newTestHandler(t, "", "bearer_jwt")
+	assertSequence(t, rotatedSequence(t, b, "/v1", j1+","+j2, 3), []string{"Bearer " + j1, "Bearer " + j2, "Bearer " + j1})
+	// 已带前缀的值和不像JWT的密钥不受影响
+	assertSequence(t, rotatedSequence(t, b, "/v2", "Bearer "+j1+","+j2, 2), []string{"Bearer " + j1, "Bearer " + j2})
+	assertSequence(t, rotatedSequence(t, b, "/v3", "k1,k2", 2), []string{"k1", "k2"})
+	// 没有前缀的X-Api-Key不补前缀
+	r := httptest.NewRequest(http.MethodGet, "/v4", nil)
+	r.Header.Set("X-Api-Key", j1+","+j2)
+	if seen, _ := serveTest(t, b, r, http.StatusOK); seen.Get("X-Api-Key") != j1 {
+		t.Errorf("X-Api-Key = %q, 期望 %q", seen.Get("X-Api-Key"), j1)
+	}
+
+	// 单个JWT与单个Bearer密钥一样原样转发，不推进索引
+	for i := 0; i < 2; i++ {
+		if got := rotatedSequence(t, b, "/single", j1, 1)[0]; got != j1 {
+			t.Errorf("单个JWT: Authorization = %q, 期望原样转发", got)
+		}
+	}
+	if _, ok := snapshotIndexes(b.indexFile)["/single"]; ok {
+		t.Error("单个JWT不应推进索引")
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	a := newTestHandler(t, "", "schemes Bearer Basic Token\nschemes ApiKey GenieKey")
+	for i, c := range []struct {
+		value string
+		want  []string
+	}{
+		{"Token a1,a2", []string{"Token a1", "Token a2"}},
+		// 保留请求中的原始写法
+		{"apikey a1,a2", []string{"apikey a1", "apikey a2"}},
+		{"GenieKey a1,a2", []string{"GenieKey a1", "GenieKey a2"}},
+		{"Basic a1,a2", []string{"Basic a1", "Basic a2"}},
+		// 未识别的前缀按普通密钥列表处理
+		{"Foo a1,a2", []string{"Foo a1", "a2"}},
+	} {
+		assertSequence(t, rotatedSequence(t, a, "/v"+strconv.Itoa(i), c.value, len(c.want)), c.want)
+	}
+
+	// 对所有轮换请求头生效
+	for _, want := range []string{"Token g1", "Token g2"} {
+		r := httptest.NewRequest(http.MethodGet, "/goog", nil)
+		r.Header.Set("X-Goog-Api-Key", "Token g1,g2")
+		if seen, _ := serveTest(t, a, r, http.StatusOK); seen.Get("X-Goog-Api-Key") != want {
+			t.Errorf("X-Goog-Api-Key = %q, 期望 %q", seen.Get("X-Goog-Api-Key"), want)
+		}
+	}
+
+	// 默认只识别Bearer和Basic
+	b := newTestHandler(t, "", "")
+	assertSequence(t, rotatedSequence(t, b, "/v1", "Token a1,a2", 2), []string{"Token a1", "a2"})
+}
+
+func TestLogSample(t *testing.T) {
+	a := parseTest(t, "auth_modifier index.json {\nlog_sample 3\n}")
+	if a.LogSample != 3 {
+		t.Errorf("LogSample = %d, 期望 3", a.LogSample)
+	}
+	err := new(AuthModifier).UnmarshalCaddyfile(caddyfile.NewTestDispenser("auth_modifier index.json {\nlog_sample many\n}"))
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidOption", err)
+	}
+
+	for _, c := range []struct {
+		block string
+		level zapcore.Level
+		want  int
+	}{
+		{"", zap.DebugLevel, 7},
+		{"log_sample 3", zap.DebugLevel, 3}, // 第1、4、7次
+		{"log_sample 3", zap.InfoLevel, 0},
+	} {
+		a := newTestHandler(t, "", c.block)
+		core, logs := observer.New(c.level)
+		a.logger = zap.New(core)
+		rotatedSequence(t, a, "/v1", "k0,k1", 7)
+		if n := logs.FilterMessage("Set Authorization").Len(); n != c.want {
+			t.Errorf("%q %s: 输出了 %d 条轮换日志, 期望 %d", c.block, c.level, n, c.want)
+		}
+		// 调试级别未开启时不计数
+		if c.level > zap.DebugLevel && atomic.LoadUint32(&a.logCount) != 0 {
+			t.Errorf("%q %s: 采样计数 = %d, 期望 0", c.block, c.level, a.logCount)
+		}
+	}
+}
+
+// fakeSpan 记录SetAttributes收到的属性，其余方法沿用空操作的span
+type fakeSpan struct {
+	trace.Span
+	recording bool
+	attrs     map[attribute.Key]string
+}
+
+func (s *fakeSpan) IsRecording() bool { return s.recording }
+
+func (s *fakeSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value.Emit()
+	}
+}
+
+func TestSpanAttributes(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	spanRequest := func(recording bool) (*http.Request, *fakeSpan) {
+		span := &fakeSpan{Span: trace.SpanFromContext(context.Background()), recording: recording, attrs: make(map[attribute.Key]string)}
+		r := authRequest("/v1", "k0,k1,k2")
+		return r.WithContext(trace.ContextWithSpan(r.Context(), span)), span
+	}
+
+	// 未启用追踪时是空操作：没有span或span不在记录时都不写入属性
+	serveTest(t, a, authRequest("/v1", "k0,k1,k2"), http.StatusOK)
+	r, idle := spanRequest(false)
+	serveTest(t, a, r, http.StatusOK)
+	if len(idle.attrs) != 0 {
+		t.Errorf("不在记录的span收到了属性 %v", idle.attrs)
+	}
+
+	r, span := spanRequest(true)
+	serveTest(t, a, r, http.StatusOK)
+	want := map[attribute.Key]string{
+		"auth_modifier.strategy":       StrategyRoundRobin,
+		"auth_modifier.selected_index": "2",
+		"auth_modifier.selected_key":   a.keyLabel("k2"),
+		"auth_modifier.canary":         "false",
+	}
+	for k, v := range want {
+		if got := span.attrs[k]; got != v {
+			t.Errorf("%s = %q, 期望 %q", k, got, v)
+		}
+	}
+	if _, ok := span.attrs["auth_modifier.pool"]; !ok {
+		t.Error("缺少 auth_modifier.pool 属性")
+	}
+}
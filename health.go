@@ -0,0 +1,241 @@
+package auth_modifier
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maskToken 隐藏密钥的大部分内容，只保留末尾4个字符用于日志
+func maskToken(token string) string {
+	if len(token) <= 4 {
+		return "****"
+	}
+	return "****" + token[len(token)-4:]
+}
+
+// keyFailed 判断下游状态码是否说明密钥本身不可用（无效、无权限或被限流）
+func keyFailed(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
+
+// outcomeStatus 返回下游处理结果对应的状态码，处理出错时取错误中的状态码
+func outcomeStatus(rec *statusRecorder, err error) int {
+	if err != nil {
+		if herr, ok := err.(caddyhttp.HandlerError); ok && herr.StatusCode > 0 {
+			return herr.StatusCode
+		}
+		return http.StatusBadGateway
+	}
+	return rec.Status()
+}
+
+// cooldownFor 返回本次失败后密钥的隔离时长。
+// 启用honor_retry_after且下游返回429并带有Retry-After时使用服务端给出的时长，否则使用cooldown
+func (a *AuthModifier) cooldownFor(rec *statusRecorder, err error) time.Duration {
+	if a.HonorRetryAfter && err == nil && rec.Status() == http.StatusTooManyRequests {
+		if d, ok := parseRetryAfter(rec.Header().Get("Retry-After"), time.Now()); ok {
+			return d
+		}
+	}
+	return time.Duration(a.Cooldown)
+}
+
+// parseRetryAfter 解析Retry-After的秒数和HTTP日期两种格式，已过去的日期视为无效
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil || !t.After(now) {
+		return 0, false
+	}
+	return t.Sub(now), true
+}
+
+// quarantineEntry 记录一次隔离的开始和结束时间
+type quarantineEntry struct {
+	since time.Time
+	until time.Time
+}
+
+// quarantine 将密钥隔离d时长，期间共用同一共享索引的处理器选择时都会跳过该密钥
+func (a *AuthModifier) quarantine(token string, d time.Duration) {
+	now := time.Now()
+	q := a.indexFile.quarantine
+	q.mu.Lock()
+	q.entries[token] = quarantineEntry{since: now, until: now.Add(d)}
+	q.dirty = true
+	q.mu.Unlock()
+}
+
+// isQuarantinedLocked 判断密钥是否处于隔离期，过期的隔离记录会被顺便清理，调用方需持有healthMu。
+// 从文件恢复的记录只保存了密钥的哈希，第一次遇到对应的密钥时转为普通记录
+func (a *AuthModifier) isQuarantinedLocked(token string, now time.Time) bool {
+	q := a.indexFile.quarantine
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.entries[token]
+	if !ok && len(q.restored) > 0 {
+		h := tokenHash(token)
+		if entry, ok = q.restored[h]; ok {
+			delete(q.restored, h)
+			q.entries[token] = entry
+		}
+	}
+	if !ok {
+		return false
+	}
+	if now.After(entry.until) {
+		// recovery_ramp期间保留记录，由admitLocked按恢复权重放行
+		if !now.Before(a.releaseTime(entry)) {
+			delete(q.entries, token)
+		}
+		return false
+	}
+	return true
+}
+
+// isDenied 判断token是否在吊销列表中
+func (a *AuthModifier) isDenied(token string) bool {
+	if a.denied == nil {
+		return false
+	}
+	return a.denied.contains(token) || (a.denied.hasFingerprints() && a.denied.contains(fingerprintPrefix+a.keyID(token)))
+}
+
+// liveKeys 返回本次轮换的密钥列表中既未被隔离也未被吊销、且不在tried中的密钥数量
+func (a *AuthModifier) liveKeys(rot rotation, tried triedKeys) int {
+	if rot.tokens == nil {
+		return rot.length
+	}
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+	now := time.Now()
+	live := 0
+	for _, token := range rot.tokens {
+		if _, ok := tried[token]; ok {
+			continue
+		}
+		if !a.isDenied(token) && !a.isQuarantinedLocked(token, now) && !a.isDraining(token) && !a.quotaExhaustedLocked(token, now) {
+			live++
+		}
+	}
+	return live
+}
+
+// hasQuarantined 判断当前是否有处于隔离中的密钥
+func (a *AuthModifier) hasQuarantined() bool {
+	q := a.indexFile.quarantine
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries) > 0 || len(q.restored) > 0
+}
+
+// pickLive 从pos开始向后寻找第一个未被隔离、未被吊销、未在排空、未用完每日配额、本次请求未尝试过且并发未满的密钥，
+// 处于recovery_ramp的密钥按恢复权重随机接受，都不满足时退回pos。选中的密钥计入每日配额。配置了max_in_flight时会占用选中密钥的一个并发名额，
+// 第二个返回值表示是否占用成功，pos的并发也已满时为false
+func (a *AuthModifier) pickLive(r *http.Request, tokens []string, pos int) (int, bool) {
+	tried := triedFrom(r)
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+	if !a.hasQuarantined() && a.denied == nil && len(tried) == 0 && !a.tracksInFlight() && !a.hasDraining() && !a.tracksQuota() {
+		return pos, true
+	}
+	now := time.Now()
+	for i := 0; i < len(tokens); i++ {
+		p := (pos + i) % len(tokens)
+		if _, ok := tried[tokens[p]]; !ok && !a.isDenied(tokens[p]) && !a.isQuarantinedLocked(tokens[p], now) && !a.isDraining(tokens[p]) && !a.quotaExhaustedLocked(tokens[p], now) && a.admitLocked(tokens[p], now) && a.acquireLocked(tokens[p]) {
+			a.consumeQuotaLocked(tokens[p], now)
+			return p, true
+		}
+	}
+	a.consumeQuotaLocked(tokens[pos], now)
+	return pos, a.acquireLocked(tokens[pos])
+}
+
+// probeKeys 并发校验密钥池中的所有密钥，失败的密钥会被隔离一个冷却周期
+func (a *AuthModifier) probeKeys() {
+	client := &http.Client{Timeout: time.Duration(a.ProbeTimeout)}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < a.ProbeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				if err := a.probeKey(client, key); err != nil {
+					a.quarantine(key, time.Duration(a.Cooldown))
+					a.logger.Warn("Key failed startup validation, quarantined",
+						zap.String("Auth-Key", a.keyLabel(key)), zap.Error(err))
+				}
+			}
+		}()
+	}
+	for _, key := range a.keys() {
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// probeKey 携带密钥请求health_check_url，返回错误或4xx/5xx时视为失败
+func (a *AuthModifier) probeKey(client *http.Client, key string) error {
+	req, err := http.NewRequestWithContext(a.ctx, http.MethodGet, a.HealthCheckURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(a.Headers[0], key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// DeadResponse 是所有密钥都被隔离或吊销时直接返回给客户端的响应
+type DeadResponse struct {
+	StatusCode int    `json:"status_code"`
+	Body       string `json:"body,omitempty"` // 可选的JSON响应体
+}
+
+// allDead 判断本次轮换的请求头中是否有某个密钥池已没有可用的密钥
+func (a *AuthModifier) allDead(rotations []rotation) bool {
+	for _, rot := range rotations {
+		if a.liveKeys(rot, nil) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// respondAllDead 写出all_dead_response配置的响应
+func (a *AuthModifier) respondAllDead(w http.ResponseWriter, key string) error {
+	allDeadTotal.Inc()
+	a.logger.Warn("All keys are quarantined or denylisted", zap.String("index_key", key))
+	if len(a.AllDeadResponse.Body) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(a.AllDeadResponse.StatusCode)
+	_, err := io.WriteString(w, a.AllDeadResponse.Body)
+	return err
+}
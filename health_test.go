@@ -0,0 +1,194 @@
+package auth_modifier
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAllDeadResponseAfterPoolExhausted(t *testing.T) {
+	a := newTestHandler(t, "", "max_retries 10\nall_dead_response 503 `{\"error\":\"no keys\"}`")
+	var seen []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return nil
+	})
+	w := httptest.NewRecorder()
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 3 || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("尝试了 %v, 状态码 %d, 期望每个密钥各一次并返回最后的响应", seen, w.Code)
+	}
+
+	// 所有密钥都已被隔离，直接返回配置的响应而不再转发
+	before := testutil.ToFloat64(allDeadTotal)
+	seen = nil
+	w = httptest.NewRecorder()
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 0 {
+		t.Errorf("全部隔离时仍转发了 %v", seen)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != `{"error":"no keys"}` {
+		t.Errorf("响应 = %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if got := testutil.ToFloat64(allDeadTotal) - before; got != 1 {
+		t.Errorf("all_dead_total 增加了 %v, 期望 1", got)
+	}
+
+	// 其他密钥池不受影响
+	seen = nil
+	if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k4,k5"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) == 0 {
+		t.Error("未被隔离的密钥池没有转发")
+	}
+}
+
+func TestAllDeadResponseWithoutBody(t *testing.T) {
+	a := newTestHandler(t, "", "strategy failover\nall_dead_response 502")
+	next, seen := countingNext(http.StatusUnauthorized)
+	for i := 0; i < 2; i++ {
+		serveTest(t, a, authRequest("/v1", "k1,k2"), http.StatusUnauthorized)
+	}
+	w := httptest.NewRecorder()
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(*seen) != 0 || w.Code != http.StatusBadGateway || w.Body.Len() != 0 {
+		t.Errorf("转发了 %v, 响应 %d %q", *seen, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "" {
+		t.Errorf("没有响应体时 Content-Type = %q", ct)
+	}
+}
+
+func TestAllDeadResponseValidation(t *testing.T) {
+	for _, block := range []string{"all_dead_response 99", "all_dead_response 600", "all_dead_response 503 `{oops`"} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\n"+block+"\n}")
+		if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: 错误 = %v, 期望 ErrInvalidOption", block, err)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"Sun, 01 Mar 2026 13:00:00 GMT", time.Hour, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := parseRetryAfter(c.value, now)
+		if got != c.want || ok != c.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, 期望 %v, %v", c.value, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestHonorRetryAfterCooldown(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{"秒数", http.StatusTooManyRequests, "300", 5 * time.Minute},
+		{"HTTP日期", http.StatusTooManyRequests, time.Now().Add(2 * time.Hour).UTC().Format(http.TimeFormat), 2 * time.Hour},
+		{"未携带", http.StatusTooManyRequests, "", time.Minute},
+		{"无法解析", http.StatusTooManyRequests, "later", time.Minute},
+		{"非429", http.StatusUnauthorized, "300", time.Minute},
+	} {
+		a := newTestHandler(t, "", "strategy failover\ncooldown 1m\nhonor_retry_after")
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if len(c.retryAfter) > 0 {
+				w.Header().Set("Retry-After", c.retryAfter)
+			}
+			w.WriteHeader(c.status)
+			return nil
+		})
+		if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k1,k2"), next); err != nil {
+			t.Fatal(err)
+		}
+		a.indexFile.quarantine.mu.Lock()
+		entry, ok := a.indexFile.quarantine.entries["k1"]
+		a.indexFile.quarantine.mu.Unlock()
+		if !ok {
+			t.Errorf("%s: k1 没有被隔离", c.name)
+			continue
+		}
+		// HTTP日期只精确到秒
+		if got := entry.until.Sub(entry.since); got < c.want-time.Second || got > c.want+time.Second {
+			t.Errorf("%s: 隔离时长 = %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUnmarshalValidateOnStart(t *testing.T) {
+	a := parseTest(t, "auth_modifier index.json {\nvalidate_on_start\nhealth_check_url http://127.0.0.1/v1/models\nprobe_timeout 2s\nprobe_workers 3\n}")
+	if !a.ValidateOnStart || a.HealthCheckURL != "http://127.0.0.1/v1/models" || a.ProbeTimeout != caddy.Duration(2*time.Second) || a.ProbeWorkers != 3 {
+		t.Errorf("解析结果 = %v %q %s %d", a.ValidateOnStart, a.HealthCheckURL, time.Duration(a.ProbeTimeout), a.ProbeWorkers)
+	}
+	a = parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\nvalidate_on_start\nkeys k0\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrMissingOption) {
+		t.Errorf("缺少health_check_url: 错误 = %v, 期望 ErrMissingOption", err)
+	}
+}
+
+func TestValidateOnStartBoundedProbes(t *testing.T) {
+	var inFlight, peak int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if r.Header.Get("Authorization") == "bad" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+
+	a := newTestHandler(t, "", "validate_on_start\nhealth_check_url "+upstream.URL+"\nprobe_workers 2\nkeys k0 k1 bad k2 k3 k4 k5")
+	// Provision返回时所有密钥都已校验完，同时进行的校验不超过probe_workers
+	if p := atomic.LoadInt32(&peak); p != 2 {
+		t.Errorf("最大并发校验数 = %d, 期望 2", p)
+	}
+	q := a.indexFile.quarantine
+	q.mu.Lock()
+	_, bad := q.entries["bad"]
+	quarantined := len(q.entries)
+	q.mu.Unlock()
+	if !bad || quarantined != 1 {
+		t.Errorf("隔离了 %d 个密钥, bad被隔离 = %v, 期望只隔离bad", quarantined, bad)
+	}
+}
@@ -0,0 +1,764 @@
+package auth_modifier
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// indexFileVersion 是当前索引文件格式的版本号
+const indexFileVersion = 3
+
+// 完整索引文件的编码格式，增量日志总是JSON Lines
+const (
+	FormatJSON   = "json"   // JSON（默认），便于查看和手工修改
+	FormatBinary = "binary" // gob编码，索引键很多时文件更小、读写更快
+)
+
+var validFormats = []string{FormatJSON, FormatBinary}
+
+// binaryMagic 是二进制索引文件的文件头，加载时据此识别格式，切换format无需手工迁移
+var binaryMagic = []byte("AMIX\x01")
+
+// indexSnapshot 是完整索引文件的内容。
+// 版本1的文件只有索引映射本身，即 {"/v1/models": 1}，加载时仍然兼容。
+type indexSnapshot struct {
+	Version int                `json:"version"`
+	Indexes map[string]int     `json:"indexes"`
+	Weights map[string][]int   `json:"weights,omitempty"`  // 平滑加权轮询的当前权重
+	Seen    map[string]int64   `json:"seen,omitempty"`     // 每个索引键最近一次使用的Unix时间戳
+	Latency map[string]float64 `json:"latency,omitempty"`  // adaptive_latency下各密钥（按tokenHash）的延迟EWMA，单位秒
+	SavedAt int64              `json:"saved_at,omitempty"` // 保存时的Unix时间戳，用于恢复延迟统计时衰减
+	KeyBy   string             `json:"key_by,omitempty"`   // 生成这些索引键的key_by，供migrate判断是否需要迁移
+	Global  uint64             `json:"global,omitempty"`   // key_by global的计数器
+}
+
+// journalEntry 是增量日志中的一条记录，表示某个索引键的最新状态
+type journalEntry struct {
+	Path    string `json:"path"`
+	Index   *int   `json:"index,omitempty"`
+	Weights []int  `json:"weights,omitempty"`
+	Seen    int64  `json:"seen,omitempty"`
+}
+
+// indexFiles 按索引文件登记所有正在使用的indexFile，
+// 指向同一文件的多个处理器共享同一份内存索引和保存协程
+var indexFiles = caddy.NewUsagePool()
+
+// indexFile 是一个索引文件在内存中的状态，由所有指向该文件的AuthModifier共享
+type indexFile struct {
+	global uint64 // key_by global的计数器，原子操作；放在结构体开头以保证32位平台上的8字节对齐
+
+	// 后台保存的统计，原子操作，紧跟global以保持8字节对齐
+	saves    uint64 // 实际写入的次数
+	skipped  uint64 // 没有变化而跳过的次数
+	failures uint64 // 写入失败的次数
+	lastTick int64  // 保存协程最近一次被定时器唤醒的时间（UnixNano）
+	lastSave int64  // 最近一次成功写入的时间（UnixNano）
+	running  int32  // 保存协程是否在运行
+
+	Indexes    map[string]int
+	Mutex      sync.RWMutex
+	saveMu     sync.Mutex // 串行化保存，从编码到写入完成期间持有，先于Mutex获取
+	SaveTicker *time.Ticker
+	Changed    bool // 追踪索引数据是否有变化
+
+	persistOptions
+
+	path    string // 索引文件路径
+	storage certmagic.Storage
+	logger  *zap.Logger
+	done    chan struct{}
+
+	dirty          map[string]struct{} // 自上次保存以来发生变化的索引键
+	journalEntries int                 // 当前增量日志中的记录数
+	swrr           map[string][]int    // 平滑加权轮询中每个索引键下各密钥的当前权重
+	lastSeen       map[string]time.Time
+	removed        bool             // 自上次保存以来是否删除过索引键，增量日志无法表达删除，需要重写完整索引
+	lastReset      int64            // 最近一次定期重置的时间点（Unix时间戳）
+	memoryOnly     bool             // 只在内存中维护索引，不读写文件或存储
+	latency        *latencyTracker  // 各密钥的延迟统计，随完整索引文件保存
+	quota          *quotaCounter    // 每日配额的计数，保存在单独的计数文件中
+	quarantine     *quarantineState // 被隔离的密钥，保存在单独的隔离记录文件中
+	keyBy          string           // 索引键的计算方式，见keyByMode
+	savedGlobal    uint64           // 上次写入完整索引文件时的全局计数器
+
+	drainMu       sync.Mutex
+	draining      map[string]struct{}        // 通过管理接口标记为排空的密钥指纹
+	drainingCount int32                      // draining的大小，原子操作，用于无锁判断是否有排空中的密钥
+	handlers      map[*AuthModifier]struct{} // 使用该共享索引的处理器
+}
+
+// persistOptions 是共享索引文件的持久化配置，由保存协程在持有锁时读取
+type persistOptions struct {
+	journal      bool
+	compactAfter int
+	pruneAfter   time.Duration // 超过该时长未使用的索引键会在保存时被清理，0表示不清理
+	maxFileBytes int           // 完整索引文件的大小上限，超过时丢弃最久未使用的索引键，0表示不限制
+	format       string        // 完整索引文件的编码格式
+	pretty       bool          // json格式下是否缩进输出
+	interval     time.Duration // 定时保存的间隔
+}
+
+// persistOptions 返回处理器配置的索引文件持久化选项
+func (a *AuthModifier) persistOptions() persistOptions {
+	return persistOptions{
+		journal:      a.Journal,
+		compactAfter: a.CompactAfter,
+		pruneAfter:   time.Duration(a.PruneAfter),
+		maxFileBytes: a.MaxFileBytes,
+		format:       a.Format,
+		pretty:       a.Pretty,
+		interval:     time.Duration(a.SaveInterval),
+	}
+}
+
+// instancePath 在索引文件的扩展名之前加上实例标识，如indexes.json变为indexes-<id>.json
+func instancePath(name, id string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + id + ext
+}
+
+// isInstanceID 判断id是否可以安全地用作文件名的一部分
+func isInstanceID(id string) bool {
+	if id == "." || id == ".." {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// registryKey 返回用于在indexFiles中查找共享索引的键
+func (a *AuthModifier) registryKey() (string, error) {
+	if a.IgnorePersisted {
+		return "memory:" + a.IndexPath, nil
+	}
+	if a.UseStorage {
+		return "storage:" + a.IndexPath, nil
+	}
+	abs, err := filepath.Abs(a.IndexPath)
+	if err != nil {
+		return "", err
+	}
+	return "file:" + abs, nil
+}
+
+// openIndexFile 获取当前配置对应的共享索引，首次使用时加载文件并启动保存协程。
+// 共享时以最后一个打开该文件的处理器的持久化配置为准，见reconfigure
+func (a *AuthModifier) openIndexFile(storage certmagic.Storage) error {
+	key, err := a.registryKey()
+	if err != nil {
+		return err
+	}
+	val, loaded, err := indexFiles.LoadOrNew(key, func() (caddy.Destructor, error) {
+		f := &indexFile{
+			persistOptions: a.persistOptions(),
+			path:           a.IndexPath,
+			storage:        storage,
+			logger:         a.logger,
+			done:           make(chan struct{}),
+			dirty:          make(map[string]struct{}),
+			swrr:           make(map[string][]int),
+			lastSeen:       make(map[string]time.Time),
+			latency:        newLatencyTracker(),
+			quota:          newQuotaCounter(),
+			quarantine:     newQuarantineState(),
+			draining:       make(map[string]struct{}),
+			handlers:       make(map[*AuthModifier]struct{}),
+			memoryOnly:     a.IgnorePersisted,
+		}
+		if f.memoryOnly {
+			f.storage = nil
+		}
+		f.loadIndexes()
+		if !a.Migrate {
+			f.applyKeyBy(a.keyByMode(), false)
+		}
+		f.start()
+		return f, nil
+	})
+	if err != nil {
+		return err
+	}
+	a.indexFile = val.(*indexFile)
+	if loaded {
+		a.logger.Debug("Sharing indexes with another handler", zap.String("path", a.IndexPath))
+		a.indexFile.reconfigure(a.persistOptions())
+		if !a.Migrate {
+			a.indexFile.applyKeyBy(a.keyByMode(), false)
+		}
+	}
+	a.indexFileKey = key
+	return nil
+}
+
+// saveInterval 返回定时保存的间隔。非法的间隔会由Validate拒绝，这里只保证不会因此panic
+func (o persistOptions) saveInterval() time.Duration {
+	if o.interval <= 0 {
+		return defaultSaveInterval
+	}
+	return o.interval
+}
+
+// reconfigure 应用后打开该文件的处理器的持久化配置。重载配置时新的处理器在旧的处理器
+// 释放共享索引之前Provision，以后者为准，修改journal、format等选项才能在重载后生效；
+// 同一份配置中指向同一文件的处理器配置不一致时，以最后一个为准并记录警告
+func (f *indexFile) reconfigure(opts persistOptions) {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	if f.persistOptions == opts {
+		return
+	}
+	f.logger.Warn("Handlers sharing the index file have different persistence options, applying the latest",
+		zap.String("path", f.path), zap.Bool("journal", opts.journal), zap.String("format", opts.format),
+		zap.Duration("save_interval", opts.interval))
+	if opts.saveInterval() != f.saveInterval() {
+		f.SaveTicker.Reset(opts.saveInterval())
+	}
+	// 编码格式变化后尽快按新格式重写完整索引，关闭增量日志时同时合并遗留的日志
+	if opts.format != f.format || opts.pretty != f.pretty || (f.journal && !opts.journal) {
+		f.removed = true
+		f.Changed = true
+	}
+	f.persistOptions = opts
+}
+
+// start 启动定时任务，每隔saveInterval保存一次索引到文件
+func (f *indexFile) start() {
+	f.SaveTicker = time.NewTicker(f.saveInterval())
+	f.run(f.SaveTicker.C)
+}
+
+// run 启动保存协程，每从ticks收到一次时间就保存一次索引，直到done关闭
+func (f *indexFile) run(ticks <-chan time.Time) {
+	atomic.StoreInt32(&f.running, 1)
+	go func() {
+		defer atomic.StoreInt32(&f.running, 0)
+		for {
+			select {
+			case now := <-ticks:
+				atomic.StoreInt64(&f.lastTick, now.UnixNano())
+				f.saveIndexes()
+			case <-f.done:
+				return
+			}
+		}
+	}()
+}
+
+// saverStatus 是后台保存协程的运行状态
+type saverStatus struct {
+	Running  bool       `json:"running"`
+	Saves    uint64     `json:"saves"`
+	Skipped  uint64     `json:"skipped"`
+	Failures uint64     `json:"failures"`
+	LastTick *time.Time `json:"last_tick,omitempty"`
+	LastSave *time.Time `json:"last_save,omitempty"`
+}
+
+// status 返回后台保存协程的运行状态和保存计数，计数包括定时保存以及管理接口、重置、迁移和退出时的保存
+func (f *indexFile) status() saverStatus {
+	return saverStatus{
+		Running:  atomic.LoadInt32(&f.running) == 1,
+		Saves:    atomic.LoadUint64(&f.saves),
+		Skipped:  atomic.LoadUint64(&f.skipped),
+		Failures: atomic.LoadUint64(&f.failures),
+		LastTick: unixNanoTime(atomic.LoadInt64(&f.lastTick)),
+		LastSave: unixNanoTime(atomic.LoadInt64(&f.lastSave)),
+	}
+}
+
+// unixNanoTime 把UnixNano时间戳转换为时间，0表示尚未发生，返回nil
+func unixNanoTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns)
+	return &t
+}
+
+// Destruct 在最后一个使用者释放时调用，停止保存协程并保存一次完整索引和每日配额计数
+func (f *indexFile) Destruct() error {
+	close(f.done)       // 通知goroutine退出
+	f.SaveTicker.Stop() // 停止定时器
+	f.persistIndexes(true)
+	if !f.memoryOnly {
+		f.saveQuota()
+	}
+	return nil
+}
+
+// journalPath 返回增量日志文件的路径
+func (f *indexFile) journalPath() string {
+	return f.path + ".journal"
+}
+
+// storageKey 返回索引在Caddy存储中的键
+func (f *indexFile) storageKey() string {
+	return path.Join("auth_modifier", f.path)
+}
+
+// readIndexes 读取完整索引数据，数据不存在时返回nil
+func (f *indexFile) readIndexes() ([]byte, error) {
+	if f.storage != nil {
+		// certmagic的ErrNotExist无法可靠区分，先判断是否存在
+		if !f.storage.Exists(f.storageKey()) {
+			return nil, nil
+		}
+		return f.storage.Load(f.storageKey())
+	}
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f *indexFile) loadIndexes() {
+	f.Indexes = make(map[string]int)
+	if f.memoryOnly {
+		return
+	}
+	data, err := f.readIndexes()
+	if err != nil {
+		f.logger.Error("Error reading indexes file", zap.Error(err))
+	} else if len(data) > 0 {
+		if err := f.unmarshalSnapshot(data); err != nil {
+			f.logger.Error("Error parsing indexes file", zap.Error(err))
+			f.Indexes = make(map[string]int)
+			f.swrr = make(map[string][]int)
+		}
+	}
+	// 即使未开启增量日志也回放遗留的日志，避免关闭该选项后丢失最近的变化
+	if f.storage == nil {
+		f.replayJournal()
+	}
+	// 旧文件没有记录使用时间，视为刚刚使用过
+	now := time.Now()
+	for key := range f.Indexes {
+		f.touchLocked(key, now, false)
+	}
+	for key := range f.swrr {
+		f.touchLocked(key, now, false)
+	}
+}
+
+// touchLocked 记录索引键的使用时间，overwrite为false时不覆盖已有记录，调用方需持有锁
+func (f *indexFile) touchLocked(key string, now time.Time, overwrite bool) {
+	if _, ok := f.lastSeen[key]; ok && !overwrite {
+		return
+	}
+	f.lastSeen[key] = now
+}
+
+// removeLocked 删除索引键及其权重和使用时间，下次保存时重写完整索引，调用方需持有锁
+func (f *indexFile) removeLocked(key string) {
+	delete(f.Indexes, key)
+	delete(f.swrr, key)
+	delete(f.lastSeen, key)
+	delete(f.dirty, key)
+	f.removed = true
+	f.Changed = true
+}
+
+// replace 用indexes整体替换当前的索引，不在其中的索引键的权重和使用时间一并删除，
+// 下次保存时重写完整索引。返回替换前的索引键数量
+func (f *indexFile) replace(indexes map[string]int) int {
+	now := time.Now()
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	previous := len(f.Indexes)
+	for key := range f.Indexes {
+		if _, ok := indexes[key]; !ok {
+			delete(f.swrr, key)
+			delete(f.lastSeen, key)
+		}
+	}
+	f.Indexes = indexes
+	f.dirty = make(map[string]struct{})
+	for key := range indexes {
+		f.touchLocked(key, now, true)
+	}
+	f.removed = true
+	f.Changed = true
+	return previous
+}
+
+// pruneLocked 清理超过pruneAfter未使用的索引键，返回清理的数量，调用方需持有锁
+func (f *indexFile) pruneLocked(now time.Time) int {
+	if f.pruneAfter <= 0 {
+		return 0
+	}
+	pruned := 0
+	for key, seen := range f.lastSeen {
+		if now.Sub(seen) <= f.pruneAfter {
+			continue
+		}
+		delete(f.Indexes, key)
+		delete(f.swrr, key)
+		delete(f.lastSeen, key)
+		delete(f.dirty, key)
+		pruned++
+	}
+	if pruned > 0 {
+		f.logger.Info("Pruned idle index entries", zap.Int("count", pruned))
+	}
+	return pruned
+}
+
+// truncateLocked 按最近使用时间从旧到新丢弃索引键，直到完整索引不超过maxFileBytes，
+// 返回重新编码后的数据。每轮按平均每个索引键占用的字节数估计需要丢弃的数量，调用方需持有锁
+func (f *indexFile) truncateLocked(data []byte) ([]byte, error) {
+	keys := make([]string, 0, len(f.Indexes))
+	for key := range f.Indexes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return f.lastSeen[keys[i]].Before(f.lastSeen[keys[j]])
+	})
+	size := len(data)
+	dropped := 0
+	var err error
+	for len(data) > f.maxFileBytes && dropped < len(keys) {
+		per := len(data) / (len(keys) - dropped)
+		if per < 1 {
+			per = 1
+		}
+		n := (len(data)-f.maxFileBytes)/per + 1
+		if dropped+n > len(keys) {
+			n = len(keys) - dropped
+		}
+		for _, key := range keys[dropped : dropped+n] {
+			delete(f.Indexes, key)
+			delete(f.swrr, key)
+			delete(f.lastSeen, key)
+			delete(f.dirty, key)
+		}
+		dropped += n
+		if data, err = f.marshalSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+	f.logger.Warn("Dropped least recently used index entries to fit max_file_bytes",
+		zap.Int("count", dropped), zap.Int("bytes_before", size), zap.Int("bytes", len(data)),
+		zap.Int("max_file_bytes", f.maxFileBytes))
+	if len(data) > f.maxFileBytes {
+		f.logger.Warn("Index file still exceeds max_file_bytes without any index entries", zap.Int("bytes", len(data)))
+	}
+	return data, nil
+}
+
+// unmarshalSnapshot 解析完整索引文件，按文件头自动识别二进制格式，兼容只包含索引映射的旧格式
+func (f *indexFile) unmarshalSnapshot(data []byte) error {
+	var snapshot indexSnapshot
+	if bytes.HasPrefix(data, binaryMagic) {
+		if err := gob.NewDecoder(bytes.NewReader(data[len(binaryMagic):])).Decode(&snapshot); err != nil {
+			return err
+		}
+		f.applySnapshot(snapshot)
+		return nil
+	}
+	if err := json.Unmarshal(data, &snapshot); err == nil && snapshot.Version > 0 {
+		f.applySnapshot(snapshot)
+		return nil
+	}
+	return json.Unmarshal(data, &f.Indexes)
+}
+
+// applySnapshot 用解析出的完整索引替换内存中的状态
+func (f *indexFile) applySnapshot(snapshot indexSnapshot) {
+	if snapshot.Indexes != nil {
+		f.Indexes = snapshot.Indexes
+	}
+	if snapshot.Weights != nil {
+		f.swrr = snapshot.Weights
+	}
+	for key, seen := range snapshot.Seen {
+		f.lastSeen[key] = time.Unix(seen, 0)
+	}
+	var elapsed time.Duration
+	if snapshot.SavedAt > 0 {
+		elapsed = time.Since(time.Unix(snapshot.SavedAt, 0))
+	}
+	f.latency.restore(snapshot.Latency, elapsed)
+	f.keyBy = snapshot.KeyBy
+	atomic.StoreUint64(&f.global, snapshot.Global)
+	f.savedGlobal = snapshot.Global
+}
+
+// marshalSnapshot 按format编码完整索引文件，调用方需持有锁
+func (f *indexFile) marshalSnapshot() ([]byte, error) {
+	return f.encodeSnapshot(f.snapshotLocked(f.latency.values()))
+}
+
+// snapshotLocked 汇总需要写入完整索引文件的状态，不修改内存中的状态，调用方需持有锁
+func (f *indexFile) snapshotLocked(latency map[string]float64) indexSnapshot {
+	snapshot := indexSnapshot{
+		Version: indexFileVersion,
+		Indexes: f.Indexes,
+		Latency: latency,
+		SavedAt: time.Now().Unix(),
+		KeyBy:   f.keyBy,
+		Global:  atomic.LoadUint64(&f.global),
+	}
+	if len(f.swrr) > 0 {
+		snapshot.Weights = f.swrr
+	}
+	if len(f.lastSeen) > 0 {
+		snapshot.Seen = make(map[string]int64, len(f.lastSeen))
+		for key, seen := range f.lastSeen {
+			snapshot.Seen[key] = seen.Unix()
+		}
+	}
+	return snapshot
+}
+
+// encodeSnapshot 按format和pretty编码完整索引
+func (f *indexFile) encodeSnapshot(snapshot indexSnapshot) ([]byte, error) {
+	if f.format == FormatBinary {
+		var buf bytes.Buffer
+		buf.Write(binaryMagic)
+		if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if f.pretty {
+		data, err := json.MarshalIndent(snapshot, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+	return json.Marshal(snapshot)
+}
+
+// replayJournal 将增量日志中的记录依次应用到内存索引上
+func (f *indexFile) replayJournal() {
+	file, err := os.Open(f.journalPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.logger.Error("Error opening indexes journal", zap.Error(err))
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// 进程崩溃时最后一行可能只写了一半，跳过即可
+			f.logger.Warn("Skipping malformed journal entry", zap.Error(err))
+			continue
+		}
+		if entry.Index != nil {
+			f.Indexes[entry.Path] = *entry.Index
+		}
+		if entry.Weights != nil {
+			f.swrr[entry.Path] = entry.Weights
+		}
+		if entry.Seen > 0 {
+			f.lastSeen[entry.Path] = time.Unix(entry.Seen, 0)
+		}
+		f.journalEntries++
+	}
+	if err := scanner.Err(); err != nil {
+		f.logger.Error("Error reading indexes journal", zap.Error(err))
+	}
+}
+
+func (f *indexFile) saveIndexes() {
+	f.persistIndexes(false)
+}
+
+// persistIndexes 保存索引。开启增量日志时只追加变化的路径，
+// 日志记录数超过阈值或compact为true时重写完整索引文件并清空日志。返回写入的字节数。
+// 写入期间不持有Mutex以免阻塞请求，由saveMu保证定时保存与管理接口等的保存不会交错，
+// 否则较旧的快照可能覆盖较新的快照，或在日志被合并删除后又追加较旧的记录
+func (f *indexFile) persistIndexes(compact bool) (int, error) {
+	if f.memoryOnly {
+		atomic.AddUint64(&f.skipped, 1)
+		return 0, nil
+	}
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+	f.Mutex.Lock()
+	// 增量日志无法表达删除，清理过索引键时需要重写完整索引
+	if f.pruneLocked(time.Now()) > 0 || f.removed {
+		f.Changed = true
+		compact = true
+	}
+	// 全局计数器只随完整索引文件保存，且不会产生增量日志记录，变化时直接重写完整索引；
+	// key_by global下没有其他索引键，完整索引很小。
+	// 写入成功后才记为已保存，编码之后计数器的递增最多让下一次保存多写一次
+	global := atomic.LoadUint64(&f.global)
+	if global != f.savedGlobal {
+		f.Changed = true
+		compact = true
+	}
+	// 延迟统计只随完整索引文件保存，增量日志模式下等到压缩时一并写入
+	if f.latency.isChanged() && (compact || !f.journal || f.storage != nil) {
+		f.Changed = true
+	}
+	if !f.Changed {
+		f.Mutex.Unlock()
+		atomic.AddUint64(&f.skipped, 1)
+		return 0, nil
+	}
+	// Caddy存储不支持追加写入，使用存储时总是写入完整索引
+	compact = compact || !f.journal || f.storage != nil || f.journalEntries+len(f.dirty) > f.compactAfter
+	var data []byte
+	var err error
+	if compact {
+		data, err = f.marshalSnapshot()
+		if err == nil && f.maxFileBytes > 0 && len(data) > f.maxFileBytes {
+			data, err = f.truncateLocked(data)
+		}
+	} else {
+		data, err = f.marshalJournal()
+	}
+	if err != nil {
+		f.logger.Error("Error marshalling indexes", zap.Error(err))
+		f.Mutex.Unlock()
+		atomic.AddUint64(&f.failures, 1)
+		return 0, err
+	}
+	dirty := f.dirty
+	f.dirty = make(map[string]struct{})
+	f.Changed = false
+	removed := f.removed
+	f.removed = false
+	f.Mutex.Unlock()
+
+	if compact {
+		err = f.writeSnapshot(data)
+	} else {
+		err = f.appendJournal(data)
+	}
+
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	if err != nil {
+		f.logger.Error("Error writing indexes to file", zap.Error(err))
+		for path := range dirty {
+			f.dirty[path] = struct{}{}
+		}
+		f.removed = f.removed || removed
+		f.Changed = true
+		atomic.AddUint64(&f.failures, 1)
+		return 0, err
+	}
+	if compact {
+		f.journalEntries = 0
+		f.savedGlobal = global
+	} else {
+		f.journalEntries += len(dirty)
+	}
+	atomic.AddUint64(&f.saves, 1)
+	atomic.StoreInt64(&f.lastSave, time.Now().UnixNano())
+	return len(data), nil
+}
+
+// flush 立即同步写入完整索引文件并合并增量日志，即使自上次保存以来没有变化
+func (f *indexFile) flush() (int, error) {
+	f.Mutex.Lock()
+	f.Changed = true
+	f.Mutex.Unlock()
+	return f.persistIndexes(true)
+}
+
+// marshalJournal 将变化的路径编码为JSON Lines格式，调用方需持有锁
+func (f *indexFile) marshalJournal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for path := range f.dirty {
+		entry := journalEntry{Path: path, Weights: f.swrr[path]}
+		if seen, ok := f.lastSeen[path]; ok {
+			entry.Seen = seen.Unix()
+		}
+		if index, ok := f.Indexes[path]; ok {
+			entry.Index = &index
+		}
+		if err := enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSnapshot 写入完整索引文件，成功后删除已被合并的增量日志。
+// 日志中的记录都早于新的完整索引，删除失败时改为清空，否则下次启动回放时会覆盖较新的索引
+func (f *indexFile) writeSnapshot(data []byte) error {
+	if f.storage != nil {
+		return f.storage.Store(f.storageKey(), data)
+	}
+	if err := writeFileAtomic(f.path, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Remove(f.journalPath()); err != nil && !os.IsNotExist(err) {
+		if terr := os.Truncate(f.journalPath(), 0); terr != nil {
+			return fmt.Errorf("removing journal: %v; truncating journal: %v", err, terr)
+		}
+		f.logger.Warn("Truncated indexes journal that could not be removed", zap.Error(err))
+	}
+	return nil
+}
+
+// writeFileAtomic 先写入同一目录下的临时文件并同步到磁盘，再重命名为path，
+// 进程崩溃或磁盘写满时path要么是旧内容，要么是完整的新内容
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(name, perm)
+	}
+	if err == nil {
+		err = os.Rename(name, path)
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// appendJournal 将记录追加到增量日志末尾
+func (f *indexFile) appendJournal(data []byte) error {
+	file, err := os.OpenFile(f.journalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
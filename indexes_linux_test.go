@@ -0,0 +1,86 @@
+package auth_modifier
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 增量日志替换为命名管道，定时保存会阻塞在打开日志文件上，直到测试打开读端
+func TestFlushWaitsForTickerSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json")
+	a := newTestHandler(t, path, "journal\nsave_interval 1h")
+	f := a.indexFile
+	rotatedSequence(t, a, "/v1", pool(5), 2)
+
+	// flush删除日志后仍可以通过硬链接打开同一个管道
+	if err := syscall.Mkfifo(f.journalPath(), 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	reader := filepath.Join(dir, "journal.fifo")
+	if err := os.Link(f.journalPath(), reader); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(chan error, 1)
+	go func() {
+		_, err := f.persistIndexes(false)
+		saved <- err
+	}()
+	// 变化的索引键在写入之前已取走，此时定时保存正阻塞在写入上
+	waitFor(t, "定时保存开始写入", func() bool {
+		f.Mutex.RLock()
+		defer f.Mutex.RUnlock()
+		return len(f.dirty) == 0
+	})
+	serveTest(t, a, authRequest("/v1", pool(5)), http.StatusOK)
+
+	flushed := make(chan error, 1)
+	go func() {
+		_, err := f.flush()
+		flushed <- err
+	}()
+	select {
+	case err := <-flushed:
+		t.Error("定时保存写入期间flush不应返回")
+		flushed <- err
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r, err := os.Open(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	// flush在定时保存之后写入完整索引并删除日志，重新加载得到最新的索引
+	if _, err := os.Stat(f.journalPath()); !os.IsNotExist(err) {
+		t.Errorf("flush后增量日志仍存在: %v", err)
+	}
+	reloaded := &indexFile{
+		persistOptions: f.persistOptions,
+		path:           path,
+		logger:         a.logger,
+		swrr:           make(map[string][]int),
+		lastSeen:       make(map[string]time.Time),
+		latency:        newLatencyTracker(),
+	}
+	reloaded.loadIndexes()
+	if got := reloaded.Indexes["/v1"]; got != 3 {
+		t.Errorf("重新加载的索引 = %d, 期望 3", got)
+	}
+}
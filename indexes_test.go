@@ -0,0 +1,470 @@
+package auth_modifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestSharedIndexFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	a := newTestHandler(t, path, "")
+	b := newTestHandler(t, path, "")
+	if a.indexFile != b.indexFile {
+		t.Fatal("指向同一文件的处理器应共享索引")
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		h := a
+		if i%2 == 1 {
+			h = b
+		}
+		seen, _ := serveTest(t, h, authRequest("/v1", "k1,k2,k3"), http.StatusOK)
+		got = append(got, seen.Get("Authorization"))
+	}
+	assertSequence(t, got, []string{"k1", "k2", "k3", "k1"})
+
+	// 并发请求的推进不会丢失
+	const n = 50
+	var wg sync.WaitGroup
+	for _, h := range []*AuthModifier{a, b} {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(h *AuthModifier) {
+				defer wg.Done()
+				next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+				if err := h.ServeHTTP(httptest.NewRecorder(), authRequest("/v2", "k1,k2,k3"), next); err != nil {
+					t.Error(err)
+				}
+			}(h)
+		}
+	}
+	wg.Wait()
+	if got := snapshotIndexes(a.indexFile)["/v2"]; got != 2*n {
+		t.Errorf("/v2 的索引 = %d, 期望 %d", got, 2*n)
+	}
+}
+
+func TestReloadAppliesPersistOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	old := newTestHandler(t, path, "")
+	rotatedSequence(t, old, "/v1", "k1,k2", 1)
+
+	// 重载时新配置在旧配置释放共享索引之前Provision
+	reloaded := newTestHandler(t, path, "journal\nformat binary\nsave_interval 1h")
+	f := reloaded.indexFile
+	if f != old.indexFile {
+		t.Fatal("指向同一文件的处理器应共享索引")
+	}
+	f.Mutex.RLock()
+	opts := f.persistOptions
+	f.Mutex.RUnlock()
+	if !opts.journal || opts.format != FormatBinary || opts.interval != time.Hour {
+		t.Fatalf("persistOptions = %+v, 期望使用重载后的配置", opts)
+	}
+
+	if _, err := f.persistIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, binaryMagic) {
+		t.Errorf("修改format后应按新格式重写完整索引: %q", data)
+	}
+}
+
+func TestReconfigureUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	a := newTestHandler(t, path, "journal")
+	b := newTestHandler(t, path, "journal")
+	f := b.indexFile
+	f.Mutex.RLock()
+	defer f.Mutex.RUnlock()
+	if f != a.indexFile || f.Changed || f.removed {
+		t.Errorf("配置相同时不应标记重写: changed=%v removed=%v", f.Changed, f.removed)
+	}
+}
+
+func TestWriteSnapshotReplacesJournal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json")
+	a := newTestHandler(t, path, "journal")
+	f := a.indexFile
+	rotatedSequence(t, a, "/v1", "k1,k2,k3", 2)
+	if _, err := f.persistIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.journalPath()); err != nil {
+		t.Fatalf("增量保存后应有日志: %v", err)
+	}
+
+	if _, err := f.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.journalPath()); !os.IsNotExist(err) {
+		t.Errorf("合并后日志应被删除: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "index.json" {
+		t.Errorf("目录中只应留下索引文件: %v", entries)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("索引文件权限 = %v, %v", info.Mode(), err)
+	}
+
+	reloaded := &indexFile{
+		persistOptions: f.persistOptions,
+		path:           path,
+		logger:         a.logger,
+		swrr:           make(map[string][]int),
+		lastSeen:       make(map[string]time.Time),
+		latency:        newLatencyTracker(),
+	}
+	reloaded.loadIndexes()
+	if reloaded.Indexes["/v1"] != 2 {
+		t.Errorf("重新加载的索引 = %v, 期望 /v1 为 2", reloaded.Indexes)
+	}
+}
+
+func TestWriteFileAtomicFailureKeepsTarget(t *testing.T) {
+	dir := t.TempDir()
+	// 目标是一个非空目录，重命名必然失败
+	target := filepath.Join(dir, "index.json")
+	if err := os.MkdirAll(filepath.Join(target, "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(target, []byte("{}"), 0644); err == nil {
+		t.Fatal("期望重命名失败")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("失败后应删除临时文件: %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(target, "keep")); err != nil {
+		t.Errorf("原有内容被破坏: %v", err)
+	}
+}
+
+func TestPruneAfter(t *testing.T) {
+	a := newTestHandler(t, "", "prune_after 1h\njournal")
+	f := a.indexFile
+	rotatedSequence(t, a, "/old", "k1,k2", 1)
+	rotatedSequence(t, a, "/new", "k1,k2", 1)
+
+	start := time.Now()
+	f.Mutex.Lock()
+	f.touchLocked("/new", start.Add(50*time.Minute), true)
+	if n := f.pruneLocked(start.Add(30 * time.Minute)); n != 0 {
+		t.Errorf("未超过prune_after时清理了 %d 个索引键", n)
+	}
+	if n := f.pruneLocked(start.Add(90 * time.Minute)); n != 1 {
+		t.Errorf("清理了 %d 个索引键, 期望 1", n)
+	}
+	_, oldOK := f.Indexes["/old"]
+	_, newOK := f.Indexes["/new"]
+	f.Mutex.Unlock()
+	if oldOK || !newOK {
+		t.Fatalf("清理后的索引 = %v", snapshotIndexes(f))
+	}
+
+	// 保存时按当前时间清理，并重写完整索引文件
+	rotatedSequence(t, a, "/stale", "k1,k2", 1)
+	f.Mutex.Lock()
+	f.lastSeen["/stale"] = time.Now().Add(-2 * time.Hour)
+	f.Mutex.Unlock()
+	if _, err := f.persistIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("/stale")) || !bytes.Contains(data, []byte("/new")) {
+		t.Errorf("保存的索引文件 = %s", data)
+	}
+}
+
+func TestFormatSwitchWithoutMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	for i, format := range []string{FormatJSON, FormatBinary, FormatJSON} {
+		a := newTestHandler(t, path, "format "+format)
+		// 每次都从上一种格式写入的文件继续轮换
+		assertSequence(t, rotatedSequence(t, a, "/v1", pool(5), 1), []string{"k" + strconv.Itoa(i)})
+		if err := a.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary := bytes.HasPrefix(data, binaryMagic); binary != (format == FormatBinary) {
+			t.Errorf("format %s 写入的文件头 = %q", format, data[:len(binaryMagic)])
+		}
+	}
+}
+
+// largeIndexFile 构造包含n个索引键的索引，用于比较两种格式
+func largeIndexFile(format string, n int) *indexFile {
+	f := &indexFile{
+		persistOptions: persistOptions{format: format},
+		logger:         zap.NewNop(),
+		Indexes:        make(map[string]int, n),
+		swrr:           make(map[string][]int),
+		lastSeen:       make(map[string]time.Time),
+		latency:        newLatencyTracker(),
+	}
+	for i := 0; i < n; i++ {
+		f.Indexes["/v1/models/"+strconv.Itoa(i)] = i % defaultIndexCap
+	}
+	return f
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	f := largeIndexFile(FormatBinary, 1000)
+	f.swrr["/v1/models/1"] = []int{3, -2, -1}
+	data, err := f.marshalSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := largeIndexFile(FormatJSON, 0)
+	if err := g.unmarshalSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g.Indexes, f.Indexes) || !reflect.DeepEqual(g.swrr, f.swrr) {
+		t.Error("二进制格式读回的内容与写入的不同")
+	}
+	jsonData, err := largeIndexFile(FormatJSON, 1000).marshalSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(jsonData) {
+		t.Errorf("二进制 %d 字节, JSON %d 字节, 期望二进制更小", len(data), len(jsonData))
+	}
+}
+
+func benchmarkEncode(b *testing.B, format string) {
+	f := largeIndexFile(format, 100000)
+	var size int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := f.marshalSnapshot()
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "file-bytes")
+}
+
+func benchmarkDecode(b *testing.B, format string) {
+	data, err := largeIndexFile(format, 100000).marshalSnapshot()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := largeIndexFile(format, 0).unmarshalSnapshot(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveJSON(b *testing.B)   { benchmarkEncode(b, FormatJSON) }
+func BenchmarkSaveBinary(b *testing.B) { benchmarkEncode(b, FormatBinary) }
+func BenchmarkLoadJSON(b *testing.B)   { benchmarkDecode(b, FormatJSON) }
+func BenchmarkLoadBinary(b *testing.B) { benchmarkDecode(b, FormatBinary) }
+
+func TestPrettyRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	a := newTestHandler(t, path, "pretty")
+	rotatedSequence(t, a, "/v1", pool(3), 2)
+	w := newTestHandler(t, path, "pretty\nstrategy weighted_round_robin")
+	rotatedSequence(t, w, "/v2", "x:2,y", 1)
+	if _, err := a.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, []byte("}\n")) || !bytes.Contains(data, []byte("\n  \"indexes\": {\n")) {
+		t.Errorf("pretty 应写入带缩进和结尾换行的JSON: %s", data)
+	}
+	a.Cleanup()
+	w.Cleanup()
+
+	// 默认的紧凑格式也能加载缩进的文件，并从保存的位置继续
+	b := newTestHandler(t, path, "")
+	assertSequence(t, rotatedSequence(t, b, "/v1", pool(3), 1), []string{"k2"})
+	bw := newTestHandler(t, path, "strategy weighted_round_robin")
+	assertSequence(t, rotatedSequence(t, bw, "/v2", "x:2,y", 2), []string{"y", "x"})
+	if _, err := b.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.ContainsRune(data, '\n') {
+		t.Errorf("默认应写入紧凑的JSON: %s", data)
+	}
+}
+
+func TestMaxFileBytesDropsOldestEntries(t *testing.T) {
+	a := newTestHandler(t, "", "max_file_bytes 4096\nsave_interval 1h")
+	now := time.Now()
+	a.Mutex.Lock()
+	for i := 0; i < 500; i++ {
+		key := "/v1/models/" + strconv.Itoa(i)
+		a.Indexes[key] = i
+		// 编号越大越近使用
+		a.lastSeen[key] = now.Add(time.Duration(i-500) * time.Second)
+	}
+	a.Changed = true
+	a.Mutex.Unlock()
+
+	if _, err := a.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 4096 {
+		t.Fatalf("索引文件 %d 字节, 超过 max_file_bytes", len(data))
+	}
+	saved, _ := savedIndexes(t, a.IndexPath)
+	if len(saved) == 0 || len(saved) >= 500 {
+		t.Fatalf("保存了 %d 个索引键", len(saved))
+	}
+	// 保留的都是最近使用的索引键
+	for i := 500 - len(saved); i < 500; i++ {
+		if _, ok := saved["/v1/models/"+strconv.Itoa(i)]; !ok {
+			t.Errorf("最近使用的 /v1/models/%d 被丢弃", i)
+			break
+		}
+	}
+	// 内存中的索引与文件一致
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, saved) {
+		t.Errorf("内存中保留了 %d 个索引键, 文件中 %d 个", len(got), len(saved))
+	}
+}
+
+func TestSaverCounters(t *testing.T) {
+	a := storageReplica(t, &certmagic.FileStorage{Path: t.TempDir()})
+	f := a.indexFile
+	if s := f.status(); s.Running || s.LastTick != nil || s.LastSave != nil {
+		t.Fatalf("启动前的状态 = %+v", s)
+	}
+	ticks := make(chan time.Time)
+	f.run(ticks)
+	waitFor(t, "保存协程启动", func() bool { return f.status().Running })
+
+	// 没有变化时跳过保存
+	first := time.Unix(1700000000, 0)
+	ticks <- first
+	waitFor(t, "跳过保存", func() bool { return f.status().Skipped == 1 })
+	if s := f.status(); s.Saves != 0 || s.LastTick == nil || !s.LastTick.Equal(first) || s.LastSave != nil {
+		t.Errorf("第一次触发后的状态 = %+v", s)
+	}
+
+	setIndex(a, "/v1", 1)
+	second := first.Add(30 * time.Second)
+	ticks <- second
+	waitFor(t, "保存", func() bool { return f.status().Saves == 1 })
+	if s := f.status(); s.Skipped != 1 || !s.LastTick.Equal(second) || s.LastSave == nil || s.Failures != 0 {
+		t.Errorf("第二次触发后的状态 = %+v", s)
+	}
+
+	close(f.done)
+	waitFor(t, "保存协程退出", func() bool { return !f.status().Running })
+}
+
+func TestSaverAdmin(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	api := new(AdminAPI)
+	w, status := adminRequest(t, api.handleSaver, http.MethodGet, "/auth_modifier/saver", "")
+	if status != http.StatusOK {
+		t.Fatalf("状态码 = %d", status)
+	}
+	var resp saverResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.IndexFile != a.IndexPath || !resp.Running {
+		t.Errorf("响应 = %+v", resp)
+	}
+	if _, status := adminRequest(t, api.handleSaver, http.MethodPost, "/auth_modifier/saver", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST: 状态码 = %d, 期望 405", status)
+	}
+}
+
+func TestInstanceIDSeparateFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "indexes.json")
+	a := newTestHandler(t, path, "instance_id openai")
+	b := newTestHandler(t, path, "instance_id anthropic")
+	if a.indexFile == b.indexFile {
+		t.Fatal("不同instance_id的处理器共享了索引")
+	}
+	rotatedSequence(t, a, "/v1", pool(3), 2)
+	rotatedSequence(t, b, "/v1", pool(3), 1)
+	for _, h := range []*AuthModifier{a, b} {
+		if _, err := h.persistIndexes(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, want := range map[string]map[string]int{
+		"indexes-openai.json":    {"/v1": 2},
+		"indexes-anthropic.json": {"/v1": 1},
+	} {
+		if saved, _ := savedIndexes(t, filepath.Join(dir, file)); !reflect.DeepEqual(saved, want) {
+			t.Errorf("%s = %v, 期望 %v", file, saved, want)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("不应写入不带实例标识的 %s: %v", path, err)
+	}
+
+	// 相同的instance_id仍然共享
+	if c := newTestHandler(t, path, "instance_id openai"); c.indexFile != a.indexFile {
+		t.Error("相同instance_id的处理器没有共享索引")
+	}
+}
+
+func TestInstanceIDInvalid(t *testing.T) {
+	if got := instancePath("/data/indexes.json", "a1"); got != "/data/indexes-a1.json" {
+		t.Errorf("instancePath = %q", got)
+	}
+	if got := instancePath("indexes", "a1"); got != "indexes-a1" {
+		t.Errorf("没有扩展名时 instancePath = %q", got)
+	}
+	for _, id := range []string{"..", "a/b", "a b", "../x"} {
+		a := &AuthModifier{IndexPath: filepath.Join(t.TempDir(), "index.json"), InstanceID: id}
+		if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("instance_id %q: 错误 = %v, 期望 ErrInvalidOption", id, err)
+		}
+	}
+}
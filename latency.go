@@ -0,0 +1,164 @@
+package auth_modifier
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyAlpha 是延迟指数加权移动平均的平滑系数，越大越偏向最近的观测值
+const latencyAlpha = 0.3
+
+// latencyHalfLife 是恢复持久化的延迟统计时的衰减半衰期：
+// 距上次保存每经过一个半衰期，各密钥与平均值的差距减半，停机越久越接近等权重
+const latencyHalfLife = 10 * time.Minute
+
+// latencyTracker 记录每个密钥的上游延迟EWMA（秒），按tokenHash索引，以便随索引文件保存
+type latencyTracker struct {
+	mu      sync.Mutex
+	ewma    map[string]float64
+	changed bool // 自上次编码以来是否有新的观测值
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{ewma: make(map[string]float64)}
+}
+
+// observe 用一次观测到的延迟更新密钥的EWMA。max大于0时最多统计max个密钥，
+// 超出的新密钥不记录，选择时按当前最快的密钥对待
+func (t *latencyTracker) observe(token string, d time.Duration, max int) {
+	sample := d.Seconds()
+	h := tokenHash(token)
+	t.mu.Lock()
+	if prev, ok := t.ewma[h]; ok {
+		t.ewma[h] = latencyAlpha*sample + (1-latencyAlpha)*prev
+	} else if max > 0 && len(t.ewma) >= max {
+		t.mu.Unlock()
+		return
+	} else {
+		t.ewma[h] = sample
+	}
+	t.changed = true
+	t.mu.Unlock()
+}
+
+// weights 返回pool中各密钥的动态权重，与延迟EWMA成反比。
+// 还没有观测值的密钥按当前最快的密钥对待，保证新密钥也能被选中并得到观测值
+func (t *latencyTracker) weights(pool []string) []float64 {
+	weights := make([]float64, len(pool))
+	fastest := 0.0
+	hashes := make([]string, len(pool))
+	for i, token := range pool {
+		hashes[i] = tokenHash(token)
+	}
+	t.mu.Lock()
+	for i, h := range hashes {
+		if v, ok := t.ewma[h]; ok && v > 0 {
+			weights[i] = 1 / v
+			if weights[i] > fastest {
+				fastest = weights[i]
+			}
+		}
+	}
+	t.mu.Unlock()
+	if fastest == 0 {
+		fastest = 1
+	}
+	for i := range weights {
+		if weights[i] == 0 {
+			weights[i] = fastest
+		}
+	}
+	return weights
+}
+
+// isChanged 判断自上次编码以来是否有新的观测值
+func (t *latencyTracker) isChanged() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.changed
+}
+
+// values 返回当前统计的副本用于保存，并清除变化标记
+func (t *latencyTracker) values() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.changed = false
+	return t.copyLocked()
+}
+
+// copy 返回当前统计的副本，不影响变化标记
+func (t *latencyTracker) copy() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.copyLocked()
+}
+
+func (t *latencyTracker) copyLocked() map[string]float64 {
+	if len(t.ewma) == 0 {
+		return nil
+	}
+	values := make(map[string]float64, len(t.ewma))
+	for h, v := range t.ewma {
+		values[h] = v
+	}
+	return values
+}
+
+// restore 恢复保存的统计，并按距上次保存经过的时间elapsed向平均值衰减。
+// elapsed未知（为0）时不衰减
+func (t *latencyTracker) restore(values map[string]float64, elapsed time.Duration) {
+	if len(values) == 0 {
+		return
+	}
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	decay := 1.0
+	if elapsed > 0 {
+		decay = math.Pow(0.5, float64(elapsed)/float64(latencyHalfLife))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for h, v := range values {
+		if v > 0 {
+			t.ewma[h] = mean + (v-mean)*decay
+		}
+	}
+}
+
+// adaptiveLatencySelector 按延迟EWMA的倒数加权随机选择，越快的密钥被选中的概率越高，
+// 较慢的密钥仍会偶尔被选中，延迟恢复后可以重新得到更高的权重
+type adaptiveLatencySelector struct {
+	a *AuthModifier
+}
+
+func (s adaptiveLatencySelector) Select(ctx context.Context, key string, pool []string) int {
+	weights := s.a.latency.weights(pool)
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	draw := randFloat64(s.a.rnd) * total
+	for i, w := range weights {
+		if draw < w {
+			return i
+		}
+		draw -= w
+	}
+	return len(pool) - 1
+}
+
+// observeLatency 记录本次尝试的延迟。密钥失败的响应（如401、429）通常很快返回，不计入，避免失效的密钥显得更快
+func (a *AuthModifier) observeLatency(rotations []rotation, rec *statusRecorder, err error) {
+	if a.latency == nil || keyFailed(outcomeStatus(rec, err)) {
+		return
+	}
+	elapsed := time.Since(rec.start)
+	for _, rot := range rotations {
+		a.latency.observe(rot.token, elapsed, a.MaxTrackedKeys)
+	}
+}
@@ -0,0 +1,146 @@
+package auth_modifier
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestAdaptiveLatencyPrefersFasterKey(t *testing.T) {
+	a := newTestHandler(t, "", "strategy adaptive_latency")
+	for i := 0; i < 5; i++ {
+		a.latency.observe("fast", 10*time.Millisecond, 0)
+		a.latency.observe("slow", 90*time.Millisecond, 0)
+	}
+	const n = 5000
+	counts := map[int]int{}
+	selector := adaptiveLatencySelector{a}
+	for i := 0; i < n; i++ {
+		counts[selector.Select(context.Background(), "/v1", []string{"slow", "fast"})]++
+	}
+	// 权重与延迟成反比，fast应占约90%
+	if got := float64(counts[1]) / n; got < 0.87 || got > 0.93 {
+		t.Errorf("fast 占比 %.3f, 期望约 0.9", got)
+	}
+	if counts[0] == 0 {
+		t.Error("较慢的密钥也应偶尔被选中")
+	}
+}
+
+func TestAdaptiveLatencyWeights(t *testing.T) {
+	tracker := newLatencyTracker()
+	tracker.observe("a", 100*time.Millisecond, 0)
+	tracker.observe("a", 200*time.Millisecond, 0)
+	tracker.observe("b", 50*time.Millisecond, 0)
+	// a的EWMA为0.3*0.2+0.7*0.1=0.13s，没有观测值的c按最快的b对待
+	weights := tracker.weights([]string{"a", "b", "c"})
+	want := []float64{1 / 0.13, 20, 20}
+	for i := range want {
+		if math.Abs(weights[i]-want[i]) > 1e-9 {
+			t.Errorf("weights = %v, 期望 %v", weights, want)
+			break
+		}
+	}
+	// max_tracked_keys已满时不再记录新的密钥
+	tracker.observe("d", time.Second, 2)
+	if _, ok := tracker.copy()[tokenHash("d")]; ok {
+		t.Error("超出上限的密钥不应被记录")
+	}
+}
+
+func TestAdaptiveLatencyObservesServeTime(t *testing.T) {
+	a := newTestHandler(t, "", "strategy adaptive_latency")
+	// 固定随机源，保证每个密钥都会被选中
+	a.rnd = rand.New(rand.NewSource(1))
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		switch r.Header.Get("Authorization") {
+		case "slow":
+			time.Sleep(20 * time.Millisecond)
+		case "bad":
+			// 密钥失败的响应很快，不计入延迟
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		return nil
+	})
+	for i := 0; i < 20; i++ {
+		if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "slow,fast,bad"), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ewma := a.latency.copy()
+	slow, fast := ewma[tokenHash("slow")], ewma[tokenHash("fast")]
+	if slow < 0.015 || fast <= 0 || fast >= slow {
+		t.Errorf("slow = %.4fs, fast = %.4fs", slow, fast)
+	}
+	if _, ok := ewma[tokenHash("bad")]; ok {
+		t.Error("401的响应不应计入延迟")
+	}
+}
+
+func TestLatencyRestoreDecay(t *testing.T) {
+	values := map[string]float64{"a": 0.1, "b": 0.3}
+	for _, c := range []struct {
+		elapsed time.Duration
+		a, b    float64
+	}{
+		{0, 0.1, 0.3},
+		{latencyHalfLife, 0.15, 0.25},
+		{2 * latencyHalfLife, 0.175, 0.225},
+		{100 * latencyHalfLife, 0.2, 0.2},
+	} {
+		tracker := newLatencyTracker()
+		tracker.restore(values, c.elapsed)
+		got := tracker.copy()
+		if math.Abs(got["a"]-c.a) > 1e-9 || math.Abs(got["b"]-c.b) > 1e-9 {
+			t.Errorf("经过 %v: %v, 期望 a=%v b=%v", c.elapsed, got, c.a, c.b)
+		}
+	}
+}
+
+func TestLatencyPersistRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	a := newTestHandler(t, path, "strategy adaptive_latency")
+	a.latency.observe("fast", 10*time.Millisecond, 0)
+	a.latency.observe("slow", 90*time.Millisecond, 0)
+	if err := a.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestHandler(t, path, "strategy adaptive_latency")
+	got := b.latency.copy()
+	// saved_at只精确到秒，可能已按不到1秒的停机时间略微衰减
+	if len(got) != 2 || math.Abs(got[tokenHash("fast")]-0.01) > 1e-4 || math.Abs(got[tokenHash("slow")]-0.09) > 1e-4 {
+		t.Errorf("重启后的延迟统计 = %v", got)
+	}
+	if b.latency.isChanged() {
+		t.Error("刚恢复的统计不应标记为有变化")
+	}
+}
+
+func TestLatencyRestoreFromOldSnapshot(t *testing.T) {
+	f := largeIndexFile(FormatJSON, 1)
+	f.latency.observe("fast", 10*time.Millisecond, 0)
+	f.latency.observe("slow", 30*time.Millisecond, 0)
+	snapshot := f.snapshotLocked(f.latency.values())
+	// 停机一个半衰期后差距减半
+	snapshot.SavedAt = time.Now().Add(-latencyHalfLife).Unix()
+	data, err := f.encodeSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := largeIndexFile(FormatJSON, 0)
+	if err := g.unmarshalSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	got := g.latency.copy()
+	if math.Abs(got[tokenHash("fast")]-0.015) > 1e-4 || math.Abs(got[tokenHash("slow")]-0.025) > 1e-4 {
+		t.Errorf("恢复的延迟统计 = %v, 期望约 0.015 和 0.025", got)
+	}
+}
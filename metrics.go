@@ -0,0 +1,46 @@
+package auth_modifier
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 插件的指标注册在Prometheus默认注册表中，随Caddy的metrics端点一同输出
+var (
+	allDeadTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth_modifier",
+		Name:      "all_dead_total",
+		Help:      "Requests for which every key in the pool was quarantined or denylisted.",
+	})
+	selectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth_modifier",
+		Name:      "selections_total",
+		Help:      "Times each key was selected, labeled by strategy and by the key's alias or masked suffix.",
+	}, []string{"strategy", "key"})
+	strategyRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth_modifier",
+		Name:      "strategy_requests_total",
+		Help:      "Rotated requests, labeled by the strategy that selected the key.",
+	}, []string{"strategy"})
+	auditDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth_modifier",
+		Name:      "audit_dropped_total",
+		Help:      "Audit log entries dropped because the buffer was full or the write failed.",
+	})
+	smallPoolTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth_modifier",
+		Name:      "small_pool_total",
+		Help:      "Requests whose key pool was smaller than min_pool_size.",
+	})
+	malformedBasicTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth_modifier",
+		Name:      "malformed_basic_total",
+		Help:      "Requests carrying a Basic credential that is not valid base64 user:password.",
+	})
+)
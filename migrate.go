@@ -0,0 +1,123 @@
+package auth_modifier
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// keyByMode 返回描述索引键计算方式的字符串，随索引文件保存，用于判断key_by是否发生了变化
+func (a *AuthModifier) keyByMode() string {
+	if len(a.KeyTemplate) > 0 {
+		return "template:" + a.KeyTemplate
+	}
+	return a.KeyBy
+}
+
+// detectKeyBy 为没有记录key_by的旧索引文件推断索引键的计算方式：
+// 所有键都是路径时为path，都是"方法 路径"时为path_method，无法判断时返回空
+func detectKeyBy(indexes map[string]int) string {
+	mode := ""
+	for key := range indexes {
+		current := ""
+		switch {
+		case strings.HasPrefix(key, "/"):
+			current = KeyByPath
+		case isMethodPathKey(key):
+			current = KeyByPathMethod
+		default:
+			return ""
+		}
+		if len(mode) > 0 && mode != current {
+			return ""
+		}
+		mode = current
+	}
+	return mode
+}
+
+// isMethodPathKey 判断key是否形如"GET /v1/models"
+func isMethodPathKey(key string) bool {
+	i := strings.IndexByte(key, ' ')
+	if i <= 0 || !strings.HasPrefix(key[i+1:], "/") {
+		return false
+	}
+	return strings.ToUpper(key[:i]) == key[:i]
+}
+
+// migrateKey 将from方式下的索引键转换为to方式下的索引键，无法转换时ok为false。
+// path_method转为path时去掉方法；path转为path_method时保留原键，由indexLocked在新键首次出现时沿用；
+// 其余组合（如pool_hash、headers:、key_template）无法从旧键推出新键
+func migrateKey(key, from, to string) (string, bool) {
+	switch {
+	case from == to:
+		return key, true
+	case from == KeyByPathMethod && to == KeyByPath:
+		if i := strings.IndexByte(key, ' '); i >= 0 {
+			return key[i+1:], true
+		}
+	case from == KeyByPath && to == KeyByPathMethod:
+		return key, true
+	}
+	return "", false
+}
+
+// applyKeyBy 记录处理器的key_by，migrate为true时先转换旧的索引键，发生迁移时立即重写完整索引文件。
+// 重载配置时新的处理器在旧的处理器释放共享索引之前Provision，因此共享索引时同样需要调用，以最后一个处理器为准。
+// 开启migrate时由Validate在配置通过检查后调用，否则在Provision打开共享索引时调用
+func (f *indexFile) applyKeyBy(to string, migrate bool) {
+	f.Mutex.Lock()
+	migrated := migrate && f.migrateLocked(to)
+	f.keyBy = to
+	f.Mutex.Unlock()
+	if migrated {
+		f.persistIndexes(true)
+	}
+}
+
+// migrateLocked 在key_by变化后转换或丢弃旧的索引键，返回是否发生了迁移。
+// 多个旧键转换为同一个新键时保留较大的索引，调用方需持有锁
+func (f *indexFile) migrateLocked(to string) bool {
+	from := f.keyBy
+	if len(from) == 0 {
+		from = detectKeyBy(f.Indexes)
+	}
+	if len(from) == 0 || from == to {
+		return false
+	}
+	indexes := make(map[string]int, len(f.Indexes))
+	converted, discarded := 0, 0
+	for key, index := range f.Indexes {
+		newKey, ok := migrateKey(key, from, to)
+		if !ok {
+			delete(f.swrr, key)
+			delete(f.lastSeen, key)
+			discarded++
+			continue
+		}
+		if newKey != key {
+			if weights, ok := f.swrr[key]; ok {
+				delete(f.swrr, key)
+				f.swrr[newKey] = weights
+			}
+			if seen, ok := f.lastSeen[key]; ok {
+				delete(f.lastSeen, key)
+				if prev, ok := f.lastSeen[newKey]; !ok || seen.After(prev) {
+					f.lastSeen[newKey] = seen
+				}
+			}
+			converted++
+		}
+		if prev, ok := indexes[newKey]; !ok || index > prev {
+			indexes[newKey] = index
+		}
+	}
+	f.Indexes = indexes
+	f.dirty = make(map[string]struct{})
+	f.removed = true
+	f.Changed = true
+	f.logger.Info("Migrated indexes to new key_by",
+		zap.String("from", from), zap.String("to", to),
+		zap.Int("converted", converted), zap.Int("discarded", discarded))
+	return true
+}
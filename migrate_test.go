@@ -0,0 +1,151 @@
+package auth_modifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectKeyBy(t *testing.T) {
+	for _, c := range []struct {
+		indexes map[string]int
+		want    string
+	}{
+		{map[string]int{"/v1": 1, "/v2": 2}, KeyByPath},
+		{map[string]int{"GET /v1": 1, "POST /v1": 2}, KeyByPathMethod},
+		{map[string]int{"GET /v1": 1, "/v2": 2}, ""},
+		{map[string]int{"get /v1": 1}, ""},
+		{map[string]int{"3f2a9c": 1}, ""},
+		{map[string]int{}, ""},
+	} {
+		if got := detectKeyBy(c.indexes); got != c.want {
+			t.Errorf("detectKeyBy(%v) = %q, 期望 %q", c.indexes, got, c.want)
+		}
+	}
+}
+
+func TestMigrateKey(t *testing.T) {
+	for _, c := range []struct {
+		key, from, to, want string
+		ok                  bool
+	}{
+		{"GET /v1", KeyByPathMethod, KeyByPath, "/v1", true},
+		{"/v1", KeyByPath, KeyByPathMethod, "/v1", true},
+		{"/v1", KeyByPath, KeyByPath, "/v1", true},
+		{"/v1", KeyByPath, KeyByPoolHash, "", false},
+		{"GET /v1", KeyByPathMethod, "template:{http.request.host}", "", false},
+	} {
+		got, ok := migrateKey(c.key, c.from, c.to)
+		if got != c.want || ok != c.ok {
+			t.Errorf("migrateKey(%q, %s, %s) = %q, %v, 期望 %q, %v", c.key, c.from, c.to, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// savedIndexes 读取索引文件中保存的索引和key_by
+func savedIndexes(t *testing.T, path string) (map[string]int, string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot indexSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot.Indexes, snapshot.KeyBy
+}
+
+func TestMigrateOnKeyByChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	old := newTestHandler(t, path, "key_by path_method")
+	for method, n := range map[string]int{"GET": 2, "POST": 5} {
+		for i := 0; i < n; i++ {
+			serveTest(t, old, methodRequest(method, "/v1", pool(10)), http.StatusOK)
+		}
+	}
+	serveTest(t, old, methodRequest("GET", "/v2", pool(10)), http.StatusOK)
+
+	// 与重载配置时一样，新的处理器在旧的处理器释放共享索引之前Provision。
+	// 去掉方法后合并为同一路径，保留较大的索引，并立即重写索引文件
+	a := newTestHandler(t, path, "key_by path\nmigrate")
+	if a.indexFile != old.indexFile {
+		t.Fatal("新旧处理器应共享同一份索引")
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"/v1": 5, "/v2": 1}
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("迁移后的索引 = %v, 期望 %v", got, want)
+	}
+	if saved, keyBy := savedIndexes(t, path); !reflect.DeepEqual(saved, want) || keyBy != KeyByPath {
+		t.Errorf("索引文件 = %v key_by=%q", saved, keyBy)
+	}
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(10), 1), []string{"k5"})
+
+	// 无法转换的键被丢弃
+	b := newTestHandler(t, path, "key_by pool_hash\nmigrate")
+	if err := a.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotIndexes(b.indexFile); len(got) != 0 {
+		t.Errorf("切换到pool_hash后的索引 = %v, 期望为空", got)
+	}
+	if _, keyBy := savedIndexes(t, path); keyBy != KeyByPoolHash {
+		t.Errorf("索引文件的key_by = %q, 期望 %q", keyBy, KeyByPoolHash)
+	}
+}
+
+func TestMigrateDisabledKeepsEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	// 没有记录key_by的旧格式文件
+	if err := os.WriteFile(path, []byte(`{"GET /v1": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestHandler(t, path, "key_by path")
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, map[string]int{"GET /v1": 3}) {
+		t.Errorf("未开启migrate时索引 = %v, 期望原样保留", got)
+	}
+	if err := a.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestHandler(t, path, "key_by path\nmigrate")
+	if got := snapshotIndexes(b.indexFile); !reflect.DeepEqual(got, map[string]int{"/v1": 3}) {
+		t.Errorf("按键的格式推断后迁移的索引 = %v", got)
+	}
+}
+
+func TestMigrateInvalidKeyByLeavesIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	running := newTestHandler(t, path, "key_by path_method")
+	serveTest(t, running, methodRequest("GET", "/v1", pool(3)), http.StatusOK)
+	if _, err := running.indexFile.flush(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 与重载时一样在正在使用的处理器释放共享索引之前Provision，非法的key_by被Validate拒绝
+	a := parseTest(t, "auth_modifier "+path+" {\nkey_by pathh\nmigrate\n}")
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("错误 = %v, 期望 ErrInvalidOption", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Errorf("索引文件被改写: %s", after)
+	}
+	if got := snapshotIndexes(running.indexFile); !reflect.DeepEqual(got, map[string]int{"GET /v1": 1}) {
+		t.Errorf("正在使用的索引 = %v, 期望保持不变", got)
+	}
+}
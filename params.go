@@ -0,0 +1,75 @@
+package auth_modifier
+
+import "strings"
+
+// splitAuthParams 从去掉认证方案前缀后的密钥串rest中分离出末尾的认证参数（RFC 7235的auth-param），
+// 返回密钥列表部分和参数部分，参数部分包含其前面的分隔符，写回时原样接在选中的密钥之后。规则：
+//  1. 只在请求头带有认证方案前缀（如Bearer）时解析，scheme为空时不做处理；
+//  2. 形如 名称=值 的元素是参数：名称由token字符组成，值为token或带引号的字符串，且不以=开头，
+//     因此base64末尾的=填充不会被当成参数；
+//  3. 第一个参数及其后的所有内容都属于参数，参数之前的元素才是密钥；第一个元素就是参数时视为没有参数；
+//  4. 引号内的分隔符不拆分，如realm="a,b"。
+func splitAuthParams(scheme, rest, delimiter string) (string, string) {
+	if len(scheme) == 0 || !strings.Contains(rest, "=") {
+		return rest, ""
+	}
+	inQuote, escaped := false, false
+	start := 0
+	for i := 0; i <= len(rest); {
+		if i == len(rest) || (!inQuote && strings.HasPrefix(rest[i:], delimiter)) {
+			if isAuthParam(strings.TrimSpace(rest[start:i])) {
+				if start == 0 {
+					return rest, ""
+				}
+				return rest[:start-len(delimiter)], rest[start-len(delimiter):]
+			}
+			if i == len(rest) {
+				break
+			}
+			i += len(delimiter)
+			start = i
+			continue
+		}
+		switch c := rest[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuote:
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		}
+		i++
+	}
+	return rest, ""
+}
+
+// isAuthParam 判断s是否形如 名称=token 或 名称="带引号的字符串"
+func isAuthParam(s string) bool {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return false
+	}
+	name, value := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	if !isToken(name) || len(value) == 0 || value[0] == '=' {
+		return false
+	}
+	if value[0] == '"' {
+		return len(value) >= 2 && value[len(value)-1] == '"'
+	}
+	return isToken(value)
+}
+
+// isToken 判断s是否只由HTTP token字符组成
+func isToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSplitAuthParams(t *testing.T) {
+	tests := []struct {
+		scheme, rest string
+		keys, params string
+	}{
+		{"Bearer ", `a1,a2, realm="x"`, "a1,a2", `, realm="x"`},
+		{"Bearer ", `a1,a2,realm=x,scope="read write"`, "a1,a2", `,realm=x,scope="read write"`},
+		// 引号内的分隔符不拆分
+		{"Bearer ", `a1,a2, realm="a,b"`, "a1,a2", `, realm="a,b"`},
+		{"Bearer ", `a1, realm="say \"hi\", bye"`, "a1", `, realm="say \"hi\", bye"`},
+		// base64末尾的=填充不是参数
+		{"Basic ", "YTpi,Yzpk==", "YTpi,Yzpk==", ""},
+		{"Bearer ", "a1=,a2==", "a1=,a2==", ""},
+		// 没有认证方案前缀时不解析
+		{"", `a1,a2,realm=x`, `a1,a2,realm=x`, ""},
+		// 第一个元素就是参数时视为没有参数
+		{"Bearer ", `realm=x,a1`, `realm=x,a1`, ""},
+		// 参数之后的元素都属于参数
+		{"Bearer ", `a1,realm=x,a2`, "a1", ",realm=x,a2"},
+		// 值没有闭合引号时不是参数
+		{"Bearer ", `a1,realm="x`, `a1,realm="x`, ""},
+	}
+	for _, tt := range tests {
+		keys, params := splitAuthParams(tt.scheme, tt.rest, ",")
+		if keys != tt.keys || params != tt.params {
+			t.Errorf("splitAuthParams(%q, %q) = %q, %q, 期望 %q, %q", tt.scheme, tt.rest, keys, params, tt.keys, tt.params)
+		}
+	}
+}
+
+func TestRotatePreservesAuthParams(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	assertSequence(t, rotatedSequence(t, a, "/v1", `Bearer a1,a2, realm="x,y"`, 3),
+		[]string{`Bearer a1, realm="x,y"`, `Bearer a2, realm="x,y"`, `Bearer a1, realm="x,y"`})
+
+	// 只有一个密钥和参数时不是密钥列表，原样放行
+	seen, _ := serveTest(t, a, authRequest("/v2", `Bearer a1, realm="x"`), http.StatusOK)
+	if got := seen.Get("Authorization"); got != `Bearer a1, realm="x"` {
+		t.Errorf("Authorization = %q", got)
+	}
+	if indexes := snapshotIndexes(a.indexFile); indexes["/v2"] != 0 {
+		t.Errorf("单个密钥推进了索引: %v", indexes)
+	}
+}
@@ -0,0 +1,56 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// min_pool_size的处理方式
+const (
+	MinPoolWarn   = "warn"   // 只记录警告并计数，请求照常转发（默认）
+	MinPoolReject = "reject" // 直接返回min_pool_status，不再转发
+)
+
+var validMinPoolModes = []string{MinPoolWarn, MinPoolReject}
+
+// smallestPool 返回本次请求中最小的密钥池、其原始值和大小：配置了keys时为keys（原始值为空），
+// 否则为请求中携带的各轮换请求头（zip_headers的跟随请求头除外）。请求中没有任何密钥池时ok为false
+func (a *AuthModifier) smallestPool(r *http.Request) (name, value string, size int, ok bool) {
+	headers := a.Headers
+	if pool := a.keys(); len(pool) > 0 {
+		name, size, ok = "keys", len(pool), true
+		headers = headers[1:]
+	}
+	for _, h := range headers {
+		v := r.Header.Get(h)
+		if len(v) == 0 || a.zipped[h] {
+			continue
+		}
+		scheme, rest := a.trimScheme(h, v)
+		delimiter := a.delimiter(r, h)
+		rest, _ = splitAuthParams(scheme, rest, delimiter)
+		n := strings.Count(rest, delimiter) + 1
+		if !ok || n < size {
+			name, value, size, ok = h, v, n, true
+		}
+	}
+	return name, value, size, ok
+}
+
+// checkPoolSize 检查请求的密钥池是否达到min_pool_size，返回false时已写出拒绝的响应
+func (a *AuthModifier) checkPoolSize(w http.ResponseWriter, r *http.Request) bool {
+	name, value, size, ok := a.smallestPool(r)
+	if !ok || size >= a.MinPoolSize {
+		return true
+	}
+	smallPoolTotal.Inc()
+	a.warnPool("Key pool is smaller than min_pool_size", name, value,
+		zap.Int("size", size), zap.Int("min_pool_size", a.MinPoolSize))
+	if a.MinPoolMode != MinPoolReject {
+		return true
+	}
+	w.WriteHeader(a.MinPoolStatus)
+	return false
+}
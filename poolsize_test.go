@@ -0,0 +1,64 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMinPoolSizeWarn(t *testing.T) {
+	a := newTestHandler(t, "", "min_pool_size 3")
+	before := testutil.ToFloat64(smallPoolTotal)
+	next, seen := countingNext(http.StatusOK)
+	for _, value := range []string{"k1", "k1,k2", "k1,k2,k3"} {
+		w := httptest.NewRecorder()
+		if err := a.ServeHTTP(w, authRequest("/v1", value), next); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: 状态码 = %d, warn模式下应照常转发", value, w.Code)
+		}
+	}
+	if len(*seen) != 3 {
+		t.Errorf("转发了 %v, 期望全部转发", *seen)
+	}
+	if got := testutil.ToFloat64(smallPoolTotal) - before; got != 2 {
+		t.Errorf("small_pool_total 增加了 %v, 期望 2", got)
+	}
+}
+
+func TestMinPoolSizeReject(t *testing.T) {
+	for _, c := range []struct {
+		block  string
+		status int
+	}{
+		{"min_pool_size 2 reject", http.StatusBadRequest},
+		{"min_pool_size 2 reject\nmin_pool_status 503", http.StatusServiceUnavailable},
+	} {
+		a := newTestHandler(t, "", c.block)
+		before := testutil.ToFloat64(smallPoolTotal)
+		next, seen := countingNext(http.StatusOK)
+		w := httptest.NewRecorder()
+		if err := a.ServeHTTP(w, authRequest("/v1", "k1"), next); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != c.status || len(*seen) != 0 {
+			t.Errorf("%q: 状态码 = %d, 转发了 %v, 期望直接返回 %d", c.block, w.Code, *seen, c.status)
+		}
+		if got := testutil.ToFloat64(smallPoolTotal) - before; got != 1 {
+			t.Errorf("%q: small_pool_total 增加了 %v, 期望 1", c.block, got)
+		}
+		// 密钥池足够大或请求中没有密钥池时照常转发
+		for _, r := range []*http.Request{authRequest("/v1", "k1,k2"), httptest.NewRequest(http.MethodGet, "/v1", nil)} {
+			w = httptest.NewRecorder()
+			if err := a.ServeHTTP(w, r, next); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("%q: 状态码 = %d", c.block, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package auth_modifier
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// quarantineSnapshot 是隔离记录文件的内容。文件中不保存密钥本身，只保存其哈希
+type quarantineSnapshot struct {
+	Version int                         `json:"version"`
+	Entries map[string]quarantineRecord `json:"entries"`
+}
+
+// quarantineRecord 是一条隔离记录，时间均为Unix时间戳
+type quarantineRecord struct {
+	Since int64 `json:"since"`
+	Until int64 `json:"until"`
+}
+
+// tokenHash 返回密钥的SHA-256前16字节的十六进制表示，用于在文件中标识密钥
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// readSidecar 读取与索引文件放在一起、以suffix结尾的附属文件（如隔离记录），文件不存在时返回nil。
+// 索引保存在Caddy存储中时附属文件也放在存储中
+func (f *indexFile) readSidecar(suffix string) ([]byte, error) {
+	if f.storage != nil {
+		key := f.storageKey() + suffix
+		if !f.storage.Exists(key) {
+			return nil, nil
+		}
+		return f.storage.Load(key)
+	}
+	data, err := os.ReadFile(f.path + suffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeSidecar 以与完整索引文件相同的方式原子地写入以suffix结尾的附属文件
+func (f *indexFile) writeSidecar(suffix string, data []byte) error {
+	if f.storage != nil {
+		return f.storage.Store(f.storageKey()+suffix, data)
+	}
+	return writeFileAtomic(f.path+suffix, data, 0644)
+}
+
+// quarantineState 是被隔离的密钥，放在共享索引上，指向同一索引文件的处理器共用同一份隔离记录和记录文件，
+// 重载配置时新旧处理器也不会互相覆盖对方保存的记录
+type quarantineState struct {
+	mu       sync.Mutex
+	saveMu   sync.Mutex                 // 串行化隔离记录文件的写入
+	entries  map[string]quarantineEntry // 被隔离的密钥及其隔离时间
+	restored map[string]quarantineEntry // 从文件恢复、尚未遇到对应密钥的隔离记录，按密钥哈希索引
+	dirty    bool                       // 隔离记录自上次保存以来是否有变化
+	loaded   bool                       // 是否已从记录文件恢复，只由第一个开启persist_quarantine的处理器恢复
+}
+
+func newQuarantineState() *quarantineState {
+	return &quarantineState{
+		entries:  make(map[string]quarantineEntry),
+		restored: make(map[string]quarantineEntry),
+	}
+}
+
+// loadQuarantine 恢复上一个进程保存的隔离记录。已到期的记录，以及开始时间
+// 早于quarantine_max_age的记录会被丢弃，避免冷却规则变化后密钥被旧记录长期禁用。
+// 共享索引上的记录已经恢复过时跳过，重载时继续使用内存中的记录
+func (a *AuthModifier) loadQuarantine() {
+	q := a.indexFile.quarantine
+	q.mu.Lock()
+	loaded := q.loaded
+	q.loaded = true
+	q.mu.Unlock()
+	if loaded {
+		return
+	}
+	data, err := a.indexFile.readSidecar(".quarantine")
+	if err != nil {
+		a.logger.Error("Error reading quarantine file", zap.Error(err))
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	var snapshot quarantineSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		a.logger.Error("Error parsing quarantine file", zap.Error(err))
+		return
+	}
+	now := time.Now()
+	stale := 0
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for h, rec := range snapshot.Entries {
+		entry := quarantineEntry{since: time.Unix(rec.Since, 0), until: time.Unix(rec.Until, 0)}
+		if !now.Before(a.releaseTime(entry)) {
+			continue
+		}
+		if a.QuarantineMaxAge > 0 && now.Sub(entry.since) > time.Duration(a.QuarantineMaxAge) {
+			stale++
+			continue
+		}
+		q.restored[h] = entry
+	}
+	a.logger.Info("Quarantine restored", zap.Int("keys", len(q.restored)), zap.Int("stale", stale))
+}
+
+// saveQuarantine 保存共享索引上仍在隔离期或恢复期内的记录，没有变化时跳过
+func (a *AuthModifier) saveQuarantine() {
+	q := a.indexFile.quarantine
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	now := time.Now()
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	snapshot := quarantineSnapshot{Version: 1, Entries: make(map[string]quarantineRecord)}
+	for h, entry := range q.restored {
+		if now.Before(a.releaseTime(entry)) {
+			snapshot.Entries[h] = quarantineRecord{Since: entry.since.Unix(), Until: entry.until.Unix()}
+		}
+	}
+	for token, entry := range q.entries {
+		if now.Before(a.releaseTime(entry)) {
+			snapshot.Entries[tokenHash(token)] = quarantineRecord{Since: entry.since.Unix(), Until: entry.until.Unix()}
+		}
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = a.indexFile.writeSidecar(".quarantine", data)
+	}
+	if err != nil {
+		a.logger.Error("Error writing quarantine file", zap.Error(err))
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+}
+
+// startQuarantineSaves 每隔save_interval保存一次隔离记录，直到处理器被清理
+func (a *AuthModifier) startQuarantineSaves() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(a.SaveInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				a.saveQuarantine()
+			}
+		}
+	}()
+}
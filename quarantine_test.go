@@ -0,0 +1,112 @@
+package auth_modifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// writeQuarantine 写入上一个进程留下的隔离记录文件
+func writeQuarantine(t *testing.T, path string, entries map[string]quarantineRecord) {
+	t.Helper()
+	data, err := json.Marshal(quarantineSnapshot{Version: 1, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".quarantine", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuarantineMaxAgeDropsStaleEntries(t *testing.T) {
+	now := time.Now()
+	entries := map[string]quarantineRecord{
+		tokenHash("old"):     {Since: now.Add(-2 * time.Hour).Unix(), Until: now.Add(time.Hour).Unix()},
+		tokenHash("recent"):  {Since: now.Add(-10 * time.Minute).Unix(), Until: now.Add(time.Hour).Unix()},
+		tokenHash("expired"): {Since: now.Add(-10 * time.Minute).Unix(), Until: now.Add(-time.Minute).Unix()},
+	}
+	for _, c := range []struct {
+		block string
+		want  []string
+	}{
+		{"strategy failover\npersist_quarantine\nquarantine_max_age 1h", []string{"recent"}},
+		{"strategy failover\npersist_quarantine", []string{"old", "recent"}},
+	} {
+		path := filepath.Join(t.TempDir(), "index.json")
+		writeQuarantine(t, path, entries)
+		a := newTestHandler(t, path, c.block)
+		a.indexFile.quarantine.mu.Lock()
+		restored := len(a.indexFile.quarantine.restored)
+		a.indexFile.quarantine.mu.Unlock()
+		if restored != len(c.want) {
+			t.Errorf("%q: 恢复了 %d 条记录, 期望 %v", c.block, restored, c.want)
+		}
+		for _, token := range []string{"old", "recent", "expired"} {
+			seen, _ := serveTest(t, a, authRequest("/v1", token+",spare"), http.StatusOK)
+			skipped := seen.Get("Authorization") == "spare"
+			if want := contains(c.want, token); skipped != want {
+				t.Errorf("%q: %s 被跳过 = %v, 期望 %v", c.block, token, skipped, want)
+			}
+		}
+	}
+}
+
+func TestQuarantineSharedAcrossReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	old := newTestHandler(t, path, "strategy failover\npersist_quarantine")
+	old.quarantine("k0", time.Hour)
+	old.saveQuarantine()
+
+	// 重载时新的处理器在旧的处理器Cleanup之前Provision，两者共用同一份隔离记录，
+	// 旧的处理器在此期间隔离的密钥不会被新的处理器的保存覆盖
+	reloaded := newTestHandler(t, path, "strategy failover\npersist_quarantine")
+	if reloaded.indexFile.quarantine != old.indexFile.quarantine {
+		t.Fatal("指向同一索引文件的处理器应共享隔离记录")
+	}
+	old.quarantine("k1", time.Hour)
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	assertSequence(t, rotatedSequence(t, reloaded, "/v1", "k0,k1,k2,k3", 1), []string{"k2"})
+	reloaded.quarantine("k2", time.Hour)
+	reloaded.saveQuarantine()
+
+	data, err := os.ReadFile(path + ".quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved quarantineSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"k0", "k1", "k2"} {
+		if _, ok := saved.Entries[tokenHash(token)]; !ok {
+			t.Errorf("保存的隔离记录缺少 %s: %v", token, saved.Entries)
+		}
+	}
+}
+
+// Caddy在Provision失败时调用Cleanup，此时共享索引尚未打开，Cleanup不能因保存隔离记录而panic
+func TestQuarantineCleanupAfterFailedProvision(t *testing.T) {
+	a := &AuthModifier{
+		IndexPath:         filepath.Join(t.TempDir(), "index.json"),
+		PersistQuarantine: true,
+		QuotaTimezone:     "Mars/Base",
+		DailyQuota:        1,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := a.Provision(ctx); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Provision错误 = %v, 期望 ErrInvalidOption", err)
+	}
+	if err := a.Cleanup(); err != nil {
+		t.Errorf("Cleanup: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// quotaSuffix 是每日配额计数文件相对索引文件的后缀
+const quotaSuffix = ".quota"
+
+// quotaSnapshot 是每日配额计数文件的内容。与隔离记录一样只保存密钥的哈希
+type quotaSnapshot struct {
+	Version int            `json:"version"`
+	Period  int64          `json:"period"` // 计数所属周期的开始时间，Unix时间戳
+	Counts  map[string]int `json:"counts"`
+}
+
+// parseQuotaReset 解析quota_reset的"HH:MM"，返回距当天零点的偏移
+func parseQuotaReset(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: quota_reset '%s' must be HH:MM", ErrInvalidOption, value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// quotaPeriodStart 返回now所在的配额周期开始的时间，即不晚于now的最近一次重置时间
+func quotaPeriodStart(now time.Time, offset time.Duration, loc *time.Location) time.Time {
+	local := now.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).Add(offset)
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// tracksQuota 判断是否配置了每日配额
+func (a *AuthModifier) tracksQuota() bool {
+	return a.DailyQuota > 0 || len(a.DailyQuotas) > 0
+}
+
+// quotaFor 返回token的每日配额，daily_quotas中按指纹单独配置的优先，0表示不限制
+func (a *AuthModifier) quotaFor(token string) int {
+	if n, ok := a.DailyQuotas[a.keyID(token)]; ok {
+		return n
+	}
+	return a.DailyQuota
+}
+
+// quotaCounter 是每日配额的计数，放在共享索引上，指向同一索引文件的处理器共用同一份计数和计数文件，
+// 重载配置时新旧处理器也不会互相覆盖对方的计数
+type quotaCounter struct {
+	mu     sync.Mutex
+	saveMu sync.Mutex     // 串行化计数文件的写入
+	period time.Time      // 当前每日配额周期的开始时间
+	counts map[string]int // 当前周期内各密钥（按tokenHash）的请求数
+	dirty  bool           // 计数自上次保存以来是否有变化
+	loaded bool           // 是否已从计数文件恢复，只由第一个配置了每日配额的处理器恢复
+}
+
+func newQuotaCounter() *quotaCounter {
+	return &quotaCounter{counts: make(map[string]int)}
+}
+
+// rollQuotaLocked 进入新的配额周期时清空所有计数，调用方需持有q.mu
+func (a *AuthModifier) rollQuotaLocked(q *quotaCounter, now time.Time) {
+	start := quotaPeriodStart(now, a.quotaOffset, a.quotaLoc)
+	if !start.After(q.period) {
+		return
+	}
+	if len(q.counts) > 0 {
+		a.logger.Info("Daily quota reset", zap.Time("period", start), zap.Int("keys", len(q.counts)))
+	}
+	q.period = start
+	q.counts = make(map[string]int)
+	q.dirty = true
+}
+
+// quotaExhaustedLocked 判断token在当前周期内是否已用完每日配额，调用方需持有healthMu
+func (a *AuthModifier) quotaExhaustedLocked(token string, now time.Time) bool {
+	if !a.tracksQuota() {
+		return false
+	}
+	limit := a.quotaFor(token)
+	if limit <= 0 {
+		return false
+	}
+	q := a.indexFile.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a.rollQuotaLocked(q, now)
+	return q.counts[tokenHash(token)] >= limit
+}
+
+// consumeQuotaLocked 为本次选中的token计数一次，调用方需持有healthMu
+func (a *AuthModifier) consumeQuotaLocked(token string, now time.Time) {
+	if !a.tracksQuota() || a.quotaFor(token) <= 0 {
+		return
+	}
+	q := a.indexFile.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a.rollQuotaLocked(q, now)
+	q.counts[tokenHash(token)]++
+	q.dirty = true
+}
+
+// loadQuota 恢复上一个进程保存的计数，只有仍属于当前周期的计数才会恢复。
+// 共享索引上的计数已经恢复过时跳过，重载时继续使用内存中的计数
+func (a *AuthModifier) loadQuota() {
+	q := a.indexFile.quota
+	q.mu.Lock()
+	loaded := q.loaded
+	q.loaded = true
+	q.mu.Unlock()
+	if loaded {
+		return
+	}
+	data, err := a.indexFile.readSidecar(quotaSuffix)
+	if err != nil {
+		a.logger.Error("Error reading quota file", zap.Error(err))
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	var snapshot quotaSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		a.logger.Error("Error parsing quota file", zap.Error(err))
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a.rollQuotaLocked(q, time.Now())
+	if snapshot.Period != q.period.Unix() {
+		a.logger.Info("Discarded quota counters from a previous period", zap.Time("period", time.Unix(snapshot.Period, 0)))
+		return
+	}
+	for h, n := range snapshot.Counts {
+		q.counts[h] += n
+	}
+	a.logger.Info("Quota counters restored", zap.Int("keys", len(snapshot.Counts)))
+}
+
+// saveQuota 保存共享索引上当前周期的计数，没有变化时跳过
+func (a *AuthModifier) saveQuota() {
+	a.indexFile.saveQuota()
+}
+
+// saveQuota 保存当前周期的计数，没有变化时跳过。各处理器的定时保存和最后一个使用者释放时都会调用
+func (f *indexFile) saveQuota() {
+	q := f.quota
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	snapshot := quotaSnapshot{Version: 1, Period: q.period.Unix(), Counts: make(map[string]int, len(q.counts))}
+	for h, n := range q.counts {
+		snapshot.Counts[h] = n
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = f.writeSidecar(quotaSuffix, data)
+	}
+	if err != nil {
+		f.logger.Error("Error writing quota file", zap.Error(err))
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+}
+
+// startQuotaSaves 每隔save_interval保存一次计数，直到处理器被清理
+func (a *AuthModifier) startQuotaSaves() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(a.SaveInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				a.saveQuota()
+			}
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+package auth_modifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	day := func(d, h, m int) time.Time { return time.Date(2024, 3, d, h, m, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		now    time.Time
+		offset time.Duration
+		want   time.Time
+	}{
+		{day(10, 15, 0), 0, day(10, 0, 0)},
+		{day(10, 0, 0), 0, day(10, 0, 0)},
+		{day(10, 7, 59), 8 * time.Hour, day(9, 8, 0)},
+		{day(10, 8, 0), 8 * time.Hour, day(10, 8, 0)},
+		{day(10, 23, 59), 8 * time.Hour, day(10, 8, 0)},
+	} {
+		if got := quotaPeriodStart(c.now, c.offset, time.UTC); !got.Equal(c.want) {
+			t.Errorf("quotaPeriodStart(%s, %s) = %s, 期望 %s", c.now, c.offset, got, c.want)
+		}
+	}
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 上海的零点是UTC前一天的16:00
+	if got := quotaPeriodStart(day(10, 15, 0), 0, loc); !got.Equal(day(9, 16, 0)) {
+		t.Errorf("Asia/Shanghai: quotaPeriodStart = %s", got.UTC())
+	}
+	if got := quotaPeriodStart(day(10, 16, 0), 0, loc); !got.Equal(day(10, 16, 0)) {
+		t.Errorf("Asia/Shanghai: quotaPeriodStart = %s", got.UTC())
+	}
+}
+
+func TestDailyQuotaResetBoundary(t *testing.T) {
+	a := newTestHandler(t, "", "daily_quota 2\ndaily_quota "+tokenHash("k-small")+" 1\nquota_reset 08:00")
+	beforeReset := time.Date(2024, 3, 10, 7, 59, 0, 0, time.UTC)
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+	for i := 0; i < 2; i++ {
+		if a.quotaExhaustedLocked("k1", beforeReset) {
+			t.Fatalf("第%d次使用前 k1 已用完配额", i)
+		}
+		a.consumeQuotaLocked("k1", beforeReset)
+	}
+	if !a.quotaExhaustedLocked("k1", beforeReset.Add(59*time.Second)) {
+		t.Error("k1 用满 2 次后应跳过直到重置")
+	}
+	// 按指纹单独配置的配额优先
+	a.consumeQuotaLocked("k-small", beforeReset)
+	if !a.quotaExhaustedLocked("k-small", beforeReset) {
+		t.Error("k-small 的单独配额为 1")
+	}
+
+	// 推进时钟越过重置时间后所有计数清零
+	reset := beforeReset.Add(time.Minute)
+	if a.quotaExhaustedLocked("k1", reset) || a.quotaExhaustedLocked("k-small", reset) {
+		t.Error("重置后仍然跳过密钥")
+	}
+	q := a.indexFile.quota
+	if !q.period.Equal(reset) || len(q.counts) != 0 {
+		t.Errorf("重置后 period = %s, counts = %v", q.period, q.counts)
+	}
+}
+
+func TestDailyQuotaSkipsExhaustedKey(t *testing.T) {
+	a := newTestHandler(t, "", "daily_quota 2\ndaily_quota "+tokenHash("k0")+" 1")
+	assertSequence(t, rotatedSequence(t, a, "/v1", "k0,k1", 3), []string{"k0", "k1", "k1"})
+}
+
+func TestDailyQuotaPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	a := newTestHandler(t, path, "daily_quota 1")
+	rotatedSequence(t, a, "/v1", "k0,k1", 1)
+	a.saveQuota()
+	var saved quotaSnapshot
+	data, err := os.ReadFile(path + quotaSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Counts[tokenHash("k0")] != 1 || saved.Counts["k0"] != 0 {
+		t.Errorf("保存的计数 = %v, 期望按哈希保存 k0 的 1 次", saved.Counts)
+	}
+	a.Cleanup()
+
+	// 重启后恢复同一周期的计数，k0 仍然被跳过
+	b := newTestHandler(t, path, "daily_quota 1")
+	assertSequence(t, rotatedSequence(t, b, "/v2", "k0,k1", 1), []string{"k1"})
+	b.Cleanup()
+
+	// 上一个周期的计数被丢弃
+	saved.Period -= 86400
+	if data, err = json.Marshal(saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+quotaSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestHandler(t, path, "daily_quota 1")
+	assertSequence(t, rotatedSequence(t, c, "/v3", "k0,k1", 1), []string{"k0"})
+}
+
+func TestDailyQuotaSharedAcrossReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	old := newTestHandler(t, path, "daily_quota 10")
+	rotatedSequence(t, old, "/v1", "k0,k1", 1)
+	old.saveQuota()
+
+	// 重载时新的处理器在旧的处理器Cleanup之前Provision，两者共用同一份计数，
+	// 旧的处理器在此期间的计数不会被新的处理器的保存覆盖
+	reloaded := newTestHandler(t, path, "daily_quota 10")
+	if reloaded.indexFile.quota != old.indexFile.quota {
+		t.Fatal("指向同一索引文件的处理器应共享配额计数")
+	}
+	rotatedSequence(t, old, "/v1", "k0,k1", 1)
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	rotatedSequence(t, reloaded, "/v2", "k0,k1", 1)
+	reloaded.saveQuota()
+
+	data, err := os.ReadFile(path + quotaSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved quotaSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Counts[tokenHash("k0")] != 2 || saved.Counts[tokenHash("k1")] != 1 {
+		t.Errorf("保存的计数 = %v, 期望 k0 2 次、k1 1 次", saved.Counts)
+	}
+}
+
+func TestDailyQuotaInvalid(t *testing.T) {
+	for _, block := range []string{"quota_reset 25:00\ndaily_quota 1", "quota_reset 08:00 Mars/Base\ndaily_quota 1"} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\n"+block+"\n}")
+		if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: 错误 = %v, 期望 ErrInvalidOption", block, err)
+		}
+	}
+}
+
+// Caddy在Provision失败时调用Cleanup，此时共享索引尚未打开，Cleanup不能因保存配额计数而panic
+func TestDailyQuotaCleanupAfterFailedProvision(t *testing.T) {
+	a := &AuthModifier{
+		IndexPath:     filepath.Join(t.TempDir(), "index.json"),
+		DailyQuota:    1,
+		QuotaTimezone: "Mars/Base",
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := a.Provision(ctx); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Provision错误 = %v, 期望 ErrInvalidOption", err)
+	}
+	if err := a.Cleanup(); err != nil {
+		t.Errorf("Cleanup: %v", err)
+	}
+}
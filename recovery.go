@@ -0,0 +1,42 @@
+package auth_modifier
+
+import "time"
+
+// recoveryMinWeight 是恢复期开始时密钥被接受的最低概率，避免刚解除隔离的密钥完全拿不到流量
+const recoveryMinWeight = 0.05
+
+// recoveryWeight 返回隔离在until结束、恢复期为ramp的密钥在now时的恢复权重，
+// 从recoveryMinWeight线性增长到1
+func recoveryWeight(until time.Time, ramp time.Duration, now time.Time) float64 {
+	elapsed := now.Sub(until)
+	if ramp <= 0 || elapsed >= ramp {
+		return 1
+	}
+	w := float64(elapsed) / float64(ramp)
+	if w < recoveryMinWeight {
+		w = recoveryMinWeight
+	}
+	return w
+}
+
+// releaseTime 返回隔离记录可以被清理的时间：隔离结束后还要经过recovery_ramp
+func (a *AuthModifier) releaseTime(entry quarantineEntry) time.Time {
+	return entry.until.Add(time.Duration(a.RecoveryRamp))
+}
+
+// admitLocked 按恢复权重随机决定本次是否使用token，不在恢复期的密钥总是接受，调用方需持有healthMu。
+// 未被接受的密钥由pickLive顺延到下一个密钥，因此对所有策略都生效
+func (a *AuthModifier) admitLocked(token string, now time.Time) bool {
+	if a.RecoveryRamp <= 0 {
+		return true
+	}
+	q := a.indexFile.quarantine
+	q.mu.Lock()
+	entry, ok := q.entries[token]
+	q.mu.Unlock()
+	if !ok {
+		return true
+	}
+	w := recoveryWeight(entry.until, time.Duration(a.RecoveryRamp), now)
+	return w >= 1 || randFloat64(a.rnd) < w
+}
@@ -0,0 +1,74 @@
+package auth_modifier
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRecoveryWeight(t *testing.T) {
+	until := time.Unix(1700000000, 0)
+	ramp := 10 * time.Minute
+	for _, c := range []struct {
+		at   time.Duration
+		want float64
+	}{
+		{-time.Minute, recoveryMinWeight},
+		{0, recoveryMinWeight},
+		{15 * time.Second, recoveryMinWeight},
+		{150 * time.Second, 0.25},
+		{5 * time.Minute, 0.5},
+		{ramp, 1},
+		{time.Hour, 1},
+	} {
+		if got := recoveryWeight(until, ramp, until.Add(c.at)); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("+%s: 恢复权重 = %v, 期望 %v", c.at, got, c.want)
+		}
+	}
+	if got := recoveryWeight(until, 0, until); got != 1 {
+		t.Errorf("未配置recovery_ramp时恢复权重 = %v, 期望 1", got)
+	}
+}
+
+func TestRecoveryRampAdmission(t *testing.T) {
+	a := newTestHandler(t, "", "strategy failover\nrecovery_ramp 10m")
+	a.rnd = rand.New(rand.NewSource(1))
+	until := time.Now().Add(-time.Hour)
+	a.indexFile.quarantine.mu.Lock()
+	a.indexFile.quarantine.entries["k1"] = quarantineEntry{since: until.Add(-time.Minute), until: until}
+	a.indexFile.quarantine.mu.Unlock()
+
+	// 推进时钟走完恢复期，被接受的比例随之线性增长
+	const draws = 4000
+	for _, c := range []struct {
+		at   time.Duration
+		want float64
+	}{
+		{0, recoveryMinWeight},
+		{2 * time.Minute, 0.2},
+		{5 * time.Minute, 0.5},
+		{8 * time.Minute, 0.8},
+		{10 * time.Minute, 1},
+	} {
+		admitted := 0
+		a.healthMu.Lock()
+		for i := 0; i < draws; i++ {
+			if a.admitLocked("k1", until.Add(c.at)) {
+				admitted++
+			}
+		}
+		// 不在恢复期的密钥总是接受
+		other := a.admitLocked("k2", until.Add(c.at))
+		a.healthMu.Unlock()
+		if got := float64(admitted) / draws; math.Abs(got-c.want) > 0.03 {
+			t.Errorf("+%s: 接受比例 = %.3f, 期望约 %.2f", c.at, got, c.want)
+		}
+		if !other {
+			t.Errorf("+%s: 拒绝了不在恢复期的密钥", c.at)
+		}
+	}
+	if got, want := a.releaseTime(a.indexFile.quarantine.entries["k1"]), until.Add(10*time.Minute); !got.Equal(want) {
+		t.Errorf("releaseTime = %s, 期望 %s", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+package auth_modifier
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultResetSkew 是未配置reset_skew时容忍的各副本时钟偏差
+const defaultResetSkew = 2 * time.Second
+
+// startResets 按reset_every定期清空索引。重置时间点按墙上时间对齐（例如24h对齐到UTC零点），
+// 各副本据此得到相同的时间点，并在时间点之后再等待reset_skew，确保时钟偏慢的副本也已越过该时间点
+func (a *AuthModifier) startResets() {
+	every := time.Duration(a.ResetEvery)
+	skew := time.Duration(a.ResetSkew)
+	go func() {
+		for {
+			now := time.Now()
+			boundary := now.Truncate(every)
+			// 刚越过时间点、还在偏差窗口内时仍处理这个时间点，已处理过的会被跳过
+			if !now.Before(boundary.Add(skew)) {
+				boundary = boundary.Add(every)
+			}
+			timer := time.NewTimer(time.Until(boundary.Add(skew)))
+			select {
+			case <-a.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			a.resetIndexes(boundary)
+		}
+	}()
+}
+
+// resetIndexes 清空boundary时间点对应的一次重置。使用Caddy存储时借助存储的锁和重置标记
+// 保证只有一个副本执行重置，其余副本直接重新加载已清空的索引；
+// 未使用共享存储时每个实例各自按本机时钟重置。
+func (a *AuthModifier) resetIndexes(boundary time.Time) {
+	f := a.indexFile
+	if f.storage == nil {
+		f.Mutex.Lock()
+		done := f.lastReset >= boundary.Unix()
+		if !done {
+			f.clearLocked(boundary)
+		}
+		f.Mutex.Unlock()
+		if !done {
+			f.persistIndexes(true)
+			a.logger.Info("Indexes reset", zap.Time("boundary", boundary))
+		}
+		return
+	}
+
+	lockKey := f.storageKey() + ".reset.lock"
+	if err := f.storage.Lock(a.ctx, lockKey); err != nil {
+		a.logger.Error("Error locking storage for reset", zap.Error(err))
+		return
+	}
+	defer func() {
+		if err := f.storage.Unlock(lockKey); err != nil {
+			a.logger.Error("Error unlocking storage after reset", zap.Error(err))
+		}
+	}()
+
+	markerKey := f.storageKey() + ".reset"
+	if f.storage.Exists(markerKey) {
+		if data, err := f.storage.Load(markerKey); err == nil {
+			if last, err := strconv.ParseInt(string(data), 10, 64); err == nil && last >= boundary.Unix() {
+				// 其他副本已完成本次重置，加载已清空的索引
+				f.reload(boundary)
+				a.logger.Debug("Indexes already reset by another instance", zap.Time("boundary", boundary))
+				return
+			}
+		}
+	}
+	f.Mutex.Lock()
+	f.clearLocked(boundary)
+	f.Mutex.Unlock()
+	f.persistIndexes(true)
+	if err := f.storage.Store(markerKey, []byte(strconv.FormatInt(boundary.Unix(), 10))); err != nil {
+		a.logger.Error("Error writing reset marker", zap.Error(err))
+	}
+	a.logger.Info("Indexes reset", zap.Time("boundary", boundary))
+}
+
+// clearLocked 清空所有索引和平滑加权状态并记录重置时间点，调用方需持有锁
+func (f *indexFile) clearLocked(boundary time.Time) {
+	f.Indexes = make(map[string]int)
+	f.swrr = make(map[string][]int)
+	f.lastSeen = make(map[string]time.Time)
+	f.dirty = make(map[string]struct{})
+	atomic.StoreUint64(&f.global, 0)
+	f.lastReset = boundary.Unix()
+	f.Changed = true
+}
+
+// reload 从存储重新加载索引，替换内存中的状态
+func (f *indexFile) reload(boundary time.Time) {
+	data, err := f.readIndexes()
+	if err != nil {
+		f.logger.Error("Error reading indexes file", zap.Error(err))
+		return
+	}
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	f.clearLocked(boundary)
+	f.Changed = false
+	if len(data) > 0 {
+		if err := f.unmarshalSnapshot(data); err != nil {
+			f.logger.Error("Error parsing indexes file", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package auth_modifier
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// storageReplica 模拟另一个进程中的副本：使用同一个存储，但不经过indexFiles共享索引
+func storageReplica(t *testing.T, storage certmagic.Storage) *AuthModifier {
+	t.Helper()
+	f := &indexFile{
+		persistOptions: persistOptions{format: "json"},
+		path:           "index.json",
+		storage:        storage,
+		logger:         zap.NewNop(),
+		done:           make(chan struct{}),
+		dirty:          make(map[string]struct{}),
+		swrr:           make(map[string][]int),
+		lastSeen:       make(map[string]time.Time),
+		latency:        newLatencyTracker(),
+		quarantine:     newQuarantineState(),
+		draining:       make(map[string]struct{}),
+		handlers:       make(map[*AuthModifier]struct{}),
+	}
+	f.loadIndexes()
+	return &AuthModifier{indexFile: f, ctx: context.Background(), logger: zap.NewNop()}
+}
+
+func setIndex(a *AuthModifier, key string, n int) {
+	a.Mutex.Lock()
+	a.Indexes[key] = n
+	a.dirty[key] = struct{}{}
+	a.Changed = true
+	a.Mutex.Unlock()
+}
+
+func TestResetCoordinatedThroughStorage(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	first := storageReplica(t, storage)
+	setIndex(first, "/v1", 5)
+	if _, err := first.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	second := storageReplica(t, storage)
+	if second.Indexes["/v1"] != 5 {
+		t.Fatalf("副本加载的索引 = %v", second.Indexes)
+	}
+
+	boundary := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	first.resetIndexes(boundary)
+	if len(first.Indexes) != 0 {
+		t.Fatalf("重置后索引 = %v, 期望为空", first.Indexes)
+	}
+	// 重置之后第一个副本继续推进，第二个副本稍后越过时间点时应加载而不是再次清空
+	setIndex(first, "/v1", 1)
+	if _, err := first.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	setIndex(second, "/v2", 3)
+	second.resetIndexes(boundary)
+	if len(second.Indexes) != 1 || second.Indexes["/v1"] != 1 {
+		t.Errorf("第二个副本的索引 = %v, 期望加载 map[/v1:1]", second.Indexes)
+	}
+	if second.lastReset != boundary.Unix() {
+		t.Errorf("lastReset = %d, 期望 %d", second.lastReset, boundary.Unix())
+	}
+
+	// 下一个时间点仍由先到的副本执行
+	next := boundary.Add(24 * time.Hour)
+	second.resetIndexes(next)
+	first.resetIndexes(next)
+	if len(first.Indexes) != 0 || len(second.Indexes) != 0 {
+		t.Errorf("索引 = %v / %v, 期望都为空", first.Indexes, second.Indexes)
+	}
+}
+
+func TestResetWithoutStorageOncePerBoundary(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	boundary := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	setIndex(a, "/v1", 5)
+	a.resetIndexes(boundary)
+	if len(a.Indexes) != 0 {
+		t.Fatalf("重置后索引 = %v, 期望为空", a.Indexes)
+	}
+	// 共享索引文件的另一个处理器对同一时间点的重置会被跳过
+	setIndex(a, "/v1", 2)
+	a.resetIndexes(boundary)
+	if a.Indexes["/v1"] != 2 {
+		t.Errorf("重复重置后索引 = %v, 期望保持 map[/v1:2]", a.Indexes)
+	}
+	a.resetIndexes(boundary.Add(time.Hour))
+	if len(a.Indexes) != 0 {
+		t.Errorf("下一个时间点重置后索引 = %v, 期望为空", a.Indexes)
+	}
+}
+
+func TestResetSkewShorterThanPeriod(t *testing.T) {
+	for _, c := range []struct {
+		block string
+		ok    bool
+	}{
+		{"reset_every 1h\nreset_skew 5s", true},
+		{"reset_every 1h", true},
+		{"reset_every 10s\nreset_skew 10s", false},
+		{"reset_every 10s\nreset_skew 1m", false},
+	} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\n"+c.block+"\n}")
+		err := provisionTest(t, a)
+		if c.ok && err != nil {
+			t.Errorf("%q: %v", c.block, err)
+		}
+		if !c.ok && !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: 错误 = %v, 期望 ErrInvalidOption", c.block, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// statusRecorder 记录下游写出的状态码，用于在请求结束后判断是否成功。
+// 设置了discard时，被它判定为需要丢弃的响应不会写给客户端，以便换一个密钥重试。
+type statusRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	status    int
+	discard   func(status int) bool
+	discarded bool
+	start     time.Time // 开始转发的时间，用于统计上游延迟
+}
+
+func newStatusRecorder(w http.ResponseWriter, discard func(status int) bool) *statusRecorder {
+	return &statusRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		discard:               discard,
+		start:                 time.Now(),
+	}
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	// 1xx信息性响应之后还会有最终状态码，只记录最终状态码
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+		rec.discarded = rec.discard != nil && rec.discard(status)
+	}
+	if rec.discarded {
+		return
+	}
+	rec.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.discarded {
+		return len(b), nil
+	}
+	return rec.ResponseWriterWrapper.Write(b)
+}
+
+func (rec *statusRecorder) Flush() {
+	if rec.discarded {
+		return
+	}
+	rec.ResponseWriterWrapper.Flush()
+}
+
+// Status 返回下游写出的状态码，未显式写出时视为200
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
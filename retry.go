@@ -0,0 +1,197 @@
+package auth_modifier
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// triedKeysCtxKey 是请求上下文中保存已尝试密钥集合的键
+const triedKeysCtxKey caddy.CtxKey = "auth_modifier_tried_keys"
+
+// triedKeys 是单个请求内已经尝试过的密钥
+type triedKeys map[string]struct{}
+
+// triedFrom 返回请求上下文中的已尝试密钥集合，不在重试流程中时为nil
+func triedFrom(r *http.Request) triedKeys {
+	tried, _ := r.Context().Value(triedKeysCtxKey).(triedKeys)
+	return tried
+}
+
+// maxRetryBodySize 是为了重试而缓存的请求体上限，超过时该请求不重试
+const maxRetryBodySize = 10 << 20
+
+// serveWithRetries 转发请求，密钥失败时隔离该密钥并换下一个密钥重试，
+// 失败的响应会被丢弃，最后一次尝试的响应原样返回给客户端
+func (a *AuthModifier) serveWithRetries(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	body, ok, err := bufferBody(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if !ok {
+		// 请求体太大无法重放，退化为只尝试一次
+		r, key, rotations := a.rotate(r)
+		if a.saturated(rotations) {
+			return a.respondSaturated(w, key, rotations)
+		}
+		defer a.release(rotations)
+		if a.AllDeadResponse != nil && a.allDead(rotations) {
+			return a.respondAllDead(w, key)
+		}
+		rec := newStatusRecorder(w, nil)
+		err := next.ServeHTTP(rec, r)
+		a.finish(r, key, rotations, rec, err)
+		return err
+	}
+
+	// 记录本次请求已经尝试过的密钥，无论哪种策略，重试时都不会再选中它们
+	tried := make(triedKeys)
+	r = r.WithContext(context.WithValue(r.Context(), triedKeysCtxKey, tried))
+	reqHeader := r.Header.Clone()
+	respHeader := w.Header().Clone()
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		r.Header = reqHeader.Clone()
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		req, key, rotations := a.rotate(r)
+		if a.saturated(rotations) {
+			return a.respondSaturated(w, key, rotations)
+		}
+		if a.AllDeadResponse != nil && a.allDead(rotations) {
+			a.release(rotations)
+			return a.respondAllDead(w, key)
+		}
+		canRetry := a.hasSpareKey(r, rotations) && a.retryAllowed(r, attempt, start)
+		// 上游可能用掉大部分剩余时间，丢弃失败的响应之前按响应到达的时间重新检查，
+		// 来不及退避重试时把上游的真实响应返回给客户端，而不是在退避中等到超时
+		rec := newStatusRecorder(w, func(status int) bool {
+			return canRetry && keyFailed(status) && a.retryAllowed(r, attempt, start)
+		})
+		err := next.ServeHTTP(rec, req)
+		a.release(rotations)
+		a.finish(req, key, rotations, rec, err)
+		for _, rot := range rotations {
+			tried[rot.token] = struct{}{}
+		}
+
+		// 下游出错且未写出响应时也可以安全重试
+		retry := rec.discarded || (canRetry && err != nil && rec.status == 0 && keyFailed(outcomeStatus(rec, err)) && a.retryAllowed(r, attempt, start))
+		if !retry {
+			return err
+		}
+		resetHeader(w.Header(), respHeader)
+
+		wait := a.retryWait(attempt)
+		a.logger.Debug("Retrying with next key", zap.Int("attempt", attempt+1), zap.Duration("backoff", wait))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return r.Context().Err()
+			}
+		}
+	}
+}
+
+// isUpgrade 判断请求是否要求升级协议，例如WebSocket
+func isUpgrade(r *http.Request) bool {
+	if len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasSpareKey 判断本次使用的密钥之外是否还有未尝试过的可用密钥。只剩当前密钥或全部失效时
+// 再重试也只会得到同样的结果，直接返回本次的响应
+func (a *AuthModifier) hasSpareKey(r *http.Request, rotations []rotation) bool {
+	if len(rotations) == 0 {
+		return false
+	}
+	tried := triedFrom(r)
+	for _, rot := range rotations {
+		if a.liveKeys(rot, tried) < 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// retryAllowed 判断第attempt次尝试失败后能否再重试：次数未用完，
+// 且从现在起等待退避后既不超过max_retry_time，也不超过请求上下文的截止时间。
+// 转发前和上游响应后各检查一次
+func (a *AuthModifier) retryAllowed(r *http.Request, attempt int, start time.Time) bool {
+	if attempt >= a.MaxRetries {
+		return false
+	}
+	resume := time.Now().Add(a.retryWait(attempt))
+	if resume.Sub(start) > time.Duration(a.MaxRetryTime) {
+		return false
+	}
+	if deadline, ok := r.Context().Deadline(); ok && resume.After(deadline) {
+		return false
+	}
+	return true
+}
+
+// retryWait 返回第attempt次尝试失败后的退避时长
+func (a *AuthModifier) retryWait(attempt int) time.Duration {
+	wait := float64(a.RetryBackoff)
+	if a.RetryBackoffFactor > 1 {
+		for i := 0; i < attempt; i++ {
+			wait *= a.RetryBackoffFactor
+		}
+	}
+	return time.Duration(wait)
+}
+
+// bufferBody 读取并缓存请求体以便重放，请求体超过上限时返回false，
+// 此时请求体会被还原为未读取的状态
+func bufferBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > maxRetryBodySize {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxRetryBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return body, true, nil
+}
+
+// resetHeader 将h恢复为snapshot的内容，丢弃失败响应写入的头部
+func resetHeader(h, snapshot http.Header) {
+	for name := range h {
+		delete(h, name)
+	}
+	for name, values := range snapshot {
+		h[name] = values
+	}
+}
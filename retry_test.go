@@ -0,0 +1,201 @@
+package auth_modifier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// countingNext 返回按顺序响应statuses的下游处理器，并记录每次看到的Authorization
+func countingNext(statuses ...int) (caddyhttp.Handler, *[]string) {
+	var seen []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		status := statuses[len(statuses)-1]
+		if len(seen) < len(statuses) {
+			status = statuses[len(seen)]
+		}
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+		return nil
+	})
+	return next, &seen
+}
+
+func TestUpgradeNotRetried(t *testing.T) {
+	a := newTestHandler(t, "", "max_retries 2")
+	r := authRequest("/ws", "k1,k2,k3")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	next, seen := countingNext(http.StatusUnauthorized)
+	w := httptest.NewRecorder()
+	if err := a.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if len(*seen) != 1 || (*seen)[0] != "k1" {
+		t.Fatalf("协议升级请求应只转发一次: %v", *seen)
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("状态码 = %d, 期望原样返回 401", w.Code)
+	}
+	if index := snapshotIndexes(a.indexFile)["/ws"]; index != 1 {
+		t.Errorf("索引 = %d, 期望只推进一次", index)
+	}
+
+	// 普通请求在同样的配置下会重试
+	next, seen = countingNext(http.StatusUnauthorized, http.StatusOK)
+	if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/api", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(*seen) != 2 {
+		t.Errorf("普通请求应重试一次: %v", *seen)
+	}
+}
+
+func TestRetriesBoundedByLiveKeys(t *testing.T) {
+	a := newTestHandler(t, "", "max_retries 10")
+	var seen []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid key " + r.Header.Get("Authorization")))
+		return nil
+	})
+	w := httptest.NewRecorder()
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	// 所有密钥都失败后不再重试，最后一次的响应原样返回
+	if len(seen) != 3 {
+		t.Fatalf("尝试了 %v, 期望每个密钥各一次", seen)
+	}
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "invalid key "+seen[2] {
+		t.Errorf("响应 = %d %q, 期望最后一次的上游响应", w.Code, w.Body.String())
+	}
+
+	// 所有密钥都已被隔离时只尝试一次
+	seen = nil
+	w = httptest.NewRecorder()
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || w.Code != http.StatusUnauthorized {
+		t.Errorf("全部隔离时尝试了 %v, 状态码 %d", seen, w.Code)
+	}
+}
+
+func TestRetryNeverReusesTriedKey(t *testing.T) {
+	for _, strategy := range []string{StrategyRoundRobin, StrategyRandom, StrategyWeightedRandom, StrategyFailover, StrategyP2C} {
+		a := newTestHandler(t, "", "strategy "+strategy+"\nmax_retries 4")
+		var seen []string
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			// 清空隔离，只靠已尝试密钥集合避免重复
+			a.indexFile.quarantine.mu.Lock()
+			a.indexFile.quarantine.entries = make(map[string]quarantineEntry)
+			a.indexFile.quarantine.mu.Unlock()
+			seen = append(seen, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return nil
+		})
+		for i := 0; i < 20; i++ {
+			seen = nil
+			if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k1,k2,k3,k4,k5"), next); err != nil {
+				t.Fatal(err)
+			}
+			tried := make(map[string]bool)
+			for _, token := range seen {
+				if tried[token] {
+					t.Fatalf("%s: 同一请求中重复尝试了 %s: %v", strategy, token, seen)
+				}
+				tried[token] = true
+			}
+			if len(seen) != 5 {
+				t.Fatalf("%s: 尝试了 %v, 期望每个密钥各一次", strategy, seen)
+			}
+		}
+	}
+}
+
+func TestRetryBackoffGrowth(t *testing.T) {
+	for _, c := range []struct {
+		block string
+		want  []time.Duration
+	}{
+		{"max_retries 3\nretry_backoff 10ms", []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond}},
+		{"max_retries 3\nretry_backoff 10ms exponential", []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}},
+	} {
+		a := newTestHandler(t, "", c.block)
+		for attempt, want := range c.want {
+			if got := a.retryWait(attempt); got != want {
+				t.Errorf("%q: 第 %d 次退避 = %s, 期望 %s", c.block, attempt+1, got, want)
+			}
+		}
+	}
+
+	// 两次重试之间实际等待了退避时长
+	a := newTestHandler(t, "", "max_retries 2\nretry_backoff 20ms exponential")
+	var at []time.Time
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		at = append(at, time.Now())
+		w.WriteHeader(http.StatusTooManyRequests)
+		return nil
+	})
+	if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(at) != 3 {
+		t.Fatalf("尝试了 %d 次, 期望 3 次", len(at))
+	}
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if got := at[i+1].Sub(at[i]); got < want {
+			t.Errorf("第 %d 次重试前等待了 %s, 期望至少 %s", i+1, got, want)
+		}
+	}
+}
+
+// slowNext 返回等待delay后以429和带密钥的响应体响应的下游处理器
+func slowNext(delay time.Duration) (caddyhttp.Handler, *[]string) {
+	var seen []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		seen = append(seen, r.Header.Get("Authorization"))
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("rate limited " + r.Header.Get("Authorization")))
+		return nil
+	})
+	return next, &seen
+}
+
+func TestRetryStopsWhenUpstreamExhaustsBudget(t *testing.T) {
+	// 转发前退避后仍在max_retry_time之内，上游响应后已来不及再等一次退避
+	a := newTestHandler(t, "", "max_retries 3\nretry_backoff 50ms\nmax_retry_time 100ms")
+	next, seen := slowNext(80 * time.Millisecond)
+	w := httptest.NewRecorder()
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2,k3"), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(*seen) != 1 {
+		t.Errorf("尝试了 %v, 期望超出max_retry_time后不再重试", *seen)
+	}
+	if w.Code != http.StatusTooManyRequests || w.Body.String() != "rate limited k1" {
+		t.Errorf("响应 = %d %q, 期望第一次的上游响应", w.Code, w.Body.String())
+	}
+}
+
+func TestRetryStopsBeforeRequestDeadline(t *testing.T) {
+	a := newTestHandler(t, "", "max_retries 3\nretry_backoff 50ms\nmax_retry_time 10s")
+	next, seen := slowNext(80 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	// 截止时间到来之前返回上游的响应，而不是在退避中等到上下文超时
+	if err := a.ServeHTTP(w, authRequest("/v1", "k1,k2,k3").WithContext(ctx), next); err != nil {
+		t.Fatalf("错误 = %v, 期望返回上游的响应", err)
+	}
+	if len(*seen) != 1 || w.Code != http.StatusTooManyRequests || w.Body.String() != "rate limited k1" {
+		t.Errorf("尝试了 %v, 响应 = %d %q, 期望第一次的上游响应", *seen, w.Code, w.Body.String())
+	}
+}
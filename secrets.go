@@ -0,0 +1,149 @@
+package auth_modifier
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// secretsDir 从目录加载密钥池，每个文件的内容是一个密钥，目录变化时自动重新加载。
+// 适用于Kubernetes以目录形式挂载的Secret
+type secretsDir struct {
+	path     string
+	keys     atomic.Value // []string
+	collapse bool         // 是否去掉重复的密钥，见collapse_duplicates
+	logger   *zap.Logger
+}
+
+// newSecretsDir 加载目录中的密钥，并在ctx结束前持续监视目录的变化。
+// 首次加载失败直接返回错误，之后的加载失败只记录日志并保留上一次的密钥池
+func newSecretsDir(ctx context.Context, path string, collapse bool, logger *zap.Logger) (*secretsDir, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &secretsDir{path: abs, collapse: collapse, logger: logger}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(abs); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go s.watch(ctx, watcher)
+	return s, nil
+}
+
+// watch 在目录中的任何文件变化时重新加载。Kubernetes通过替换..data符号链接更新Secret，
+// 因此不按文件名过滤
+func (s *secretsDir) watch(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if err := s.reload(); err != nil {
+				s.logger.Error("Error reloading secrets_dir, keeping the previous pool", zap.String("path", s.path), zap.Error(err))
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			s.logger.Warn("Error watching secrets_dir", zap.String("path", s.path), zap.Error(err))
+		}
+	}
+}
+
+// reload 重新读取目录，成功且密钥池有变化时整体替换
+func (s *secretsDir) reload() error {
+	keys, err := readSecretsDir(s.path)
+	if err != nil {
+		return err
+	}
+	if s.collapse {
+		keys, _ = collapseDuplicates(keys, nil)
+	}
+	if prev := s.load(); prev != nil && equalPools(prev, keys) {
+		return nil
+	}
+	s.keys.Store(keys)
+	s.logger.Info("Key pool loaded from secrets_dir", zap.String("path", s.path), zap.Int("keys", len(keys)))
+	return nil
+}
+
+// load 返回当前的密钥池
+func (s *secretsDir) load() []string {
+	keys, _ := s.keys.Load().([]string)
+	return keys
+}
+
+// readSecretsDir 按文件名顺序读取目录中的每个文件，去掉首尾空白后作为一个密钥。
+// 跳过子目录、以.开头的文件（如Kubernetes的..data）和空文件，没有任何密钥时视为错误
+func readSecretsDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		file := filepath.Join(path, name)
+		// Kubernetes挂载的文件是指向..data的符号链接，需要跟随链接判断类型
+		info, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if key := strings.TrimSpace(string(data)); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// equalPools 判断两个密钥池是否完全相同
+func equalPools(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package auth_modifier
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeSecret(t *testing.T, dir, name, value string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSecretsDir(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(t, dir, "b-key", "sk-b\n")
+	writeSecret(t, dir, "a-key", "  sk-a  ")
+	writeSecret(t, dir, "empty", "\n")
+	writeSecret(t, dir, ".hidden", "sk-hidden")
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSecret(t, filepath.Join(dir, "sub"), "c-key", "sk-c")
+
+	keys, err := readSecretsDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"sk-a", "sk-b"}) {
+		t.Errorf("keys = %q, 期望按文件名排序的 [sk-a sk-b]", keys)
+	}
+	if _, err := readSecretsDir(filepath.Join(dir, "sub", "missing")); err == nil {
+		t.Error("目录不存在时应返回错误")
+	}
+	if _, err := readSecretsDir(t.TempDir()); err == nil {
+		t.Error("没有任何密钥时应返回错误")
+	}
+}
+
+func TestSecretsDirReload(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(t, dir, "key1", "sk-1")
+	writeSecret(t, dir, "key2", "sk-2")
+	a := newTestHandler(t, "", "secrets_dir "+dir)
+	// 忽略客户端传入的值，使用目录中的密钥池
+	assertSequence(t, rotatedSequence(t, a, "/v1", "client-key", 3), []string{"sk-1", "sk-2", "sk-1"})
+
+	// 新增、修改和删除文件后整体替换密钥池
+	writeSecret(t, dir, "key3", "sk-3")
+	waitFor(t, "新增的密钥", func() bool { return reflect.DeepEqual(a.keys(), []string{"sk-1", "sk-2", "sk-3"}) })
+	writeSecret(t, dir, "key2", "sk-2b")
+	waitFor(t, "修改的密钥", func() bool { return reflect.DeepEqual(a.keys(), []string{"sk-1", "sk-2b", "sk-3"}) })
+	if err := os.Remove(filepath.Join(dir, "key1")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "删除的密钥", func() bool { return reflect.DeepEqual(a.keys(), []string{"sk-2b", "sk-3"}) })
+
+	// 目录被清空时保留上一次的密钥池
+	if err := os.Remove(filepath.Join(dir, "key2")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "删除的密钥", func() bool { return reflect.DeepEqual(a.keys(), []string{"sk-3"}) })
+	if err := os.Remove(filepath.Join(dir, "key3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.secrets.reload(); err == nil {
+		t.Error("空目录的重新加载应返回错误")
+	}
+	if got := a.keys(); !reflect.DeepEqual(got, []string{"sk-3"}) {
+		t.Errorf("清空目录后 keys = %q, 期望保留上一次的密钥池", got)
+	}
+}
+
+func TestSecretsDirKubernetesLayout(t *testing.T) {
+	// Kubernetes通过替换..data符号链接原子地更新Secret
+	dir := t.TempDir()
+	for version, key := range map[string]string{"..v1": "sk-old", "..v2": "sk-new"} {
+		if err := os.Mkdir(filepath.Join(dir, version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeSecret(t, filepath.Join(dir, version), "api-key", key)
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "api-key"), filepath.Join(dir, "api-key")); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestHandler(t, "", "secrets_dir "+dir)
+	if got := a.keys(); !reflect.DeepEqual(got, []string{"sk-old"}) {
+		t.Fatalf("keys = %q", got)
+	}
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "更新后的Secret", func() bool { return reflect.DeepEqual(a.keys(), []string{"sk-new"}) })
+}
+
+func TestSecretsDirEmpty(t *testing.T) {
+	a := &AuthModifier{SecretsDir: t.TempDir()}
+	if err := provisionTest(t, a); !errors.Is(err, ErrKeySource) {
+		t.Errorf("错误 = %v, 期望 ErrKeySource", err)
+	}
+}
@@ -0,0 +1,243 @@
+package auth_modifier
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+)
+
+// Selector 从密钥池中为索引键key选出本次使用的下标。
+// pool是请求头或keys中的原始密钥列表，可能带有":权重"后缀；返回值超出范围时会按池大小取模。
+// 自定义策略可以注册为http.handlers.auth_modifier.selectors命名空间下的Caddy模块，
+// 通过selector配置启用，并可用SelectionIndex读取当前索引键的轮换计数。
+type Selector interface {
+	Select(ctx context.Context, key string, pool []string) int
+}
+
+// selectionCtxKey 是Select的ctx中保存本次选择信息的键
+type selectionCtxKey struct{}
+
+// selection 是传给Selector的本次请求的选择信息
+type selection struct {
+	index   uint64 // 轮换位置，key_by global下是全局计数器的原始值
+	request *http.Request
+}
+
+// maxInt 是int能表示的最大值
+const maxInt = int(^uint(0) >> 1)
+
+// SelectionIndex 返回ctx对应请求的索引键当前的轮换计数，不在选择过程中时为0。
+// key_by global下的全局计数器超出int的范围时按int的范围回绕
+func SelectionIndex(ctx context.Context) int {
+	sel, _ := ctx.Value(selectionCtxKey{}).(selection)
+	return int(sel.index % uint64(maxInt))
+}
+
+// selectionPosition 将本次的轮换位置直接按密钥池的长度取模，
+// key_by global下的全局计数器不经过IndexCap，任意大小的密钥池都只在计数器回绕时跳变
+func selectionPosition(ctx context.Context, length int) int {
+	sel, _ := ctx.Value(selectionCtxKey{}).(selection)
+	return int(sel.index % uint64(length))
+}
+
+// roundRobinSelector 按索引依次轮换，用于round_robin和round_robin_global_seeded
+type roundRobinSelector struct{}
+
+func (roundRobinSelector) Select(ctx context.Context, key string, pool []string) int {
+	return selectionPosition(ctx, len(pool))
+}
+
+// randomSelector 每次随机选择
+type randomSelector struct {
+	rnd *rand.Rand
+}
+
+func (s randomSelector) Select(ctx context.Context, key string, pool []string) int {
+	return randIntn(s.rnd, len(pool))
+}
+
+// failoverSelector 总是从第一个密钥开始，由pickLive跳过被隔离的密钥，恢复后自动回到靠前的密钥
+type failoverSelector struct{}
+
+func (failoverSelector) Select(ctx context.Context, key string, pool []string) int {
+	return 0
+}
+
+// weightedSelector 按密钥的":权重"后缀做平滑加权轮询
+type weightedSelector struct {
+	a *AuthModifier
+}
+
+func (s weightedSelector) Select(ctx context.Context, key string, pool []string) int {
+	weights := make([]int, len(pool))
+	for i, token := range pool {
+		_, weights[i] = parseWeight(token)
+	}
+	cost := 1
+	if sel, ok := ctx.Value(selectionCtxKey{}).(selection); ok && sel.request != nil {
+		cost = s.a.requestWeight(sel.request)
+	}
+	return s.a.smoothWeighted(key, weights, cost)
+}
+
+// weightedRandomSelector 按权重随机选择：构造累计权重数组，用一次随机数二分查找落点
+type weightedRandomSelector struct {
+	rnd *rand.Rand
+}
+
+func (s weightedRandomSelector) Select(ctx context.Context, key string, pool []string) int {
+	cumulative := make([]int, len(pool))
+	total := 0
+	for i, token := range pool {
+		_, w := parseWeight(token)
+		total += w
+		cumulative[i] = total
+	}
+	draw := randIntn(s.rnd, total)
+	return sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > draw })
+}
+
+// weightedHashSelector 按索引键做加权最高随机权重哈希（rendezvous hashing）：
+// 每个密钥对索引键打分，得分为-权重/ln(h)，h为索引键与密钥的哈希映射到(0,1)的值，选得分最高的密钥。
+// 同一索引键总是选中同一个密钥，各密钥分到的索引键数量与权重成正比；
+// 增删密钥时只有原本落在该密钥上（或改落到新密钥上）的索引键会移动
+type weightedHashSelector struct{}
+
+func (weightedHashSelector) Select(ctx context.Context, key string, pool []string) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, token := range pool {
+		token, w := parseWeight(token)
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(token))
+		// 取高53位映射到(0,1)，避免ln(0)
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		if score := -float64(w) / math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix64 是MurmurHash3的64位终结函数。FNV-1a最后写入的字节只影响哈希的低位，
+// 同一索引键对不同密钥的哈希高位几乎相同，需要先打散再映射到(0,1)
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// jumpHashSelector 实现Google的jump consistent hash（Lamping & Veach, 2014）：
+// 把索引键的FNV-1a哈希映射到[0, len(pool))，不需要构建哈希环，也不占用额外内存。
+// 密钥池从n增长到n+1时只有约1/(n+1)的索引键移动到新密钥上，其余保持不变；
+// 只适合在末尾增删密钥，从中间删除密钥会让其后的所有下标错位
+type jumpHashSelector struct{}
+
+func (jumpHashSelector) Select(ctx context.Context, key string, pool []string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return jumpHash(h.Sum64(), len(pool))
+}
+
+// jumpHash 返回key在n个桶中所属的桶
+func jumpHash(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// maxBodyHashSize 是body_hash计算哈希时读取的请求体前缀上限
+const maxBodyHashSize = 64 << 10
+
+// bodyHashSelector 按请求体前缀的FNV-1a哈希选择，内容相同的请求总是使用同一个密钥，便于上游缓存。
+// 读取的前缀会被放回请求体，下游仍能读到完整的请求体
+type bodyHashSelector struct{}
+
+func (bodyHashSelector) Select(ctx context.Context, key string, pool []string) int {
+	sel, _ := ctx.Value(selectionCtxKey{}).(selection)
+	if sel.request == nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(peekBody(sel.request, maxBodyHashSize))
+	return int(h.Sum64() % uint64(len(pool)))
+}
+
+// peekBody 读取请求体最多n字节的前缀，并将请求体还原为可从头完整读取的状态
+func peekBody(r *http.Request, n int64) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	prefix, err := io.ReadAll(io.LimitReader(r.Body, n))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), errReader{err}, r.Body), r.Body}
+	return prefix
+}
+
+// errReader 在读取到它时返回err，用于把peekBody读取前缀时遇到的错误留给下游，err为nil时视为读完
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	return 0, io.EOF
+}
+
+// builtinSelector 返回内置策略对应的Selector
+func (a *AuthModifier) builtinSelector() Selector {
+	switch a.Strategy {
+	case StrategyRandom:
+		return randomSelector{rnd: a.rnd}
+	case StrategyWeightedRoundRobin:
+		return weightedSelector{a: a}
+	case StrategyWeightedRandom:
+		return weightedRandomSelector{rnd: a.rnd}
+	case StrategyFailover:
+		return failoverSelector{}
+	case StrategyAdaptiveLatency:
+		return adaptiveLatencySelector{a: a}
+	case StrategyBodyHash:
+		return bodyHashSelector{}
+	case StrategyWeightedHash:
+		return weightedHashSelector{}
+	case StrategyP2C:
+		return p2cSelector{a: a}
+	case StrategyJumpHash:
+		return jumpHashSelector{}
+	}
+	return roundRobinSelector{}
+}
+
+// strategyLabel 返回指标中的strategy标签：内置策略的名称，自定义Selector统一为custom，保证标签取值有限
+func (a *AuthModifier) strategyLabel() string {
+	if a.custom {
+		return "custom"
+	}
+	return a.Strategy
+}
+
+// choose 委托配置的Selector为索引键key从pool中选出本次使用的下标
+func (a *AuthModifier) choose(r *http.Request, key string, index uint64, pool []string) int {
+	ctx := context.WithValue(r.Context(), selectionCtxKey{}, selection{index: index, request: r})
+	pos := a.selector.Select(ctx, key, pool) % len(pool)
+	if pos < 0 {
+		pos += len(pool)
+	}
+	return pos
+}
@@ -0,0 +1,291 @@
+package auth_modifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(offsetSelector{})
+}
+
+// offsetSelector 是测试用的自定义选择模块，选中轮换计数之后第Offset个密钥
+type offsetSelector struct {
+	Offset int `json:"offset,omitempty"`
+}
+
+func (offsetSelector) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.auth_modifier.selectors.test_offset",
+		New: func() caddy.Module { return new(offsetSelector) },
+	}
+}
+
+func (s *offsetSelector) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("offset '%s': %v", d.Val(), err)
+			}
+			s.Offset = n
+		}
+	}
+	return nil
+}
+
+func (s offsetSelector) Select(ctx context.Context, key string, pool []string) int {
+	return SelectionIndex(ctx) + s.Offset
+}
+
+func TestCustomSelectorModule(t *testing.T) {
+	a := newTestHandler(t, "", "selector test_offset 1")
+	if _, ok := a.selector.(*offsetSelector); !ok {
+		t.Fatalf("selector = %T, 期望自定义模块", a.selector)
+	}
+	if got := a.strategyLabel(); got != "custom" {
+		t.Errorf("strategy标签 = %q, 期望 custom", got)
+	}
+	// 超出范围的返回值按池大小取模，索引照常推进
+	assertSequence(t, rotatedSequence(t, a, "/v1", "k0,k1,k2", 4), []string{"k1", "k2", "k0", "k1"})
+	if got := snapshotIndexes(a.indexFile)["/v1"]; got != 4 {
+		t.Errorf("索引 = %d, 期望 4", got)
+	}
+}
+
+func TestUnknownSelectorModule(t *testing.T) {
+	a := &AuthModifier{
+		IndexPath:   filepath.Join(t.TempDir(), "index.json"),
+		SelectorRaw: json.RawMessage(`{"selector":"bogus"}`),
+	}
+	if err := provisionTest(t, a); !errors.Is(err, ErrInvalidStrategy) {
+		t.Errorf("错误 = %v, 期望包装 ErrInvalidStrategy", err)
+	}
+}
+
+// bodyNext 返回记录下游看到的Authorization和完整请求体的处理器
+func bodyNext(t *testing.T) (caddyhttp.Handler, *[]string, *[]string) {
+	var keys, bodies []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("读取请求体: %v", err)
+		}
+		keys = append(keys, r.Header.Get("Authorization"))
+		bodies = append(bodies, string(body))
+		return nil
+	})
+	return next, &keys, &bodies
+}
+
+func bodyRequest(body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1", strings.NewReader(body))
+	r.Header.Set("Authorization", pool(8))
+	return r
+}
+
+func TestBodyHashIdenticalBodies(t *testing.T) {
+	a := newTestHandler(t, "", "strategy body_hash")
+	next, keys, bodies := bodyNext(t)
+	for i := 0; i < 5; i++ {
+		if err := a.ServeHTTP(httptest.NewRecorder(), bodyRequest(`{"prompt":"hello"}`), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range *keys {
+		if (*keys)[i] != (*keys)[0] {
+			t.Fatalf("相同的请求体选中了不同的密钥: %v", *keys)
+		}
+		if (*bodies)[i] != `{"prompt":"hello"}` {
+			t.Errorf("下游读到的请求体 = %q", (*bodies)[i])
+		}
+	}
+	// 不需要持久化状态
+	if indexes := snapshotIndexes(a.indexFile); len(indexes) != 0 {
+		t.Errorf("body_hash 不应记录索引: %v", indexes)
+	}
+}
+
+func TestBodyHashDifferingBodies(t *testing.T) {
+	a := newTestHandler(t, "", "strategy body_hash")
+	next, keys, bodies := bodyNext(t)
+	for i := 0; i < 32; i++ {
+		if err := a.ServeHTTP(httptest.NewRecorder(), bodyRequest("request "+strconv.Itoa(i)), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	distinct := map[string]bool{}
+	for i, key := range *keys {
+		distinct[key] = true
+		if want := "request " + strconv.Itoa(i); (*bodies)[i] != want {
+			t.Errorf("下游读到的请求体 = %q, 期望 %q", (*bodies)[i], want)
+		}
+	}
+	if len(distinct) < 4 {
+		t.Errorf("32个不同的请求体只用到了 %d 个密钥", len(distinct))
+	}
+}
+
+func TestBodyHashBoundedPrefix(t *testing.T) {
+	a := newTestHandler(t, "", "strategy body_hash")
+	next, keys, bodies := bodyNext(t)
+	prefix := strings.Repeat("x", maxBodyHashSize)
+	// 超出前缀上限的部分不参与哈希，但下游仍能读到完整的请求体
+	for _, suffix := range []string{"a", "b", strings.Repeat("c", 1<<20)} {
+		if err := a.ServeHTTP(httptest.NewRecorder(), bodyRequest(prefix+suffix), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if (*keys)[0] != (*keys)[1] || (*keys)[1] != (*keys)[2] {
+		t.Errorf("前缀相同的请求体选中了 %v", *keys)
+	}
+	if len((*bodies)[2]) != maxBodyHashSize+1<<20 || (*bodies)[0] != prefix+"a" {
+		t.Errorf("下游读到的请求体长度 = %d", len((*bodies)[2]))
+	}
+
+	// 没有请求体的请求总是选择同一个密钥
+	var empty []string
+	for i := 0; i < 3; i++ {
+		seen, _ := serveTest(t, a, authRequest("/v1", pool(8)), http.StatusOK)
+		empty = append(empty, seen.Get("Authorization"))
+	}
+	if empty[0] != empty[1] || empty[1] != empty[2] {
+		t.Errorf("没有请求体时选中了 %v", empty)
+	}
+}
+
+func TestWeightedHashDistribution(t *testing.T) {
+	pool := []string{"a:1", "b:3", "c:4"}
+	const tenants = 8000
+	counts := make([]int, len(pool))
+	for i := 0; i < tenants; i++ {
+		key := "tenant-" + strconv.Itoa(i)
+		pos := weightedHashSelector{}.Select(context.Background(), key, pool)
+		counts[pos]++
+		// 同一租户总是映射到同一个密钥
+		if again := (weightedHashSelector{}).Select(context.Background(), key, pool); again != pos {
+			t.Fatalf("%s 两次选择不同: %d, %d", key, pos, again)
+		}
+	}
+	for i, w := range []float64{1, 3, 4} {
+		got, want := float64(counts[i])/tenants, w/8
+		if got < want-0.03 || got > want+0.03 {
+			t.Errorf("%s 分到 %.3f 的租户, 期望约 %.3f", pool[i], got, want)
+		}
+	}
+}
+
+func TestWeightedHashMinimalReshuffle(t *testing.T) {
+	before := []string{"a:1", "b:1", "c:2"}
+	after := append(append([]string(nil), before...), "d:2")
+	moved := 0
+	const tenants = 4000
+	for i := 0; i < tenants; i++ {
+		key := "tenant-" + strconv.Itoa(i)
+		old := weightedHashSelector{}.Select(context.Background(), key, before)
+		pos := weightedHashSelector{}.Select(context.Background(), key, after)
+		if pos != old {
+			// 只允许移动到新增的密钥上
+			if pos != 3 {
+				t.Fatalf("%s 从 %s 移动到了 %s", key, before[old], after[pos])
+			}
+			moved++
+		}
+	}
+	// 新密钥占总权重的1/3
+	if share := float64(moved) / tenants; share < 0.3 || share > 0.37 {
+		t.Errorf("移动了 %.3f 的租户, 期望约 0.333", share)
+	}
+}
+
+func TestWeightedHashSticky(t *testing.T) {
+	a := newTestHandler(t, "", "strategy weighted_hash\nkey_by headers:X-Tenant")
+	pick := func(tenant string) string {
+		r := authRequest("/v1", "Bearer a:1,b:2,c:3")
+		r.Header.Set("X-Tenant", tenant)
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		return seen.Get("Authorization")
+	}
+	for _, tenant := range []string{"acme", "globex", "initech"} {
+		first := pick(tenant)
+		for i := 0; i < 5; i++ {
+			if got := pick(tenant); got != first {
+				t.Errorf("租户 %s 第%d次请求 = %q, 期望保持 %q", tenant, i, got, first)
+			}
+		}
+	}
+}
+
+func TestJumpHashUniform(t *testing.T) {
+	const keys, buckets = 20000, 10
+	counts := make([]int, buckets)
+	pool := strings.Split(pool(buckets), ",")
+	for i := 0; i < keys; i++ {
+		pos := jumpHashSelector{}.Select(context.Background(), "tenant-"+strconv.Itoa(i), pool)
+		if pos < 0 || pos >= buckets {
+			t.Fatalf("下标 %d 越界", pos)
+		}
+		counts[pos]++
+	}
+	for i, n := range counts {
+		if share := float64(n) / keys; share < 0.09 || share > 0.11 {
+			t.Errorf("k%d 分到 %.3f 的索引键, 期望约 0.100", i, share)
+		}
+	}
+}
+
+func TestJumpHashMinimalReshuffle(t *testing.T) {
+	const keys = 20000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		h := uint64(i)*0x9e3779b97f4a7c15 + 1
+		before, after := jumpHash(h, 10), jumpHash(h, 11)
+		if before != after {
+			// 扩容时只会移动到新增的桶，反过来缩容时也只有最后一个桶中的键移动
+			if after != 10 {
+				t.Fatalf("键 %d 从桶 %d 移动到了 %d", i, before, after)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / keys; share < 0.08 || share > 0.1 {
+		t.Errorf("从10个桶扩容到11个移动了 %.3f 的键, 期望约 1/11", share)
+	}
+	if jumpHash(12345, 1) != 0 {
+		t.Error("只有一个桶时应总是返回0")
+	}
+}
+
+func TestJumpHashSticky(t *testing.T) {
+	a := newTestHandler(t, "", "strategy jump_hash\nkey_by headers:X-Tenant")
+	pick := func(tenant string) string {
+		r := authRequest("/v1", pool(8))
+		r.Header.Set("X-Tenant", tenant)
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		return seen.Get("Authorization")
+	}
+	chosen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		tenant := "tenant-" + strconv.Itoa(i)
+		first := pick(tenant)
+		if again := pick(tenant); again != first {
+			t.Errorf("%s 两次请求分别选中了 %s 和 %s", tenant, first, again)
+		}
+		chosen[first] = true
+	}
+	if len(chosen) < 4 {
+		t.Errorf("20 个租户只分布到了 %d 个密钥", len(chosen))
+	}
+}
@@ -0,0 +1,95 @@
+package auth_modifier
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// selfTestPath 返回自检写入的临时文件路径或存储键，与正式的索引文件放在同一位置，以便检查同样的权限
+func (f *indexFile) selfTestPath() string {
+	if f.storage != nil {
+		return f.storageKey() + ".selftest"
+	}
+	return f.path + ".selftest"
+}
+
+// selfTest 把当前索引按配置的格式编码后写入临时位置，再读回解码并与内存中的状态比较，
+// 用于确认存储的读写、权限和编解码都正常。不修改内存中的状态，也不触碰正式的索引文件，返回写入的字节数
+func (f *indexFile) selfTest() (int, error) {
+	f.Mutex.RLock()
+	snapshot := f.snapshotLocked(f.latency.copy())
+	data, err := f.encodeSnapshot(snapshot)
+	indexes := make(map[string]int, len(f.Indexes))
+	for key, index := range f.Indexes {
+		indexes[key] = index
+	}
+	weights := make(map[string][]int, len(f.swrr))
+	for key, w := range f.swrr {
+		weights[key] = append([]int(nil), w...)
+	}
+	f.Mutex.RUnlock()
+	if err != nil {
+		return 0, fmt.Errorf("encoding: %v", err)
+	}
+
+	key := f.selfTestPath()
+	if err := f.writeSelfTest(key, data); err != nil {
+		return 0, fmt.Errorf("writing %s: %v", key, err)
+	}
+	defer f.removeSelfTest(key)
+	read, err := f.readSelfTest(key)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %v", key, err)
+	}
+	if !bytes.Equal(read, data) {
+		return 0, fmt.Errorf("read back %d bytes from %s, wrote %d", len(read), key, len(data))
+	}
+
+	scratch := &indexFile{
+		Indexes:  make(map[string]int),
+		swrr:     make(map[string][]int),
+		lastSeen: make(map[string]time.Time),
+		latency:  newLatencyTracker(),
+	}
+	if err := scratch.unmarshalSnapshot(read); err != nil {
+		return 0, fmt.Errorf("decoding: %v", err)
+	}
+	if !reflect.DeepEqual(scratch.Indexes, indexes) {
+		return 0, fmt.Errorf("decoded %d indexes, expected %d or different values", len(scratch.Indexes), len(indexes))
+	}
+	if len(weights) > 0 && !reflect.DeepEqual(scratch.swrr, weights) {
+		return 0, fmt.Errorf("decoded weights differ from memory")
+	}
+	return len(data), nil
+}
+
+func (f *indexFile) writeSelfTest(key string, data []byte) error {
+	if f.storage != nil {
+		return f.storage.Store(key, data)
+	}
+	return os.WriteFile(key, data, 0644)
+}
+
+func (f *indexFile) readSelfTest(key string) ([]byte, error) {
+	if f.storage != nil {
+		return f.storage.Load(key)
+	}
+	return os.ReadFile(key)
+}
+
+func (f *indexFile) removeSelfTest(key string) {
+	var err error
+	if f.storage != nil {
+		err = f.storage.Delete(key)
+	} else {
+		err = os.Remove(key)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		f.logger.Warn("Error removing self-test file", zap.String("path", key), zap.Error(err))
+	}
+}
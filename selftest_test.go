@@ -0,0 +1,103 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// faultyStorage 在文件存储的基础上注入写入失败或读回的数据损坏
+type faultyStorage struct {
+	*certmagic.FileStorage
+	storeErr error
+	corrupt  bool
+}
+
+func (s *faultyStorage) Store(key string, value []byte) error {
+	if s.storeErr != nil {
+		return s.storeErr
+	}
+	return s.FileStorage.Store(key, value)
+}
+
+func (s *faultyStorage) Load(key string) ([]byte, error) {
+	data, err := s.FileStorage.Load(key)
+	if err == nil && s.corrupt {
+		data = append(data, '\n')
+	}
+	return data, err
+}
+
+func TestSelfTestAdmin(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	rotatedSequence(t, a, "/v1", pool(3), 2)
+	if _, err := a.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := new(AdminAPI)
+
+	w, status := adminRequest(t, api.handleSelfTest, http.MethodPost, "/auth_modifier/selftest", "")
+	if status != http.StatusOK {
+		t.Fatalf("状态码 = %d", status)
+	}
+	var resp selfTestResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OK || resp.Bytes == 0 {
+		t.Errorf("响应 = %+v", resp)
+	}
+	// 不留下临时文件，也不触碰正式的索引文件和内存中的索引
+	if _, err := os.Stat(a.IndexPath + ".selftest"); !os.IsNotExist(err) {
+		t.Errorf("临时文件没有删除: %v", err)
+	}
+	if after, _ := os.ReadFile(a.IndexPath); string(after) != string(before) {
+		t.Errorf("索引文件被修改: %s", after)
+	}
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, map[string]int{"/v1": 2}) {
+		t.Errorf("索引 = %v", got)
+	}
+
+	// 临时位置无法写入时报告失败
+	if err := os.Mkdir(a.IndexPath+".selftest", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := adminRequest(t, api.handleSelfTest, http.MethodPost, "/auth_modifier/selftest", ""); status != http.StatusInternalServerError {
+		t.Errorf("写入失败: 状态码 = %d, 期望 500", status)
+	}
+	if _, status := adminRequest(t, api.handleSelfTest, http.MethodGet, "/auth_modifier/selftest", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET: 状态码 = %d, 期望 405", status)
+	}
+}
+
+func TestSelfTestStorageFailures(t *testing.T) {
+	storage := &faultyStorage{FileStorage: &certmagic.FileStorage{Path: t.TempDir()}}
+	a := storageReplica(t, storage)
+	setIndex(a, "/v1", 3)
+	if _, err := a.selfTest(); err != nil {
+		t.Fatalf("正常存储的自检失败: %v", err)
+	}
+
+	storage.storeErr = errors.New("disk full")
+	if _, err := a.selfTest(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("写入失败: 错误 = %v", err)
+	}
+
+	storage.storeErr, storage.corrupt = nil, true
+	if _, err := a.selfTest(); err == nil || !strings.Contains(err.Error(), "read back") {
+		t.Errorf("读回的数据不一致: 错误 = %v", err)
+	}
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, map[string]int{"/v1": 3}) {
+		t.Errorf("自检修改了内存中的索引: %v", got)
+	}
+}
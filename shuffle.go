@@ -0,0 +1,52 @@
+package auth_modifier
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"os"
+)
+
+// hostnameSeed 返回由主机名哈希得到的打乱种子，同一主机每次启动都相同，不同主机通常不同
+func hostnameSeed() (int64, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(hostname))
+	return int64(h.Sum64()), nil
+}
+
+// shufflePerm 返回长度为n的密钥池在shuffle_seed下的固定排列，perm[i]为打乱后第i个位置对应的原下标。
+// 同一种子和长度总是得到相同的排列，按长度缓存；未配置shuffle_seed时返回nil
+func (a *AuthModifier) shufflePerm(n int) []int {
+	if a.ShuffleSeed == 0 {
+		return nil
+	}
+	if perm, ok := a.perms.Load(n); ok {
+		return perm.([]int)
+	}
+	perm := rand.New(rand.NewSource(a.ShuffleSeed)).Perm(n)
+	a.perms.Store(n, perm)
+	return perm
+}
+
+// permute 按perm重新排列list，list为nil时返回nil
+func permute(list []string, perm []int) []string {
+	if list == nil {
+		return nil
+	}
+	permuted := make([]string, len(list))
+	for i, j := range perm {
+		permuted[i] = list[j]
+	}
+	return permuted
+}
+
+// originalPos 把打乱后的下标换算回密钥在请求中的原下标，zip_headers按原下标配对
+func originalPos(perm []int, pos int) int {
+	if perm == nil {
+		return pos
+	}
+	return perm[pos]
+}
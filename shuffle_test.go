@@ -0,0 +1,79 @@
+package auth_modifier
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestShufflePermStable(t *testing.T) {
+	a := newTestHandler(t, "", "shuffle_seed 42")
+	perm := a.shufflePerm(8)
+	sorted := append([]int(nil), perm...)
+	sort.Ints(sorted)
+	if !reflect.DeepEqual(sorted, []int{0, 1, 2, 3, 4, 5, 6, 7}) {
+		t.Fatalf("%v 不是一个排列", perm)
+	}
+	if reflect.DeepEqual(perm, []int{0, 1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("种子42没有打乱顺序")
+	}
+	// 同一种子在另一个进程（处理器）中得到相同的排列
+	if again := newTestHandler(t, "", "shuffle_seed 42").shufflePerm(8); !reflect.DeepEqual(again, perm) {
+		t.Errorf("同一种子的排列不同: %v, %v", perm, again)
+	}
+	if other := newTestHandler(t, "", "shuffle_seed 7").shufflePerm(8); reflect.DeepEqual(other, perm) {
+		t.Errorf("不同种子得到了相同的排列 %v", perm)
+	}
+	if perm := newTestHandler(t, "", "").shufflePerm(8); perm != nil {
+		t.Errorf("未配置shuffle_seed时排列 = %v, 期望 nil", perm)
+	}
+}
+
+func TestShuffleSeedFailoverOrder(t *testing.T) {
+	keys := pool(8)
+	perm := newTestHandler(t, "", "shuffle_seed 42").shufflePerm(8)
+	want := "k" + strconv.Itoa(perm[0])
+
+	// 各副本固定地从打乱后的第一个密钥开始故障切换
+	for i := 0; i < 2; i++ {
+		a := newTestHandler(t, "", "strategy failover\nshuffle_seed 42")
+		assertSequence(t, rotatedSequence(t, a, "/v1", keys, 3), []string{want, want, want})
+	}
+
+	// 轮询按打乱后的顺序遍历整个池
+	a := newTestHandler(t, "", "shuffle_seed 42")
+	got := rotatedSequence(t, a, "/v1", keys, 8)
+	tokens := strings.Split(keys, ",")
+	for i, j := range perm {
+		if got[i] != tokens[j] {
+			t.Fatalf("序列 = %v, 期望按排列 %v", got, perm)
+		}
+	}
+}
+
+func TestShuffleSeedHostname(t *testing.T) {
+	a := newTestHandler(t, "", "shuffle_seed hostname")
+	seed, err := hostnameSeed()
+	if err != nil {
+		t.Skip(err)
+	}
+	if a.ShuffleSeed != seed {
+		t.Errorf("ShuffleSeed = %d, 期望主机名的哈希 %d", a.ShuffleSeed, seed)
+	}
+}
+
+func TestShuffleSeedInvalid(t *testing.T) {
+	for _, seed := range []string{"abc", "0"} {
+		a := new(AuthModifier)
+		input := "auth_modifier " + filepath.Join(t.TempDir(), "index.json") + " {\nshuffle_seed " + seed + "\n}"
+		if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("shuffle_seed %s: 错误 = %v, 期望 ErrInvalidOption", seed, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package auth_modifier
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// simulatedKey 是模拟选择时使用的索引键
+const simulatedKey = "/"
+
+// SimulateSelection 返回strategy策略下连续n次请求依次选中的pool下标，用于验证配置或绘制分布。
+// 只在内存中模拟，不读写索引文件，也不影响正在运行的处理器。随机类策略使用固定的种子，结果可以复现；
+// 模拟中没有请求体和延迟观测，body_hash总是选中0，adaptive_latency等同于等权随机。strategy不合法时返回nil
+func SimulateSelection(pool []string, n int, strategy string) []int {
+	return SimulateSelectionSeeded(pool, n, strategy, 1)
+}
+
+// SimulateSelectionSeeded 与SimulateSelection相同，随机类策略使用给定的种子
+func SimulateSelectionSeeded(pool []string, n int, strategy string, seed int64) []int {
+	if len(pool) == 0 || n <= 0 || !contains(validStrategies, strategy) {
+		return nil
+	}
+	a := &AuthModifier{
+		Strategy: strategy,
+		KeyBy:    KeyByPath,
+		IndexCap: defaultIndexCap,
+		logger:   zap.NewNop(),
+		rnd:      rand.New(rand.NewSource(seed)),
+	}
+	a.indexFile = &indexFile{
+		Indexes:    make(map[string]int),
+		logger:     a.logger,
+		dirty:      make(map[string]struct{}),
+		swrr:       make(map[string][]int),
+		lastSeen:   make(map[string]time.Time),
+		latency:    newLatencyTracker(),
+		memoryOnly: true,
+	}
+	a.latency = a.indexFile.latency
+	selector := a.builtinSelector()
+	chosen := make([]int, n)
+	for i := range chosen {
+		a.Mutex.RLock()
+		index := a.indexLocked(simulatedKey)
+		a.Mutex.RUnlock()
+		ctx := context.WithValue(context.Background(), selectionCtxKey{}, selection{index: uint64(index)})
+		pos := selector.Select(ctx, simulatedKey, pool) % len(pool)
+		if pos < 0 {
+			pos += len(pool)
+		}
+		chosen[i] = pos
+		a.updateIndex(simulatedKey)
+	}
+	return chosen
+}
+
+// randIntn 从rnd取[0,n)的随机数，rnd为nil时使用全局随机源
+func randIntn(rnd *rand.Rand, n int) int {
+	if rnd == nil {
+		return rand.Intn(n)
+	}
+	return rnd.Intn(n)
+}
+
+// randFloat64 从rnd取[0,1)的随机数，rnd为nil时使用全局随机源
+func randFloat64(rnd *rand.Rand) float64 {
+	if rnd == nil {
+		return rand.Float64()
+	}
+	return rnd.Float64()
+}
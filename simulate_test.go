@@ -0,0 +1,69 @@
+package auth_modifier
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSimulateSelectionDeterministic(t *testing.T) {
+	for _, c := range []struct {
+		strategy string
+		pool     []string
+		want     []int
+	}{
+		{StrategyRoundRobin, []string{"a", "b", "c"}, []int{0, 1, 2, 0, 1}},
+		{StrategyWeightedRoundRobin, []string{"k1:5", "k2", "k3"}, []int{0, 0, 1, 0, 2, 0, 0}},
+		{StrategyFailover, []string{"a", "b"}, []int{0, 0, 0}},
+		{StrategyBodyHash, []string{"a", "b"}, []int{0, 0}},
+	} {
+		if got := SimulateSelection(c.pool, len(c.want), c.strategy); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: %v, 期望 %v", c.strategy, got, c.want)
+		}
+	}
+}
+
+func TestSimulateSelectionSeeded(t *testing.T) {
+	pool := []string{"a", "b", "c", "d"}
+	for _, strategy := range []string{StrategyRandom, StrategyWeightedRandom, StrategyP2C, StrategyAdaptiveLatency} {
+		first := SimulateSelectionSeeded(pool, 50, strategy, 7)
+		if again := SimulateSelectionSeeded(pool, 50, strategy, 7); !reflect.DeepEqual(first, again) {
+			t.Errorf("%s: 相同的种子得到了不同的序列", strategy)
+		}
+		if other := SimulateSelectionSeeded(pool, 50, strategy, 8); reflect.DeepEqual(first, other) {
+			t.Errorf("%s: 不同的种子得到了相同的序列", strategy)
+		}
+		for _, pos := range first {
+			if pos < 0 || pos >= len(pool) {
+				t.Fatalf("%s: 下标 %d 越界", strategy, pos)
+			}
+		}
+	}
+}
+
+func TestSimulateSelectionInvalid(t *testing.T) {
+	for _, got := range [][]int{
+		SimulateSelection([]string{"a"}, 3, "rondom"),
+		SimulateSelection(nil, 3, StrategyRoundRobin),
+		SimulateSelection([]string{"a"}, 0, StrategyRoundRobin),
+	} {
+		if got != nil {
+			t.Errorf("期望 nil, 得到 %v", got)
+		}
+	}
+}
+
+func TestSimulateSelectionLeavesStateAlone(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	rotatedSequence(t, a, "/", "a,b,c", 2)
+	before := snapshotIndexes(a.indexFile)
+	SimulateSelection([]string{"a", "b", "c"}, 10, StrategyRoundRobin)
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, before) {
+		t.Errorf("模拟修改了正在使用的索引: %v, 之前 %v", got, before)
+	}
+}
+
+func ExampleSimulateSelection() {
+	fmt.Println(SimulateSelection([]string{"k1:5", "k2", "k3"}, 7, StrategyWeightedRoundRobin))
+	// Output: [0 0 1 0 2 0 0]
+}
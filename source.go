@@ -0,0 +1,172 @@
+package auth_modifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 远程密钥池的默认刷新间隔和请求超时
+const (
+	defaultSourceRefresh = time.Minute
+	sourceTimeout        = 10 * time.Second
+	maxSourceSize        = 1 << 20
+)
+
+// keySource 定期从source_url拉取密钥池，拉取失败时保留上一次成功的结果
+type keySource struct {
+	url    string
+	client *http.Client
+	logger *zap.Logger
+	keys   atomic.Value // []string
+
+	collapse bool // 是否去掉拉取到的重复密钥，见collapse_duplicates
+
+	mu           sync.Mutex // 保护etag和lastModified，避免并发刷新
+	etag         string
+	lastModified string
+}
+
+// sourcePayload 是远程密钥池的响应格式，也可以直接返回字符串数组。
+// 密钥可以带":权重"后缀，与keys的写法一致
+type sourcePayload struct {
+	Keys []string `json:"keys"`
+}
+
+func newKeySource(url string, logger *zap.Logger) *keySource {
+	return &keySource{
+		url:    url,
+		client: &http.Client{Timeout: sourceTimeout},
+		logger: logger,
+	}
+}
+
+// load 返回当前的密钥池，尚未成功拉取过时为nil
+func (s *keySource) load() []string {
+	keys, _ := s.keys.Load().([]string)
+	return keys
+}
+
+// refresh 拉取一次密钥池。借助ETag和Last-Modified，未变化时服务端返回304，不需要重新解析
+func (s *keySource) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	if len(s.etag) > 0 {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if len(s.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("key source returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceSize))
+	if err != nil {
+		return err
+	}
+	keys, err := parseSource(data)
+	if err != nil {
+		return err
+	}
+	if s.collapse {
+		keys, _ = collapseDuplicates(keys, nil)
+	}
+	s.keys.Store(keys)
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	s.logger.Debug("Key pool refreshed", zap.String("url", s.url), zap.Int("keys", len(keys)))
+	return nil
+}
+
+// parseSource 解析 {"keys": [...]} 或 [...] 两种格式，空的密钥池视为错误
+func parseSource(data []byte) ([]string, error) {
+	var payload sourcePayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		if err := json.Unmarshal(data, &payload.Keys); err != nil {
+			return nil, fmt.Errorf("parsing key source: %v", err)
+		}
+	}
+	keys := make([]string, 0, len(payload.Keys))
+	for _, key := range payload.Keys {
+		if len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key source returned an empty pool")
+	}
+	return keys, nil
+}
+
+// start 每隔interval刷新一次，直到ctx结束
+func (s *keySource) start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.refresh(ctx); err != nil {
+					s.logger.Error("Error refreshing key pool, keeping the previous pool",
+						zap.String("url", s.url), zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// keys 返回当前使用的密钥池：配置了source_url且拉取成功过时使用远程密钥池，
+// 配置了secrets_dir时使用目录中的密钥，否则使用keys
+func (a *AuthModifier) keys() []string {
+	if a.source != nil {
+		if keys := a.source.load(); keys != nil {
+			return keys
+		}
+	}
+	if a.secrets != nil {
+		return a.secrets.load()
+	}
+	return a.Keys
+}
+
+// hasServerKeys 判断第一个轮换请求头是否由服务端配置的密钥池填充
+func (a *AuthModifier) hasServerKeys() bool {
+	return len(a.Keys) > 0 || len(a.SourceURL) > 0 || len(a.SecretsDir) > 0
+}
+
+// provisionSource 首次拉取远程密钥池并启动定期刷新。
+// 首次拉取失败时如果配置了keys则先使用keys，否则返回错误
+func (a *AuthModifier) provisionSource() error {
+	a.source = newKeySource(a.SourceURL, a.logger)
+	a.source.collapse = a.CollapseDuplicates
+	if err := a.source.refresh(a.ctx); err != nil {
+		if len(a.Keys) == 0 {
+			return fmt.Errorf("%w: %s: %v", ErrKeySource, a.SourceURL, err)
+		}
+		a.logger.Error("Error fetching key pool, using configured keys until the next refresh",
+			zap.String("url", a.SourceURL), zap.Error(err))
+	}
+	a.source.start(a.ctx, time.Duration(a.SourceRefresh))
+	return nil
+}
@@ -0,0 +1,67 @@
+package auth_modifier
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// statusRange 是一段闭区间的状态码
+type statusRange struct {
+	lo, hi int
+}
+
+// parseStatusRanges 解析状态码列表，元素可以是单个状态码（429）、状态码类别（5xx）或区间（500-503）
+func parseStatusRanges(specs []string) ([]statusRange, error) {
+	ranges := make([]statusRange, 0, len(specs))
+	for _, spec := range specs {
+		r, err := parseStatusRange(strings.ToLower(strings.TrimSpace(spec)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: status '%s': %v", ErrInvalidOption, spec, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parseStatusRange(spec string) (statusRange, error) {
+	if len(spec) == 3 && strings.HasSuffix(spec, "xx") && spec[0] >= '1' && spec[0] <= '5' {
+		lo := int(spec[0]-'0') * 100
+		return statusRange{lo, lo + 99}, nil
+	}
+	lo, hi := spec, spec
+	if i := strings.IndexByte(spec, '-'); i > 0 {
+		lo, hi = spec[:i], spec[i+1:]
+	}
+	l, err := strconv.Atoi(lo)
+	if err != nil {
+		return statusRange{}, err
+	}
+	h, err := strconv.Atoi(hi)
+	if err != nil {
+		return statusRange{}, err
+	}
+	if l < 100 || h > 599 || l > h {
+		return statusRange{}, fmt.Errorf("must be between 100 and 599")
+	}
+	return statusRange{l, h}, nil
+}
+
+// matchStatus 判断status是否落在ranges中的某一段
+func matchStatus(ranges []statusRange, status int) bool {
+	for _, r := range ranges {
+		if status >= r.lo && status <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// statusAdvances 判断advance_on为status时下游状态码是否推进索引：
+// 配置了advance_on_status时须匹配其一，且不能匹配no_advance_on_status
+func (a *AuthModifier) statusAdvances(status int) bool {
+	if len(a.advanceStatus) > 0 && !matchStatus(a.advanceStatus, status) {
+		return false
+	}
+	return !matchStatus(a.noAdvanceStatus, status)
+}
@@ -0,0 +1,63 @@
+package auth_modifier
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges([]string{"2xx", "429", " 500-503 ", "4XX"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []statusRange{{200, 299}, {429, 429}, {500, 503}, {400, 499}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ranges = %v, 期望 %v", ranges, want)
+	}
+	for _, spec := range []string{"6xx", "abc", "99", "600", "503-500", "500-", "x00"} {
+		if _, err := parseStatusRanges([]string{spec}); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: 错误 = %v, 期望 ErrInvalidOption", spec, err)
+		}
+	}
+}
+
+func TestAdvanceOnStatus(t *testing.T) {
+	statuses := []int{200, 503, 429, 500, 404, 200}
+	for _, c := range []struct {
+		block string
+		want  []string
+	}{
+		// 5xx说明请求没有真正消耗配额，不推进
+		{"no_advance_on_status 5xx", []string{"k0", "k1", "k1", "k2", "k2", "k0"}},
+		{"advance_on_status 2xx 4xx", []string{"k0", "k1", "k1", "k2", "k2", "k0"}},
+		// 两者同时配置时no_advance_on_status优先
+		{"advance_on_status 2xx 429 500-503\nno_advance_on_status 503", []string{"k0", "k1", "k1", "k2", "k0", "k0"}},
+		{"advance_on status\nadvance_on_status 429", []string{"k0", "k0", "k0", "k1", "k1", "k1"}},
+	} {
+		a := newTestHandler(t, "", c.block)
+		next, seen := countingNext(statuses...)
+		for range statuses {
+			if err := a.ServeHTTP(httptest.NewRecorder(), authRequest("/v1", pool(3)), next); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(*seen, c.want) {
+			t.Errorf("%q: 序列 = %v, 期望 %v", c.block, *seen, c.want)
+		}
+	}
+}
+
+func TestAdvanceOnStatusInvalid(t *testing.T) {
+	for _, block := range []string{
+		"advance_on_status 7xx",
+		"advance_on status",
+		"advance_on always\nadvance_on_status 2xx",
+	} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\n"+block+"\n}")
+		if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: 错误 = %v, 期望 ErrInvalidOption", block, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package auth_modifier
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// indexKey 计算请求对应的索引键
+func (a *AuthModifier) indexKey(r *http.Request) string {
+	if len(a.KeyTemplate) > 0 {
+		return a.templateKey(r)
+	}
+	if a.KeyBy == KeyByPoolHash {
+		if pool := a.requestPool(r); len(pool) > 0 {
+			return poolHash(pool)
+		}
+	}
+	if a.KeyBy == KeyByPathMethod {
+		return r.Method + " " + r.URL.Path
+	}
+	if a.KeyBy == KeyByGlobal {
+		return globalKey
+	}
+	if len(a.keyHeaders) > 0 {
+		return headersKey(r, a.keyHeaders)
+	}
+	return r.URL.Path
+}
+
+// hostnameOrdinal 返回主机名末尾的数字，如StatefulSet中pod名称web-2对应2
+func hostnameOrdinal() (int, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	i := len(hostname)
+	for i > 0 && hostname[i-1] >= '0' && hostname[i-1] <= '9' {
+		i--
+	}
+	if i == len(hostname) {
+		return 0, fmt.Errorf("hostname '%s' does not end with an ordinal", hostname)
+	}
+	return strconv.Atoi(hostname[i:])
+}
+
+// globalKey 是key_by global下所有请求共用的索引键，用于占位符、日志和加权轮询的状态
+const globalKey = "global"
+
+// globalCounter 返回全局计数器的原始值（round_robin_global_seeded下加上seed）。计数器是单调递增的uint64，
+// 不经过IndexCap，选择时才直接按密钥池的长度取模，因此与密钥池大小无关；
+// 回绕发生在2^64次请求之后，回绕时取模结果最多跳变一次，不会出现负数下标
+func (a *AuthModifier) globalCounter() uint64 {
+	counter := atomic.LoadUint64(&a.global)
+	if a.Strategy == StrategyRoundRobinSeeded {
+		counter += uint64(a.Seed)
+	}
+	return counter
+}
+
+// positionLocked 返回索引键key本次的轮换位置（已加上replica_offset），调用方需持有a.Mutex。
+// key_by global下是全局计数器的原始值，其他情况下在IndexCap处回绕
+func (a *AuthModifier) positionLocked(key string) uint64 {
+	if a.KeyBy == KeyByGlobal {
+		return a.globalCounter() + uint64(a.ReplicaOffset)
+	}
+	return uint64((a.indexLocked(key) + a.ReplicaOffset) % a.IndexCap)
+}
+
+// headerKeySeparator 连接组合索引键中各请求头的值
+const headerKeySeparator = "|"
+
+// headersKey 按顺序连接各请求头的值作为索引键，缺少的请求头视为空值，
+// 例如只带X-Tenant: a的请求在headers:X-Tenant,X-Region下得到"a|"
+func headersKey(r *http.Request, names []string) string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = r.Header.Get(name)
+	}
+	return strings.Join(values, headerKeySeparator)
+}
+
+// templateKey 用请求的占位符展开key_template，开启strip_query时去掉查询串和片段，
+// 避免缓存参数、时间戳等让索引键无限增长
+func (a *AuthModifier) templateKey(r *http.Request) string {
+	key := a.KeyTemplate
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		key = repl.ReplaceAll(key, "")
+	}
+	if a.StripQuery {
+		if i := strings.IndexAny(key, "?#"); i >= 0 {
+			key = key[:i]
+		}
+	}
+	return key
+}
+
+// indexLocked 返回索引键key当前的索引，调用方需持有a.Mutex。
+// 从path切换到path_method后，新键第一次出现时沿用同一路径原有的索引，避免轮换进度归零。
+func (a *AuthModifier) indexLocked(key string) int {
+	if v, ok := a.Indexes[key]; ok {
+		return v
+	}
+	if a.Strategy == StrategyRoundRobinSeeded {
+		return a.Seed % a.IndexCap
+	}
+	if a.KeyBy != KeyByPathMethod {
+		return 0
+	}
+	if i := strings.IndexByte(key, ' '); i >= 0 {
+		return a.Indexes[key[i+1:]]
+	}
+	return 0
+}
+
+// requestPool 返回请求实际使用的密钥池：优先使用配置的keys，否则取第一个携带了值的轮换请求头
+func (a *AuthModifier) requestPool(r *http.Request) []string {
+	if keys := a.keys(); len(keys) > 0 {
+		return keys
+	}
+	for _, name := range a.Headers {
+		if value := r.Header.Get(name); len(value) > 0 {
+			_, tokens := a.splitCredential(r, name, value)
+			return tokens
+		}
+	}
+	return nil
+}
+
+// poolHash 对去掉首尾空白并排序后的密钥列表取SHA-256，截取前16个十六进制字符作为索引键。
+// 64位的哈希碰撞概率可以忽略，即便碰撞也只是两组密钥共享同一个计数器，不影响正确性。
+func poolHash(pool []string) string {
+	normalized := make([]string, len(pool))
+	for i, token := range pool {
+		normalized[i] = strings.TrimSpace(token)
+	}
+	sort.Strings(normalized)
+	sum := sha256.Sum256([]byte(strings.Join(normalized, "\n")))
+	return "pool:" + hex.EncodeToString(sum[:8])
+}
+
+// usesIndex 判断当前策略是否依赖按路径记录的索引
+func (a *AuthModifier) usesIndex() bool {
+	return a.Strategy == StrategyRoundRobin || a.Strategy == StrategyRoundRobinSeeded
+}
+
+// selectIndex 根据策略从长度为length的列表中选出本次使用的下标
+func (a *AuthModifier) selectIndex(index uint64, length int) int {
+	if a.Strategy == StrategyRandom {
+		return rand.Intn(length)
+	}
+	return int(index % uint64(length))
+}
+
+// stripWeights 在加权策略下返回去掉":权重"后缀的密钥，其他策略下密钥保持原样
+func (a *AuthModifier) stripWeights(tokens []string) []string {
+	if a.Strategy != StrategyWeightedRoundRobin && a.Strategy != StrategyWeightedRandom && a.Strategy != StrategyWeightedHash {
+		return tokens
+	}
+	stripped := make([]string, len(tokens))
+	for i, token := range tokens {
+		stripped[i], _ = parseWeight(token)
+	}
+	return stripped
+}
+
+// collapseDuplicates 去掉pool中重复的密钥，只保留每个密钥第一次出现的位置，没有重复时原样返回。
+// schemes与pool一一对应（可为nil），随pool同步删除。密钥按原文比较，"k1:2"与"k1"视为不同的元素
+func collapseDuplicates(pool, schemes []string) ([]string, []string) {
+	seen := make(map[string]bool, len(pool))
+	var keptPool, keptSchemes []string
+	for i, token := range pool {
+		if seen[token] {
+			if keptPool == nil {
+				keptPool = append([]string(nil), pool[:i]...)
+				if schemes != nil {
+					keptSchemes = append([]string(nil), schemes[:i]...)
+				}
+			}
+			continue
+		}
+		seen[token] = true
+		if keptPool != nil {
+			keptPool = append(keptPool, token)
+			if schemes != nil {
+				keptSchemes = append(keptSchemes, schemes[i])
+			}
+		}
+	}
+	if keptPool == nil {
+		return pool, schemes
+	}
+	return keptPool, keptSchemes
+}
+
+// parseWeight 解析"密钥:权重"格式，未带权重或权重不是正整数时视为权重1
+func parseWeight(token string) (string, int) {
+	i := strings.LastIndexByte(token, ':')
+	if i < 0 {
+		return token, 1
+	}
+	w, err := strconv.Atoi(token[i+1:])
+	if err != nil || w <= 0 {
+		return token, 1
+	}
+	return token[:i], w
+}
+
+// maxRequestWeight 是请求权重的上限，避免单个请求一次性推进过多轮次
+const maxRequestWeight = 100
+
+// requestWeight 读取客户端声明的请求代价，未启用、未携带或不合法时为1
+func (a *AuthModifier) requestWeight(r *http.Request) int {
+	if len(a.RequestWeightHeader) == 0 {
+		return 1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(a.RequestWeightHeader)))
+	if err != nil || n < 1 {
+		return 1
+	}
+	if n > maxRequestWeight {
+		return maxRequestWeight
+	}
+	return n
+}
+
+// smoothWeighted 实现Nginx的平滑加权轮询：每次所有密钥的当前权重加上各自权重，
+// 选出当前权重最大的密钥并减去总权重。5:1:1的权重会得到 a a b a c a a 的序列。
+func (a *AuthModifier) smoothWeighted(key string, weights []int, cost int) int {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	current := a.swrr[key]
+	// freeze_index下在副本上计算，保存的状态保持不变
+	if a.FreezeIndex {
+		current = append([]int(nil), current...)
+	}
+	// 密钥数量变化后之前的状态已无意义，重新开始
+	if len(current) != len(weights) {
+		current = make([]int, len(weights))
+		if !a.FreezeIndex {
+			a.swrr[key] = current
+		}
+	}
+	// 代价为cost的请求相当于一次推进cost轮：权重高的密钥积累得更多，因此更容易被选中，
+	// 选中后扣除total*cost，各密钥的总和仍保持为0，长期来看各密钥承担的代价与权重成正比
+	total, best := 0, 0
+	for i, w := range weights {
+		current[i] += w * cost
+		total += w * cost
+		if current[i] > current[best] {
+			best = i
+		}
+	}
+	current[best] -= total
+	if a.FreezeIndex {
+		return best
+	}
+	a.touchLocked(key, time.Now(), true)
+	a.dirty[key] = struct{}{}
+	a.Changed = true
+	return best
+}
@@ -0,0 +1,507 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestInvalidStrategyListsOptions(t *testing.T) {
+	a := &AuthModifier{Strategy: "rondom"}
+	err := provisionTest(t, a)
+	if !errors.Is(err, ErrInvalidStrategy) {
+		t.Fatalf("错误 = %v, 期望包装 ErrInvalidStrategy", err)
+	}
+	if !strings.Contains(err.Error(), "'rondom'") {
+		t.Errorf("错误 %q 中没有填写的策略", err)
+	}
+	for _, strategy := range validStrategies {
+		if !strings.Contains(err.Error(), strategy) {
+			t.Errorf("错误 %q 中没有列出 %s", err, strategy)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSequence(t *testing.T) {
+	a := newTestHandler(t, "", "strategy weighted_round_robin")
+	got := rotatedSequence(t, a, "/v1", "k1:5,k2,k3", 14)
+	// 平滑加权轮询的交错序列，每7个请求一个周期
+	want := []string{"k1", "k1", "k2", "k1", "k3", "k1", "k1"}
+	assertSequence(t, got, append(want, want...))
+}
+
+func TestWeightedRoundRobinPerPool(t *testing.T) {
+	a := newTestHandler(t, "", "strategy weighted_round_robin")
+	// 不同路径的权重状态互不影响
+	assertSequence(t, rotatedSequence(t, a, "/a", "x:2,y", 2), []string{"x", "y"})
+	assertSequence(t, rotatedSequence(t, a, "/b", "x:2,y", 3), []string{"x", "y", "x"})
+	assertSequence(t, rotatedSequence(t, a, "/a", "x:2,y", 1), []string{"x"})
+}
+
+// pool 返回k0到k(n-1)组成的密钥列表
+func pool(n int) string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestIndexCapWraps(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	a.Mutex.Lock()
+	a.Indexes["/v1"] = defaultIndexCap - 2
+	a.Mutex.Unlock()
+
+	// 同一路径交替使用10个和2个密钥的池，回绕前后各自的顺序保持连续
+	var got []string
+	for i := 0; i < 4; i++ {
+		keys := pool(10)
+		if i%2 == 1 {
+			keys = pool(2)
+		}
+		seen, _ := serveTest(t, a, authRequest("/v1", keys), http.StatusOK)
+		got = append(got, seen.Get("Authorization"))
+	}
+	assertSequence(t, got, []string{"k8", "k1", "k0", "k1"})
+	if index := snapshotIndexes(a.indexFile)["/v1"]; index != 2 {
+		t.Errorf("回绕后的索引 = %d, 期望 2", index)
+	}
+}
+
+func TestIndexCapConfigured(t *testing.T) {
+	a := newTestHandler(t, "", "index_cap 6")
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(3), 8), []string{"k0", "k1", "k2", "k0", "k1", "k2", "k0", "k1"})
+	if index := snapshotIndexes(a.indexFile)["/v1"]; index != 2 {
+		t.Errorf("索引 = %d, 期望在index_cap处回绕为 2", index)
+	}
+}
+
+func TestKeyByPoolHash(t *testing.T) {
+	a := newTestHandler(t, "", "key_by pool_hash")
+	// 同一组密钥无论从哪个路径进来、顺序如何都共享轮换进度
+	var got []string
+	for _, path := range []string{"/a", "/b", "/c"} {
+		seen, _ := serveTest(t, a, authRequest(path, "k1,k2,k3"), http.StatusOK)
+		got = append(got, seen.Get("Authorization"))
+	}
+	assertSequence(t, got, []string{"k1", "k2", "k3"})
+
+	indexes := snapshotIndexes(a.indexFile)
+	key := poolHash([]string{"k1", "k2", "k3"})
+	if len(indexes) != 1 || indexes[key] != 3 {
+		t.Errorf("索引 = %v, 期望只有 %s", indexes, key)
+	}
+	if poolHash([]string{" k3", "k1", "k2 "}) != key {
+		t.Error("排序和去掉空白后相同的密钥池应得到相同的哈希")
+	}
+	if poolHash([]string{"k1", "k2"}) == key {
+		t.Error("不同的密钥池应得到不同的哈希")
+	}
+	// 其他密钥池有独立的索引
+	seen, _ := serveTest(t, a, authRequest("/a", "x1,x2"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "x1" {
+		t.Errorf("Authorization = %q, 期望 x1", got)
+	}
+}
+
+// methodRequest 构造指定方法、携带Authorization的请求
+func methodRequest(method, path, value string) *http.Request {
+	r := authRequest(path, value)
+	r.Method = method
+	return r
+}
+
+func TestKeyByPathMethod(t *testing.T) {
+	a := newTestHandler(t, "", "key_by path_method")
+	var got []string
+	for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodPost, http.MethodGet, http.MethodPost} {
+		seen, _ := serveTest(t, a, methodRequest(method, "/v1/resource", "k1,k2,k3"), http.StatusOK)
+		got = append(got, method+":"+seen.Get("Authorization"))
+	}
+	assertSequence(t, got, []string{"GET:k1", "GET:k2", "POST:k1", "GET:k3", "POST:k2"})
+	want := map[string]int{"GET /v1/resource": 3, "POST /v1/resource": 2}
+	if indexes := snapshotIndexes(a.indexFile); !reflect.DeepEqual(indexes, want) {
+		t.Errorf("索引 = %v, 期望 %v", indexes, want)
+	}
+}
+
+func TestKeyByPathMethodInheritsPathIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	t.Run("path", func(t *testing.T) {
+		rotatedSequence(t, newTestHandler(t, path, ""), "/v1", "k1,k2,k3", 2)
+	})
+	// 从path切换过来时，新键首次出现沿用该路径原有的索引
+	a := newTestHandler(t, path, "key_by path_method")
+	seen, _ := serveTest(t, a, methodRequest(http.MethodPost, "/v1", "k1,k2,k3"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "k3" {
+		t.Errorf("Authorization = %q, 期望沿用路径的索引选中 k3", got)
+	}
+	seen, _ = serveTest(t, a, methodRequest(http.MethodGet, "/v1", "k1,k2,k3"), http.StatusOK)
+	if got := seen.Get("Authorization"); got != "k3" {
+		t.Errorf("GET Authorization = %q, 期望 k3", got)
+	}
+}
+
+// weightedRequest 构造声明了请求代价的请求，cost为空时不携带X-Request-Weight
+func weightedRequest(path, value, cost string) *http.Request {
+	r := authRequest(path, value)
+	if len(cost) > 0 {
+		r.Header.Set("X-Request-Weight", cost)
+	}
+	return r
+}
+
+func TestRequestWeightPrefersHeavierKey(t *testing.T) {
+	a := newTestHandler(t, "", "strategy weighted_round_robin\nrequest_weight_header")
+	heavy := map[string]int{}
+	served := map[string]int{}
+	for i := 0; i < 40; i++ {
+		cost := ""
+		if i%4 == 3 {
+			cost = "10"
+		}
+		seen, _ := serveTest(t, a, weightedRequest("/v1", "big:3,small", cost), http.StatusOK)
+		token := seen.Get("Authorization")
+		if len(cost) > 0 {
+			heavy[token]++
+			served[token] += 10
+		} else {
+			served[token]++
+		}
+	}
+	if heavy["small"] > 0 {
+		t.Errorf("重请求分布 = %v, 期望全部落在高权重密钥", heavy)
+	}
+	// 长期来看各密钥承担的代价与权重成正比
+	if got := float64(served["big"]) / float64(served["big"]+served["small"]); got < 0.7 || got > 0.8 {
+		t.Errorf("代价分布 = %v, big占比 %.2f, 期望约0.75", served, got)
+	}
+}
+
+func TestRequestWeightIgnoresInvalidHeader(t *testing.T) {
+	a := newTestHandler(t, "", "strategy weighted_round_robin\nrequest_weight_header X-Cost")
+	var got []string
+	for _, cost := range []string{"", "abc", "-3", "0"} {
+		r := authRequest("/v1", "k1:2,k2")
+		if len(cost) > 0 {
+			r.Header.Set("X-Cost", cost)
+		}
+		seen, _ := serveTest(t, a, r, http.StatusOK)
+		got = append(got, seen.Get("Authorization"))
+	}
+	// 不合法的代价按1处理，与普通加权轮询的序列相同
+	assertSequence(t, got, []string{"k1", "k2", "k1", "k1"})
+}
+
+func TestRequestWeightCapped(t *testing.T) {
+	a := &AuthModifier{RequestWeightHeader: "X-Request-Weight"}
+	for cost, want := range map[string]int{"1": 1, "50": 50, "100": 100, "101": maxRequestWeight, "99999": maxRequestWeight} {
+		if got := a.requestWeight(weightedRequest("/", "", cost)); got != want {
+			t.Errorf("requestWeight(%s) = %d, 期望 %d", cost, got, want)
+		}
+	}
+}
+
+func TestRoundRobinGlobalSeededSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	// 索引文件中已有的进度会被忽略
+	persisted := newTestHandler(t, path, "")
+	rotatedSequence(t, persisted, "/v1", pool(3), 2)
+	if _, err := persisted.persistIndexes(true); err != nil {
+		t.Fatal(err)
+	}
+
+	block := "strategy round_robin_global_seeded\nseed 4\nignore_persisted"
+	for run := 0; run < 2; run++ {
+		a := newTestHandler(t, path, block)
+		// 4 % 3 = 1，每个索引键都从第2个密钥开始
+		assertSequence(t, rotatedSequence(t, a, "/v1", pool(3), 5), []string{"k1", "k2", "k0", "k1", "k2"})
+		assertSequence(t, rotatedSequence(t, a, "/v2", pool(3), 2), []string{"k1", "k2"})
+		assertSequence(t, rotatedSequence(t, a, "/v3", pool(4), 2), []string{"k0", "k1"})
+		if err := a.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWeightedRandomProportions(t *testing.T) {
+	a := newTestHandler(t, "", "strategy weighted_random")
+	const n = 10000
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		seen, _ := serveTest(t, a, authRequest("/v1", "a:6,b:3,c:1"), http.StatusOK)
+		counts[seen.Get("Authorization")]++
+	}
+	for token, weight := range map[string]float64{"a": 0.6, "b": 0.3, "c": 0.1} {
+		// 10000次抽样的标准差不超过0.5%，3%的容差几乎不会误报
+		if got := float64(counts[token]) / n; got < weight-0.03 || got > weight+0.03 {
+			t.Errorf("%s 占比 %.3f, 期望约 %.1f: %v", token, got, weight, counts)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("选中的密钥 = %v", counts)
+	}
+	// 不需要持久化状态
+	if indexes := snapshotIndexes(a.indexFile); len(indexes) != 0 {
+		t.Errorf("weighted_random 不应记录索引: %v", indexes)
+	}
+}
+
+func TestKeyByMultipleHeaders(t *testing.T) {
+	a := newTestHandler(t, "", "key_by headers:X-Tenant,X-Region")
+	send := func(tenant, region string) {
+		r := authRequest("/v1", pool(3))
+		if len(tenant) > 0 {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		if len(region) > 0 {
+			r.Header.Set("X-Region", region)
+		}
+		serveTest(t, a, r, http.StatusOK)
+	}
+	send("a", "eu")
+	send("a", "eu")
+	send("a", "us")
+	send("a", "")
+	send("", "eu")
+	send("", "")
+	send("", "")
+	want := map[string]int{"a|eu": 2, "a|us": 1, "a|": 1, "|eu": 1, "|": 2}
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("索引 = %v, 期望 %v", got, want)
+	}
+}
+
+func TestGlobalCounterWraps(t *testing.T) {
+	a := newTestHandler(t, "", "key_by global")
+	start := uint64(math.MaxUint64 - 2)
+	atomic.StoreUint64(&a.global, start)
+	var want []string
+	for i := uint64(0); i < 6; i++ {
+		// 计数器只在选择时按密钥池的长度取模，回绕后从0继续
+		counter := start + i
+		want = append(want, "k"+strconv.Itoa(int(counter%3)))
+	}
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(3), 6), want)
+	if got := atomic.LoadUint64(&a.global); got != 3 {
+		t.Errorf("计数器 = %d, 期望回绕到 3", got)
+	}
+	if want[3] != "k0" {
+		t.Errorf("回绕后应从第一个密钥开始: %v", want)
+	}
+}
+
+func TestGlobalCounterIgnoresIndexCap(t *testing.T) {
+	a := newTestHandler(t, "", "key_by global")
+	// 17不整除默认的IndexCap，越过IndexCap时顺序也不应跳变
+	start := uint64(a.IndexCap - 2)
+	atomic.StoreUint64(&a.global, start)
+	var want []string
+	for i := uint64(0); i < 4; i++ {
+		want = append(want, "k"+strconv.Itoa(int((start+i)%17)))
+	}
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(17), 4), want)
+}
+
+func TestGlobalCounterSavedWithJournal(t *testing.T) {
+	a := newTestHandler(t, "", "key_by global\njournal\nsave_interval 1h")
+	rotatedSequence(t, a, "/v1", pool(3), 3)
+	// 全局计数器不产生增量日志记录，定时保存时直接写入完整索引文件
+	if _, err := a.persistIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(a.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved indexSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Global != 3 {
+		t.Errorf("保存的全局计数器 = %d, 期望 3", saved.Global)
+	}
+	// 没有变化时跳过保存
+	if n, err := a.persistIndexes(false); err != nil || n != 0 {
+		t.Errorf("persistIndexes = %d, %v, 期望跳过保存", n, err)
+	}
+}
+
+func TestGlobalCounterSavedAfterFailedWrite(t *testing.T) {
+	a := newTestHandler(t, "", "key_by global\njournal\nsave_interval 1h")
+	rotatedSequence(t, a, "/v1", pool(3), 2)
+	// 用普通文件占住目录名，使完整索引无法写入
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := a.indexFile.path
+	a.indexFile.path = filepath.Join(blocker, "index.json")
+	if _, err := a.persistIndexes(false); err == nil {
+		t.Fatal("写入被占用的路径应失败")
+	}
+	a.indexFile.path = path
+
+	// 写入失败后计数器仍视为未保存，下一次定时保存重写完整索引，而不是只追加增量日志
+	if _, err := a.persistIndexes(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved indexSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Global != 2 {
+		t.Errorf("保存的全局计数器 = %d, 期望 2", saved.Global)
+	}
+}
+
+func TestGlobalCounterSharedAcrossPools(t *testing.T) {
+	a := newTestHandler(t, "", "key_by global")
+	// 所有路径和不同大小的密钥池共享同一个计数器
+	var got []string
+	for i, path := range []string{"/a", "/b", "/a", "/c", "/b"} {
+		n := 3 + i%2*2
+		seen, _ := serveTest(t, a, authRequest(path, pool(n)), http.StatusOK)
+		got = append(got, seen.Get("Authorization"))
+	}
+	assertSequence(t, got, []string{"k0", "k1", "k2", "k3", "k1"})
+	if indexes := snapshotIndexes(a.indexFile); len(indexes) != 0 {
+		t.Errorf("key_by global 不应记录每个路径的索引: %v", indexes)
+	}
+}
+
+func TestReplicaOffset(t *testing.T) {
+	// 3个副本、3个密钥时第一个请求分散到所有密钥上
+	var first []string
+	for replica := 0; replica < 3; replica++ {
+		a := newTestHandler(t, "", "replica_offset "+strconv.Itoa(replica))
+		got := rotatedSequence(t, a, "/v1", pool(3), 2)
+		first = append(first, got[0])
+		if want := "k" + strconv.Itoa((replica+1)%3); got[1] != want {
+			t.Errorf("副本%d第二次请求 = %s, 期望 %s", replica, got[1], want)
+		}
+		// 偏移只在选择时生效，不写入索引
+		if index := snapshotIndexes(a.indexFile)["/v1"]; index != 2 {
+			t.Errorf("副本%d的索引 = %d, 期望 2", replica, index)
+		}
+	}
+	assertSequence(t, first, []string{"k0", "k1", "k2"})
+
+	for _, value := range []string{"-1", "two"} {
+		a := new(AuthModifier)
+		if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser("auth_modifier index.json {\nreplica_offset " + value + "\n}")); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("replica_offset %s: 错误 = %v, 期望 ErrInvalidOption", value, err)
+		}
+	}
+}
+
+func TestCollapseDuplicatesToggle(t *testing.T) {
+	// 默认保留重复的密钥，重复即权重
+	a := newTestHandler(t, "", "")
+	assertSequence(t, rotatedSequence(t, a, "/v1", "k1,k1,k1,k2", 8), []string{"k1", "k1", "k1", "k2", "k1", "k1", "k1", "k2"})
+
+	// 去重后按唯一的密钥轮换，不同的权重后缀视为不同的元素
+	a = newTestHandler(t, "", "collapse_duplicates")
+	assertSequence(t, rotatedSequence(t, a, "/v1", "k1,k1,k1,k2", 4), []string{"k1", "k2", "k1", "k2"})
+	assertSequence(t, rotatedSequence(t, a, "/v2", "k1,k2,k1:2", 3), []string{"k1", "k2", "k1:2"})
+
+	// 服务端配置的密钥池在Provision时去重
+	a = newTestHandler(t, "", "keys s1 s2 s1 s2\ncollapse_duplicates")
+	if !reflect.DeepEqual(a.keys(), []string{"s1", "s2"}) {
+		t.Errorf("keys = %v", a.keys())
+	}
+	assertSequence(t, rotatedSequence(t, a, "/v1", "client", 3), []string{"s1", "s2", "s1"})
+}
+
+func TestCollapseDuplicatesSchemes(t *testing.T) {
+	pool, schemes := collapseDuplicates([]string{"a", "b", "a", "c", "b"}, []string{"Bearer ", "Token ", "Bearer ", "Bearer ", "Token "})
+	if !reflect.DeepEqual(pool, []string{"a", "b", "c"}) || !reflect.DeepEqual(schemes, []string{"Bearer ", "Token ", "Bearer "}) {
+		t.Errorf("pool = %q, schemes = %q", pool, schemes)
+	}
+	// 没有重复时原样返回
+	if pool, _ := collapseDuplicates([]string{"a", "b"}, nil); !reflect.DeepEqual(pool, []string{"a", "b"}) {
+		t.Errorf("pool = %q", pool)
+	}
+}
+
+func TestFreezeIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	live := newTestHandler(t, path, "")
+	rotatedSequence(t, live, "/v1", pool(3), 2)
+	live.Cleanup()
+
+	a := newTestHandler(t, path, "freeze_index")
+	// 按当前索引选择并照常改写请求头，但索引从不推进
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(3), 4), []string{"k2", "k2", "k2", "k2"})
+	assertSequence(t, rotatedSequence(t, a, "/v2", pool(3), 2), []string{"k0", "k0"})
+	a.Mutex.RLock()
+	changed := a.Changed
+	a.Mutex.RUnlock()
+	if changed {
+		t.Error("freeze_index 标记了Changed")
+	}
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, map[string]int{"/v1": 2}) {
+		t.Errorf("索引 = %v", got)
+	}
+	if n, err := a.persistIndexes(false); err != nil || n != 0 {
+		t.Errorf("persistIndexes = %d, %v, 期望跳过保存", n, err)
+	}
+}
+
+func TestFreezeIndexOtherStrategies(t *testing.T) {
+	// 平滑加权轮询在副本上计算，保存的权重保持不变
+	a := newTestHandler(t, "", "strategy weighted_round_robin\nfreeze_index")
+	assertSequence(t, rotatedSequence(t, a, "/v1", "x:2,y", 3), []string{"x", "x", "x"})
+	a.Mutex.RLock()
+	weights := len(a.swrr)
+	a.Mutex.RUnlock()
+	if weights != 0 {
+		t.Errorf("freeze_index 保存了平滑加权轮询的权重")
+	}
+
+	a = newTestHandler(t, "", "key_by global\nfreeze_index")
+	assertSequence(t, rotatedSequence(t, a, "/v1", pool(3), 3), []string{"k0", "k0", "k0"})
+	if got := atomic.LoadUint64(&a.global); got != 0 {
+		t.Errorf("全局计数器 = %d, 期望 0", got)
+	}
+}
+
+func TestKeyTemplateStripQuery(t *testing.T) {
+	request := func(uri string) *http.Request {
+		r, repl, _ := withVars(authRequest(uri, "k1,k2,k3"))
+		repl.Set("test.uri", r.RequestURI)
+		return r
+	}
+	a := newTestHandler(t, "", "key_template {test.uri}\nstrip_query")
+	for _, uri := range []string{"/v1?ts=1", "/v1?ts=2", "/v1?ts=3#frag"} {
+		serveTest(t, a, request(uri), http.StatusOK)
+	}
+	// 只有查询串不同的请求共用同一个索引
+	if got := snapshotIndexes(a.indexFile); !reflect.DeepEqual(got, map[string]int{"/v1": 3}) {
+		t.Errorf("Indexes = %v, 期望 /v1 推进 3 次", got)
+	}
+
+	// 未开启时每个查询串各占一个索引
+	b := newTestHandler(t, "", "key_template {test.uri}")
+	for _, uri := range []string{"/v1?ts=1", "/v1?ts=2"} {
+		serveTest(t, b, request(uri), http.StatusOK)
+	}
+	if got := snapshotIndexes(b.indexFile); len(got) != 2 || got["/v1?ts=1"] != 1 || got["/v1?ts=2"] != 1 {
+		t.Errorf("Indexes = %v", got)
+	}
+}
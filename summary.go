@@ -0,0 +1,70 @@
+package auth_modifier
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// summaryKey 标识某个索引键下被选中的密钥下标
+type summaryKey struct {
+	key string
+	pos int
+}
+
+// rotationCounters 统计一个周期内每个索引键下各密钥被选中的次数
+type rotationCounters struct {
+	counts sync.Map // summaryKey -> *int64
+}
+
+// record 计数加一，已存在的计数只需一次原子操作
+func (c *rotationCounters) record(key string, pos int) {
+	k := summaryKey{key: key, pos: pos}
+	v, ok := c.counts.Load(k)
+	if !ok {
+		v, _ = c.counts.LoadOrStore(k, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// drain 取出并清零所有计数，按索引键分组返回，清理本周期内没有请求的条目
+func (c *rotationCounters) drain() map[string]map[string]int64 {
+	summary := make(map[string]map[string]int64)
+	c.counts.Range(func(k, v interface{}) bool {
+		n := atomic.SwapInt64(v.(*int64), 0)
+		if n == 0 {
+			c.counts.Delete(k)
+			return true
+		}
+		sk := k.(summaryKey)
+		if summary[sk.key] == nil {
+			summary[sk.key] = make(map[string]int64)
+		}
+		summary[sk.key][strconv.Itoa(sk.pos)] = n
+		return true
+	})
+	return summary
+}
+
+// startSummary 每隔SummaryInterval输出一次本周期的轮换分布
+func (a *AuthModifier) startSummary() {
+	ticker := time.NewTicker(time.Duration(a.SummaryInterval))
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if summary := a.counters.drain(); len(summary) > 0 {
+					a.logger.Info("Rotation summary",
+						zap.Duration("interval", time.Duration(a.SummaryInterval)),
+						zap.Any("counts", summary))
+				}
+			case <-a.ctx.Done():
+				return
+			}
+		}
+	}()
+}
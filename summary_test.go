@@ -0,0 +1,61 @@
+package auth_modifier
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalSummaryInterval(t *testing.T) {
+	a := parseTest(t, "auth_modifier index.json {\nsummary_interval 5m\n}")
+	if a.SummaryInterval != caddy.Duration(5*time.Minute) {
+		t.Errorf("SummaryInterval = %s, 期望 5m", time.Duration(a.SummaryInterval))
+	}
+	err := new(AuthModifier).UnmarshalCaddyfile(caddyfile.NewTestDispenser("auth_modifier index.json {\nsummary_interval soon\n}"))
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("错误 = %v, 期望 ErrInvalidOption", err)
+	}
+	if a := newTestHandler(t, "", ""); a.counters != nil {
+		t.Error("未配置summary_interval时不应统计轮换分布")
+	}
+}
+
+func TestSummaryCountsPerPeriod(t *testing.T) {
+	a := newTestHandler(t, "", "summary_interval 1h")
+	rotatedSequence(t, a, "/v1", "k0,k1,k2", 4)
+	rotatedSequence(t, a, "/v2", "k0,k1", 1)
+	want := map[string]map[string]int64{
+		"/v1": {"0": 2, "1": 1, "2": 1},
+		"/v2": {"0": 1},
+	}
+	if got := a.counters.drain(); !reflect.DeepEqual(got, want) {
+		t.Errorf("本周期的计数 = %v, 期望 %v", got, want)
+	}
+
+	// 取出后计数清零，下一个周期只包含新的请求，没有请求的条目不会输出
+	if got := a.counters.drain(); len(got) != 0 {
+		t.Errorf("清零后的计数 = %v, 期望为空", got)
+	}
+	rotatedSequence(t, a, "/v2", "k0,k1", 1)
+	if got := a.counters.drain(); !reflect.DeepEqual(got, map[string]map[string]int64{"/v2": {"1": 1}}) {
+		t.Errorf("下一个周期的计数 = %v, 期望只有 /v2 的下标1", got)
+	}
+}
+
+func TestSummaryResetsEveryInterval(t *testing.T) {
+	a := newTestHandler(t, "", "summary_interval 20ms")
+	rotatedSequence(t, a, "/v1", "k0,k1,k2", 3)
+	// 定时输出会取走并清零计数，之后的周期里没有请求的条目也会被清理
+	waitFor(t, "定时输出清零计数", func() bool {
+		entries := 0
+		a.counters.counts.Range(func(k, v interface{}) bool {
+			entries++
+			return true
+		})
+		return entries == 0
+	})
+}
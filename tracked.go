@@ -0,0 +1,52 @@
+package auth_modifier
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// otherKeyLabel 是超出max_tracked_keys的密钥在指标中共用的标签
+const otherKeyLabel = "other"
+
+// trackedKeys 记录已经拥有独立指标标签的密钥指纹，数量不超过max
+type trackedKeys struct {
+	max   int32
+	count int32    // seen的大小，原子操作
+	seen  sync.Map // keyID -> struct{}
+}
+
+// track 判断id是否可以拥有独立的标签：已记录过的总是可以，新的只在未达到上限时记录
+func (t *trackedKeys) track(id string) bool {
+	if _, ok := t.seen.Load(id); ok {
+		return true
+	}
+	if atomic.LoadInt32(&t.count) >= t.max {
+		return false
+	}
+	if _, loaded := t.seen.LoadOrStore(id, struct{}{}); loaded {
+		return true
+	}
+	// 并发记录时可能短暂超出上限，超出的一方撤回
+	if atomic.AddInt32(&t.count, 1) > t.max {
+		t.seen.Delete(id)
+		atomic.AddInt32(&t.count, -1)
+		return false
+	}
+	return true
+}
+
+// metricLabel 返回指标中代表密钥的标签。配置了max_tracked_keys时，
+// 没有别名的密钥超出上限后统一记为other，避免大量不同的密钥导致指标基数失控
+func (a *AuthModifier) metricLabel(token string) string {
+	if a.tracked == nil {
+		return a.keyLabel(token)
+	}
+	id := a.keyID(token)
+	if alias, ok := a.KeyAliases[id]; ok {
+		return alias
+	}
+	if !a.tracked.track(id) {
+		return otherKeyLabel
+	}
+	return a.fingerprint(token)
+}
@@ -0,0 +1,75 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxTrackedKeysMetrics(t *testing.T) {
+	a := newTestHandler(t, "", "max_tracked_keys 2\nkey_alias "+tokenHash("sk-track-4444")+" aliased")
+	labels := []string{"****1111", "****2222", otherKeyLabel, "aliased"}
+	before := make([]float64, len(labels))
+	for i, label := range labels {
+		before[i] = testutil.ToFloat64(selectionsTotal.WithLabelValues(a.strategyLabel(), label))
+	}
+	for i := 0; i < 5; i++ {
+		serveTest(t, a, authRequest("/v1", "sk-track-1111,sk-track-2222,sk-track-3333,sk-track-4444,sk-track-5555"), http.StatusOK)
+	}
+	// 前两个密钥拥有独立标签，超出上限的记为other，配置了别名的不受限制
+	for i, want := range []float64{1, 1, 2, 1} {
+		if got := testutil.ToFloat64(selectionsTotal.WithLabelValues(a.strategyLabel(), labels[i])) - before[i]; got != want {
+			t.Errorf("标签 %s 增加了 %v, 期望 %v", labels[i], got, want)
+		}
+	}
+	if got := atomic.LoadInt32(&a.tracked.count); got != 2 {
+		t.Errorf("记录的密钥数量 = %d, 期望 2", got)
+	}
+	// 日志和占位符仍使用各自的标签
+	if got := a.keyLabel("sk-track-5555"); got != "****5555" {
+		t.Errorf("keyLabel = %q", got)
+	}
+}
+
+func TestMaxTrackedKeysConcurrent(t *testing.T) {
+	tracked := &trackedKeys{max: 10}
+	var wg sync.WaitGroup
+	var accepted int32
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if tracked.track("id-" + strconv.Itoa(i)) {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if accepted != 10 || atomic.LoadInt32(&tracked.count) != 10 {
+		t.Errorf("接受了 %d 个, 记录了 %d 个, 期望都为 10", accepted, tracked.count)
+	}
+}
+
+func TestMaxTrackedKeysLatency(t *testing.T) {
+	tracker := newLatencyTracker()
+	for _, token := range []string{"k1", "k2", "k3"} {
+		tracker.observe(token, 100*time.Millisecond, 2)
+	}
+	// 已记录的密钥继续更新，新的密钥不再单独记录
+	tracker.observe("k1", 200*time.Millisecond, 2)
+	values := tracker.values()
+	if len(values) != 2 {
+		t.Fatalf("延迟统计 = %v, 期望只有 2 个密钥", values)
+	}
+	if _, ok := values[tokenHash("k3")]; ok {
+		t.Error("超出上限的 k3 被记录了延迟")
+	}
+	if values[tokenHash("k1")] <= 0.1 {
+		t.Errorf("k1 的延迟没有更新: %v", values[tokenHash("k1")])
+	}
+}
@@ -0,0 +1,257 @@
+package auth_modifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Validate 实现caddy.Validator接口，在Provision之后统一检查配置。
+// 明显错误的配置返回错误，能工作但不合理的组合只输出警告。
+func (a *AuthModifier) Validate() error {
+	a.ensureLogger()
+	if len(a.Headers) == 0 {
+		return fmt.Errorf("%w: at least one header must be configured", ErrMissingOption)
+	}
+	if err := a.validateHeaders(); err != nil {
+		return err
+	}
+	if err := validateEnum("strategy", a.Strategy, validStrategies, ErrInvalidStrategy); err != nil {
+		return err
+	}
+	if err := validateEnum("advance_on", a.AdvanceOn, validAdvanceOn, ErrInvalidOption); err != nil {
+		return err
+	}
+	if strings.HasPrefix(a.KeyBy, KeyByHeadersPrefix) {
+		if len(a.keyHeaders) == 0 {
+			return fmt.Errorf("%w: key_by '%s' lists no headers", ErrInvalidOption, a.KeyBy)
+		}
+	} else if err := validateEnum("key_by", a.KeyBy, validKeyBy, ErrInvalidOption); err != nil {
+		return err
+	}
+	if err := validateEnum("format", a.Format, validFormats, ErrInvalidOption); err != nil {
+		return err
+	}
+	if err := validateEnum("multi_value_mode", a.MultiValueMode, validMultiValueModes, ErrInvalidOption); err != nil {
+		return err
+	}
+	if err := validateEnum("fingerprint_mode", a.FingerprintMode, validFingerprintModes, ErrInvalidOption); err != nil {
+		return err
+	}
+	if a.FingerprintMode == FingerprintHMAC && len(a.fingerprintKey) == 0 {
+		return fmt.Errorf("%w: fingerprint_mode hmac requires fingerprint_secret", ErrMissingOption)
+	} else if a.FingerprintMode != FingerprintHMAC && len(a.FingerprintSecret) > 0 {
+		a.logger.Warn("fingerprint_secret has no effect unless fingerprint_mode is hmac")
+	}
+	if err := validateEnum("basic_invalid", a.BasicInvalid, validBasicInvalidModes, ErrInvalidOption); err != nil {
+		return err
+	}
+	if a.BasicInvalidStatus < 100 || a.BasicInvalidStatus > 599 {
+		return fmt.Errorf("%w: basic_invalid status %d", ErrInvalidOption, a.BasicInvalidStatus)
+	}
+	if err := validateEnum("min_pool_mode", a.MinPoolMode, validMinPoolModes, ErrInvalidOption); err != nil {
+		return err
+	}
+	if a.MinPoolStatus < 100 || a.MinPoolStatus > 599 {
+		return fmt.Errorf("%w: min_pool_status %d", ErrInvalidOption, a.MinPoolStatus)
+	}
+	if a.SaveInterval <= 0 {
+		return fmt.Errorf("%w: save_interval must be positive", ErrInvalidOption)
+	}
+	if a.ValidateOnStart && len(a.HealthCheckURL) == 0 {
+		return fmt.Errorf("%w: validate_on_start requires health_check_url", ErrMissingOption)
+	}
+	if len(a.RequireHeaderValue) > 0 && len(a.RequireHeader) == 0 {
+		return fmt.Errorf("%w: require_header_value requires require_header", ErrMissingOption)
+	}
+	if len(a.CookieName) > 0 && containsHeader(a.Headers, "Cookie") {
+		return fmt.Errorf("%w: Cookie cannot be rotated as a whole header when cookie_name is set", ErrInvalidHeader)
+	}
+	for _, scheme := range a.Schemes {
+		if len(scheme) == 0 || strings.ContainsAny(scheme, " \t,") {
+			return fmt.Errorf("%w: scheme '%s' must be a single word", ErrInvalidOption, scheme)
+		}
+	}
+	if a.CanaryPercent < 0 || a.CanaryPercent > 100 {
+		return fmt.Errorf("%w: canary_percent must be between 0 and 100", ErrInvalidOption)
+	}
+	if a.CanaryPercent > 0 && len(a.CanaryKey) == 0 {
+		return fmt.Errorf("%w: canary_percent requires canary_key", ErrMissingOption)
+	}
+	if a.SaturatedStatus < 100 || a.SaturatedStatus > 599 {
+		return fmt.Errorf("%w: saturated_status %d", ErrInvalidOption, a.SaturatedStatus)
+	}
+	if a.AllDeadResponse != nil {
+		if a.AllDeadResponse.StatusCode < 100 || a.AllDeadResponse.StatusCode > 599 {
+			return fmt.Errorf("%w: all_dead_response status %d", ErrInvalidOption, a.AllDeadResponse.StatusCode)
+		}
+		if len(a.AllDeadResponse.Body) > 0 && !json.Valid([]byte(a.AllDeadResponse.Body)) {
+			return fmt.Errorf("%w: all_dead_response body is not valid JSON", ErrInvalidOption)
+		}
+	}
+	if len(a.SecretsDir) > 0 && len(a.SourceURL) > 0 {
+		return fmt.Errorf("%w: secrets_dir and source_url are mutually exclusive", ErrInvalidOption)
+	}
+	if len(a.PreferHeader) > 0 {
+		if !containsHeader(a.Headers, a.PreferHeader) {
+			return fmt.Errorf("%w: prefer_header '%s' is not in headers", ErrInvalidHeader, a.PreferHeader)
+		}
+		if a.hasServerKeys() {
+			a.logger.Warn("prefer_header does not remove the header filled from keys", zap.String("header", a.Headers[0]))
+		}
+	}
+	for _, fingerprint := range a.Drain {
+		if fingerprint = strings.ToLower(fingerprint); len(fingerprint) != 32 || strings.Trim(fingerprint, "0123456789abcdef") != "" {
+			return fmt.Errorf("%w: drain fingerprint '%s' must be 32 hex characters", ErrInvalidOption, fingerprint)
+		}
+	}
+	if len(a.DelimiterHeader) > 0 && containsHeader(a.Headers, a.DelimiterHeader) {
+		return fmt.Errorf("%w: delimiter_header '%s' is a rotated header", ErrInvalidHeader, a.DelimiterHeader)
+	}
+	for name := range a.SetHeaders {
+		if containsHeader(a.Headers, name) {
+			return fmt.Errorf("%w: set_headers header '%s' is a rotated header", ErrInvalidHeader, name)
+		}
+	}
+	if err := validateVarsPrefix(a.VarsPrefix); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOption, err)
+	}
+	if a.DecisionBuffer < 0 {
+		return fmt.Errorf("%w: decision_buffer must not be negative", ErrInvalidOption)
+	}
+	if a.MaxTrackedKeys < 0 {
+		return fmt.Errorf("%w: max_tracked_keys must not be negative", ErrInvalidOption)
+	}
+	for fingerprint := range a.KeyAliases {
+		if len(fingerprint) != 32 || strings.Trim(fingerprint, "0123456789abcdef") != "" {
+			return fmt.Errorf("%w: key alias fingerprint '%s' must be 32 lowercase hex characters", ErrInvalidOption, fingerprint)
+		}
+	}
+	if cb := a.CircuitBreaker; cb != nil {
+		if cb.ErrorPercent > 100 {
+			return fmt.Errorf("%w: circuit_breaker error_percent %v must be between 0 and 100", ErrInvalidOption, cb.ErrorPercent)
+		}
+		if cb.StatusCode < 100 || cb.StatusCode > 599 {
+			return fmt.Errorf("%w: circuit_breaker status_code %d", ErrInvalidOption, cb.StatusCode)
+		}
+	}
+	if a.ResetEvery > 0 && a.ResetSkew >= a.ResetEvery {
+		return fmt.Errorf("%w: reset_skew must be shorter than reset_every", ErrInvalidOption)
+	}
+	if a.Strict && !a.UseStorage && !a.IgnorePersisted {
+		if err := checkWritable(a.IndexPath); err != nil {
+			return fmt.Errorf("%w: index file %s: %v", ErrPathNotWritable, a.IndexPath, err)
+		}
+	}
+
+	if (a.Strategy == StrategyRandom || a.Strategy == StrategyWeightedRandom || a.Strategy == StrategyAdaptiveLatency || a.Strategy == StrategyBodyHash || a.Strategy == StrategyWeightedHash || a.Strategy == StrategyP2C || a.Strategy == StrategyJumpHash) && a.Journal {
+		a.logger.Warn("Random strategies do not use indexes, journal has nothing to persist", zap.String("strategy", a.Strategy))
+	}
+	if a.Journal && a.UseStorage {
+		a.logger.Warn("Journal is not supported with Caddy storage, falling back to full saves")
+	}
+	if a.ValidateOnStart && len(a.keys()) == 0 {
+		a.logger.Warn("validate_on_start has no effect without configured keys")
+	}
+	if len(a.CanaryKey) > 0 && a.CanaryPercent == 0 {
+		a.logger.Warn("canary_key is configured but canary_percent is 0, the canary key will never be used")
+	}
+	if a.ResetEvery > 0 && !a.UseStorage {
+		a.logger.Warn("reset_every without use_storage resets each instance by its own clock")
+	}
+	if len(a.RequestWeightHeader) > 0 && a.Strategy != StrategyWeightedRoundRobin {
+		a.logger.Warn("request_weight_header only affects weighted_round_robin", zap.String("strategy", a.Strategy))
+	}
+	if len(a.KeyTemplate) > 0 && a.KeyBy != KeyByPath {
+		a.logger.Warn("key_template takes precedence over key_by", zap.String("key_by", a.KeyBy))
+	}
+	if a.StripQuery && len(a.KeyTemplate) == 0 {
+		a.logger.Warn("strip_query only applies to key_template, request paths never include the query")
+	}
+	if a.ReplicaOffset < 0 {
+		return fmt.Errorf("%w: replica_offset must not be negative", ErrInvalidOption)
+	}
+	if a.ReplicaOffset > 0 && a.UseStorage {
+		a.logger.Warn("replica_offset is meant for replicas without shared state, with use_storage every replica shifts the shared index")
+	}
+	if a.Seed > 0 && a.Strategy != StrategyRoundRobinSeeded {
+		a.logger.Warn("seed only affects round_robin_global_seeded", zap.String("strategy", a.Strategy))
+	}
+	if a.IgnorePersisted && (a.Journal || a.UseStorage) {
+		a.logger.Warn("ignore_persisted disables journal and use_storage")
+	}
+	if (len(a.AdvanceOnStatus) > 0 || len(a.NoAdvanceOnStatus) > 0) != (a.AdvanceOn == AdvanceStatus) {
+		return fmt.Errorf("%w: advance_on status requires advance_on_status or no_advance_on_status, and they only apply to advance_on status", ErrInvalidOption)
+	}
+	if (len(a.CacheHeader) > 0 || len(a.CacheMissValue) > 0) && a.AdvanceOn != AdvanceCacheMiss {
+		a.logger.Warn("cache_header and cache_miss_value only apply with advance_on cache_miss", zap.String("advance_on", a.AdvanceOn))
+	}
+	if a.Pretty && a.Format == FormatBinary {
+		a.logger.Warn("pretty only applies to the json format")
+	}
+	if a.HonorRetryAfter && a.Strategy != StrategyFailover && a.MaxRetries == 0 {
+		a.logger.Warn("honor_retry_after only applies when keys are quarantined, i.e. with failover or max_retries")
+	}
+	if a.RecoveryRamp < 0 {
+		return fmt.Errorf("%w: recovery_ramp must not be negative", ErrInvalidOption)
+	}
+	if a.RecoveryRamp > 0 && a.Strategy != StrategyFailover && a.MaxRetries == 0 && !a.ValidateOnStart {
+		a.logger.Warn("recovery_ramp only applies when keys are quarantined, i.e. with failover, max_retries or validate_on_start")
+	}
+	if a.DailyQuota < 0 {
+		return fmt.Errorf("%w: daily_quota must not be negative", ErrInvalidOption)
+	}
+	for fingerprint, n := range a.DailyQuotas {
+		if len(fingerprint) != 32 || strings.Trim(fingerprint, "0123456789abcdef") != "" {
+			return fmt.Errorf("%w: daily_quota fingerprint '%s' must be 32 lowercase hex characters", ErrInvalidOption, fingerprint)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: daily_quota for '%s' must not be negative", ErrInvalidOption, fingerprint)
+		}
+	}
+	if a.QuarantineMaxAge > 0 && !a.PersistQuarantine {
+		a.logger.Warn("quarantine_max_age only applies with persist_quarantine")
+	}
+	if a.QuarantineMaxAge < 0 {
+		return fmt.Errorf("%w: quarantine_max_age must not be negative", ErrInvalidOption)
+	}
+	if len(a.ClientCerts) > 0 && len(a.Keys) > 0 && len(a.ClientCerts) != len(a.Keys) {
+		a.logger.Warn("Client certificates pair with keys by position, but their counts differ",
+			zap.Int("client_certs", len(a.ClientCerts)), zap.Int("keys", len(a.Keys)))
+	}
+	// 迁移会改写共享索引并立即保存，放在所有检查通过之后，非法的配置不会破坏索引文件和正在使用的索引
+	if a.Migrate && a.indexFile != nil {
+		a.indexFile.applyKeyBy(a.keyByMode(), true)
+	}
+	return nil
+}
+
+// validateEnum 检查value是否为合法选项，返回包装了kind的错误并列出所有可选值
+func validateEnum(name, value string, valid []string, kind error) error {
+	if contains(valid, value) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s '%s', valid options are: %s", kind, name, value, strings.Join(valid, ", "))
+}
+
+// contains 判断value是否在list中
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable 以追加方式打开文件来确认可写，文件不存在时会被创建
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,57 @@
+package auth_modifier
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 密钥池警告去重的默认时间窗口和最多记录的密钥池数量
+const (
+	defaultPoolWarnInterval = 5 * time.Minute
+	maxPoolWarnings         = 1024
+)
+
+// warnCache 记录每个密钥池上次输出警告的时间，同一密钥池在时间窗口内只警告一次
+type warnCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	last   map[string]time.Time
+}
+
+func newWarnCache(window time.Duration) *warnCache {
+	return &warnCache{window: window, last: make(map[string]time.Time)}
+}
+
+// allow 判断key本次是否需要输出警告，需要时记录时间。
+// 记录已满时先清理过期的条目，仍然满时不再为新的密钥池输出警告，避免大量不同的密钥池占满内存
+func (c *warnCache) allow(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.last[key]; ok && now.Sub(last) < c.window {
+		return false
+	}
+	if _, ok := c.last[key]; !ok && len(c.last) >= maxPoolWarnings {
+		for k, last := range c.last {
+			if now.Sub(last) >= c.window {
+				delete(c.last, k)
+			}
+		}
+		if len(c.last) >= maxPoolWarnings {
+			return false
+		}
+	}
+	c.last[key] = now
+	return true
+}
+
+// warnPool 为请求头name中值为value的密钥池输出警告，同一密钥池每个pool_warn_interval只输出一次。
+// 日志中只记录密钥池的指纹
+func (a *AuthModifier) warnPool(msg, name, value string, fields ...zap.Field) {
+	fingerprint := a.keyID(value)
+	if !a.poolWarnings.allow(name+"\x00"+fingerprint, time.Now()) {
+		return
+	}
+	a.logger.Warn(msg, append([]zap.Field{zap.String("pool", name), zap.String("pool_fingerprint", fingerprint)}, fields...)...)
+}
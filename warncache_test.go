@@ -0,0 +1,74 @@
+package auth_modifier
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWarnPoolOncePerPool(t *testing.T) {
+	a := newTestHandler(t, "", "")
+	core, logs := observer.New(zap.WarnLevel)
+	a.logger = zap.New(core)
+	for i := 0; i < 5; i++ {
+		serveTest(t, a, authRequest("/v1", "Bearer k1,,k2"), http.StatusOK)
+	}
+	serveTest(t, a, authRequest("/v2", "Bearer k1,,k2"), http.StatusOK)
+	if n := logs.FilterMessage("Key pool contains an empty key").Len(); n != 1 {
+		t.Errorf("同一密钥池输出了 %d 条警告, 期望 1", n)
+	}
+
+	// 另一个有问题的密钥池单独警告一次
+	for i := 0; i < 3; i++ {
+		serveTest(t, a, authRequest("/v1", "Bearer k3,k4,"), http.StatusOK)
+	}
+	entries := logs.FilterMessage("Key pool contains an empty key").All()
+	if len(entries) != 2 {
+		t.Fatalf("输出了 %d 条警告, 期望 2", len(entries))
+	}
+	// 日志中只有密钥池的指纹，没有密钥原文
+	for _, entry := range entries {
+		fields := entry.ContextMap()
+		if fields["pool_fingerprint"] == "" {
+			t.Errorf("警告缺少 pool_fingerprint: %v", fields)
+		}
+		for _, v := range fields {
+			if s, ok := v.(string); ok && strings.Contains(s, "k1") {
+				t.Errorf("警告中包含密钥原文: %v", fields)
+			}
+		}
+	}
+}
+
+func TestWarnCacheWindow(t *testing.T) {
+	c := newWarnCache(time.Minute)
+	now := time.Unix(1700000000, 0)
+	if !c.allow("p1", now) {
+		t.Fatal("第一次应输出警告")
+	}
+	if c.allow("p1", now.Add(59*time.Second)) {
+		t.Error("时间窗口内重复输出了警告")
+	}
+	if !c.allow("p1", now.Add(time.Minute)) {
+		t.Error("时间窗口过后应再次输出警告")
+	}
+
+	// 记录已满时不再为新的密钥池输出警告，过期的条目清理后恢复
+	for i := len(c.last); i < maxPoolWarnings; i++ {
+		c.allow("fill-"+strconv.Itoa(i), now.Add(time.Minute))
+	}
+	if c.allow("overflow", now.Add(time.Minute)) {
+		t.Error("记录已满时输出了新密钥池的警告")
+	}
+	if !c.allow("overflow", now.Add(2*time.Minute)) {
+		t.Error("过期条目清理后应输出警告")
+	}
+	if len(c.last) != 1 {
+		t.Errorf("清理后记录了 %d 个密钥池, 期望 1", len(c.last))
+	}
+}
@@ -0,0 +1,79 @@
+package auth_modifier
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// buildZipHeaders 根据zip_headers整理出每组的主请求头和跟随的请求头。
+// 每组的第一个请求头按策略选择密钥，其余请求头使用相同的下标，如X-Key的k1总是搭配X-Secret的s1
+func (a *AuthModifier) buildZipHeaders() error {
+	if len(a.ZipHeaders) == 0 {
+		return nil
+	}
+	a.zipFollowers = make(map[string][]string)
+	a.zipped = make(map[string]bool)
+	for _, group := range a.ZipHeaders {
+		if len(group) < 2 {
+			return fmt.Errorf("%w: zip_headers group %v needs at least two headers", ErrInvalidOption, group)
+		}
+		names := make([]string, len(group))
+		for i, name := range group {
+			names[i] = a.configuredHeader(name)
+			if len(names[i]) == 0 {
+				return fmt.Errorf("%w: zip_headers header '%s' is not in headers", ErrInvalidOption, name)
+			}
+			if a.hasServerKeys() && names[i] == a.Headers[0] {
+				return fmt.Errorf("%w: zip_headers header '%s' is filled from keys", ErrInvalidOption, name)
+			}
+			if a.zipped[names[i]] || len(a.zipFollowers[names[i]]) > 0 {
+				return fmt.Errorf("%w: zip_headers header '%s' appears in more than one group", ErrInvalidOption, name)
+			}
+		}
+		a.zipFollowers[names[0]] = names[1:]
+		for _, name := range names[1:] {
+			a.zipped[name] = true
+		}
+	}
+	return nil
+}
+
+// configuredHeader 返回headers中与name规范化后相同的请求头的原始写法，不存在时为空
+func (a *AuthModifier) configuredHeader(name string) string {
+	canonical := http.CanonicalHeaderKey(name)
+	for _, h := range a.Headers {
+		if http.CanonicalHeaderKey(h) == canonical {
+			return h
+		}
+	}
+	return ""
+}
+
+// rotateZipped 让主请求头的跟随请求头使用与leader相同的下标。
+// 跟随请求头的密钥数量与主请求头不一致时记录警告，并按其数量取模，避免越界
+func (a *AuthModifier) rotateZipped(r *http.Request, leader rotation) []rotation {
+	var rotations []rotation
+	for _, name := range a.zipFollowers[leader.header] {
+		value := r.Header.Get(name)
+		if len(value) == 0 {
+			continue
+		}
+		scheme, rest := a.trimScheme(name, value)
+		delimiter := a.delimiter(r, name)
+		rest, params := splitAuthParams(scheme, rest, delimiter)
+		schemes, pool := a.trimElementSchemes(name, scheme, strings.Split(rest, delimiter))
+		if len(pool) != leader.length {
+			a.logger.Warn("zip_headers pools have different lengths, pairing by position modulo the shorter pool",
+				zap.String("header", leader.header), zap.Int("length", leader.length),
+				zap.String("zipped_header", name), zap.Int("zipped_length", len(pool)))
+		}
+		pos := leader.pos % len(pool)
+		r.Header.Set(name, schemes[pos]+pool[pos]+params)
+		a.logRotation(name, pool[pos])
+		rotations = append(rotations, rotation{header: name, token: pool[pos], pos: pos, length: len(pool), follower: true})
+	}
+	return rotations
+}
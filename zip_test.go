@@ -0,0 +1,75 @@
+package auth_modifier
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// zipRequest 构造携带X-Key和X-Secret的请求
+func zipRequest(keys, secrets string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1", nil)
+	r.Header.Set("X-Key", keys)
+	r.Header.Set("X-Secret", secrets)
+	return r
+}
+
+func TestZipHeadersMatched(t *testing.T) {
+	a := newTestHandler(t, "", "headers X-Key X-Secret\nzip_headers X-Key x-secret")
+	for i, want := range [][2]string{{"k1", "s1"}, {"k2", "s2"}, {"k3", "s3"}, {"k1", "s1"}} {
+		seen, _ := serveTest(t, a, zipRequest("k1,k2,k3", "s1,s2,s3"), http.StatusOK)
+		if got := [2]string{seen.Get("X-Key"), seen.Get("X-Secret")}; got != want {
+			t.Errorf("第%d次请求 = %v, 期望 %v", i, got, want)
+		}
+	}
+	// 跟随的请求头不单独推进索引
+	if got := snapshotIndexes(a.indexFile)["/v1"]; got != 4 {
+		t.Errorf("索引 = %d, 期望 4", got)
+	}
+}
+
+func TestZipHeadersMismatched(t *testing.T) {
+	a := newTestHandler(t, "", "headers X-Key X-Secret\nzip_headers X-Key X-Secret")
+	core, logs := observer.New(zap.WarnLevel)
+	a.logger = zap.New(core)
+	var got [][2]string
+	for i := 0; i < 3; i++ {
+		seen, _ := serveTest(t, a, zipRequest("k1,k2,k3", "s1,s2"), http.StatusOK)
+		got = append(got, [2]string{seen.Get("X-Key"), seen.Get("X-Secret")})
+	}
+	// 按较短的密钥池取模，不会越界
+	want := [][2]string{{"k1", "s1"}, {"k2", "s2"}, {"k3", "s1"}}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("配对 = %v, 期望 %v", got, want)
+			break
+		}
+	}
+	if n := logs.FilterMessageSnippet("different lengths").Len(); n != 3 {
+		t.Errorf("记录了 %d 条长度不一致的警告, 期望 3", n)
+	}
+	// 只带主请求头时照常轮换
+	r := httptest.NewRequest(http.MethodGet, "/v1", nil)
+	r.Header.Set("X-Key", "k1,k2,k3")
+	if seen, _ := serveTest(t, a, r, http.StatusOK); seen.Get("X-Key") != "k1" || len(seen.Get("X-Secret")) > 0 {
+		t.Errorf("只带主请求头时 = %v", seen)
+	}
+}
+
+func TestZipHeadersInvalid(t *testing.T) {
+	for _, block := range []string{
+		"headers X-Key\nzip_headers X-Key X-Secret",
+		"headers X-Key X-Secret X-Other\nzip_headers X-Key X-Secret\nzip_headers X-Other X-Secret",
+		"headers X-Key X-Secret\nkeys k1 k2\nzip_headers X-Key X-Secret",
+	} {
+		a := parseTest(t, "auth_modifier "+filepath.Join(t.TempDir(), "index.json")+" {\n"+block+"\n}")
+		if err := provisionTest(t, a); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: 错误 = %v, 期望 ErrInvalidOption", block, err)
+		}
+	}
+}